@@ -0,0 +1,105 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// awsKMS signs with an asymmetric key of AWS KMS, with the credentials of the usual variables.
+type awsKMS struct {
+	keyID, region                string
+	accessKeyID, secretAccessKey string
+	sessionToken                 string
+	public                       crypto.PublicKey
+}
+
+func openAWSKMS(keyID string) (*awsKMS, error) {
+	k := &awsKMS{
+		keyID:           keyID,
+		region:          os.Getenv("AWS_REGION"),
+		accessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	// ARNs read arn:aws:kms:<region>:<account>:key/<ID>.
+	if parts := strings.Split(keyID, ":"); len(parts) > 3 && parts[0] == "arn" {
+		k.region = parts[3]
+	}
+	if keyID == "" || k.region == "" || k.accessKeyID == "" || k.secretAccessKey == "" {
+		return nil, errors.New("expected awskms:<key ID or ARN>, $AWS_REGION unless given an ARN, $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), signTimeout)
+	defer cancel()
+	var key struct {
+		PublicKey []byte
+	}
+	if err := k.call(ctx, "GetPublicKey", map[string]string{"KeyId": keyID}, &key); err != nil {
+		return nil, err
+	}
+	var err error
+	if k.public, err = parsePublicKey(key.PublicKey); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *awsKMS) Public() crypto.PublicKey {
+	return k.public
+}
+
+func (k *awsKMS) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash, err := hashName(opts.HashFunc())
+	if err != nil {
+		return nil, err
+	}
+	// Algorithms read ECDSA_SHA_256, RSASSA_PKCS1_V1_5_SHA_256 or RSASSA_PSS_SHA_256.
+	algorithm := "ECDSA_SHA_" + hash[3:]
+	if _, ok := k.public.(*rsa.PublicKey); ok {
+		algorithm = "RSASSA_PKCS1_V1_5_SHA_" + hash[3:]
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			algorithm = "RSASSA_PSS_SHA_" + hash[3:]
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), signTimeout)
+	defer cancel()
+	var signature struct {
+		Signature []byte
+	}
+	err = k.call(ctx, "Sign", map[string]any{"KeyId": k.keyID, "Message": digest, "MessageType": "DIGEST", "SigningAlgorithm": algorithm}, &signature)
+	return signature.Signature, err
+}
+
+func (k *awsKMS) call(ctx context.Context, action string, params any, result any) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://kms."+k.region+".amazonaws.com/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	signAWS(req, body, time.Now(), k.region, "kms", k.accessKeyID, k.secretAccessKey, k.sessionToken)
+	var failure struct {
+		Message string `json:"message"`
+	}
+	if err := doJSON(req, result, &failure); err != nil {
+		if failure.Message != "" {
+			return fmt.Errorf("kms %s: %s", action, failure.Message)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+// Package certs obtains and renews the HTTPS certificate with ACME, answering DNS-01 challenges
+// through the DNS provider of the zone, as wildcard names require.
+package certs
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/acme"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Provider publishes the TXT records of DNS-01 challenges. Operators can plug their own by setting Manager.Provider.
+type Provider interface {
+	// Present publishes a TXT record of value at fqdn, returning once the provider serves it.
+	Present(ctx context.Context, fqdn, value string) error
+	// CleanUp removes what Present published.
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// OpenProvider returns the provider described by spec, taking credentials from the environment:
+//   - cloudflare:<zone ID>, with $CLOUDFLARE_API_TOKEN allowed to edit the zone's DNS;
+//   - route53:<hosted zone ID>, with $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY and optionally $AWS_SESSION_TOKEN;
+//   - rfc2136:<server>:<port>/<zone>, sending dynamic updates signed by $RFC2136_TSIG_KEY and $RFC2136_TSIG_SECRET
+//     (base64, HMAC-SHA256) if set.
+func OpenProvider(spec string) (Provider, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "cloudflare":
+		token := os.Getenv("CLOUDFLARE_API_TOKEN")
+		if arg == "" || token == "" {
+			return nil, errors.New("expected cloudflare:<zone ID> and $CLOUDFLARE_API_TOKEN")
+		}
+		return &Cloudflare{ZoneID: arg, Token: token}, nil
+	case "route53":
+		id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+		if arg == "" || id == "" || secret == "" {
+			return nil, errors.New("expected route53:<hosted zone ID>, $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY")
+		}
+		return &Route53{ZoneID: arg, AccessKeyID: id, SecretAccessKey: secret, SessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	case "rfc2136":
+		return openRFC2136(arg)
+	default:
+		return nil, fmt.Errorf("unknown DNS provider %q", spec)
+	}
+}
+
+const (
+	// LetsEncrypt is the default ACME directory.
+	LetsEncrypt = "https://acme-v02.api.letsencrypt.org/directory"
+
+	checkInterval = 12 * time.Hour
+	retryInterval = time.Hour
+	renewBefore   = 30 * 24 * time.Hour
+	obtainTimeout = 10 * time.Minute
+	// propagationDelay gives the secondaries of a zone time to pick records up once providers serve them.
+	propagationDelay = 10 * time.Second
+)
+
+// Manager keeps a certificate for Domains at ChainPath and KeyPath, where server.Config.Certificate loads it from.
+type Manager struct {
+	Provider Provider
+	// Directory is the URL of the ACME directory, LetsEncrypt if empty.
+	Directory string
+	// Email is given to the certificate authority for expiry notices, if set.
+	Email   string
+	Domains []string
+	// AccountKeyPath holds the key of our ACME account, created on first use.
+	AccountKeyPath     string
+	ChainPath, KeyPath string
+	// Passphrase encrypts the certificate key, if set.
+	Passphrase []byte
+	// Signer is the certificate key if set, kept in a KMS or HSM; KeyPath is then unused.
+	Signer crypto.Signer
+}
+
+// Due reports whether the certificate is missing, unreadable, or expires within 30 days.
+func (m *Manager) Due() bool {
+	pair, err := m.load()
+	if err != nil {
+		return true
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return true
+	}
+	for _, domain := range m.Domains {
+		if cert.VerifyHostname(strings.Replace(domain, "*", "wildcard", 1)) != nil {
+			return true
+		}
+	}
+	return time.Until(cert.NotAfter) < renewBefore
+}
+
+// Run renews the certificate whenever it is due, checking twice a day, until ctx ends.
+func (m *Manager) Run(ctx context.Context) {
+	for {
+		wait := checkInterval
+		if m.Due() {
+			if err := m.Obtain(ctx); err != nil {
+				log.Printf("Could not renew the certificate (%v)", err)
+				wait = retryInterval
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Obtain gets a new certificate and writes it out.
+func (m *Manager) Obtain(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, obtainTimeout)
+	defer cancel()
+
+	key, err := m.accountKey()
+	if err != nil {
+		return fmt.Errorf("account key: %w", err)
+	}
+	client := &acme.Client{Key: key, DirectoryURL: m.Directory}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = LetsEncrypt
+	}
+	account := &acme.Account{}
+	if m.Email != "" {
+		account.Contact = []string{"mailto:" + m.Email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return fmt.Errorf("registration: %w", err)
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(m.Domains...))
+	if err != nil {
+		return err
+	}
+	// One at a time, as a name and its wildcard are challenged through the same record.
+	for _, url := range order.AuthzURLs {
+		if err := m.authorize(ctx, client, url); err != nil {
+			return err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return err
+	}
+
+	// Without a signer, a key is generated for every certificate.
+	var certKey crypto.Signer = m.Signer
+	var keyPEM []byte
+	if certKey == nil {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		if keyPEM, err = m.encodeKey(key); err != nil {
+			return err
+		}
+		certKey = key
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: m.Domains}, certKey)
+	if err != nil {
+		return err
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return err
+	}
+
+	var chainPEM []byte
+	for _, der := range chain {
+		chainPEM = append(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	if keyPEM != nil {
+		if err := writeAtomically(m.KeyPath, keyPEM, 0o600); err != nil {
+			return err
+		}
+	}
+	if err := writeAtomically(m.ChainPath, chainPEM, 0o644); err != nil {
+		return err
+	}
+	log.Printf("Obtained a certificate for %s", strings.Join(m.Domains, ", "))
+	return nil
+}
+
+func (m *Manager) authorize(ctx context.Context, client *acme.Client, url string) error {
+	authz, err := client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			challenge = c
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("no dns-01 challenge offered for %s", authz.Identifier.Value)
+	}
+	value, err := client.DNS01ChallengeRecord(challenge.Token)
+	if err != nil {
+		return err
+	}
+
+	fqdn := "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*.")
+	if err := m.Provider.Present(ctx, fqdn, value); err != nil {
+		return fmt.Errorf("publishing %s: %w", fqdn, err)
+	}
+	defer func() {
+		if err := m.Provider.CleanUp(context.Background(), fqdn, value); err != nil {
+			log.Printf("Could not clean %s up (%v)", fqdn, err)
+		}
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(propagationDelay):
+	}
+
+	if _, err := client.Accept(ctx, challenge); err != nil {
+		return err
+	}
+	_, err = client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+// accountKey reads the key of our ACME account, or creates it.
+func (m *Manager) accountKey() (*ecdsa.PrivateKey, error) {
+	raw, err := os.ReadFile(m.AccountKeyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return key, writeAtomically(m.AccountKeyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("%s holds no PEM", m.AccountKeyPath)
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// load reads the certificate, as KeyPair does.
+func (m *Manager) load() (tls.Certificate, error) {
+	if m.Signer != nil {
+		return LoadChain(m.ChainPath, m.Signer)
+	}
+	return LoadKeyPair(m.ChainPath, m.KeyPath, m.Passphrase)
+}
+
+// encodeKey is the PEM the certificate key is written as, encrypted if Manager has a passphrase.
+func (m *Manager) encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	if m.Passphrase == nil {
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	block, err := EncryptKey(der, m.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// writeAtomically replaces path, so readers only ever see a complete file.
+func writeAtomically(path string, data []byte, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
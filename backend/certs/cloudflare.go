@@ -0,0 +1,92 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// Cloudflare publishes records through the Cloudflare API, with a token allowed to edit the zone's DNS.
+type Cloudflare struct {
+	ZoneID, Token string
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+}
+
+func (c *Cloudflare) Present(ctx context.Context, fqdn, value string) error {
+	return c.call(ctx, http.MethodPost, "/dns_records", cloudflareRecord{Type: "TXT", Name: fqdn, Content: value, TTL: 60}, nil)
+}
+
+func (c *Cloudflare) CleanUp(ctx context.Context, fqdn, value string) error {
+	var records []cloudflareRecord
+	if err := c.call(ctx, http.MethodGet, "/dns_records?type=TXT&name="+url.QueryEscape(fqdn), nil, &records); err != nil {
+		return err
+	}
+	for _, r := range records {
+		// TXT contents come back quoted.
+		if strings.Trim(r.Content, `"`) == value {
+			if err := c.call(ctx, http.MethodDelete, "/dns_records/"+r.ID, nil, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// call sends a request about the zone, decoding the result of the response into result if not nil.
+func (c *Cloudflare) call(ctx context.Context, method, path string, body, result any) error {
+	var payload io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, cloudflareAPI+"/zones/"+c.ZoneID+path, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	var answer struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&answer); err != nil {
+		return fmt.Errorf("cloudflare answered %s", resp.Status)
+	}
+	if !answer.Success {
+		if len(answer.Errors) > 0 {
+			return fmt.Errorf("cloudflare: %s", answer.Errors[0].Message)
+		}
+		return fmt.Errorf("cloudflare answered %s", resp.Status)
+	}
+	if result != nil {
+		return json.Unmarshal(answer.Result, result)
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package certs
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/pbkdf2"
+	"hash"
+	"os"
+	"sync"
+)
+
+// Deployments keeping keys encrypted at rest give the certificate key a passphrase: PKCS#8 keys encrypted with
+// PBES2 (PBKDF2 and AES-CBC), as `openssl pkey -aes256` writes them, or legacy PEM encryption (Proc-Type: 4,ENCRYPTED).
+// Manager writes the keys it obtains encrypted the same way when it has a passphrase.
+
+var (
+	oidPBES2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+
+	errBadPassphrase = errors.New("wrong passphrase or corrupt key")
+)
+
+// encryptionIterations is how many PBKDF2 iterations keys we encrypt take.
+const encryptionIterations = 100_000
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Data      []byte
+}
+
+type pbes2Params struct {
+	KDF    pkix.AlgorithmIdentifier
+	Scheme pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// DecryptKey returns the DER of a PEM key, decrypted with passphrase if it is encrypted, and its type once decrypted.
+func DecryptKey(block *pem.Block, passphrase []byte) ([]byte, string, error) {
+	// Legacy encryption is weak and deprecated, but what older tools still write.
+	if x509.IsEncryptedPEMBlock(block) {
+		der, err := x509.DecryptPEMBlock(block, passphrase)
+		if err != nil {
+			return nil, "", errBadPassphrase
+		}
+		return der, block.Type, nil
+	}
+	if block.Type != "ENCRYPTED PRIVATE KEY" {
+		return block.Bytes, block.Type, nil
+	}
+
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(block.Bytes, &info); err != nil {
+		return nil, "", err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, "", fmt.Errorf("unsupported key encryption %v, expected PBES2", info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, "", err
+	}
+	if !params.KDF.Algorithm.Equal(oidPBKDF2) {
+		return nil, "", fmt.Errorf("unsupported key derivation %v, expected PBKDF2", params.KDF.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KDF.Parameters.FullBytes, &kdf); err != nil {
+		return nil, "", err
+	}
+	var prf func() hash.Hash
+	switch {
+	case kdf.PRF.Algorithm == nil || kdf.PRF.Algorithm.Equal(oidHMACSHA1):
+		prf = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACSHA256):
+		prf = sha256.New
+	default:
+		return nil, "", fmt.Errorf("unsupported PBKDF2 function %v", kdf.PRF.Algorithm)
+	}
+	var size int
+	switch {
+	case params.Scheme.Algorithm.Equal(oidAES128CBC):
+		size = 16
+	case params.Scheme.Algorithm.Equal(oidAES192CBC):
+		size = 24
+	case params.Scheme.Algorithm.Equal(oidAES256CBC):
+		size = 32
+	default:
+		return nil, "", fmt.Errorf("unsupported key cipher %v, expected AES-CBC", params.Scheme.Algorithm)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.Scheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, "", err
+	}
+	if len(iv) != aes.BlockSize || len(info.Data) == 0 || len(info.Data)%aes.BlockSize != 0 {
+		return nil, "", errBadPassphrase
+	}
+
+	c, err := aes.NewCipher(pbkdf2.Key(passphrase, kdf.Salt, kdf.Iterations, size, prf))
+	if err != nil {
+		return nil, "", err
+	}
+	der := make([]byte, len(info.Data))
+	cipher.NewCBCDecrypter(c, iv).CryptBlocks(der, info.Data)
+	padding := int(der[len(der)-1])
+	if padding == 0 || padding > aes.BlockSize || !bytes.Equal(der[len(der)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, "", errBadPassphrase
+	}
+	return der[:len(der)-padding], "PRIVATE KEY", nil
+}
+
+// EncryptKey encrypts the DER of a PKCS#8 key with passphrase, with PBKDF2-HMAC-SHA256 and AES-256-CBC.
+func EncryptKey(der, passphrase []byte) (*pem.Block, error) {
+	salt, iv := make([]byte, 16), make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	c, err := aes.NewCipher(pbkdf2.Key(passphrase, salt, encryptionIterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(der)%aes.BlockSize
+	data := append(append([]byte(nil), der...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(c, iv).CryptBlocks(data, data)
+
+	kdf, err := asn1.Marshal(pbkdf2Params{Salt: salt, Iterations: encryptionIterations, PRF: pkix.AlgorithmIdentifier{Algorithm: oidHMACSHA256, Parameters: asn1.NullRawValue}})
+	if err != nil {
+		return nil, err
+	}
+	rawIV, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KDF:    pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdf}},
+		Scheme: pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: rawIV}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := asn1.Marshal(encryptedPrivateKeyInfo{Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}}, Data: data})
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: encrypted}, nil
+}
+
+// LoadKeyPair reads a certificate chain and its key, decrypting the key with passphrase if it is encrypted.
+func LoadKeyPair(chainPath, keyPath string, passphrase []byte) (tls.Certificate, error) {
+	if passphrase == nil {
+		return tls.LoadX509KeyPair(chainPath, keyPath)
+	}
+	chain, err := os.ReadFile(chainPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	raw, err := os.ReadFile(keyPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return tls.Certificate{}, fmt.Errorf("%s holds no PEM", keyPath)
+	}
+	der, kind, err := DecryptKey(block, passphrase)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("%s: %w", keyPath, err)
+	}
+	return tls.X509KeyPair(chain, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}))
+}
+
+// KeyPair loads a certificate as LoadKeyPair does, or as LoadChain does with a Signer, only again once its files change,
+// as decrypting keys is slow on purpose and certificates are loaded for every visitor connection.
+type KeyPair struct {
+	ChainPath, KeyPath string
+	Passphrase         []byte
+	Signer             crypto.Signer
+
+	lock   sync.Mutex
+	stamp  string
+	loaded tls.Certificate
+}
+
+func (k *KeyPair) Load() (tls.Certificate, error) {
+	paths := []string{k.ChainPath, k.KeyPath}
+	if k.Signer != nil {
+		paths = paths[:1]
+	}
+	stamp, err := stampOf(paths...)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if stamp == k.stamp {
+		return k.loaded, nil
+	}
+	var pair tls.Certificate
+	if k.Signer != nil {
+		pair, err = LoadChain(k.ChainPath, k.Signer)
+	} else {
+		pair, err = LoadKeyPair(k.ChainPath, k.KeyPath, k.Passphrase)
+	}
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	k.stamp, k.loaded = stamp, pair
+	return pair, nil
+}
+
+// stampOf tells files apart by size and modification time, as they are replaced on renewal.
+func stampOf(paths ...string) (string, error) {
+	var stamp string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		stamp += fmt.Sprintf("%s:%d:%d;", path, info.Size(), info.ModTime().UnixNano())
+	}
+	return stamp, nil
+}
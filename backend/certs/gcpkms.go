@@ -0,0 +1,150 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gcpKMSAPI = "https://cloudkms.googleapis.com/v1/"
+	// gcpTokenURL is where instances get tokens of their service account.
+	gcpTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// gcpKMS signs with an asymmetric key version of Cloud KMS, as $GOOGLE_OAUTH_ACCESS_TOKEN or the service account
+// of the instance. Key versions only sign with one algorithm, which must be what TLS asks for; EC keys always are.
+type gcpKMS struct {
+	name   string
+	public crypto.PublicKey
+
+	lock    sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func openGCPKMS(name string) (*gcpKMS, error) {
+	if !strings.HasPrefix(name, "projects/") || !strings.Contains(name, "/cryptoKeyVersions/") {
+		return nil, errors.New("expected gcpkms:projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>/cryptoKeyVersions/<version>")
+	}
+	k := &gcpKMS{name: name}
+	ctx, cancel := context.WithTimeout(context.Background(), signTimeout)
+	defer cancel()
+	var key struct {
+		PEM string `json:"pem"`
+	}
+	if err := k.call(ctx, http.MethodGet, name+"/publicKey", nil, &key); err != nil {
+		return nil, err
+	}
+	var err error
+	if k.public, err = parsePublicKey([]byte(key.PEM)); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *gcpKMS) Public() crypto.PublicKey {
+	return k.public
+}
+
+func (k *gcpKMS) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash, err := hashName(opts.HashFunc())
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), signTimeout)
+	defer cancel()
+	var signature struct {
+		Signature []byte `json:"signature"`
+	}
+	err = k.call(ctx, http.MethodPost, k.name+":asymmetricSign", map[string]any{"digest": map[string][]byte{hash: digest}}, &signature)
+	return signature.Signature, err
+}
+
+func (k *gcpKMS) call(ctx context.Context, method, path string, params, result any) error {
+	token, err := k.accessToken(ctx)
+	if err != nil {
+		return fmt.Errorf("access token: %w", err)
+	}
+	var body []byte
+	if params != nil {
+		if body, err = json.Marshal(params); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, gcpKMSAPI+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	var failure struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := doJSON(req, result, &failure); err != nil {
+		if failure.Error.Message != "" {
+			return fmt.Errorf("cloudkms: %s", failure.Error.Message)
+		}
+		return err
+	}
+	return nil
+}
+
+// accessToken is $GOOGLE_OAUTH_ACCESS_TOKEN, or a token of the instance's service account, until a minute before it expires.
+func (k *gcpKMS) accessToken(ctx context.Context) (string, error) {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if time.Now().Before(k.expires) {
+		return k.token, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gcpTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := doJSON(req, &token, nil); err != nil {
+		return "", err
+	}
+	k.token, k.expires = token.AccessToken, time.Now().Add(time.Duration(token.ExpiresIn)*time.Second-time.Minute)
+	return k.token, nil
+}
+
+// doJSON sends a request, reading its JSON answer into result, or into failure if it is not a success.
+func doJSON(req *http.Request, result, failure any) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		if failure != nil {
+			_ = json.Unmarshal(raw, failure)
+		}
+		return fmt.Errorf("%s answered %s", req.URL.Host, resp.Status)
+	}
+	return json.Unmarshal(raw, result)
+}
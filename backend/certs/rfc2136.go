@@ -0,0 +1,191 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// RFC2136 publishes records with DNS UPDATE messages sent over TCP to the primary of a zone,
+// such as BIND, Knot or PowerDNS, signed with TSIG (HMAC-SHA256) when given a key.
+type RFC2136 struct {
+	// Server is the host:port of the primary, Zone the zone it is authoritative for.
+	Server, Zone string
+	KeyName      string
+	Secret       []byte
+}
+
+const (
+	dnsTypeSOA  = 6
+	dnsTypeTXT  = 16
+	dnsTypeTSIG = 250
+	dnsClassIN  = 1
+	// dnsClassNone deletes a record in an update, dnsClassAny is that of TSIG records.
+	dnsClassNone = 254
+	dnsClassAny  = 255
+	dnsOpUpdate  = 5 << 11
+	tsigFudge    = 300
+	tsigHMAC     = "hmac-sha256"
+	updateWait   = 30 * time.Second
+)
+
+func openRFC2136(arg string) (*RFC2136, error) {
+	server, zone, found := strings.Cut(arg, "/")
+	if _, _, err := net.SplitHostPort(server); err != nil || !found || zone == "" {
+		return nil, errors.New("expected rfc2136:<server>:<port>/<zone>")
+	}
+	p := &RFC2136{Server: server, Zone: zone, KeyName: os.Getenv("RFC2136_TSIG_KEY")}
+	if p.KeyName != "" {
+		secret, err := base64.StdEncoding.DecodeString(os.Getenv("RFC2136_TSIG_SECRET"))
+		if err != nil || len(secret) == 0 {
+			return nil, errors.New("$RFC2136_TSIG_KEY requires $RFC2136_TSIG_SECRET, in base64")
+		}
+		p.Secret = secret
+	}
+	return p, nil
+}
+
+func (p *RFC2136) Present(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, true)
+}
+
+func (p *RFC2136) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, false)
+}
+
+// update adds or deletes the TXT record of value at fqdn.
+func (p *RFC2136) update(ctx context.Context, fqdn, value string, add bool) error {
+	if len(value) > 255 {
+		return errors.New("TXT value too long")
+	}
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	msg := &bytes.Buffer{}
+	msg.Write(id[:])
+	// Flags, then one zone and one update.
+	writeUint16s(msg, dnsOpUpdate, 1, 0, 1, 0)
+	if err := writeName(msg, p.Zone); err != nil {
+		return err
+	}
+	writeUint16s(msg, dnsTypeSOA, dnsClassIN)
+	if err := writeName(msg, fqdn); err != nil {
+		return err
+	}
+	class, ttl := uint16(dnsClassNone), uint32(0)
+	if add {
+		class, ttl = dnsClassIN, 60
+	}
+	writeUint16s(msg, dnsTypeTXT, class)
+	_ = binary.Write(msg, binary.BigEndian, ttl)
+	writeUint16s(msg, uint16(len(value)+1))
+	msg.WriteByte(byte(len(value)))
+	msg.WriteString(value)
+	if p.KeyName != "" {
+		if err := p.sign(msg, binary.BigEndian.Uint16(id[:]), time.Now()); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, updateWait)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.Server)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	framed := &bytes.Buffer{}
+	writeUint16s(framed, uint16(msg.Len()))
+	framed.Write(msg.Bytes())
+	if _, err := conn.Write(framed.Bytes()); err != nil {
+		return err
+	}
+	var size uint16
+	if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+		return err
+	}
+	answer := make([]byte, size)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return err
+	}
+	if len(answer) < 12 || !bytes.Equal(answer[:2], id[:]) {
+		return errors.New("unexpected answer to the update")
+	}
+	if rcode := answer[3] & 0xf; rcode != 0 {
+		return fmt.Errorf("update refused (rcode %d)", rcode)
+	}
+	return nil
+}
+
+// sign appends a TSIG record to an update (RFC 8945), and counts it among the additional records.
+func (p *RFC2136) sign(msg *bytes.Buffer, id uint16, now time.Time) error {
+	signed := make([]byte, 6)
+	binary.BigEndian.PutUint16(signed, uint16(now.Unix()>>32))
+	binary.BigEndian.PutUint32(signed[2:], uint32(now.Unix()))
+
+	variables := &bytes.Buffer{}
+	if err := writeName(variables, strings.ToLower(p.KeyName)); err != nil {
+		return err
+	}
+	writeUint16s(variables, dnsClassAny, 0, 0)
+	_ = writeName(variables, tsigHMAC)
+	variables.Write(signed)
+	// Fudge, error, and no other data.
+	writeUint16s(variables, tsigFudge, 0, 0)
+	mac := hmac.New(sha256.New, p.Secret)
+	_, _ = mac.Write(msg.Bytes())
+	_, _ = mac.Write(variables.Bytes())
+	sum := mac.Sum(nil)
+
+	rdata := &bytes.Buffer{}
+	_ = writeName(rdata, tsigHMAC)
+	rdata.Write(signed)
+	writeUint16s(rdata, tsigFudge, uint16(len(sum)))
+	rdata.Write(sum)
+	writeUint16s(rdata, id, 0, 0)
+
+	_ = writeName(msg, strings.ToLower(p.KeyName))
+	writeUint16s(msg, dnsTypeTSIG, dnsClassAny, 0, 0, uint16(rdata.Len()))
+	msg.Write(rdata.Bytes())
+	binary.BigEndian.PutUint16(msg.Bytes()[10:], 1)
+	return nil
+}
+
+// writeName writes a domain name in wire format, uncompressed.
+func writeName(b *bytes.Buffer, name string) error {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if label == "" || len(label) > 63 {
+				return fmt.Errorf("invalid name %q", name)
+			}
+			b.WriteByte(byte(len(label)))
+			b.WriteString(label)
+		}
+	}
+	b.WriteByte(0)
+	return nil
+}
+
+func writeUint16s(b *bytes.Buffer, values ...uint16) {
+	for _, v := range values {
+		_ = binary.Write(b, binary.BigEndian, v)
+	}
+}
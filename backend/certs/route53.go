@@ -0,0 +1,111 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	route53API = "https://route53.amazonaws.com/2013-04-01"
+	// route53Region is where Route 53, a global service, signs requests.
+	route53Region = "us-east-1"
+	route53Poll   = 5 * time.Second
+)
+
+// Route53 publishes records in a hosted zone of Amazon Route 53, waiting for changes to reach its name servers.
+type Route53 struct {
+	ZoneID                       string
+	AccessKeyID, SecretAccessKey string
+	// SessionToken comes with temporary credentials.
+	SessionToken string
+}
+
+type route53Change struct {
+	XMLName xml.Name `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+	Action  string   `xml:"ChangeBatch>Changes>Change>Action"`
+	Name    string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>Name"`
+	Type    string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>Type"`
+	TTL     int      `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>TTL"`
+	Value   string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>ResourceRecords>ResourceRecord>Value"`
+}
+
+type route53ChangeInfo struct {
+	ID     string `xml:"ChangeInfo>Id"`
+	Status string `xml:"ChangeInfo>Status"`
+}
+
+func (r *Route53) Present(ctx context.Context, fqdn, value string) error {
+	return r.change(ctx, "UPSERT", fqdn, value)
+}
+
+func (r *Route53) CleanUp(ctx context.Context, fqdn, value string) error {
+	return r.change(ctx, "DELETE", fqdn, value)
+}
+
+// change applies a change to the TXT record at fqdn, then waits for it to be in sync.
+func (r *Route53) change(ctx context.Context, action, fqdn, value string) error {
+	body, err := xml.Marshal(route53Change{Action: action, Name: fqdn + ".", Type: "TXT", TTL: 60, Value: `"` + value + `"`})
+	if err != nil {
+		return err
+	}
+	zone := strings.TrimPrefix(r.ZoneID, "/hostedzone/")
+	var info route53ChangeInfo
+	if err := r.call(ctx, http.MethodPost, "/hostedzone/"+zone+"/rrset", body, &info); err != nil {
+		return err
+	}
+	for info.Status != "INSYNC" {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(route53Poll):
+		}
+		// The ID reads /change/<ID>.
+		if err := r.call(ctx, http.MethodGet, info.ID, nil, &info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Route53) call(ctx context.Context, method, path string, body []byte, result any) error {
+	req, err := http.NewRequestWithContext(ctx, method, route53API+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/xml")
+	}
+	r.sign(req, body, time.Now())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		var failure struct {
+			Message string `xml:"Error>Message"`
+		}
+		if xml.Unmarshal(raw, &failure) == nil && failure.Message != "" {
+			return fmt.Errorf("route53: %s", failure.Message)
+		}
+		return fmt.Errorf("route53 answered %s", resp.Status)
+	}
+	return xml.Unmarshal(raw, result)
+}
+
+// sign adds an AWS Signature Version 4 to a request.
+func (r *Route53) sign(req *http.Request, body []byte, now time.Time) {
+	signAWS(req, body, now, route53Region, "route53", r.AccessKeyID, r.SecretAccessKey, r.SessionToken)
+}
@@ -0,0 +1,163 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// The certificate key can stay out of the filesystem, in a KMS or HSM signing on our behalf: then only the chain is
+// read from disk, and Manager has certificates issued for the key instead of generating one.
+
+// signTimeout bounds how long a signature, made during TLS handshakes, may take.
+const signTimeout = 10 * time.Second
+
+var errKeyMismatch = errors.New("the certificate is not for the signer's key")
+
+// OpenSigner parses a signer spec: awskms:<key ID or ARN>, gcpkms:<key version name>, or exec:<command> [args].
+func OpenSigner(spec string) (crypto.Signer, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "awskms":
+		return openAWSKMS(arg)
+	case "gcpkms":
+		return openGCPKMS(arg)
+	case "exec":
+		return openExecSigner(arg)
+	default:
+		return nil, fmt.Errorf("unknown signer %q", spec)
+	}
+}
+
+// LoadChain reads a certificate chain whose key is signer.
+func LoadChain(chainPath string, signer crypto.Signer) (tls.Certificate, error) {
+	raw, err := os.ReadFile(chainPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	var pair tls.Certificate
+	for {
+		var block *pem.Block
+		if block, raw = pem.Decode(raw); block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			pair.Certificate = append(pair.Certificate, block.Bytes)
+		}
+	}
+	if len(pair.Certificate) == 0 {
+		return tls.Certificate{}, fmt.Errorf("%s holds no certificate", chainPath)
+	}
+	if pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+		return tls.Certificate{}, err
+	}
+	if !samePublicKey(pair.Leaf.PublicKey, signer.Public()) {
+		return tls.Certificate{}, fmt.Errorf("%s: %w", chainPath, errKeyMismatch)
+	}
+	pair.PrivateKey = signer
+	return pair, nil
+}
+
+func samePublicKey(a, b crypto.PublicKey) bool {
+	key, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(b)
+}
+
+// parsePublicKey reads a public key given as PEM or DER, in a certificate or not.
+func parsePublicKey(raw []byte) (crypto.PublicKey, error) {
+	if block, _ := pem.Decode(raw); block != nil {
+		raw = block.Bytes
+	}
+	if key, err := x509.ParsePKIXPublicKey(raw); err == nil {
+		return key, nil
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, errors.New("unreadable public key")
+	}
+	return cert.PublicKey, nil
+}
+
+// hashName is how hashes are named to signers.
+func hashName(h crypto.Hash) (string, error) {
+	switch h {
+	case crypto.SHA256:
+		return "sha256", nil
+	case crypto.SHA384:
+		return "sha384", nil
+	case crypto.SHA512:
+		return "sha512", nil
+	default:
+		return "", fmt.Errorf("unsupported hash %v", h)
+	}
+}
+
+// execSigner runs a command for its public key and each signature, the glue to PKCS#11 tokens and other HSMs:
+// `<command> [args] public` prints the public key, as PEM or DER, alone or in a certificate;
+// `<command> [args] sign <sha256|sha384|sha512> <pkcs1|pss|ecdsa>` reads a digest and prints its raw signature,
+// ASN.1 for ECDSA and with a salt as long as the hash for PSS.
+type execSigner struct {
+	args   []string
+	public crypto.PublicKey
+}
+
+func openExecSigner(command string) (*execSigner, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("expected exec:<command> [args]")
+	}
+	s := &execSigner{args: args}
+	ctx, cancel := context.WithTimeout(context.Background(), signTimeout)
+	defer cancel()
+	raw, err := s.run(ctx, nil, "public")
+	if err != nil {
+		return nil, err
+	}
+	if s.public, err = parsePublicKey(raw); err != nil {
+		return nil, fmt.Errorf("%s public: %w", args[0], err)
+	}
+	return s, nil
+}
+
+func (s *execSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *execSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash, err := hashName(opts.HashFunc())
+	if err != nil {
+		return nil, err
+	}
+	scheme := "ecdsa"
+	if _, ok := s.public.(*rsa.PublicKey); ok {
+		scheme = "pkcs1"
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			scheme = "pss"
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), signTimeout)
+	defer cancel()
+	return s.run(ctx, digest, "sign", hash, scheme)
+}
+
+func (s *execSigner) run(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, s.args[0], append(s.args[1:len(s.args):len(s.args)], args...)...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", s.args[0], args[0], err)
+	}
+	return out, nil
+}
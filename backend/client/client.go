@@ -0,0 +1,378 @@
+// Package client creates tunnels from Go programs and tests, as ssh -R would:
+//
+//	t, err := client.Open(ctx, "localhost:3000", client.Options{Auth: auth, HostKeyCallback: hostKeys})
+//	if err == nil {
+//		fmt.Println(t.URL())
+//		defer t.Close()
+//	}
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/wire"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Options describe how to connect; only Auth and HostKeyCallback are required.
+type Options struct {
+	// Server is the SSH address of the server, srv.us:22 by default.
+	Server string
+	// Login is a GitHub or GitLab login to get named URLs for, nomatch by default for hashed URLs only.
+	Login           string
+	Auth            []ssh.AuthMethod
+	HostKeyCallback ssh.HostKeyCallback
+	// Label tells the tunnel created by Open apart from the key's others; 0 picks the lowest free one.
+	Label uint32
+	// HTTP proxies requests over pooled channels (user+http@), Takeover takes names over from other keys (user+takeover@).
+	HTTP     bool
+	Takeover bool
+	// Timeout bounds dialing and waiting for announcements, 10s by default.
+	Timeout time.Duration
+	// Keepalive is how often we check that the server still answers, 15s by default.
+	Keepalive time.Duration
+	// OnMessage receives what the server tells us besides announcements, such as why a forward was refused.
+	OnMessage func(string)
+	// OnExchange receives the HTTP/1.x exchanges through tunnels, once their responses are complete.
+	OnExchange func(port uint32, ex *wire.Exchange)
+	// CaptureBodies is how much of request bodies OnExchange gets as Exchange.RequestBody, none if 0.
+	CaptureBodies int
+}
+
+func (o *Options) setDefaults() {
+	if o.Server == "" {
+		o.Server = "srv.us:22"
+	}
+	if o.Login == "" {
+		o.Login = "nomatch"
+	}
+	if o.Timeout == 0 {
+		o.Timeout = 10 * time.Second
+	}
+	if o.Keepalive == 0 {
+		o.Keepalive = 15 * time.Second
+	}
+	if o.OnMessage == nil {
+		o.OnMessage = func(string) {}
+	}
+}
+
+// ErrRefused is returned when the server does not forward a port; OnMessage receives its explanation.
+var ErrRefused = errors.New("forward refused")
+
+// message is a line the server writes to sessions of user+json@ connections.
+type message struct {
+	Port uint32   `json:"port,omitempty"`
+	URLs []string `json:"urls,omitempty"`
+	Text string   `json:"message,omitempty"`
+}
+
+// Client is an SSH connection to the server, carrying any number of tunnels.
+type Client struct {
+	opts Options
+	ssh  *ssh.Client
+	done chan struct{}
+
+	sync.Mutex
+	tunnels   map[uint32]*Tunnel
+	announced map[uint32][]string
+	// changed is closed, then replaced, whenever announced changes.
+	changed chan struct{}
+}
+
+// Dial connects and authenticates; ctx only bounds connecting, Close ends the connection.
+func Dial(ctx context.Context, opts Options) (*Client, error) {
+	opts.setDefaults()
+	dialer := net.Dialer{Timeout: opts.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", opts.Server)
+	if err != nil {
+		return nil, err
+	}
+	user := opts.Login + "+json"
+	if opts.HTTP {
+		user += "+http"
+	}
+	if opts.Takeover {
+		user += "+takeover"
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, opts.Server, &ssh.ClientConfig{
+		User:            user,
+		Auth:            opts.Auth,
+		HostKeyCallback: opts.HostKeyCallback,
+		Timeout:         opts.Timeout,
+	})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	cl := &Client{
+		opts:      opts,
+		ssh:       ssh.NewClient(c, chans, reqs),
+		done:      make(chan struct{}),
+		tunnels:   map[uint32]*Tunnel{},
+		announced: map[uint32][]string{},
+		changed:   make(chan struct{}),
+	}
+	go cl.serveForwards(cl.ssh.HandleChannelOpen("forwarded-tcpip"))
+
+	// The server writes announcements to sessions, so we need one.
+	session, err := cl.ssh.NewSession()
+	if err != nil {
+		_ = cl.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		_ = cl.Close()
+		return nil, err
+	}
+	if err := session.Shell(); err != nil {
+		_ = cl.Close()
+		return nil, err
+	}
+	go cl.readMessages(stdout)
+	go cl.keepalive()
+	return cl, nil
+}
+
+// Close ends the connection and its tunnels.
+func (c *Client) Close() error {
+	return c.ssh.Close()
+}
+
+// Wait returns once the connection is lost or closed.
+func (c *Client) Wait() error {
+	err := c.ssh.Wait()
+	<-c.done
+	return err
+}
+
+func (c *Client) readMessages(stdout io.Reader) {
+	defer close(c.done)
+	lines := bufio.NewScanner(stdout)
+	for lines.Scan() {
+		var m message
+		if err := json.Unmarshal(lines.Bytes(), &m); err != nil {
+			c.opts.OnMessage(lines.Text())
+			continue
+		}
+		if len(m.URLs) == 0 {
+			c.opts.OnMessage(m.Text)
+			continue
+		}
+		c.Lock()
+		c.announced[m.Port] = m.URLs
+		close(c.changed)
+		c.changed = make(chan struct{})
+		c.Unlock()
+	}
+	// Nothing will be announced anymore.
+	_ = c.ssh.Close()
+}
+
+// keepalive closes the connection once the server stops answering, as it is probably lost.
+func (c *Client) keepalive() {
+	ticker := time.NewTicker(c.opts.Keepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		replied := make(chan struct{})
+		go func() {
+			_, _, _ = c.ssh.SendRequest("keepalive@openssh.com", true, nil)
+			close(replied)
+		}()
+		select {
+		case <-replied:
+		case <-c.done:
+			return
+		case <-time.After(c.opts.Keepalive):
+			log.Printf("%s stopped answering", c.opts.Server)
+			_ = c.ssh.Close()
+			return
+		}
+	}
+}
+
+// Forward exposes localAddr as the tunnel of label (0 for the lowest free one), once the server announced its URLs.
+func (c *Client) Forward(ctx context.Context, label uint32, localAddr string) (*Tunnel, error) {
+	c.Lock()
+	delete(c.announced, label)
+	c.Unlock()
+
+	ok, reply, err := c.ssh.SendRequest("tcpip-forward", true, ssh.Marshal(&wire.ForwardRequest{BindAddr: "localhost", BindPort: label}))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%d: %w", label, ErrRefused)
+	}
+	port := label
+	var allocated struct{ Port uint32 }
+	if port == 0 && ssh.Unmarshal(reply, &allocated) == nil {
+		port = allocated.Port
+	}
+
+	t := &Tunnel{Port: port, client: c, local: localAddr}
+	c.Lock()
+	c.tunnels[port] = t
+	c.Unlock()
+
+	timeout := time.NewTimer(c.opts.Timeout)
+	defer timeout.Stop()
+	for {
+		c.Lock()
+		urls, changed := c.announced[port], c.changed
+		c.Unlock()
+		if urls != nil {
+			t.URLs = urls
+			return t, nil
+		}
+		select {
+		case <-changed:
+		case <-c.done:
+			return nil, errors.New("connection lost")
+		case <-ctx.Done():
+			_ = t.Close()
+			return nil, ctx.Err()
+		case <-timeout.C:
+			_ = t.Close()
+			return nil, fmt.Errorf("%d: no announcement", port)
+		}
+	}
+}
+
+// Tunnel is a local service exposed on URLs.
+type Tunnel struct {
+	Port uint32
+	// URLs all lead to the service, hashed ones first.
+	URLs []string
+
+	client *Client
+	local  string
+	// owned is set when the tunnel was created by Open, and closing it closes its connection.
+	owned bool
+}
+
+// Open connects and exposes localAddr as the tunnel of opts.Label, on a connection of its own.
+func Open(ctx context.Context, localAddr string, opts Options) (*Tunnel, error) {
+	c, err := Dial(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	t, err := c.Forward(ctx, opts.Label, localAddr)
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	t.owned = true
+	return t, nil
+}
+
+// URL is the first of the tunnel's URLs.
+func (t *Tunnel) URL() string {
+	return t.URLs[0]
+}
+
+// Wait returns once the connection carrying the tunnel is lost or closed.
+func (t *Tunnel) Wait() error {
+	return t.client.Wait()
+}
+
+// Close stops forwarding, and closes the connection if the tunnel was opened by Open.
+func (t *Tunnel) Close() error {
+	if t.owned {
+		return t.client.Close()
+	}
+	t.client.Lock()
+	delete(t.client.tunnels, t.Port)
+	t.client.Unlock()
+	ok, _, err := t.client.ssh.SendRequest("cancel-tcpip-forward", true, ssh.Marshal(&wire.ForwardCancelRequest{BindAddr: "localhost", BindPort: t.Port}))
+	if err == nil && !ok {
+		err = fmt.Errorf("%d: cancel refused", t.Port)
+	}
+	return err
+}
+
+func (c *Client) serveForwards(chans <-chan ssh.NewChannel) {
+	for nc := range chans {
+		var data wire.ForwardedChannelData
+		if err := ssh.Unmarshal(nc.ExtraData(), &data); err != nil {
+			_ = nc.Reject(ssh.ConnectionFailed, "invalid payload")
+			continue
+		}
+		c.Lock()
+		t := c.tunnels[data.DestPort]
+		c.Unlock()
+		if t == nil {
+			_ = nc.Reject(ssh.Prohibited, "unknown forward")
+			continue
+		}
+		go t.proxy(nc)
+	}
+}
+
+// proxy connects a channel to the local service, reporting HTTP exchanges to OnExchange if set.
+func (t *Tunnel) proxy(nc ssh.NewChannel) {
+	local, err := net.DialTimeout("tcp", t.local, t.client.opts.Timeout)
+	if err != nil {
+		log.Printf("%d: could not reach %s (%v)", t.Port, t.local, err)
+		_ = nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer func() {
+		_ = local.Close()
+	}()
+	remote, reqs, err := nc.Accept()
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = remote.Close()
+	}()
+	go ssh.DiscardRequests(reqs)
+
+	toLocal, toRemote := io.Writer(local), io.Writer(remote)
+	var obs *wire.Observer
+	if onExchange := t.client.opts.OnExchange; onExchange != nil {
+		obs = wire.NewCapturingObserver(t.client.opts.CaptureBodies, nil, func(ex *wire.Exchange) {
+			onExchange(t.Port, ex)
+		})
+		toLocal = io.MultiWriter(local, obs.Requests)
+		toRemote = io.MultiWriter(remote, obs.Responses)
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(toLocal, remote)
+		if obs != nil {
+			obs.Requests.Close()
+		}
+		if tcp, ok := local.(*net.TCPConn); ok {
+			_ = tcp.CloseWrite()
+		}
+	}()
+	_, err = io.Copy(toRemote, local)
+	if obs != nil {
+		obs.Responses.Close()
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		log.Printf("%d: copy from %s failed (%v)", t.Port, t.local, err)
+	}
+	_ = remote.CloseWrite()
+	wg.Wait()
+}
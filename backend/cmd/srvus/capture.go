@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// With -capture, requests are also kept on disk, so webhooks received overnight can be reviewed the next day
+// even if the client restarted meanwhile: each is appended as a JSON line, with its headers and the start of its body,
+// to a file per hour, e.g. requests-20241001T13.jsonl. Files are deleted once their requests are older than
+// -capture-max-age, and the oldest ones while they take more than -capture-max-size, which is checked every minute.
+
+const (
+	// captureBodyLimit bounds the bytes of each request body kept.
+	captureBodyLimit = 64 << 10
+	captureHour      = "20060102T15"
+	capturePrune     = time.Minute
+	// maxCaptureLine bounds the lines read back, a body and its headers encoded.
+	maxCaptureLine = 1 << 20
+)
+
+type capture struct {
+	dir     string
+	maxAge  time.Duration
+	maxSize int64
+
+	lock   sync.Mutex
+	pruned time.Time
+}
+
+func openCapture(dir string, maxAge time.Duration, maxSize int64) (*capture, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	c := &capture{dir: dir, maxAge: maxAge, maxSize: maxSize}
+	c.prune(time.Now())
+	return c, nil
+}
+
+// write appends a record to the file of its hour.
+func (c *capture) write(r record) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("Could not capture request (%v)", err)
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if now := time.Now(); now.Sub(c.pruned) >= capturePrune {
+		c.prune(now)
+	}
+	f, err := os.OpenFile(filepath.Join(c.dir, "requests-"+r.Time.UTC().Format(captureHour)+".jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Printf("Could not capture request (%v)", err)
+		return
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Printf("Could not capture request (%v)", err)
+	}
+	_ = f.Close()
+}
+
+// files returns the capture files with the hour they start, oldest first.
+func (c *capture) files() ([]string, []time.Time) {
+	paths, _ := filepath.Glob(filepath.Join(c.dir, "requests-*.jsonl"))
+	sort.Strings(paths)
+	var kept []string
+	var hours []time.Time
+	for _, path := range paths {
+		name := filepath.Base(path)
+		hour, err := time.Parse(captureHour, name[len("requests-"):len(name)-len(".jsonl")])
+		if err != nil {
+			continue
+		}
+		kept = append(kept, path)
+		hours = append(hours, hour)
+	}
+	return kept, hours
+}
+
+// prune deletes the files past the retention policy. The file of the current hour is only deleted for its age.
+func (c *capture) prune(now time.Time) {
+	c.pruned = now
+	paths, hours := c.files()
+	var kept []string
+	var sizes []int64
+	var total int64
+	for i, path := range paths {
+		if c.maxAge > 0 && now.Sub(hours[i].Add(time.Hour)) > c.maxAge {
+			c.remove(path)
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		kept = append(kept, path)
+		sizes = append(sizes, info.Size())
+		total += info.Size()
+	}
+	for c.maxSize > 0 && total > c.maxSize && len(kept) > 1 {
+		c.remove(kept[0])
+		total -= sizes[0]
+		kept, sizes = kept[1:], sizes[1:]
+	}
+}
+
+func (c *capture) remove(path string) {
+	if err := os.Remove(path); err != nil {
+		log.Printf("Could not delete %s (%v)", path, err)
+	}
+}
+
+// load reads back the records since a time, oldest first; only the latest limit of them if limit isn't 0.
+func (c *capture) load(since time.Time, limit int) []record {
+	paths, hours := c.files()
+	var result []record
+	for i := len(paths) - 1; i >= 0 && (limit == 0 || len(result) < limit); i-- {
+		if hours[i].Add(time.Hour).Before(since) {
+			break
+		}
+		records := readCapture(paths[i], since)
+		if limit != 0 && len(result)+len(records) > limit {
+			records = records[len(result)+len(records)-limit:]
+		}
+		result = append(records, result...)
+	}
+	return result
+}
+
+func readCapture(path string, since time.Time) []record {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("Could not read %s (%v)", path, err)
+		return nil
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	var records []record
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxCaptureLine)
+	for scanner.Scan() {
+		var r record
+		// A line cut short, e.g. by a crash, is skipped.
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil || r.Time.Before(since) {
+			continue
+		}
+		records = append(records, r)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Could not read %s (%v)", path, err)
+	}
+	return records
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/wire"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recentRequests bounds how many exchanges the inspector remembers.
+const recentRequests = 100
+
+type record struct {
+	Time     time.Time     `json:"time"`
+	Port     uint32        `json:"port"`
+	Method   string        `json:"method"`
+	URI      string        `json:"uri"`
+	Host     string        `json:"host"`
+	Status   int           `json:"status"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"duration_ns"`
+	// RequestID is the X-Request-Id the server gave the request, for tunnels proxied request by request.
+	RequestID string `json:"request_id,omitempty"`
+	// Header, Body and BodyBytes are only kept when capturing, Body up to captureBodyLimit of the BodyBytes sent.
+	Header    http.Header `json:"header,omitempty"`
+	Body      []byte      `json:"body,omitempty"`
+	BodyBytes int64       `json:"body_bytes,omitempty"`
+}
+
+// inspector remembers the latest HTTP exchanges through our tunnels and lists them over HTTP.
+type inspector struct {
+	sync.Mutex
+	records []record
+	// capture keeps records on disk too, if set.
+	capture *capture
+	// forwards are where requests are replayed by label.
+	forwards []forward
+}
+
+// newInspector starts from the latest records captured, if capturing.
+func newInspector(c *capture, forwards []forward) *inspector {
+	i := &inspector{capture: c, forwards: forwards}
+	if c != nil {
+		i.records = c.load(time.Time{}, recentRequests)
+	}
+	return i
+}
+
+// exchanged records an exchange, as client.Options.OnExchange.
+func (i *inspector) exchanged(port uint32, ex *wire.Exchange) {
+	r := record{
+		Time:      ex.Start,
+		Port:      port,
+		Method:    ex.Request.Method,
+		URI:       ex.Request.RequestURI,
+		Host:      ex.Request.Host,
+		Status:    ex.Response.StatusCode,
+		Bytes:     ex.ResponseBytes,
+		Duration:  time.Since(ex.Start),
+		RequestID: ex.Request.Header.Get("X-Request-Id"),
+	}
+	if i.capture != nil {
+		r.Header, r.Body, r.BodyBytes = ex.Request.Header, ex.RequestBody, ex.RequestBytes
+		i.capture.write(r)
+	}
+	i.Lock()
+	defer i.Unlock()
+	i.records = append(i.records, r)
+	if len(i.records) > recentRequests {
+		i.records = i.records[len(i.records)-recentRequests:]
+	}
+}
+
+// latest returns the records, most recent first.
+func (i *inspector) latest() []record {
+	i.Lock()
+	defer i.Unlock()
+	result := make([]record, len(i.records))
+	for j, r := range i.records {
+		result[len(result)-1-j] = r
+	}
+	return result
+}
+
+func (i *inspector) serve(l net.Listener) {
+	_ = http.Serve(l, i)
+}
+
+// since returns the records since a time, most recent first, from disk if capturing.
+func (i *inspector) since(t time.Time) []record {
+	if i.capture == nil {
+		var result []record
+		for _, r := range i.latest() {
+			if !r.Time.Before(t) {
+				result = append(result, r)
+			}
+		}
+		return result
+	}
+	records := i.capture.load(t, 0)
+	for j, k := 0, len(records)-1; j < k; j, k = j+1, k-1 {
+		records[j], records[k] = records[k], records[j]
+	}
+	return records
+}
+
+// ServeHTTP lists the records as text, or as JSON for clients that accept it; all of those since ?since=<RFC 3339 time> if set.
+func (i *inspector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/replay" {
+		i.replay(w, r)
+		return
+	}
+	records := i.latest()
+	if since := r.URL.Query().Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			http.Error(w, "Invalid since, expected e.g. 2024-10-01T18:00:00Z.", http.StatusBadRequest)
+			return
+		}
+		records = i.since(t)
+	}
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(records)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, rec := range records {
+		_, _ = fmt.Fprintf(w, "%s %d: %s %s%s → %d, %d bytes in %v",
+			rec.Time.Format(time.TimeOnly), rec.Port, rec.Method, rec.Host, rec.URI, rec.Status, rec.Bytes, rec.Duration.Round(time.Millisecond))
+		if rec.RequestID != "" {
+			_, _ = fmt.Fprintf(w, " (%s)", rec.RequestID)
+		}
+		if rec.BodyBytes > 0 {
+			_, _ = fmt.Fprintf(w, ", sent %d bytes", rec.BodyBytes)
+		}
+		_, _ = fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,246 @@
+// Command srvus exposes local services like ssh -R does, but reconnects on its own with backoff,
+// prints QR codes for the URLs it gets, reads profiles from a config file, and can list the requests it forwards.
+//
+//	srvus [flags] [label:][host:]port...
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/client"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// profile holds the settings of a run; the config file names several, and flags override them.
+type profile struct {
+	Server     string `json:"server,omitempty"`
+	Login      string `json:"login,omitempty"`
+	Identity   string `json:"identity,omitempty"`
+	KnownHosts string `json:"known_hosts,omitempty"`
+	HTTP       bool   `json:"http,omitempty"`
+	Takeover   bool   `json:"takeover,omitempty"`
+	QR         bool   `json:"qr,omitempty"`
+	Inspect    string `json:"inspect,omitempty"`
+	// Capture is where requests are kept on disk, per profile so per key, within CaptureMaxAge and CaptureMaxSize.
+	Capture        string   `json:"capture,omitempty"`
+	CaptureMaxAge  duration `json:"capture_max_age,omitempty"`
+	CaptureMaxSize int64    `json:"capture_max_size,omitempty"`
+	Forwards       []string `json:"forwards,omitempty"`
+}
+
+// duration is a time.Duration written as in flags, e.g. "168h", in the config file.
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var text string
+	if err := json.Unmarshal(b, &text); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(text)
+	*d = duration(parsed)
+	return err
+}
+
+type configFile struct {
+	Profiles map[string]profile `json:"profiles"`
+}
+
+func defaultProfile() profile {
+	p := profile{Server: "srv.us:22", CaptureMaxAge: duration(7 * 24 * time.Hour), CaptureMaxSize: 100 << 20}
+	if u, err := user.Current(); err == nil {
+		p.Login = u.Username
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		p.KnownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	return p
+}
+
+// bind defines flags overriding p, so parsing them twice lets the chosen profile's values act as defaults.
+func bind(fs *flag.FlagSet, p *profile, profileName, configPath *string) {
+	fs.StringVar(profileName, "profile", *profileName, "Profile of the config file to use")
+	fs.StringVar(configPath, "config", *configPath, "Path of the config file")
+	fs.StringVar(&p.Server, "server", p.Server, "SSH address of the server")
+	fs.StringVar(&p.Login, "login", p.Login, "GitHub or GitLab login, nomatch for hashed URLs only")
+	fs.StringVar(&p.Identity, "identity", p.Identity, "Private key to authenticate with (default: ssh-agent, then ~/.ssh/id_*)")
+	fs.StringVar(&p.KnownHosts, "known-hosts", p.KnownHosts, "known_hosts file; unknown servers are added to it")
+	fs.BoolVar(&p.HTTP, "http", p.HTTP, "Proxy HTTP requests over pooled channels (user+http@)")
+	fs.BoolVar(&p.Takeover, "takeover", p.Takeover, "Take names over from other keys of the login (user+takeover@)")
+	fs.BoolVar(&p.QR, "qr", p.QR, "Print QR codes of the URLs")
+	fs.StringVar(&p.Inspect, "inspect", p.Inspect, "Address to list forwarded HTTP requests on, e.g. localhost:4040")
+	fs.StringVar(&p.Capture, "capture", p.Capture, "Directory to keep forwarded HTTP requests in, with their headers and the start of their bodies")
+	fs.DurationVar((*time.Duration)(&p.CaptureMaxAge), "capture-max-age", time.Duration(p.CaptureMaxAge), "How long captured requests are kept")
+	fs.Int64Var(&p.CaptureMaxSize, "capture-max-size", p.CaptureMaxSize, "Bytes captured requests may take on disk")
+}
+
+func loadProfile(path, name string, explicit bool) (profile, error) {
+	p := defaultProfile()
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		return p, nil
+	}
+	if err != nil {
+		return p, err
+	}
+	var cfg configFile
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return p, fmt.Errorf("%s: %w", path, err)
+	}
+	found, ok := cfg.Profiles[name]
+	if !ok {
+		if explicit {
+			return p, fmt.Errorf("%s has no profile %q", path, name)
+		}
+		return p, nil
+	}
+	b, _ = json.Marshal(found)
+	// Unmarshalling over the defaults only replaces what the profile sets.
+	err = json.Unmarshal(b, &p)
+	return p, err
+}
+
+func main() {
+	configPath := ""
+	if dir, err := os.UserConfigDir(); err == nil {
+		configPath = filepath.Join(dir, "srvus", "config.json")
+	}
+	profileName := "default"
+
+	// First pass: only to find which profile to load.
+	scratch := defaultProfile()
+	first := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	first.SetOutput(io.Discard)
+	bind(first, &scratch, &profileName, &configPath)
+	_ = first.Parse(os.Args[1:])
+	explicit := false
+	first.Visit(func(f *flag.Flag) {
+		explicit = explicit || f.Name == "profile" || f.Name == "config"
+	})
+
+	p, err := loadProfile(configPath, profileName, explicit)
+	if err != nil {
+		log.Fatalf("Could not load profile (%v)", err)
+	}
+	bind(flag.CommandLine, &p, &profileName, &configPath)
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [label:][host:]port...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() > 0 {
+		p.Forwards = flag.Args()
+	}
+	if len(p.Forwards) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var forwards []forward
+	for i, spec := range p.Forwards {
+		f, err := parseForward(spec, i+1)
+		if err != nil {
+			log.Fatalf("Invalid forward %q (%v)", spec, err)
+		}
+		forwards = append(forwards, f)
+	}
+
+	auth, err := client.Keys(p.Identity)
+	if err != nil {
+		log.Fatalf("Could not load keys (%v)", err)
+	}
+	hostKeys, err := client.KnownHosts(p.KnownHosts)
+	if err != nil {
+		log.Fatalf("Could not load known hosts (%v)", err)
+	}
+
+	options := client.Options{
+		Server:          p.Server,
+		Login:           p.Login,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+		HTTP:            p.HTTP,
+		Takeover:        p.Takeover,
+		OnMessage: func(text string) {
+			fmt.Println(text)
+		},
+	}
+	var c *capture
+	if p.Capture != "" {
+		if c, err = openCapture(p.Capture, time.Duration(p.CaptureMaxAge), p.CaptureMaxSize); err != nil {
+			log.Fatalf("Could not capture requests (%v)", err)
+		}
+		options.CaptureBodies = captureBodyLimit
+	}
+	if p.Inspect != "" || c != nil {
+		ins := newInspector(c, forwards)
+		options.OnExchange = ins.exchanged
+		if p.Inspect != "" {
+			l, err := net.Listen("tcp", p.Inspect)
+			if err != nil {
+				log.Fatalf("Could not listen for inspection (%v)", err)
+			}
+			log.Printf("Listing requests on http://%s/", l.Addr())
+			go ins.serve(l)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	t := &tunnels{options: options, forwards: forwards, qr: p.QR, shown: map[string]bool{}}
+	if err := t.run(ctx); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// forward is a local service, exposed as the tunnel of its label.
+type forward struct {
+	Label uint32
+	Addr  string
+}
+
+// parseForward reads [label:][host:]port, like the end of ssh -R; the label defaults to position.
+func parseForward(spec string, position int) (forward, error) {
+	f := forward{Label: uint32(position)}
+	parts := strings.Split(spec, ":")
+	if len(parts) == 3 {
+		label, err := strconv.ParseUint(parts[0], 10, 16)
+		if err != nil {
+			return f, fmt.Errorf("bad label (%w)", err)
+		}
+		f.Label = uint32(label)
+		parts = parts[1:]
+	}
+	host := "localhost"
+	switch len(parts) {
+	case 1:
+	case 2:
+		host = parts[0]
+	default:
+		return f, errors.New("expected [label:][host:]port")
+	}
+	port := parts[len(parts)-1]
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return f, fmt.Errorf("bad port (%w)", err)
+	}
+	f.Addr = net.JoinHostPort(host, port)
+	return f, nil
+}
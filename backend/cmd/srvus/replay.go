@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Captured requests can be replayed against another build of a service, e.g. a webhook handler being fixed:
+// POST /replay?time=<time of the request, as listed in JSON>&to=<target> on the inspector sends it again,
+// headers and body included, to the local service of the forward labelled target, or else to localhost:target
+// or to target as host:port, and answers with what the service did.
+
+const replayTimeout = 30 * time.Second
+
+var replayClient = &http.Client{
+	Timeout: replayTimeout,
+	// Redirects are for whoever replays to follow, or not.
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// replay resends a captured request.
+func (i *inspector) replay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Replays are POSTed.", http.StatusMethodNotAllowed)
+		return
+	}
+	if i.capture == nil {
+		http.Error(w, "Only captured requests can be replayed, see -capture.", http.StatusNotFound)
+		return
+	}
+	t, err := time.Parse(time.RFC3339Nano, r.URL.Query().Get("time"))
+	if err != nil {
+		http.Error(w, "Invalid time, expected that of a request as listed in JSON.", http.StatusBadRequest)
+		return
+	}
+	addr, ok := i.replayTarget(r.URL.Query().Get("to"))
+	if !ok {
+		http.Error(w, "Invalid to, expected a label, a port or host:port.", http.StatusBadRequest)
+		return
+	}
+	var rec *record
+	for _, candidate := range i.capture.load(t, 0) {
+		if candidate.Time.Equal(t) {
+			rec = &candidate
+			break
+		}
+	}
+	if rec == nil {
+		http.Error(w, "No request captured at that time.", http.StatusNotFound)
+		return
+	}
+	if int64(len(rec.Body)) < rec.BodyBytes {
+		http.Error(w, fmt.Sprintf("Only %d of the %d bytes of its body were captured.", len(rec.Body), rec.BodyBytes), http.StatusConflict)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), rec.Method, "http://"+addr+rec.URI, bytes.NewReader(rec.Body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Header = rec.Header.Clone()
+	req.Host = rec.Host
+	resp, err := replayClient.Do(req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not replay to %s (%v).", addr, err), http.StatusBadGateway)
+		return
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("X-Replayed-To", addr)
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+// replayTarget resolves the label of a forward, a local port or host:port to an address.
+func (i *inspector) replayTarget(to string) (string, bool) {
+	if n, err := strconv.ParseUint(to, 10, 16); err == nil {
+		for _, f := range i.forwards {
+			if f.Label == uint32(n) {
+				return f.Addr, true
+			}
+		}
+		return net.JoinHostPort("localhost", to), true
+	}
+	_, port, err := net.SplitHostPort(to)
+	return to, err == nil && port != ""
+}
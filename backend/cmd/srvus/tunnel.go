@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/client"
+	"github.com/pcarrier/srv.us/backend/qr"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+type tunnels struct {
+	options  client.Options
+	forwards []forward
+	qr       bool
+	// shown remembers URLs we printed QR codes for, not to repeat them on every reconnection.
+	shown map[string]bool
+}
+
+// run connects until ctx is done or authentication fails, waiting longer after every failure.
+func (t *tunnels) run(ctx context.Context) error {
+	backoff := minBackoff
+	for {
+		established, err := t.connect(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil && strings.Contains(err.Error(), "unable to authenticate") {
+			return fmt.Errorf("%s refused our keys (%v)", t.options.Server, err)
+		}
+		if established {
+			backoff = minBackoff
+		}
+		// Jitter spreads reconnections when the server restarts.
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		log.Printf("Disconnected (%v), reconnecting in %v", err, delay.Round(time.Second))
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// connect serves the forwards over one connection until it is lost,
+// reporting whether it got as far as authenticating.
+func (t *tunnels) connect(ctx context.Context) (bool, error) {
+	c, err := client.Dial(ctx, t.options)
+	if err != nil {
+		return false, err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		_ = c.Close()
+	}()
+
+	for _, f := range t.forwards {
+		tunnel, err := c.Forward(ctx, f.Label, f.Addr)
+		if errors.Is(err, client.ErrRefused) {
+			// The server explained why in a message.
+			continue
+		}
+		if err != nil {
+			return true, err
+		}
+		t.show(tunnel)
+	}
+	return true, c.Wait()
+}
+
+func (t *tunnels) show(tunnel *client.Tunnel) {
+	fmt.Printf("%d: %s\n", tunnel.Port, strings.Join(tunnel.URLs, ", "))
+	if !t.qr || t.shown[tunnel.URL()] {
+		return
+	}
+	t.shown[tunnel.URL()] = true
+	code, err := qr.Encode(tunnel.URL())
+	if err != nil {
+		log.Printf("No QR code for %s (%v)", tunnel.URL(), err)
+		return
+	}
+	fmt.Print(code.Terminal())
+}
@@ -0,0 +1,246 @@
+// Package geoip locates addresses with MaxMind databases, and decides who may reach an endpoint from where.
+package geoip
+
+import (
+	"fmt"
+	"github.com/oschwald/maxminddb-golang"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Info is what we know about where a visitor or client comes from.
+type Info struct {
+	Country string `json:"country,omitempty"`
+	ASN     uint   `json:"asn,omitempty"`
+	ASOrg   string `json:"as_org,omitempty"`
+}
+
+// DB looks addresses up in optional MaxMind databases (GeoLite2/GeoIP2 Country or City, and ASN).
+// A nil *DB knows nothing.
+type DB struct {
+	country *maxminddb.Reader
+	asn     *maxminddb.Reader
+}
+
+// Open opens the databases at the paths given, returning nil if there are none.
+func Open(countryPath, asnPath string) (*DB, error) {
+	if countryPath == "" && asnPath == "" {
+		return nil, nil
+	}
+	g := &DB{}
+	if countryPath != "" {
+		r, err := maxminddb.Open(countryPath)
+		if err != nil {
+			return nil, err
+		}
+		g.country = r
+	}
+	if asnPath != "" {
+		r, err := maxminddb.Open(asnPath)
+		if err != nil {
+			g.Close()
+			return nil, err
+		}
+		g.asn = r
+	}
+	return g, nil
+}
+
+// HasCountry tells whether countries are known, so country rules can be evaluated.
+func (g *DB) HasCountry() bool {
+	return g != nil && g.country != nil
+}
+
+// HasASN tells whether AS numbers are known, so AS rules can be evaluated.
+func (g *DB) HasASN() bool {
+	return g != nil && g.asn != nil
+}
+
+// Evaluates tells whether the database a rule needs is loaded.
+func (g *DB) Evaluates(rule string) bool {
+	if strings.HasPrefix(rule, "AS") {
+		return g.HasASN()
+	}
+	return g.HasCountry()
+}
+
+// Check returns why some rules cannot be evaluated, if they cannot.
+func (g *DB) Check(r *Rules) error {
+	if r == nil {
+		return nil
+	}
+	for _, rule := range append(append([]string{}, r.Allow...), r.Block...) {
+		if g.Evaluates(rule) {
+			continue
+		}
+		if strings.HasPrefix(rule, "AS") {
+			return fmt.Errorf("%s needs an ASN database, which this server lacks", rule)
+		}
+		return fmt.Errorf("%s needs a country database, which this server lacks", rule)
+	}
+	return nil
+}
+
+// Applicable returns the rules that can be evaluated, failing open for the others, e.g. rules stored before a database
+// was removed: blocks that cannot be evaluated are left out, and so is an allow list if any of its rules cannot be.
+func (g *DB) Applicable(r *Rules) *Rules {
+	if r.Empty() {
+		return r
+	}
+	applicable := &Rules{Allow: r.Allow}
+	for _, rule := range r.Allow {
+		if !g.Evaluates(rule) {
+			applicable.Allow = nil
+			break
+		}
+	}
+	for _, rule := range r.Block {
+		if g.Evaluates(rule) {
+			applicable.Block = append(applicable.Block, rule)
+		}
+	}
+	return applicable
+}
+
+func (g *DB) Lookup(ip net.IP) Info {
+	var info Info
+	if g == nil || ip == nil {
+		return info
+	}
+	if g.country != nil {
+		var record struct {
+			Country struct {
+				ISOCode string `maxminddb:"iso_code"`
+			} `maxminddb:"country"`
+		}
+		if err := g.country.Lookup(ip, &record); err == nil {
+			info.Country = record.Country.ISOCode
+		}
+	}
+	if g.asn != nil {
+		var record struct {
+			Number       uint   `maxminddb:"autonomous_system_number"`
+			Organization string `maxminddb:"autonomous_system_organization"`
+		}
+		if err := g.asn.Lookup(ip, &record); err == nil {
+			info.ASN = record.Number
+			info.ASOrg = record.Organization
+		}
+	}
+	return info
+}
+
+func (g *DB) LookupAddr(addr net.Addr) Info {
+	return g.Lookup(net.ParseIP(host(addr)))
+}
+
+func host(addr net.Addr) string {
+	h, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return h
+}
+
+func (g *DB) Close() {
+	if g == nil {
+		return
+	}
+	if g.country != nil {
+		_ = g.country.Close()
+	}
+	if g.asn != nil {
+		_ = g.asn.Close()
+	}
+}
+
+// Rules decide which visitors may reach an endpoint.
+// Entries are ISO country codes (FR) or AS numbers (AS13335). Block wins over allow;
+// a non-empty allow list admits nobody else.
+type Rules struct {
+	Allow []string `json:"allow,omitempty"`
+	Block []string `json:"block,omitempty"`
+}
+
+func (r *Rules) Empty() bool {
+	return r == nil || (len(r.Allow) == 0 && len(r.Block) == 0)
+}
+
+func (r *Rules) Permits(info Info) bool {
+	if r.Empty() {
+		return true
+	}
+	for _, rule := range r.Block {
+		if ruleMatches(rule, info) {
+			return false
+		}
+	}
+	if len(r.Allow) == 0 {
+		return true
+	}
+	for _, rule := range r.Allow {
+		if ruleMatches(rule, info) {
+			return true
+		}
+	}
+	return false
+}
+
+func ruleMatches(rule string, info Info) bool {
+	if strings.HasPrefix(rule, "AS") {
+		return info.ASN != 0 && rule == fmt.Sprintf("AS%d", info.ASN)
+	}
+	return info.Country != "" && rule == info.Country
+}
+
+// ParseRule normalizes a country code or AS number as written by a user.
+func ParseRule(s string) (string, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if strings.HasPrefix(s, "AS") {
+		n, err := strconv.ParseUint(s[2:], 10, 32)
+		if err != nil || n == 0 {
+			return "", fmt.Errorf("invalid AS number %q", s)
+		}
+		return fmt.Sprintf("AS%d", n), nil
+	}
+	if len(s) != 2 || s[0] < 'A' || s[0] > 'Z' || s[1] < 'A' || s[1] > 'Z' {
+		return "", fmt.Errorf("invalid country code %q", s)
+	}
+	return s, nil
+}
+
+func ParseRules(items []string) ([]string, error) {
+	result := make([]string, 0, len(items))
+	for _, item := range items {
+		rule, err := ParseRule(item)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, rule)
+	}
+	return result, nil
+}
+
+func (r *Rules) Normalize() error {
+	var err error
+	if r.Allow, err = ParseRules(r.Allow); err != nil {
+		return err
+	}
+	r.Block, err = ParseRules(r.Block)
+	return err
+}
+
+func (r *Rules) String() string {
+	if r.Empty() {
+		return "no rules"
+	}
+	var parts []string
+	if len(r.Allow) > 0 {
+		parts = append(parts, "allow "+strings.Join(r.Allow, " "))
+	}
+	if len(r.Block) > 0 {
+		parts = append(parts, "block "+strings.Join(r.Block, " "))
+	}
+	return strings.Join(parts, ", ")
+}
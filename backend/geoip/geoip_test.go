@@ -0,0 +1,76 @@
+package geoip
+
+import (
+	"github.com/oschwald/maxminddb-golang"
+	"path/filepath"
+	"testing"
+)
+
+func TestPermits(t *testing.T) {
+	rules := &Rules{Allow: []string{"FR", "BE"}, Block: []string{"AS16276"}}
+	for _, tc := range []struct {
+		info     Info
+		expected bool
+	}{
+		{Info{Country: "FR", ASN: 3215}, true},
+		{Info{Country: "BE"}, true},
+		{Info{Country: "FR", ASN: 16276}, false},
+		{Info{Country: "DE", ASN: 3320}, false},
+		{Info{}, false},
+	} {
+		if got := rules.Permits(tc.info); got != tc.expected {
+			t.Errorf("%+v: got %v, expected %v", tc.info, got, tc.expected)
+		}
+	}
+	if !(*Rules)(nil).Permits(Info{}) || !(&Rules{Block: []string{"FR"}}).Permits(Info{}) {
+		t.Error("visitors matching no block must be permitted without allow rules")
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules([]string{" fr", "as013335"})
+	if err != nil || len(rules) != 2 || rules[0] != "FR" || rules[1] != "AS13335" {
+		t.Fatalf("got %v, %v", rules, err)
+	}
+	for _, invalid := range []string{"FRA", "F1", "AS", "AS0", "ASx"} {
+		if _, err := ParseRule(invalid); err == nil {
+			t.Errorf("%q: accepted", invalid)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	if g, err := Open("", ""); g != nil || err != nil {
+		t.Fatalf("got %v, %v without databases", g, err)
+	}
+	missing := filepath.Join(t.TempDir(), "missing.mmdb")
+	if _, err := Open("", missing); err == nil {
+		t.Fatal("opened a missing database")
+	}
+}
+
+// TestApplicable evaluates rules on servers missing databases, which must neither lock visitors out nor block them.
+func TestApplicable(t *testing.T) {
+	asnOnly := &DB{asn: &maxminddb.Reader{}}
+	rules := &Rules{Allow: []string{"FR", "AS3215"}, Block: []string{"BE", "AS16276"}}
+	if err := asnOnly.Check(rules); err == nil {
+		t.Error("country rules accepted without a country database")
+	}
+	if err := asnOnly.Check(&Rules{Allow: []string{"AS3215"}}); err != nil {
+		t.Error(err)
+	}
+	if err := (*DB)(nil).Check(&Rules{Block: []string{"AS3215"}}); err == nil {
+		t.Error("AS rules accepted without databases")
+	}
+
+	applicable := asnOnly.Applicable(rules)
+	if len(applicable.Allow) != 0 || len(applicable.Block) != 1 || applicable.Block[0] != "AS16276" {
+		t.Fatalf("got %+v", applicable)
+	}
+	if !applicable.Permits(Info{ASN: 1}) || applicable.Permits(Info{ASN: 16276}) {
+		t.Error("got wrong decisions from applicable rules")
+	}
+	if !(*DB)(nil).Applicable(rules).Permits(Info{}) {
+		t.Error("visitors locked out without databases")
+	}
+}
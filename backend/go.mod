@@ -4,7 +4,10 @@ go 1.20
 
 require (
 	github.com/jackc/pgx/v4 v4.18.1
+	github.com/oschwald/maxminddb-golang v1.12.0
 	golang.org/x/crypto v0.11.0
+	golang.org/x/sys v0.10.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -16,6 +19,5 @@ require (
 	github.com/jackc/pgservicefile v0.0.0-20221227161230-091c0ba34f0a // indirect
 	github.com/jackc/pgtype v1.14.0 // indirect
 	github.com/jackc/puddle v1.3.0 // indirect
-	golang.org/x/sys v0.10.0 // indirect
 	golang.org/x/text v0.11.0 // indirect
 )
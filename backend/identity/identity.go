@@ -0,0 +1,99 @@
+// Package identity derives who a client is from its SSH key and login, and which endpoint names it gets.
+package identity
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Base32 is the lowercase, unpadded encoding used in names.
+var Base32 = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base64.NoPadding)
+
+// KeyID identifies a client key, as GitHub and GitLab list them without the trailing =.
+func KeyID(key ssh.PublicKey) string {
+	return base64.RawStdEncoding.EncodeToString(key.Marshal())
+}
+
+// Endpoints lists the names of a tunnel: its hashed name, then the subdomains of verified accounts.
+func Endpoints(domain string, user string, key ssh.PublicKey, port uint32, salt string, githubEnabled bool, gitlabEnabled bool) []string {
+	result := []string{HashedEndpoint(domain, key.Marshal(), port, salt)}
+	if githubEnabled {
+		if port == 1 {
+			result = append(result, fmt.Sprintf("%s.gh.%s", user, domain))
+		} else {
+			result = append(result, fmt.Sprintf("%s--%d.gh.%s", user, port, domain))
+		}
+	}
+	if gitlabEnabled {
+		result = append(result, fmt.Sprintf("%s-%d.gl.%s", user, port, domain))
+	}
+	return result
+}
+
+// HashedEndpoint derives the stable name of a tunnel from its key and port,
+// mixing in the salt its owner got by rotating it, if any.
+func HashedEndpoint(domain string, key []byte, port uint32, salt string) string {
+	hasher := sha256.New()
+	_, _ = hasher.Write(key)
+	_, _ = hasher.Write([]byte{0})
+	_, _ = hasher.Write([]byte(strconv.Itoa(int(port))))
+	if salt != "" {
+		_, _ = hasher.Write([]byte{0})
+		_, _ = hasher.Write([]byte(salt))
+	}
+	b32 := Base32.EncodeToString(hasher.Sum(nil)[:16])
+	return fmt.Sprintf("%s.%s", b32, domain)
+}
+
+// IsHashed reports whether name is a hashed name under domain, rather than the subdomain of an account.
+func IsHashed(domain, name string) bool {
+	label, found := strings.CutSuffix(name, "."+domain)
+	return found && len(label) == Base32.EncodedLen(16) && !strings.Contains(label, ".")
+}
+
+// KeyMatchesAccount checks whether a key is listed by https://<domain>/<user>.keys, as GitHub and GitLab publish them.
+// The lookup gives up after 5 seconds, or once ctx ends.
+func KeyMatchesAccount(ctx context.Context, domain, user, key string) bool {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://%s/%s.keys", domain, user), nil)
+	if err != nil {
+		log.Printf("Error creating request to %s for %s (%v)", domain, user, err)
+		return false
+	}
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("Error querying %s for %s (%v)", domain, user, err)
+		return false
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		log.Printf("Error reading response from %s for %s (%v)", domain, user, err)
+		return false
+	}
+	lines := strings.Split(string(body), "\n")
+	for _, line := range lines {
+		parts := strings.SplitN(line, " ", 3)
+		if len(parts) < 2 {
+			continue
+		}
+		if strings.TrimRight(parts[1], "=") == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,26 @@
+package identity
+
+import "strings"
+
+// Options are the flags a client appends to its SSH login, as in ssh jdoe+takeover@srv.us.
+// Neither GitHub nor GitLab allow + in usernames, so the login itself is never ambiguous.
+type Options map[string]string
+
+// ParseUser splits an SSH user into the account login and its options, written as +name or +name=value.
+func ParseUser(user string) (string, Options) {
+	parts := strings.Split(user, "+")
+	opts := Options{}
+	for _, part := range parts[1:] {
+		if part == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(part, "=")
+		opts[strings.ToLower(name)] = value
+	}
+	return parts[0], opts
+}
+
+func (o Options) Has(name string) bool {
+	_, found := o[name]
+	return found
+}
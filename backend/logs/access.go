@@ -0,0 +1,125 @@
+package logs
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/geoip"
+	"github.com/pcarrier/srv.us/backend/wire"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var AccessFormats = map[string]bool{"combined": true, "json": true}
+
+// Access writes one line per proxied HTTP request, in Apache combined log format or as JSON.
+// A nil *Access records nothing.
+type Access struct {
+	w      io.Writer
+	format string
+	geo    *geoip.DB
+}
+
+func NewAccess(w io.Writer, format string, geo *geoip.DB) *Access {
+	return &Access{w: w, format: format, geo: geo}
+}
+
+func (l *Access) Record(host string, keyID string, remote net.Addr, ex *wire.Exchange) {
+	if l == nil || ex.Response == nil {
+		return
+	}
+	var line []byte
+	if l.format == "json" {
+		line = accessLogJSON(host, keyID, remote, l.geo.LookupAddr(remote), ex)
+	} else {
+		line = accessLogCombined(remote, ex)
+	}
+	if _, err := l.w.Write(line); err != nil {
+		log.Printf("Could not write access log (%v)", err)
+	}
+}
+
+func remoteHost(remote net.Addr) string {
+	host, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		return remote.String()
+	}
+	return host
+}
+
+func accessLogCombined(remote net.Addr, ex *wire.Exchange) []byte {
+	req := ex.Request
+	user := "-"
+	if u, _, ok := req.BasicAuth(); ok && u != "" {
+		user = combinedEscape(u)
+	}
+	size := "-"
+	if ex.ResponseBytes > 0 {
+		size = strconv.FormatInt(ex.ResponseBytes, 10)
+	}
+	return []byte(fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"\n",
+		remoteHost(remote),
+		user,
+		ex.Start.Format("02/Jan/2006:15:04:05 -0700"),
+		combinedEscape(req.Method),
+		combinedEscape(req.RequestURI),
+		combinedEscape(req.Proto),
+		ex.Response.StatusCode,
+		size,
+		combinedOrDash(req.Referer()),
+		combinedOrDash(req.UserAgent()),
+	))
+}
+
+func combinedOrDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return combinedEscape(s)
+}
+
+// combinedEscape escapes quotes, backslashes and control characters as Apache does.
+func combinedEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			_, _ = fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func accessLogJSON(host string, keyID string, remote net.Addr, geo geoip.Info, ex *wire.Exchange) []byte {
+	req := ex.Request
+	line, err := json.Marshal(map[string]any{
+		"time":               ex.Start.UTC().Format(time.RFC3339Nano),
+		"host":               host,
+		"key":                keyID,
+		"remote":             remoteHost(remote),
+		"method":             req.Method,
+		"uri":                req.RequestURI,
+		"proto":              req.Proto,
+		"status":             ex.Response.StatusCode,
+		"bytes":              ex.ResponseBytes,
+		"duration_ms":        time.Since(ex.Start).Milliseconds(),
+		"referer":            req.Referer(),
+		"user_agent":         req.UserAgent(),
+		"request_id":         req.Header.Get("X-Request-Id"),
+		"service_request_id": ex.Response.Header.Get("X-Service-Request-Id"),
+		"geo":                geo,
+	})
+	if err != nil {
+		return nil
+	}
+	return append(line, '\n')
+}
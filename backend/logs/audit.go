@@ -0,0 +1,40 @@
+package logs
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"time"
+)
+
+// Audit records security-relevant events as JSON lines, one per event, separately from operational logs.
+// A nil *Audit records nothing.
+type Audit struct {
+	w io.Writer
+}
+
+func NewAudit(w io.Writer) *Audit {
+	return &Audit{w: w}
+}
+
+type Fields map[string]any
+
+func (a *Audit) Record(event string, fields Fields) {
+	if a == nil {
+		return
+	}
+	entry := make(map[string]any, len(fields)+2)
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["event"] = event
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Could not encode audit event %s (%v)", event, err)
+		return
+	}
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		log.Printf("Could not write audit event %s (%v)", event, err)
+	}
+}
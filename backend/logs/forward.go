@@ -0,0 +1,215 @@
+package logs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Forwarder is written audit events, one JSON line per write, and sends them on to a webhook or NATS,
+// so operators can feed their alerting and billing systems. It never blocks the events it is written:
+// they are queued, sent in batches, and dropped if the sink cannot keep up.
+type Forwarder struct {
+	events  map[string]bool
+	queue   chan []byte
+	send    func(ctx context.Context, batch [][]byte) error
+	stop    chan struct{}
+	done    chan struct{}
+	closing sync.Once
+}
+
+const (
+	forwardQueue    = 4096
+	forwardBatch    = 100
+	forwardInterval = time.Second
+	forwardTimeout  = 10 * time.Second
+)
+
+// OpenForwarder sends events to spec, an http:// or https:// URL receiving them as POSTed JSON lines,
+// or nats://host:port/subject where each is published. Only the named events are sent, or all without names.
+func OpenForwarder(spec string, events []string) (*Forwarder, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	f := &Forwarder{queue: make(chan []byte, forwardQueue), stop: make(chan struct{}), done: make(chan struct{})}
+	if len(events) > 0 {
+		f.events = map[string]bool{}
+		for _, e := range events {
+			f.events[e] = true
+		}
+	}
+	switch u.Scheme {
+	case "http", "https":
+		f.send = postTo(spec)
+	case "nats":
+		subject := strings.TrimPrefix(u.Path, "/")
+		if u.Host == "" || subject == "" {
+			return nil, errors.New("expected nats://host:port/subject")
+		}
+		f.send = (&natsPublisher{addr: u.Host, subject: subject}).publish
+	default:
+		return nil, fmt.Errorf("unsupported event sink %q", spec)
+	}
+	go f.run()
+	return f, nil
+}
+
+// Write queues an event, unless it is filtered out or the queue is full.
+func (f *Forwarder) Write(line []byte) (int, error) {
+	if f.events != nil {
+		var e struct {
+			Event string `json:"event"`
+		}
+		if err := json.Unmarshal(line, &e); err != nil || !f.events[e.Event] {
+			return len(line), nil
+		}
+	}
+	select {
+	case <-f.stop:
+	case f.queue <- bytes.TrimSpace(line):
+	default:
+		log.Println("Event sink is not keeping up, dropping an event")
+	}
+	return len(line), nil
+}
+
+// Close sends the events still queued, then stops.
+func (f *Forwarder) Close() error {
+	f.closing.Do(func() {
+		close(f.stop)
+	})
+	<-f.done
+	return nil
+}
+
+func (f *Forwarder) run() {
+	defer close(f.done)
+	t := time.NewTicker(forwardInterval)
+	defer t.Stop()
+	var batch [][]byte
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), forwardTimeout)
+		defer cancel()
+		if err := f.send(ctx, batch); err != nil {
+			log.Printf("Could not forward %d events (%v)", len(batch), err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case line := <-f.queue:
+			batch = append(batch, line)
+			if len(batch) >= forwardBatch {
+				flush()
+			}
+		case <-f.stop:
+			for len(f.queue) > 0 {
+				batch = append(batch, <-f.queue)
+			}
+			flush()
+			return
+		case <-t.C:
+			flush()
+		}
+	}
+}
+
+func postTo(endpoint string) func(ctx context.Context, batch [][]byte) error {
+	return func(ctx context.Context, batch [][]byte) error {
+		body := append(bytes.Join(batch, []byte("\n")), '\n')
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("webhook answered %s", resp.Status)
+		}
+		return nil
+	}
+}
+
+// natsPublisher publishes with the NATS text protocol, over a connection opened again whenever it fails.
+type natsPublisher struct {
+	addr, subject string
+	// lock guards writes to conn, shared with the answers to the server's pings.
+	lock sync.Mutex
+	conn net.Conn
+}
+
+func (p *natsPublisher) publish(ctx context.Context, batch [][]byte) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.conn == nil {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", p.addr)
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write([]byte("CONNECT {\"verbose\":false,\"name\":\"srvus\"}\r\n")); err != nil {
+			_ = conn.Close()
+			return err
+		}
+		p.conn = conn
+		go p.answerPings(conn)
+	}
+	var out bytes.Buffer
+	for _, line := range batch {
+		_, _ = fmt.Fprintf(&out, "PUB %s %d\r\n%s\r\n", p.subject, len(line), line)
+	}
+	deadline, _ := ctx.Deadline()
+	_ = p.conn.SetWriteDeadline(deadline)
+	if _, err := p.conn.Write(out.Bytes()); err != nil {
+		_ = p.conn.Close()
+		p.conn = nil
+		return err
+	}
+	return nil
+}
+
+// answerPings keeps a connection alive until it fails; servers disconnect clients that do not answer.
+func (p *natsPublisher) answerPings(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		if strings.HasPrefix(line, "PING") {
+			p.lock.Lock()
+			_ = conn.SetWriteDeadline(time.Now().Add(forwardTimeout))
+			_, err = conn.Write([]byte("PONG\r\n"))
+			p.lock.Unlock()
+		} else if strings.HasPrefix(line, "-ERR") {
+			log.Printf("NATS refused events (%s)", strings.TrimSpace(line))
+		}
+		if err != nil {
+			break
+		}
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	_ = conn.Close()
+	if p.conn == conn {
+		p.conn = nil
+	}
+}
@@ -0,0 +1,114 @@
+// Package logs writes the audit and access logs, rotating their files.
+package logs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RotatingFile is an append-only log file that gets rotated by size and/or age.
+// Rotated files are renamed with a timestamp suffix; only the most recent keep are retained.
+type RotatingFile struct {
+	sync.Mutex
+	path     string
+	maxSize  int64
+	interval time.Duration
+	keep     int
+
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// OpenRotatingFile opens path for appending. A zero maxSize or interval disables that trigger, a zero keep retains everything.
+func OpenRotatingFile(path string, maxSize int64, interval time.Duration, keep int) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, maxSize: maxSize, interval: interval, keep: keep}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	r.f = f
+	r.size = info.Size()
+	r.opened = time.Now()
+	return nil
+}
+
+// Write appends p in a single write, rotating beforehand if needed.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.due(int64(len(p))) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) due(incoming int64) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.maxSize > 0 && r.size+incoming > r.maxSize {
+		return true
+	}
+	return r.interval > 0 && time.Since(r.opened) >= r.interval
+}
+
+// A lock is required
+func (r *RotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%s", r.path, time.Now().UTC().Format("20060102T150405.000"))
+	if err := os.Rename(r.path, rotated); err != nil {
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.prune()
+	return nil
+}
+
+func (r *RotatingFile) prune() {
+	if r.keep <= 0 {
+		return
+	}
+	old, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return
+	}
+	sort.Strings(old)
+	for len(old) > r.keep {
+		if err := os.Remove(old[0]); err != nil {
+			return
+		}
+		old = old[1:]
+	}
+}
+
+func (r *RotatingFile) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.f.Close()
+}
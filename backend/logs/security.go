@@ -0,0 +1,39 @@
+package logs
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// Security writes what clients failed at as lines for tools like fail2ban to firewall them, one per event:
+//
+//	2026-10-14T19:17:03Z srvus: auth_failure from 203.0.113.5 (ssh password)
+//
+// Events are auth_failure, handshake_failure, handshake_flood, banned and banned_hit, always from the address alone
+// and with their details last, so a failregex such as `srvus: (auth|handshake)_failure from <HOST> \(` matches them.
+// A nil *Security records nothing.
+type Security struct {
+	w io.Writer
+}
+
+func NewSecurity(w io.Writer) *Security {
+	return &Security{w: w}
+}
+
+// Record writes an event of the client at remote, an address with or without its port.
+func (l *Security) Record(event, remote, detail string) {
+	if l == nil {
+		return
+	}
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	line := fmt.Sprintf("%s srvus: %s from %s (%s)\n", time.Now().UTC().Format(time.RFC3339), event, host, detail)
+	if _, err := io.WriteString(l.w, line); err != nil {
+		log.Printf("Could not write security event %s (%v)", event, err)
+	}
+}
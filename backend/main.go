@@ -1,749 +1,701 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
-	"crypto/sha1"
-	"crypto/sha256"
-	"crypto/tls"
-	"encoding/base32"
-	"encoding/base64"
+	"crypto"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/jackc/pgx/v4/pgxpool"
-	"golang.org/x/crypto/ssh"
+	"github.com/pcarrier/srv.us/backend/certs"
+	"github.com/pcarrier/srv.us/backend/geoip"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/nameserver"
+	"github.com/pcarrier/srv.us/backend/scan"
+	"github.com/pcarrier/srv.us/backend/server"
+	"github.com/pcarrier/srv.us/backend/store"
+	"github.com/pcarrier/srv.us/backend/systemd"
+	"github.com/pcarrier/srv.us/backend/tracing"
+	"github.com/pcarrier/srv.us/backend/upgrade"
+	"golang.org/x/sys/unix"
 	"io"
 	"log"
-	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"os/exec"
+	"os/signal"
 	"strconv"
 	"strings"
-	"sync"
-	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 )
 
 var (
-	b32encoder = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base64.NoPadding)
+	config = server.DefaultConfig()
 
-	domain           = flag.String("domain", "srv.us", "Domain name under which we run")
 	sshPort          = flag.Int("ssh-port", 22, "Port for SSH to bind to")
 	httpsPort        = flag.Int("https-port", 443, "Port for SSH to bind to")
 	httpsChainPath   = flag.String("https-chain-path", "/etc/letsencrypt/live/srv.us/fullchain.pem", "Path to the certificate chain")
 	httpsKeyPath     = flag.String("https-key-path", "/etc/letsencrypt/live/srv.us/privkey.pem", "Path to the private key")
-	sshHostKeysPath  = flag.String("ssh-host-keys-path", "/etc/ssh", "Path where ssh_host_ecdsa_key, ssh_host_ed25519_key, ssh_host_rsa_key can be found")
-	githubSubdomains = flag.Bool("github-subdomains", true, "Whether to expose $username.gh subdomains")
-	gitlabSubdomains = flag.Bool("gitlab-subdomains", true, "Whether to expose $username.gl subdomains")
+	sshHostKeysPath  = flag.String("ssh-host-keys-path", "/etc/ssh", "Comma-separated host key files, and directories holding ssh_host_*_key files, later keys of a type replacing earlier ones (reloaded with POST /host-keys on the admin API)")
 	pgConn           = flag.String("pg-conn", "", "Postgres connection string")
-)
+	healthCheck      = flag.String("health-check", "", "Query /healthz of the admin API at this address, e.g. localhost:8022, then exit with 0 if healthy (for container health checks)")
+	broadcastMessage = flag.String("broadcast", "", "Send this message to every connected client through the admin API at -admin-addr, authenticated with -admin-token, then exit")
+	printSSHFP       = flag.Bool("print-sshfp", false, "Print the SSHFP records of the host keys as zone file lines, for clients to verify them with VerifyHostKeyDNS, then exit (served at the apex by -dns-addr)")
 
-type remoteForwardRequest struct {
-	BindAddr string
-	BindPort uint32
-}
+	httpsKeyPassphrase   = flag.String("https-key-passphrase", "", "Where the passphrase of an encrypted -https-key-path comes from: env:<variable>, file:<path>, or exec:<command> [args] printing it, e.g. a KMS client (keys written by -acme-dns are then encrypted with it too)")
+	sshHostKeyPassphrase = flag.String("ssh-host-key-passphrase", "", "Where the passphrase of encrypted host keys comes from, as for -https-key-passphrase")
+	httpsKeySigner       = flag.String("https-key-signer", "", "Signer holding the certificate key instead of -https-key-path: awskms:<key ID or ARN>, gcpkms:<key version name>, or exec:<command> [args] for PKCS#11 and other HSMs (see the README)")
 
-type remoteForwardCancelRequest struct {
-	BindAddr string
-	BindPort uint32
-}
+	auditLogPath           = flag.String("audit-log-path", "", "Path of the append-only audit log (disabled if empty)")
+	auditLogMaxSize        = flag.Int64("audit-log-max-size", 100<<20, "Size in bytes after which the audit log is rotated (0 to disable)")
+	auditLogRotateInterval = flag.Duration("audit-log-rotate-interval", 24*time.Hour, "Age after which the audit log is rotated (0 to disable)")
+	auditLogKeep           = flag.Int("audit-log-keep", 30, "Number of rotated audit logs to keep (0 to keep all)")
 
-type remoteForwardChannelData struct {
-	DestAddr   string
-	DestPort   uint32
-	OriginAddr string
-	OriginPort uint32
-}
+	eventsSink = flag.String("events-sink", "", "Where to send audit events as they happen: an http(s):// webhook receiving JSON lines, or nats://host:port/subject (disabled if empty)")
+	events     = flag.String("events", "", "Comma-separated audit events sent to -events-sink, e.g. tunnel_open,tunnel_close,abuse_reported (all if empty)")
 
-type target struct {
-	KeyID  string
-	Remote *ssh.ServerConn
-	Host   string
-	Port   uint32
-}
+	securityLogPath = flag.String("security-log-path", "", "Path of the log of what clients fail at, for fail2ban and the like, rotated daily and kept a week (disabled if empty)")
 
-type void struct{}
+	accessLogPath           = flag.String("access-log-path", "", "Path of the access log for proxied HTTP requests (disabled if empty)")
+	accessLogFormat         = flag.String("access-log-format", "combined", "Access log format (combined or json)")
+	accessLogMaxSize        = flag.Int64("access-log-max-size", 100<<20, "Size in bytes after which the access log is rotated (0 to disable)")
+	accessLogRotateInterval = flag.Duration("access-log-rotate-interval", 24*time.Hour, "Age after which the access log is rotated (0 to disable)")
+	accessLogKeep           = flag.Int("access-log-keep", 7, "Number of rotated access logs to keep (0 to keep all)")
 
-var v void
+	geoIPCountryDB = flag.String("geoip-country-db", "", "Path to a MaxMind Country or City database (optional)")
+	geoIPASNDB     = flag.String("geoip-asn-db", "", "Path to a MaxMind ASN database (optional)")
 
-type tunnelRef struct {
-	Endpoint string
-	Target   *target
-}
+	dnsAddr        = flag.String("dns-addr", "", "Address for the authoritative name server of the domain to bind to over UDP and TCP, e.g. :53 (disabled if empty)")
+	dnsAddresses   = flag.String("dns-addresses", "", "Comma-separated addresses the domain and its endpoints resolve to, required by -dns-addr")
+	statusNodes    = flag.String("status-nodes", "", "Comma-separated HTTPS listeners of the other nodes, as host or host:port, checked by -status-page")
+	dnsNameServers = flag.String("dns-nameservers", "", "Comma-separated names of the domain's name servers, resolving to -dns-addresses (default: ns1. under the domain)")
 
-type sshConnection struct {
-	KeyID      string
-	Sessions   map[ssh.Channel]void
-	TunnelRefs map[*tunnelRef]void
-	lastPort   uint16
-}
+	acmeDNS            = flag.String("acme-dns", "", "DNS provider answering ACME DNS-01 challenges, to obtain and renew the certificate at -https-chain-path and -https-key-path: cloudflare:<zone ID>, route53:<hosted zone ID>, rfc2136:<server>:<port>/<zone>, or self for the name server of -dns-addr (certificates are expected on disk if empty)")
+	acmeDirectory      = flag.String("acme-directory", certs.LetsEncrypt, "URL of the ACME directory")
+	acmeEmail          = flag.String("acme-email", "", "Contact of the ACME account, for expiry notices (optional)")
+	acmeAccountKeyPath = flag.String("acme-account-key-path", "/etc/srvus/acme-account.pem", "Path of the ACME account key, created if missing")
+	acmeDomains        = flag.String("acme-domains", "", "Comma-separated names of the certificate, e.g. for custom domains (default: the domain and the wildcards of its tunnels)")
 
-type server struct {
-	sync.Mutex
-	conns     map[*ssh.ServerConn]*sshConnection
-	endpoints map[string]map[*target]void
-	pool      *pgxpool.Pool
-}
+	otlpEndpoint    = flag.String("otlp-endpoint", "", "OTLP/HTTP endpoint receiving traces of visitor connections and requests, e.g. http://localhost:4318/v1/traces (disabled if empty)")
+	traceSampleRate = flag.Float64("trace-sample-rate", 0.01, "Share of visitor connections traced, unless their requests carry a traceparent header")
 
-func newServer(pool *pgxpool.Pool) *server {
-	return &server{
-		conns:     map[*ssh.ServerConn]*sshConnection{},
-		endpoints: map[string]map[*target]void{},
-		pool:      pool,
-	}
-}
+	scanner = flag.String("scanner", "", "Content scanner for endpoints flagged through the admin API: clamd:unix:<path>, clamd:tcp:<host>:<port> or an HTTP(S) URL (disabled if empty)")
 
-func (s *server) startSession(keyID string, conn *ssh.ServerConn, ch ssh.Channel) {
-	s.Lock()
-	defer s.Unlock()
+	connectionsSocket = flag.String("connections-socket", "", "Path of a unix socket streaming the visitor and SSH connections open as JSON lines, for traffic shapers (disabled if empty)")
+	adminAddr         = flag.String("admin-addr", "", "Address for the admin API to bind to, e.g. localhost:8022 (disabled if empty)")
 
-	if _, found := s.conns[conn]; !found {
-		s.conns[conn] = newConnection(keyID, ch)
-	} else {
-		s.conns[conn].Sessions[ch] = v
-	}
-}
+	expiryWarnings = flag.String("expiry-warnings", "1h,10m,1m", "How long before expiry sessions get warned, comma-separated")
 
-func (s *server) newPort(conn *ssh.ServerConn) uint16 {
-	s.Lock()
-	defer s.Unlock()
+	bannerPath = flag.String("banner-path", "", "Path of the template shown by SSH clients before they authenticate (disabled if empty)")
+	motdPath   = flag.String("motd-path", "", "Path of the template of the message of the day sent to connected clients (disabled if empty)")
 
-	s.conns[conn].lastPort++
-	return s.conns[conn].lastPort
-}
+	brandingPath    = flag.String("branding-path", "", "Path of the YAML bundle of what users read (service name, docs URL, usage, banner, message of the day, error pages), to white-label the service (srv.us's if empty)")
+	landingPath     = flag.String("landing-path", "", "Directory of the landing page served at the domain: *.html templates, index.html first, and static assets (the built-in page if empty)")
+	landingRedirect = flag.Bool("landing-redirect", false, "Redirect the domain to the docs URL of the branding instead of serving a landing page")
 
-// A lock is required
-func (s *server) insertEndpointTarget(endpoint string, t *target) {
-	log.Printf("%s(%s) on %s", t.Remote.RemoteAddr(), t.KeyID, endpoint)
+	plansPath       = flag.String("plans-path", "", "Path of the YAML plans operators assign keys to (disabled if empty)")
+	labelPolicyPath = flag.String("label-policy-path", "", "Path of the YAML policy reserving ports and account names for some keys (disabled if empty)")
 
-	if s.endpoints[endpoint] != nil {
-		s.endpoints[endpoint][t] = v
-	} else {
-		s.endpoints[endpoint] = map[*target]void{t: v}
-	}
-	sConn := s.conns[t.Remote]
-	sConn.TunnelRefs[&tunnelRef{
-		Endpoint: endpoint,
-		Target:   t,
-	}] = v
-}
+	upgradeDrainTimeout = flag.Duration("upgrade-drain-timeout", 30*time.Second, "How long to wait for visitors in flight before handing tunnels over to an upgraded binary (started on SIGHUP)")
+)
 
-// A lock is required
-func (s *server) removeEndpointTarget(endpoint string, t *target) {
-	log.Printf("%s(%s) off %s", t.Remote.RemoteAddr(), t.KeyID, endpoint)
+func init() {
+	flag.StringVar(&config.Domain, "domain", config.Domain, "Domain name under which we run")
+	flag.BoolVar(&config.GitHubSubdomains, "github-subdomains", config.GitHubSubdomains, "Whether to expose $username.gh subdomains")
+	flag.BoolVar(&config.GitLabSubdomains, "gitlab-subdomains", config.GitLabSubdomains, "Whether to expose $username.gl subdomains")
+
+	flag.StringVar(&config.AdminToken, "admin-token", os.Getenv("SRVUS_ADMIN_TOKEN"), "Bearer token required by the admin API (defaults to $SRVUS_ADMIN_TOKEN)")
+
+	flag.DurationVar(&config.MaxConnectionDuration, "max-connection-duration", config.MaxConnectionDuration, "Lifetime after which SSH connections are closed (0 for unlimited)")
+	flag.DurationVar(&config.MaxTunnelDuration, "max-tunnel-duration", config.MaxTunnelDuration, "Lifetime after which tunnels are removed (0 for unlimited)")
+	flag.DurationVar(&config.ReconcileInterval, "reconcile-interval", config.ReconcileInterval, "Interval between consistency checks of the connection and endpoint tables (0 to disable them)")
+	flag.BoolVar(&config.ReconcileRepair, "reconcile-repair", config.ReconcileRepair, "Whether to remove inconsistent entries found by consistency checks")
+	flag.DurationVar(&config.StatsInterval, "stats-interval", config.StatsInterval, "Interval between traffic summaries in the logs (0 to disable them, see the metrics of the admin API)")
+	flag.IntVar(&config.StatsTopEndpoints, "stats-top-endpoints", config.StatsTopEndpoints, "Busiest endpoints listed in traffic summaries")
+	flag.StringVar(&config.TransferLog, "transfer-log", config.TransferLog, "How the bytes moved by visitor connections are logged: each, summary (per endpoint) or off")
+	flag.Float64Var(&config.TransferLogSampleRate, "transfer-log-sample-rate", config.TransferLogSampleRate, "Share of visitor connections logged in each mode")
+	flag.DurationVar(&config.TransferLogInterval, "transfer-log-interval", config.TransferLogInterval, "Interval over which transfers are summed up in summary mode")
+	flag.StringVar(&config.UsageExport, "usage-export", "", "Directory or http(s) URL the usage of each key is exported to, for billing (disabled if empty)")
+	flag.StringVar(&config.UsageExportFormat, "usage-export-format", config.UsageExportFormat, "Format of usage files: csv or json")
+	flag.DurationVar(&config.UsageExportInterval, "usage-export-interval", config.UsageExportInterval, "Interval between usage exports")
+	flag.DurationVar(&config.ResponseHeaderTimeout, "response-header-timeout", config.ResponseHeaderTimeout, "Default wait for the response headers of requests proxied one by one (0 to wait as long as it takes)")
+	flag.DurationVar(&config.RequestTimeout, "request-timeout", config.RequestTimeout, "Default deadline of requests proxied one by one, responses included (0 for none)")
+	flag.IntVar(&config.AbuseReportThreshold, "abuse-report-threshold", config.AbuseReportThreshold, "Distinct addresses reporting a tunnel within a day before it is suspended (0 to never suspend)")
+	flag.BoolVar(&config.Interstitial, "interstitial", false, "Warn browsers visiting a tunnel for the first time that anybody could be running it")
+	flag.BoolVar(&config.PublicStats, "public-stats", false, "Serve totals of the service (clients, tunnels, endpoints, bytes proxied today) as JSON at /stats on the domain, for anybody to see")
+	flag.BoolVar(&config.StatusPage, "status-page", false, "Serve the health of the listeners, the certificate and -status-nodes, with the incident set through the admin API, at /status on the domain")
+	flag.BoolVar(&config.ConfirmWithAgent, "confirm-with-agent", false, "Make sensitive console commands need a signature from the agent forwarded to their session (ssh -A)")
+	flag.DurationVar(&config.KeepaliveInterval, "keepalive-interval", config.KeepaliveInterval, "Interval between keepalives sent to clients")
+	flag.IntVar(&config.KeepaliveMissed, "keepalive-missed", config.KeepaliveMissed, "Keepalives a client may leave unanswered before being disconnected")
+	flag.IntVar(&config.MaxChannelOpens, "max-channel-opens", config.MaxChannelOpens, "Channels a client may be asked to open at once")
+	flag.IntVar(&config.ChannelOpenQueue, "channel-open-queue", config.ChannelOpenQueue, "Visitors waiting for a channel to open to a busy client before they get a 503")
+	flag.DurationVar(&config.ChannelOpenTimeout, "channel-open-timeout", config.ChannelOpenTimeout, "How long visitors wait for a channel to open to a busy client")
+	flag.IntVar(&config.MaxSSHHandshakes, "max-ssh-handshakes", config.MaxSSHHandshakes, "SSH handshakes an address (or IPv6 /64) may have in flight at once (0 for unlimited)")
+	flag.IntVar(&config.MaxSSHFailures, "max-ssh-failures", config.MaxSSHFailures, "Failed SSH handshakes or authentication attempts an address may make within 10 minutes before being banned (0 for unlimited)")
+	flag.DurationVar(&config.SSHBanTime, "ssh-ban-time", config.SSHBanTime, "How long the first ban of an address lasts, doubling with every ban")
+	flag.DurationVar(&config.SSHMaxBanTime, "ssh-max-ban-time", config.SSHMaxBanTime, "How long bans of an address last at most")
+	flag.Int64Var(&config.MaxConnectionMemory, "max-connection-memory", config.MaxConnectionMemory, "Bytes the visitors of a connection may make us hold (buffers, bodies being scanned or mirrored) before it gets no more (0 for unlimited)")
+	flag.Int64Var(&config.MaxMemory, "max-memory", config.MaxMemory, "Bytes the visitors of all connections may make us hold before the heaviest connection is disconnected (0 to never disconnect)")
+	flag.IntVar(&config.SpareChannels, "spare-channels", config.SpareChannels, "Channels busy forwards keep opened ahead of time for pooled and synthetic-origin visitors, closed after 30s unused (0 for none)")
+	flag.BoolVar(&config.SyntheticOrigins, "synthetic-origins", config.SyntheticOrigins, "Whether to report our domain and a counter as the origin of forwarded channels, instead of the visitor's address and port")
+	flag.DurationVar(&config.IdleTunnelTimeout, "idle-tunnel-timeout", config.IdleTunnelTimeout, "Duration without traffic after which tunnels are removed (0 to keep them)")
+
+	flag.DurationVar(&config.Chaos.Latency, "chaos-latency", 0, "Development only: delay every proxied read by a random duration up to this one")
+	flag.Float64Var(&config.Chaos.OpenFailureRate, "chaos-open-failure-rate", 0, "Development only: share of visitor connections failing as if the tunnel could not be reached")
+	flag.Float64Var(&config.Chaos.ResetRate, "chaos-reset-rate", 0, "Development only: probability for every proxied read to reset the connection")
+}
 
-	if s.endpoints[endpoint] == nil {
-		return
+// certificateNames lists the names of the certificate: those given, or our domain and the wildcards of its tunnels.
+func certificateNames(given string) []string {
+	var names []string
+	for _, name := range strings.Split(given, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
 	}
-
-	delete(s.endpoints[endpoint], t)
-	if len(s.endpoints[endpoint]) == 0 {
-		delete(s.endpoints, endpoint)
+	if len(names) > 0 {
+		return names
 	}
-
-	sConn := s.conns[t.Remote]
-	delete(sConn.TunnelRefs, &tunnelRef{
-		Endpoint: endpoint,
-		Target:   t,
-	})
+	names = []string{config.Domain, "*." + config.Domain}
+	if config.GitHubSubdomains {
+		names = append(names, "*.gh."+config.Domain)
+	}
+	if config.GitLabSubdomains {
+		names = append(names, "*.gl."+config.Domain)
+	}
+	return names
 }
 
-func (s *server) pickTarget(endpoint string) *target {
-	s.Lock()
-	ep, found := s.endpoints[endpoint]
-	s.Unlock()
+// readGreeting parses the template at path, if any.
+func readGreeting(path string) (*template.Template, error) {
+	if path == "" {
+		return nil, nil
+	}
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return server.ParseGreeting(string(text))
+}
 
-	if !found {
-		return nil
-	} else {
-		var candidates []*target
-		for c := range ep {
-			candidates = append(candidates, c)
+// readPassphrase gets a passphrase from its source, an environment variable, a file or what a command prints, if any.
+func readPassphrase(source string) ([]byte, error) {
+	if source == "" {
+		return nil, nil
+	}
+	kind, arg, _ := strings.Cut(source, ":")
+	var passphrase []byte
+	switch kind {
+	case "env":
+		value, found := os.LookupEnv(arg)
+		if !found {
+			return nil, fmt.Errorf("%s is not set", arg)
+		}
+		passphrase = []byte(value)
+	case "file":
+		raw, err := os.ReadFile(arg)
+		if err != nil {
+			return nil, err
+		}
+		passphrase = raw
+	case "exec":
+		args := strings.Fields(arg)
+		if len(args) == 0 {
+			return nil, errors.New("no command")
 		}
-		return candidates[rand.Intn(len(candidates))]
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, err
+		}
+		passphrase = out
+	default:
+		return nil, fmt.Errorf("unknown source %q, expected env:, file: or exec:", kind)
+	}
+	passphrase = bytes.TrimRight(passphrase, "\r\n")
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
 	}
+	return passphrase, nil
 }
 
-func newConnection(keyID string, ch ssh.Channel) *sshConnection {
-	return &sshConnection{
-		KeyID:      keyID,
-		Sessions:   map[ssh.Channel]void{ch: v},
-		TunnelRefs: map[*tunnelRef]void{},
-		lastPort:   0,
+func readBranding(path string) (*server.Branding, error) {
+	if path == "" {
+		return nil, nil
 	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return server.ParseBranding(raw)
 }
 
-func (s *server) endSession(conn *ssh.ServerConn, ch ssh.Channel) {
-	reportStatus(ch, 0)
-	if err := ch.Close(); err != nil && !errors.Is(err, io.EOF) {
-		log.Printf("Could not end SSH session (%v)", err)
+func readLabelPolicy(path string) (*server.LabelPolicy, error) {
+	if path == "" {
+		return nil, nil
 	}
-
-	s.Lock()
-	defer s.Unlock()
-
-	c := s.conns[conn]
-	if c == nil {
-		return
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
-	delete(c.Sessions, ch)
+	return server.ParseLabelPolicy(raw)
+}
 
-	if len(c.Sessions) == 0 {
-		go func() {
-			_ = conn.Close()
-		}()
+func readPlans(path string) (*server.Plans, error) {
+	if path == "" {
+		return nil, nil
 	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return server.ParsePlans(raw)
 }
 
-func (s *server) closeConnection(conn *ssh.ServerConn) {
-	s.Lock()
-	defer s.Unlock()
+func main() {
+	flag.Parse()
 
-	sConn, found := s.conns[conn]
-	if !found {
-		return
+	if *healthCheck != "" {
+		os.Exit(checkHealth(*healthCheck))
 	}
-	for er := range sConn.TunnelRefs {
-		s.removeEndpointTarget(er.Endpoint, er.Target)
+	if *broadcastMessage != "" {
+		os.Exit(broadcast(*adminAddr, config.AdminToken, *broadcastMessage))
 	}
-	delete(s.conns, conn)
-	go func() {
-		_ = conn.Close()
-		log.Printf("%s(%s) disconnected", conn.RemoteAddr(), sConn.KeyID)
-	}()
-}
 
-func (s *server) serveHTTPS() {
-	listener, err := net.Listen("tcp", ":"+strconv.Itoa(*httpsPort))
-	if err != nil {
-		log.Fatalln(err)
-	}
+	// Stopping cancels everything in flight, flushing the logs on the way out.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	defer func() {
-		err := listener.Close()
-		if err != nil {
-			log.Printf("Could not close HTTPS listener (%v)", err)
+	var err error
+	for _, path := range strings.Split(*sshHostKeysPath, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			config.HostKeyPaths = append(config.HostKeyPaths, path)
 		}
-	}()
-
-	for {
-		conn, err := listener.Accept()
+	}
+	if config.HostKeyPassphrase, err = readPassphrase(*sshHostKeyPassphrase); err != nil {
+		log.Fatalf("Invalid -ssh-host-key-passphrase (%v)", err)
+	}
+	if *printSSHFP {
+		keys, err := server.LoadHostKeys(config.HostKeyPaths, config.HostKeyPassphrase)
 		if err != nil {
-			log.Printf("Failed to accept HTTPS connection (%s)", err)
-			continue
+			log.Fatalf("Failed to load host keys (%v)", err)
 		}
-
-		go s.serveHTTPSConnection(conn)
+		for _, record := range server.SSHFPRecords(keys) {
+			fmt.Printf("%s. IN SSHFP %s\n", config.Domain, record.Value)
+		}
+		return
 	}
-}
-
-func (s *server) serveHTTPSConnection(raw net.Conn) {
-	name := ""
-
-	cert, err := tls.LoadX509KeyPair(*httpsChainPath, *httpsKeyPath)
+	httpsPassphrase, err := readPassphrase(*httpsKeyPassphrase)
 	if err != nil {
-		log.Println(err)
+		log.Fatalf("Invalid -https-key-passphrase (%v)", err)
 	}
-
-	c := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		GetConfigForClient: func(i *tls.ClientHelloInfo) (*tls.Config, error) {
-			name = i.ServerName
-			return nil, nil
-		},
-		NextProtos: []string{
-			"http/1.1",
-		},
+	var httpsSigner crypto.Signer
+	if *httpsKeySigner != "" {
+		if httpsSigner, err = certs.OpenSigner(*httpsKeySigner); err != nil {
+			log.Fatalf("Invalid -https-key-signer (%v)", err)
+		}
 	}
-
-	https := tls.Server(raw, c)
-
-	defer func() {
-		_ = https.Close()
-	}()
-
-	if err := https.Handshake(); err != nil {
-		return
+	if config.ExpiryWarnings, err = server.ParseWarnings(*expiryWarnings); err != nil {
+		log.Fatalf("Invalid -expiry-warnings (%v)", err)
 	}
 
-	if name == *domain {
-		err = s.serveRoot(https)
-		if err != nil {
-			log.Printf("root failed (%d)", err)
+	if config.Banner, err = readGreeting(*bannerPath); err != nil {
+		log.Fatalf("Invalid -banner-path (%v)", err)
+	}
+	if config.MOTD, err = readGreeting(*motdPath); err != nil {
+		log.Fatalf("Invalid -motd-path (%v)", err)
+	}
+	if config.Branding, err = readBranding(*brandingPath); err != nil {
+		log.Fatalf("Invalid -branding-path (%v)", err)
+	}
+	if !*landingRedirect {
+		if config.Landing, err = server.OpenLanding(*landingPath); err != nil {
+			log.Fatalf("Invalid -landing-path (%v)", err)
 		}
-		return
 	}
-
-	tgt := s.pickTarget(name)
-	if tgt == nil {
-		_ = httpErrorOut(https, "503 Service Unavailable", "No tunnel available.")
-		return
+	if config.Branding != nil {
+		if config.Banner == nil {
+			config.Banner = config.Branding.Banner
+		}
+		if config.MOTD == nil {
+			config.MOTD = config.Branding.MOTD
+		}
 	}
-
-	sshChannel, reqs, err := tgt.Remote.OpenChannel("forwarded-tcpip", ssh.Marshal(&remoteForwardChannelData{
-		DestAddr:   tgt.Host,
-		DestPort:   tgt.Port,
-		OriginAddr: *domain,
-		OriginPort: uint32(s.newPort(tgt.Remote)),
-	}))
-
-	if err != nil {
-		_ = httpErrorOut(https, "502 Bad Gateway", err.Error())
-		return
+	if config.LabelPolicy, err = readLabelPolicy(*labelPolicyPath); err != nil {
+		log.Fatalf("Invalid -label-policy-path (%v)", err)
+	}
+	if config.Plans, err = readPlans(*plansPath); err != nil {
+		log.Fatalf("Invalid -plans-path (%v)", err)
 	}
 
-	defer func() {
-		if err := sshChannel.Close(); err != nil && !errors.Is(err, io.EOF) {
-			log.Printf("%v:%s→%v channel close failed (%d)", tgt.Remote.RemoteAddr(), name, raw.RemoteAddr(), err)
+	if *scanner != "" {
+		if config.Scanner, err = scan.Open(*scanner); err != nil {
+			log.Fatalf("Invalid -scanner (%v)", err)
 		}
-	}()
+	}
 
-	wg := sync.WaitGroup{}
-	wg.Add(2)
+	for _, node := range strings.Split(*statusNodes, ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			config.StatusNodes = append(config.StatusNodes, node)
+		}
+	}
 
-	go func() {
-		for req := range reqs {
-			if req.WantReply {
-				_ = req.Reply(false, nil)
+	if *dnsAddr != "" {
+		var addresses []net.IP
+		for _, field := range strings.Split(*dnsAddresses, ",") {
+			if field = strings.TrimSpace(field); field == "" {
+				continue
+			}
+			ip := net.ParseIP(field)
+			if ip == nil {
+				log.Fatalf("Invalid address %q in -dns-addresses", field)
 			}
+			addresses = append(addresses, ip)
 		}
-	}()
-
-	go func() {
-		b, err := io.Copy(https, sshChannel)
-		log.Printf("%v:%s→%v xfer %d", tgt.Remote.RemoteAddr(), name, raw.RemoteAddr(), b)
-		if err != nil && !errors.Is(err, io.EOF) {
-			log.Printf("%v:%s→%v copy failed (%v)", tgt.Remote.RemoteAddr(), name, raw.RemoteAddr(), err)
+		if len(addresses) == 0 {
+			log.Fatalln("-dns-addr requires -dns-addresses")
 		}
-		if err := https.CloseWrite(); err != nil && !errors.Is(err, io.EOF) {
-			log.Printf("%v:%s→%v close failed (%v)", tgt.Remote.RemoteAddr(), name, raw.RemoteAddr(), err)
+		nameServers := []string{"ns1." + config.Domain}
+		if *dnsNameServers != "" {
+			nameServers = strings.Split(*dnsNameServers, ",")
 		}
-		wg.Done()
-	}()
+		config.DNS = nameserver.New(config.Domain, addresses, nameServers)
+	}
 
-	go func() {
-		b, err := io.Copy(sshChannel, https)
-		log.Printf("%v:%s←%v xfer %d", tgt.Remote.RemoteAddr(), name, raw.RemoteAddr(), b)
-		if err != nil && !errors.Is(err, io.EOF) {
-			log.Printf("%v:%s←%v copy failed (%v)", tgt.Remote.RemoteAddr(), name, raw.RemoteAddr(), err)
+	var certificates *certs.Manager
+	if *acmeDNS != "" {
+		var provider certs.Provider = config.DNS
+		if *acmeDNS != "self" {
+			if provider, err = certs.OpenProvider(*acmeDNS); err != nil {
+				log.Fatalf("Invalid -acme-dns (%v)", err)
+			}
+		} else if config.DNS == nil {
+			log.Fatalln("-acme-dns self requires -dns-addr")
 		}
-		if err := sshChannel.CloseWrite(); err != nil && !errors.Is(err, io.EOF) {
-			log.Printf("%v:%s←%v close failed (%v)", tgt.Remote.RemoteAddr(), name, raw.RemoteAddr(), err)
+		certificates = &certs.Manager{
+			Provider:       provider,
+			Directory:      *acmeDirectory,
+			Email:          *acmeEmail,
+			Domains:        certificateNames(*acmeDomains),
+			AccountKeyPath: *acmeAccountKeyPath,
+			ChainPath:      *httpsChainPath,
+			KeyPath:        *httpsKeyPath,
+			Passphrase:     httpsPassphrase,
+			Signer:         httpsSigner,
 		}
-		wg.Done()
-	}()
+	}
 
-	wg.Wait()
-}
+	if *otlpEndpoint != "" {
+		if *traceSampleRate < 0 || *traceSampleRate > 1 {
+			log.Fatalln("-trace-sample-rate must be between 0 and 1")
+		}
+		config.Tracer = tracing.New(*otlpEndpoint, config.Domain, *traceSampleRate)
+		defer func() {
+			_ = config.Tracer.Close()
+		}()
+	}
 
-func (s *server) serveRoot(https *tls.Conn) error {
-	r := bufio.NewReader(https)
-	req, err := http.ReadRequest(r)
+	config.Chaos.Log()
+
+	pool, err := pgxpool.Connect(ctx, *pgConn)
 	if err != nil {
-		return err
+		log.Fatal(err)
 	}
-	if req.URL.Path == "/echo" {
+	defer pool.Close()
+	config.Pastes = pool
+
+	if config.Store, err = store.NewPostgres(ctx, pool); err != nil {
+		log.Fatalf("Failed to prepare the settings store (%v)", err)
+	}
+	pair := &certs.KeyPair{ChainPath: *httpsChainPath, KeyPath: *httpsKeyPath, Passphrase: httpsPassphrase, Signer: httpsSigner}
+	config.Certificate = pair.Load
+	if certificates != nil {
+		// Obtains the certificate right away if there is none yet.
+		go certificates.Run(ctx)
+	}
+	if config.GeoIP, err = geoip.Open(*geoIPCountryDB, *geoIPASNDB); err != nil {
+		log.Fatalf("Failed to open GeoIP databases (%v)", err)
+	}
+	defer config.GeoIP.Close()
+	// The event sink comes first, as it never fails.
+	var audited []io.Writer
+	if *eventsSink != "" {
+		var names []string
+		for _, name := range strings.Split(*events, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		f, err := logs.OpenForwarder(*eventsSink, names)
+		if err != nil {
+			log.Fatalf("Invalid -events-sink (%v)", err)
+		}
 		defer func() {
-			_ = req.Body.Close()
+			_ = f.Close()
 		}()
-		ct := req.Header.Get("Content-Type")
-		if ct == "" {
-			ct = "text/plain"
+		audited = append(audited, f)
+	}
+	if *auditLogPath != "" {
+		f, err := logs.OpenRotatingFile(*auditLogPath, *auditLogMaxSize, *auditLogRotateInterval, *auditLogKeep)
+		if err != nil {
+			log.Fatalf("Failed to open audit log %s (%v)", *auditLogPath, err)
 		}
-		_, _ = https.Write([]byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: %s\r\n\r\n", ct)))
-		_, _ = io.Copy(https, req.Body)
-	} else if req.Method == "POST" {
 		defer func() {
-			_ = req.Body.Close()
+			_ = f.Close()
 		}()
-		content, err := io.ReadAll(req.Body)
+		audited = append(audited, f)
+	}
+	if len(audited) > 0 {
+		config.Audit = logs.NewAudit(io.MultiWriter(audited...))
+	}
+	if !server.TransferLogModes[config.TransferLog] {
+		log.Fatalf("Unknown transfer log mode %s", config.TransferLog)
+	}
+	if !server.UsageExportFormats[config.UsageExportFormat] {
+		log.Fatalf("Unknown usage export format %s", config.UsageExportFormat)
+	}
+	if *securityLogPath != "" {
+		f, err := logs.OpenRotatingFile(*securityLogPath, 0, 24*time.Hour, 7)
 		if err != nil {
-			return err
+			log.Fatalf("Failed to open security log %s (%v)", *securityLogPath, err)
 		}
-		hash := sha1.Sum(content)
-		code := b32encoder.EncodeToString(hash[:])
-		rows, _ := s.pool.Query(context.Background(), "INSERT INTO pastes(code, content) VALUES ($1, $2) ON CONFLICT DO NOTHING", code, content)
-		if rows != nil {
-			rows.Close()
-		}
-		_, _ = https.Write([]byte(fmt.Sprintf("HTTP/1.1 200 OK\r\n\r\nhttps://%s/%s\r\n", *domain, code)))
-	} else if req.URL.Path == "/" {
-		_, _ = https.Write([]byte("HTTP/1.1 307 Temporary Redirect\r\nLocation: https://docs.srv.us\r\n\r\n"))
-	} else {
-		code := req.URL.Path[1:]
-		res, _ := s.pool.Query(context.Background(), "SELECT content FROM pastes WHERE code = $1", code)
-		if res != nil {
-			defer res.Close()
-			if res.Next() {
-				cols, err := res.Values()
-				if err != nil {
-					_, _ = https.Write([]byte("HTTP/1.1 404 Not Found\r\n\r\n"))
-					return err
-				}
-				content := cols[0].([]byte)
-				_, _ = https.Write([]byte(fmt.Sprintf("HTTP/1.1 200 OK\r\n\r\n%s", content)))
-			} else {
-				_, _ = https.Write([]byte("HTTP/1.1 404 Not Found\r\n\r\n"))
-			}
+		defer func() {
+			_ = f.Close()
+		}()
+		config.Security = logs.NewSecurity(f)
+	}
+	if *accessLogPath != "" {
+		if !logs.AccessFormats[*accessLogFormat] {
+			log.Fatalf("Unknown access log format %s", *accessLogFormat)
 		}
+		f, err := logs.OpenRotatingFile(*accessLogPath, *accessLogMaxSize, *accessLogRotateInterval, *accessLogKeep)
+		if err != nil {
+			log.Fatalf("Failed to open access log %s (%v)", *accessLogPath, err)
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		config.Access = logs.NewAccess(f, *accessLogFormat, config.GeoIP)
 	}
-	return nil
-}
 
-func httpErrorOut(conn net.Conn, status string, message string) error {
-	r := bufio.NewReader(conn)
-	if _, err := http.ReadRequest(r); err != nil {
-		return err
+	s := server.New(config)
+	if err := s.Start(ctx); err != nil {
+		log.Fatalf("Failed to start (%v)", err)
 	}
-	_, err := conn.Write([]byte(fmt.Sprintf("HTTP/1.1 %s\r\nContent-Length: %d\r\n\r\n%s", status, len(message), message)))
-	return err
-}
-
-func (s *server) serveSSH() {
-	sshConfig := ssh.ServerConfig{ServerVersion: "SSH-2.0-" + *domain + "-1.0"}
-	addKey(&sshConfig, *sshHostKeysPath+"/ssh_host_ecdsa_key")
-	addKey(&sshConfig, *sshHostKeysPath+"/ssh_host_ed25519_key")
-	addKey(&sshConfig, *sshHostKeysPath+"/ssh_host_rsa_key")
 
-	listener, err := net.Listen("tcp", "0.0.0.0:"+strconv.Itoa(*sshPort))
+	hostKeys, err := server.LoadHostKeys(config.HostKeyPaths, config.HostKeyPassphrase)
 	if err != nil {
-		log.Fatalf("Failed to listen on port %d (%s)", *sshPort, err)
+		log.Fatalf("Failed to load host keys (%v)", err)
 	}
+	s.SetHostKeys(hostKeys)
 
-	for {
-		tcpConn, err := listener.Accept()
-		if err != nil {
-			log.Printf("Failed to accept (%s)", err)
-		} else {
-			go s.serveSSHConnection(&sshConfig, &tcpConn)
-		}
+	inherited, err := upgrade.Inherited()
+	if err != nil {
+		log.Fatalf("Failed to use the sockets handed over by the previous process (%v)", err)
 	}
-}
-
-func (s *server) serveSSHConnection(sshConfig *ssh.ServerConfig, tcpConn *net.Conn) {
-	var key *ssh.PublicKey
-	config := sshConfig
-	config.PublicKeyCallback = func(conn ssh.ConnMetadata, k ssh.PublicKey) (*ssh.Permissions, error) {
-		key = &k
-		return &ssh.Permissions{}, nil
+	sockets, err := systemd.Listeners()
+	if err != nil {
+		log.Fatalf("Failed to use the sockets passed by systemd (%v)", err)
+	}
+	listeners := map[string]net.Listener{}
+	for position, name := range []string{"https", "ssh"} {
+		if l := inherited[name]; l != nil {
+			listeners[name] = l
+		} else if l := activated(sockets, name, position); l != nil {
+			listeners[name] = l
+		}
 	}
-
-	conn, newChans, reqs, err := ssh.NewServerConn(*tcpConn, config)
-	if key == nil || err != nil {
-		return
+	if listeners["https"] == nil {
+		if listeners["https"], err = net.Listen("tcp", ":"+strconv.Itoa(*httpsPort)); err != nil {
+			log.Fatalln(err)
+		}
 	}
-
-	keyID := base64.RawStdEncoding.EncodeToString((*key).Marshal()[:])
-
-	githubEnabled := false
-	if *githubSubdomains && conn.User() != "nomatch" {
-		githubEnabled = keyMatchesAccount("github.com", conn.User(), keyID)
+	if listeners["ssh"] == nil {
+		if listeners["ssh"], err = net.Listen("tcp", "0.0.0.0:"+strconv.Itoa(*sshPort)); err != nil {
+			log.Fatalf("Failed to listen on port %d (%s)", *sshPort, err)
+		}
 	}
-	gitlabEnabled := false
-	if *gitlabSubdomains && conn.User() != "nomatch" {
-		gitlabEnabled = keyMatchesAccount("gitlab.com", conn.User(), keyID)
+	if *adminAddr != "" {
+		if config.AdminToken == "" {
+			log.Fatalln("The admin API requires -admin-token")
+		}
+		if listeners["admin"] = inherited["admin"]; listeners["admin"] == nil {
+			if listeners["admin"], err = net.Listen("tcp", *adminAddr); err != nil {
+				log.Fatalf("Failed to listen on %s (%v)", *adminAddr, err)
+			}
+		}
+		go func() {
+			err := http.Serve(listeners["admin"], s.AdminHandler())
+			if !errors.Is(err, net.ErrClosed) {
+				log.Fatalf("Admin API failed (%v)", err)
+			}
+		}()
 	}
 
-	log.Printf("%s(%s) connected (%s, %s, gh:%v, gl:%v)",
-		conn.RemoteAddr(), keyID, conn.ClientVersion(), conn.User(), githubEnabled, gitlabEnabled)
-
-	// We want to have at least one session opened so we can send messages to it.
-	outputReady := false
-	outputReadyCh := make(chan void)
-	keepalives := make(chan void)
-	msgs := make(chan string)
-	requested := int32(0)
-
-	defer func() {
-		close(msgs)
-		s.closeConnection(conn)
-	}()
-
-	go func() {
-		t := time.NewTicker(5 * time.Second)
-		for range t.C {
-			if _, _, err := conn.SendRequest("keepalive@openssh.com", true, nil); err != nil {
-				close(keepalives)
-				return
-			} else {
-				keepalives <- v
+	if *connectionsSocket != "" {
+		if listeners["connections"] = inherited["connections"]; listeners["connections"] == nil {
+			// A socket left by a previous process that did not hand it over is stale.
+			_ = os.Remove(*connectionsSocket)
+			l, err := net.Listen("unix", *connectionsSocket)
+			if err != nil {
+				log.Fatalf("Failed to listen on %s (%v)", *connectionsSocket, err)
 			}
+			// Upgraded processes still serve it after we close it.
+			l.(*net.UnixListener).SetUnlinkOnClose(false)
+			listeners["connections"] = l
 		}
-	}()
+		go s.ServeConnectionExport(ctx, listeners["connections"])
+	}
 
-	go func() {
-		for nc := range newChans {
-			newChannel := nc
-			go func() {
-				if t := newChannel.ChannelType(); t != "session" {
-					log.Printf("Rejecting channel type %s", t)
-					err := newChannel.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type: %s", t))
-					if err != nil {
-						log.Printf("Failed to reject channel type %s (%s)", t, err)
-					}
-					return
-				}
-
-				channel, sessionReqs, err := newChannel.Accept()
-				if err != nil {
-					log.Printf("Could not accept channel (%s)", err)
-					return
-				}
-
-				s.startSession(keyID, conn, channel)
-				defer s.endSession(conn, channel)
-
-				if !outputReady {
-					outputReadyCh <- v
-					outputReady = true
-				}
-
-				go func() {
-					buf := make([]byte, 256)
-					for {
-						read, err := channel.Read(buf)
-						if err != nil && errors.Is(err, io.EOF) {
-							return
-						}
-						// ctrl-c & ctrl-d
-						if bytes.ContainsAny(buf[:read], "\x03\x04") {
-							s.endSession(conn, channel)
-							break
-						}
-					}
-				}()
-
-				go func() {
-					<-time.After(1 * time.Second)
-					if atomic.LoadInt32(&requested) == 0 {
-						failWithUsage(channel)
-					}
-				}()
-
-				for req := range sessionReqs {
-					if req.Type == "shell" || req.Type == "pty-req" {
-						if err := req.Reply(true, nil); err != nil {
-							log.Printf("Could not accept request of type %s (%v)", req.Type, err)
-						}
-					} else {
-						if err := req.Reply(false, nil); err != nil {
-							return
-						}
-					}
-				}
-			}()
+	if config.DNS != nil {
+		udp, tcp, err := listenDNS(*dnsAddr)
+		if err != nil {
+			log.Fatalf("Failed to listen for DNS on %s (%v)", *dnsAddr, err)
 		}
-	}()
+		go config.DNS.ServeUDP(ctx, udp)
+		go config.DNS.ServeTCP(ctx, tcp)
+	}
 
-	go func() {
-		<-outputReadyCh
-
-		for msg := range msgs {
-			c := s.conns[conn]
-			if c != nil {
-				for sess := range c.Sessions {
-					if _, err := sess.Write([]byte(msg + "\r\n")); err != nil {
-						log.Printf("Could not send message %s (%v)", msg, err)
-					}
-				}
-			}
+	go s.ServeHTTPS(ctx, listeners["https"])
+	go s.ServeSSH(ctx, listeners["ssh"], nil)
+
+	if upgrade.Upgraded() {
+		// The previous process is still the one systemd knows about; it will hand over once we are ready.
+		if err := upgrade.Ready(); err != nil {
+			log.Printf("Could not tell the previous process we are ready (%v)", err)
 		}
-	}()
+	} else if err := systemd.Notify("READY=1"); err != nil {
+		log.Printf("Could not notify systemd (%v)", err)
+	}
+	if interval := systemd.WatchdogInterval(); interval > 0 {
+		go watchdog(ctx, s, interval)
+	}
 
+	upgrades := make(chan os.Signal, 1)
+	signal.Notify(upgrades, syscall.SIGHUP)
 	for {
 		select {
-		case req := <-reqs:
-			if req == nil {
-				return
+		case <-ctx.Done():
+			log.Println("Shutting down")
+			_ = systemd.Notify("STOPPING=1")
+			return
+		case <-upgrades:
+			log.Println("Upgrading")
+			pid, err := upgrade.Start(listeners)
+			if err != nil {
+				log.Printf("Upgrade failed, still serving (%v)", err)
+				continue
 			}
-			switch req.Type {
-			case "tcpip-forward":
-				var payload remoteForwardRequest
-				if err = ssh.Unmarshal(req.Payload, &payload); err != nil {
-					log.Printf("Invalid new tcpip-forward request (%v)", err)
-					if req.WantReply {
-						if err := req.Reply(false, nil); err != nil {
-							log.Printf("Could not reject new channel request of type %s (%v)", req.Type, err)
-						}
-					}
-				} else {
-					endpoints := endpointURLs(conn.User(), key, payload.BindPort, githubEnabled, gitlabEnabled)
-					atomic.AddInt32(&requested, 1)
-
-					var urls []string
-					for _, endpoint := range endpoints {
-						urls = append(urls, "https://"+endpoint+"/")
-					}
-					msgs <- fmt.Sprintf("%d: %s", payload.BindPort, strings.Join(urls, ", "))
-
-					s.Lock()
-					for _, endpoint := range endpoints {
-						s.insertEndpointTarget(endpoint, &target{
-							KeyID:  keyID,
-							Remote: conn,
-							Host:   payload.BindAddr,
-							Port:   payload.BindPort,
-						})
-					}
-					s.Unlock()
-
-					if req.WantReply {
-						if err := req.Reply(true, ssh.Marshal(struct{ uint32 }{443})); err != nil {
-							log.Printf("Could not accept new channel request of type %s (%v)", req.Type, err)
-						}
-					}
-				}
-			case "cancel-tcpip-forward":
-				var payload remoteForwardCancelRequest
-				if err = ssh.Unmarshal(req.Payload, &payload); err != nil {
-					log.Printf("Invalid new tcpip-forward request (%v)", err)
-					if req.WantReply {
-						if err := req.Reply(false, nil); err != nil {
-							log.Printf("Could not reject new channel request of type %s (%v)", req.Type, err)
-						}
-					}
-				} else {
-					endpoints := endpointURLs(conn.User(), key, payload.BindPort, githubEnabled, gitlabEnabled)
-					atomic.AddInt32(&requested, 1)
-
-					s.Lock()
-					for _, endpoint := range endpoints {
-						s.removeEndpointTarget(endpoint, &target{
-							KeyID:  keyID,
-							Remote: conn,
-							Host:   payload.BindAddr,
-							Port:   payload.BindPort,
-						})
-					}
-					s.Unlock()
-
-					if req.WantReply {
-						if err := req.Reply(true, ssh.Marshal(struct{ uint32 }{443})); err != nil {
-							log.Printf("Could not accept new channel request of type %s (%v)", req.Type, err)
-						}
-					}
-				}
-			case "keepalive@openssh.com":
-				if req.WantReply {
-					_ = req.Reply(true, nil)
-				}
-			default:
-				if req.WantReply {
-					if err := req.Reply(false, nil); err != nil {
-						log.Printf("Failed to reply to %v (%v)", req, err)
-					} else {
-						log.Printf("Rejected request of type %v", req.Type)
-					}
-				}
+			log.Printf("Process %d took over, draining", pid)
+			_ = systemd.Notify("MAINPID=" + strconv.Itoa(pid))
+			for _, l := range listeners {
+				_ = l.Close()
 			}
-		case <-keepalives:
-		case <-time.After(10 * time.Second):
-			log.Printf("%s(%s) timed out", conn.RemoteAddr(), keyID)
+			s.Drain(ctx, *upgradeDrainTimeout)
 			return
 		}
 	}
 }
 
-func keyMatchesAccount(domain, user, key string) bool {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://%s/%s.keys", domain, user), nil)
+// checkHealth queries the health of the server whose admin API listens on addr, returning the exit code,
+// since container images have nothing else to run health checks with.
+func checkHealth(addr string) int {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get("http://" + addr + "/healthz")
 	if err != nil {
-		log.Printf("Error creating request to %s for %s (%v)", domain, user, err)
-		return false
+		log.Printf("Health check failed (%v)", err)
+		return 1
 	}
-	response, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return false
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	_, _ = io.Copy(os.Stdout, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return 1
 	}
+	return 0
+}
+
+// broadcast asks the admin API at addr to send msg to every connected client.
+func broadcast(addr, token, msg string) int {
+	req, err := http.NewRequest(http.MethodPost, "http://"+addr+"/broadcast", strings.NewReader(msg))
 	if err != nil {
-		log.Printf("Error querying %s for %s (%v)", domain, user, err)
-		return false
+		log.Printf("Broadcast failed (%v)", err)
+		return 1
 	}
-	body, err := io.ReadAll(response.Body)
+	req.Header.Set("Authorization", "Bearer "+token)
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("Error reading response from %s for %s (%v)", domain, user, err)
-		return false
+		log.Printf("Broadcast failed (%v)", err)
+		return 1
 	}
-	lines := strings.Split(string(body), "\n")
-	for _, line := range lines {
-		parts := strings.SplitN(line, " ", 3)
-		if len(parts) < 2 {
-			continue
-		}
-		if strings.TrimRight(parts[1], "=") == key {
-			return true
-		}
-	}
-	return false
-}
-
-func (s *server) logStats() {
-	t := time.NewTicker(time.Minute)
-	for range t.C {
-		log.Printf("Stats: %d conns, %d endpoints", len(s.conns), len(s.endpoints))
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	_, _ = io.Copy(os.Stdout, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return 1
 	}
+	return 0
 }
 
-func endpointURLs(user string, key *ssh.PublicKey, port uint32, githubEnabled bool, gitlabEnabled bool) []string {
-	hasher := sha256.New()
-	_, _ = hasher.Write((*key).Marshal())
-	_, _ = hasher.Write([]byte{0})
-	_, _ = hasher.Write([]byte(strconv.Itoa(int(port))))
-	b32 := b32encoder.EncodeToString(hasher.Sum(nil)[:16])
-	result := []string{fmt.Sprintf("%s.%s", b32, *domain)}
-	if githubEnabled {
-		if port == 1 {
-			result = append(result, fmt.Sprintf("%s.gh.%s", user, *domain))
-		} else {
-			result = append(result, fmt.Sprintf("%s--%d.gh.%s", user, port, *domain))
+// listenDNS binds addr over UDP and TCP with SO_REUSEPORT, so upgraded binaries can bind it before we stop.
+func listenDNS(addr string) (net.PacketConn, net.Listener, error) {
+	lc := net.ListenConfig{Control: func(_, _ string, c syscall.RawConn) error {
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}); err != nil {
+			return err
 		}
+		return sockErr
+	}}
+	udp, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, nil, err
 	}
-	if gitlabEnabled {
-		result = append(result, fmt.Sprintf("%s-%d.gl.%s", user, port, *domain))
+	tcp, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		_ = udp.Close()
+		return nil, nil, err
 	}
-	return result
-}
-
-func reportStatus(ch ssh.Channel, status byte) {
-	_, _ = ch.SendRequest("exit-status", false, []byte{0, 0, 0, status})
-}
-
-func failWithUsage(ch ssh.Channel) {
-	_, _ = ch.Write([]byte("Usage: ssh " + *domain + " -R 1:localhost:3000 -R 2:192.168.0.1:80 …\r\n"))
-	reportStatus(ch, 1)
-	_ = ch.Close()
+	return udp, tcp, nil
 }
 
-func addKey(sshConfig *ssh.ServerConfig, path string) {
-	privateBytes, err := os.ReadFile(path)
-	if err != nil {
-		log.Fatalf("Failed to read private key %s (%v)", path, err)
+// activated picks the socket systemd passed for name (FileDescriptorName=https or ssh),
+// falling back to its position among unnamed sockets.
+func activated(sockets []systemd.Socket, name string, position int) net.Listener {
+	for _, socket := range sockets {
+		if socket.Name == name {
+			return socket.Listener
+		}
 	}
-
-	private, err := ssh.ParsePrivateKey(privateBytes)
-	if err != nil {
-		log.Fatalf("Failed to parse private key %s (%v)", path, err)
+	if position < len(sockets) && sockets[position].Name != "https" && sockets[position].Name != "ssh" {
+		return sockets[position].Listener
 	}
-
-	sshConfig.AddHostKey(private)
+	return nil
 }
 
-func main() {
-	flag.Parse()
-
-	pool, err := pgxpool.Connect(context.Background(), *pgConn)
-	if err != nil {
-		log.Fatal(err)
+// watchdog pets the systemd watchdog for as long as the server's tables can be locked,
+// so a deadlocked server gets restarted.
+func watchdog(ctx context.Context, s *server.Server, interval time.Duration) {
+	t := time.NewTicker(interval / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.Counts()
+			if err := systemd.Notify("WATCHDOG=1"); err != nil {
+				log.Printf("Could not notify the systemd watchdog (%v)", err)
+			}
+		}
 	}
-	defer pool.Close()
-
-	s := newServer(pool)
-	go s.logStats()
-	go s.serveHTTPS()
-	s.serveSSH()
 }
@@ -0,0 +1,104 @@
+// Package metrics is a minimal metrics registry, exposed in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	metricsLock sync.Mutex
+	allMetrics  []metric
+)
+
+func register(m metric) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	allMetrics = append(allMetrics, m)
+}
+
+// Counter counts events, optionally split by the values of one label.
+type Counter struct {
+	name   string
+	help   string
+	label  string
+	lock   sync.Mutex
+	values map[string]*atomic.Int64
+}
+
+func NewCounter(name, help, label string) *Counter {
+	c := &Counter{name: name, help: help, label: label, values: map[string]*atomic.Int64{}}
+	register(c)
+	return c
+}
+
+func (c *Counter) With(value string) *atomic.Int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	v, found := c.values[value]
+	if !found {
+		v = &atomic.Int64{}
+		c.values[value] = v
+	}
+	return v
+}
+
+func (c *Counter) Add(value string, n int64) {
+	c.With(value).Add(n)
+}
+
+func (c *Counter) Inc(value string) {
+	c.Add(value, 1)
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	var keys []string
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if c.label == "" {
+			_, _ = fmt.Fprintf(w, "%s %d\n", c.name, c.values[k].Load())
+		} else {
+			_, _ = fmt.Fprintf(w, "%s{%s=%q} %d\n", c.name, c.label, k, c.values[k].Load())
+		}
+	}
+}
+
+// gaugeFunc reports a value computed when scraped.
+type gaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+// NewGaugeFunc registers a gauge computed by fn when scraped.
+func NewGaugeFunc(name, help string, fn func() float64) {
+	register(&gaugeFunc{name: name, help: help, fn: fn})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", g.name, g.help, g.name, g.name, g.fn())
+}
+
+// Serve writes every registered metric.
+func Serve(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	for _, m := range allMetrics {
+		m.write(w)
+	}
+}
@@ -0,0 +1,30 @@
+package metrics
+
+import "runtime"
+
+// RegisterRuntime exposes goroutine, memory and garbage collection figures of the process.
+func RegisterRuntime() {
+	NewGaugeFunc("go_goroutines", "Goroutines that currently exist.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+	NewGaugeFunc("go_memstats_heap_alloc_bytes", "Bytes of allocated heap objects.", memStat(func(m *runtime.MemStats) float64 {
+		return float64(m.HeapAlloc)
+	}))
+	NewGaugeFunc("go_memstats_sys_bytes", "Bytes of memory obtained from the OS.", memStat(func(m *runtime.MemStats) float64 {
+		return float64(m.Sys)
+	}))
+	NewGaugeFunc("go_gc_cycles", "Completed garbage collection cycles.", memStat(func(m *runtime.MemStats) float64 {
+		return float64(m.NumGC)
+	}))
+	NewGaugeFunc("go_gc_pause_seconds", "Cumulative time spent in garbage collection pauses.", memStat(func(m *runtime.MemStats) float64 {
+		return float64(m.PauseTotalNs) / 1e9
+	}))
+}
+
+func memStat(fn func(*runtime.MemStats) float64) func() float64 {
+	return func() float64 {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		return fn(&m)
+	}
+}
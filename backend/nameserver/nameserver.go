@@ -0,0 +1,385 @@
+// Package nameserver answers DNS queries for the tunnel domain authoritatively, so endpoint names resolve
+// while they are served, and records such as verification TXTs are managed through the admin API
+// rather than in a separate zone with wildcard records.
+package nameserver
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record is a record of a name, managed at runtime.
+type Record struct {
+	// Type is A, AAAA, TXT or SSHFP, whose value reads "<algorithm> <type> <hex fingerprint>".
+	Type  string `json:"type"`
+	Value string `json:"value"`
+	// TTL defaults to DefaultTTL.
+	TTL uint32 `json:"ttl,omitempty"`
+}
+
+const (
+	DefaultTTL = 60
+	// negativeTTL is how long resolvers remember names that do not exist, short as endpoints come up at any time.
+	negativeTTL = 30
+
+	typeA     = 1
+	typeNS    = 2
+	typeSOA   = 6
+	typeTXT   = 16
+	typeAAAA  = 28
+	typeSSHFP = 44
+	typeANY   = 255
+	classIN   = 1
+	rcodeOK   = 0
+	rcodeForm = 1
+	rcodeNX   = 3
+	rcodeImp  = 4
+	rcodeRefd = 5
+	// maxUDP is the size of answers over UDP; larger ones are truncated, for resolvers to retry over TCP.
+	maxUDP     = 512
+	tcpTimeout = 10 * time.Second
+)
+
+var types = map[string]uint16{"A": typeA, "AAAA": typeAAAA, "TXT": typeTXT, "SSHFP": typeSSHFP}
+
+// Validate checks a record can be served.
+func (r Record) Validate() error {
+	switch r.Type {
+	case "A":
+		if ip := net.ParseIP(r.Value); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid IPv4 address %q", r.Value)
+		}
+	case "AAAA":
+		if ip := net.ParseIP(r.Value); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid IPv6 address %q", r.Value)
+		}
+	case "TXT":
+		if len(r.Value) > 4096 {
+			return errors.New("TXT value too long")
+		}
+	case "SSHFP":
+		if sshfpData(r.Value) == nil {
+			return fmt.Errorf("invalid SSHFP value %q, expected <algorithm> <type> <hex fingerprint>", r.Value)
+		}
+	default:
+		return fmt.Errorf("unsupported record type %q, expected A, AAAA, TXT or SSHFP", r.Type)
+	}
+	return nil
+}
+
+// Server answers for Zone: its apex, NameServers and the names Serves reports resolve to Addresses,
+// next to the records set with SetRecords and the challenges presented for ACME.
+type Server struct {
+	Zone string
+	// Addresses are those of the nodes serving tunnels.
+	Addresses []net.IP
+	// NameServers are the names of the zone's servers, also resolving to Addresses; the first is the primary.
+	NameServers []string
+	// Serves reports whether a name is an endpoint being served.
+	Serves func(name string) bool
+
+	lock       sync.RWMutex
+	records    map[string][]Record
+	challenges map[string][]string
+	// hostKeys are the SSHFP records of the apex, kept apart from those managed through the admin API.
+	hostKeys []Record
+	serial   uint32
+}
+
+func New(zone string, addresses []net.IP, nameServers []string) *Server {
+	return &Server{
+		Zone:        normalize(zone),
+		Addresses:   addresses,
+		NameServers: nameServers,
+		records:     map[string][]Record{},
+		challenges:  map[string][]string{},
+		serial:      uint32(time.Now().Unix()),
+	}
+}
+
+func normalize(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// SetRecords replaces the records of a name, or removes them if there are none.
+func (s *Server) SetRecords(name string, records []Record) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(records) == 0 {
+		delete(s.records, normalize(name))
+	} else {
+		s.records[normalize(name)] = records
+	}
+	s.serial++
+}
+
+// SetHostKeys replaces the SSHFP records of the apex, listing the host keys of the SSH server.
+func (s *Server) SetHostKeys(records []Record) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.hostKeys = records
+	s.serial++
+}
+
+// Records lists the records set with SetRecords, by name.
+func (s *Server) Records() map[string][]Record {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	result := make(map[string][]Record, len(s.records))
+	for name, records := range s.records {
+		result[name] = records
+	}
+	return result
+}
+
+// Present serves the TXT record of a DNS-01 challenge, so the server can also get its own certificate.
+func (s *Server) Present(_ context.Context, fqdn, value string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	name := normalize(fqdn)
+	s.challenges[name] = append(s.challenges[name], value)
+	return nil
+}
+
+func (s *Server) CleanUp(_ context.Context, fqdn, value string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	name := normalize(fqdn)
+	kept := s.challenges[name][:0]
+	for _, v := range s.challenges[name] {
+		if v != value {
+			kept = append(kept, v)
+		}
+	}
+	if len(kept) == 0 {
+		delete(s.challenges, name)
+	} else {
+		s.challenges[name] = kept
+	}
+	return nil
+}
+
+// ServeUDP answers queries on conn until it closes or ctx ends.
+func (s *Server) ServeUDP(ctx context.Context, conn net.PacketConn) {
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to read a DNS query (%v)", err)
+			continue
+		}
+		if answer := s.answer(buf[:n], maxUDP); answer != nil {
+			_, _ = conn.WriteTo(answer, addr)
+		}
+	}
+}
+
+// ServeTCP answers queries of the connections accepted on l until it closes or ctx ends.
+func (s *Server) ServeTCP(ctx context.Context, l net.Listener) {
+	go func() {
+		<-ctx.Done()
+		_ = l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to accept DNS (%v)", err)
+			continue
+		}
+		go s.serveTCPConn(conn)
+	}
+}
+
+func (s *Server) serveTCPConn(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+	for {
+		_ = conn.SetDeadline(time.Now().Add(tcpTimeout))
+		var size uint16
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+		query := make([]byte, size)
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		answer := s.answer(query, 65535)
+		if answer == nil {
+			return
+		}
+		framed := binary.BigEndian.AppendUint16(nil, uint16(len(answer)))
+		if _, err := conn.Write(append(framed, answer...)); err != nil {
+			return
+		}
+	}
+}
+
+// answer builds the response to a query, nil if it cannot even be answered with an error.
+func (s *Server) answer(query []byte, limit int) []byte {
+	if len(query) < 12 || query[2]&0x80 != 0 {
+		return nil
+	}
+	m := &message{id: binary.BigEndian.Uint16(query), flags: 0x8400 | uint16(query[2]&0x79)<<8}
+	if binary.BigEndian.Uint16(query[4:]) != 1 {
+		return m.finish(rcodeForm, limit)
+	}
+	name, rest, err := readName(query[12:])
+	if err != nil || len(rest) < 4 {
+		return m.finish(rcodeForm, limit)
+	}
+	m.question = query[12 : len(query)-len(rest)+4]
+	qtype, qclass := binary.BigEndian.Uint16(rest), binary.BigEndian.Uint16(rest[2:])
+	if opcode := query[2] >> 3 & 0xf; opcode != 0 {
+		return m.finish(rcodeImp, limit)
+	}
+	if qclass != classIN {
+		return m.finish(rcodeRefd, limit)
+	}
+	name = normalize(name)
+	if name != s.Zone && !strings.HasSuffix(name, "."+s.Zone) {
+		return m.finish(rcodeRefd, limit)
+	}
+
+	found := s.lookup(name)
+	if len(found) == 0 {
+		m.authority = append(m.authority, s.soa())
+		return m.finish(rcodeNX, limit)
+	}
+	for _, r := range found {
+		if qtype == typeANY || r.rtype == qtype {
+			m.answers = append(m.answers, r)
+		}
+	}
+	if len(m.answers) == 0 {
+		m.authority = append(m.authority, s.soa())
+	}
+	return m.finish(rcodeOK, limit)
+}
+
+// lookup lists every record of a name.
+func (s *Server) lookup(name string) []rr {
+	var found []rr
+	addresses := name == s.Zone || (s.Serves != nil && s.Serves(name))
+	for _, ns := range s.NameServers {
+		addresses = addresses || normalize(ns) == name
+	}
+	if name == s.Zone {
+		found = append(found, s.soa())
+		for _, ns := range s.NameServers {
+			found = append(found, rr{rtype: typeNS, ttl: DefaultTTL * 60, data: nameData(ns)})
+		}
+	}
+	if addresses {
+		for _, ip := range s.Addresses {
+			if v4 := ip.To4(); v4 != nil {
+				found = append(found, rr{rtype: typeA, ttl: DefaultTTL, data: v4})
+			} else {
+				found = append(found, rr{rtype: typeAAAA, ttl: DefaultTTL, data: ip.To16()})
+			}
+		}
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	managed := s.records[name]
+	if name == s.Zone {
+		managed = append(managed[:len(managed):len(managed)], s.hostKeys...)
+	}
+	for _, r := range managed {
+		ttl := r.TTL
+		if ttl == 0 {
+			ttl = DefaultTTL
+		}
+		found = append(found, rr{rtype: types[r.Type], ttl: ttl, data: recordData(r)})
+	}
+	for _, value := range s.challenges[name] {
+		found = append(found, rr{rtype: typeTXT, ttl: DefaultTTL, data: txtData(value)})
+	}
+	return found
+}
+
+func (s *Server) soa() rr {
+	primary := "ns." + s.Zone
+	if len(s.NameServers) > 0 {
+		primary = s.NameServers[0]
+	}
+	data := append(nameData(primary), nameData("hostmaster."+s.Zone)...)
+	s.lock.RLock()
+	serial := s.serial
+	s.lock.RUnlock()
+	for _, v := range []uint32{serial, 3600, 600, 86400, negativeTTL} {
+		data = binary.BigEndian.AppendUint32(data, v)
+	}
+	return rr{owner: s.Zone, rtype: typeSOA, ttl: negativeTTL, data: data}
+}
+
+func recordData(r Record) []byte {
+	switch r.Type {
+	case "A":
+		return net.ParseIP(r.Value).To4()
+	case "AAAA":
+		return net.ParseIP(r.Value).To16()
+	case "SSHFP":
+		return sshfpData(r.Value)
+	default:
+		return txtData(r.Value)
+	}
+}
+
+// txtData splits a value into the strings of at most 255 bytes TXT records are made of.
+func txtData(value string) []byte {
+	var data []byte
+	for {
+		chunk := value
+		if len(chunk) > 255 {
+			chunk = chunk[:255]
+		}
+		data = append(append(data, byte(len(chunk))), chunk...)
+		value = value[len(chunk):]
+		if value == "" {
+			return data
+		}
+	}
+}
+
+// sshfpData encodes the value of an SSHFP record, nil if invalid.
+func sshfpData(value string) []byte {
+	fields := strings.Fields(value)
+	if len(fields) != 3 {
+		return nil
+	}
+	algorithm, err := strconv.ParseUint(fields[0], 10, 8)
+	if err != nil {
+		return nil
+	}
+	kind, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil {
+		return nil
+	}
+	fingerprint, err := hex.DecodeString(fields[2])
+	if err != nil || len(fingerprint) == 0 {
+		return nil
+	}
+	return append([]byte{byte(algorithm), byte(kind)}, fingerprint...)
+}
@@ -0,0 +1,90 @@
+package nameserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// rr is a resource record to answer with.
+type rr struct {
+	// owner is the name of the record, that of the question if empty.
+	owner string
+	rtype uint16
+	ttl   uint32
+	data  []byte
+}
+
+type message struct {
+	id, flags          uint16
+	question           []byte
+	answers, authority []rr
+}
+
+var errBadName = errors.New("malformed name")
+
+// readName reads an uncompressed name, as questions have, returning what follows it.
+func readName(b []byte) (string, []byte, error) {
+	var labels []string
+	for {
+		if len(b) == 0 {
+			return "", nil, errBadName
+		}
+		size := int(b[0])
+		if size == 0 {
+			return strings.Join(labels, "."), b[1:], nil
+		}
+		if size > 63 || len(b) < 1+size {
+			return "", nil, errBadName
+		}
+		labels = append(labels, string(b[1:1+size]))
+		b = b[1+size:]
+	}
+}
+
+// nameData encodes a name, uncompressed.
+func nameData(name string) []byte {
+	var data []byte
+	for _, label := range strings.Split(normalize(name), ".") {
+		if label != "" {
+			data = append(append(data, byte(len(label))), label...)
+		}
+	}
+	return append(data, 0)
+}
+
+// finish encodes the message with an rcode, without its records if it does not fit within limit.
+func (m *message) finish(rcode uint16, limit int) []byte {
+	out := m.encode(rcode, m.answers, m.authority)
+	if len(out) > limit {
+		m.flags |= 0x0200
+		out = m.encode(rcode, nil, nil)
+	}
+	return out
+}
+
+func (m *message) encode(rcode uint16, answers, authority []rr) []byte {
+	questions := uint16(0)
+	if m.question != nil {
+		questions = 1
+	}
+	out := make([]byte, 0, 512)
+	for _, v := range []uint16{m.id, m.flags | rcode, questions, uint16(len(answers)), uint16(len(authority)), 0} {
+		out = binary.BigEndian.AppendUint16(out, v)
+	}
+	out = append(out, m.question...)
+	for _, r := range append(answers, authority...) {
+		if r.owner == "" {
+			// A pointer to the name of the question, right after the header.
+			out = append(out, 0xc0, 12)
+		} else {
+			out = append(out, nameData(r.owner)...)
+		}
+		out = binary.BigEndian.AppendUint16(out, r.rtype)
+		out = binary.BigEndian.AppendUint16(out, classIN)
+		out = binary.BigEndian.AppendUint32(out, r.ttl)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(r.data)))
+		out = append(out, r.data...)
+	}
+	return out
+}
@@ -0,0 +1,71 @@
+package registry
+
+import "sync"
+
+// flights counts the visitor connections and requests going through a target,
+// so forwards being cancelled can wait for them.
+type flights struct {
+	sync.Mutex
+	count    int
+	draining bool
+	idle     chan struct{}
+}
+
+// Hold records a visitor connection or request in flight through t, until the returned function is called.
+func (t *Target) Hold() func() {
+	f := &t.flights
+	f.Lock()
+	defer f.Unlock()
+	f.count++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			f.Lock()
+			defer f.Unlock()
+			f.count--
+			if f.count == 0 && f.idle != nil {
+				close(f.idle)
+				f.idle = nil
+			}
+		})
+	}
+}
+
+// InFlight returns how many visitor connections or requests go through t.
+func (t *Target) InFlight() int {
+	t.flights.Lock()
+	defer t.flights.Unlock()
+	return t.flights.count
+}
+
+// Draining reports whether t was removed, so it should not take new requests.
+func (t *Target) Draining() bool {
+	t.flights.Lock()
+	defer t.flights.Unlock()
+	return t.flights.draining
+}
+
+// Drain marks t as no longer taking new requests, and returns a channel closed once nothing is in flight.
+func (t *Target) Drain() <-chan struct{} {
+	f := &t.flights
+	f.Lock()
+	defer f.Unlock()
+	f.draining = true
+	if f.idle == nil {
+		f.idle = make(chan struct{})
+		if f.count == 0 {
+			close(f.idle)
+			idle := f.idle
+			f.idle = nil
+			return idle
+		}
+	}
+	return f.idle
+}
+
+func (f *flights) resume() {
+	f.Lock()
+	defer f.Unlock()
+	f.draining = false
+}
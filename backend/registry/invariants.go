@@ -0,0 +1,65 @@
+package registry
+
+// Kinds of inconsistencies between Conns and Endpoints.
+const (
+	// A connection references a target its endpoint no longer routes to.
+	LeakOrphanRef = "orphan_ref"
+	// An endpoint routes to a target no live connection references.
+	LeakOrphanTarget = "orphan_target"
+	// An endpoint is left without any target.
+	LeakEmptyEndpoint = "empty_endpoint"
+)
+
+type Leak struct {
+	Kind     string
+	Endpoint string
+	target   *Target
+	ref      TunnelRef
+}
+
+// CheckInvariants lists the inconsistencies between Conns and Endpoints.
+// A lock is required
+func (r *Registry) CheckInvariants() []Leak {
+	var leaks []Leak
+	referenced := map[*Target]bool{}
+	for _, c := range r.Conns {
+		for ref, t := range c.Tunnels {
+			if _, found := r.Endpoints[ref.Endpoint][t]; !found {
+				leaks = append(leaks, Leak{Kind: LeakOrphanRef, Endpoint: ref.Endpoint, target: t, ref: ref})
+			} else {
+				referenced[t] = true
+			}
+		}
+	}
+	for endpoint, targets := range r.Endpoints {
+		if len(targets) == 0 {
+			leaks = append(leaks, Leak{Kind: LeakEmptyEndpoint, Endpoint: endpoint})
+		}
+		for t := range targets {
+			if _, live := r.Conns[t.Remote]; !live || !referenced[t] {
+				leaks = append(leaks, Leak{Kind: LeakOrphanTarget, Endpoint: endpoint, target: t})
+			}
+		}
+	}
+	return leaks
+}
+
+// Repair removes leaked entries.
+// A lock is required
+func (r *Registry) Repair(leaks []Leak) {
+	for _, l := range leaks {
+		switch l.Kind {
+		case LeakOrphanRef:
+			if c := r.Conns[l.target.Remote]; c != nil {
+				delete(c.Tunnels, l.ref)
+			}
+		case LeakOrphanTarget:
+			delete(r.Endpoints[l.Endpoint], l.target)
+			if len(r.Endpoints[l.Endpoint]) == 0 {
+				delete(r.Endpoints, l.Endpoint)
+			}
+		case LeakEmptyEndpoint:
+			delete(r.Endpoints, l.Endpoint)
+		}
+	}
+}
@@ -0,0 +1,468 @@
+// Package registry tracks SSH connections, their sessions and tunnels, and which targets serve each endpoint.
+package registry
+
+import (
+	"context"
+	"github.com/pcarrier/srv.us/backend/settings"
+	"golang.org/x/crypto/ssh"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Target is a forward requested by a connection, serving visitors of an endpoint.
+type Target struct {
+	KeyID  string
+	Remote *ssh.ServerConn
+	Host   string
+	Port   uint32
+	// HTTP pools the channels of forwards requested by user+http@; without it,
+	// every visitor connection gets its own channel.
+	HTTP *http.Transport
+	// OnDemandHTTP pools channels like HTTP for other forwards, once their settings need requests parsed.
+	OnDemandHTTP atomic.Pointer[http.Transport]
+	// Shadow targets, forwarded by user+shadow@, never serve visitors but get copies of their requests.
+	Shadow bool
+	// Tag names the group of targets the connection's forwards belong to (user+tag=canary@), for weighted splits.
+	Tag string
+
+	Settings   atomic.Pointer[settings.Endpoint]
+	lastActive atomic.Int64
+	visited    atomic.Bool
+	flights    flights
+}
+
+// Touch records that a target just carried traffic.
+func (t *Target) Touch() {
+	t.lastActive.Store(time.Now().UnixNano())
+}
+
+// FirstVisit reports whether a target gets its first visitor, only once.
+func (t *Target) FirstVisit() bool {
+	return !t.visited.Swap(true)
+}
+
+func (t *Target) IdleSince() time.Time {
+	return time.Unix(0, t.lastActive.Load())
+}
+
+// DefaultTag is the group of targets forwarded without a tag.
+const DefaultTag = "default"
+
+// TunnelRef identifies a target of a connection by value, as clients refer to their forwards.
+type TunnelRef struct {
+	Endpoint string
+	Host     string
+	Port     uint32
+}
+
+func RefOf(endpoint string, t *Target) TunnelRef {
+	return TunnelRef{Endpoint: endpoint, Host: t.Host, Port: t.Port}
+}
+
+type Connection struct {
+	KeyID string
+	// Cancel ends the work in flight for the connection.
+	Cancel   context.CancelFunc
+	Sessions map[ssh.Channel]struct{}
+	Tunnels  map[TunnelRef]*Target
+	// ports are the origin ports of the channels open to the connection, lastPort the latest handed out.
+	ports    map[uint16]struct{}
+	lastPort uint16
+}
+
+func newConnection(keyID string) *Connection {
+	return &Connection{
+		KeyID:    keyID,
+		Sessions: map[ssh.Channel]struct{}{},
+		Tunnels:  map[TunnelRef]*Target{},
+		ports:    map[uint16]struct{}{},
+	}
+}
+
+// Registry is locked by callers that need several operations to happen atomically,
+// such as replacing another key's targets; methods documented as such expect it.
+type Registry struct {
+	sync.Mutex
+	Conns     map[*ssh.ServerConn]*Connection
+	Endpoints map[string]map[*Target]struct{}
+}
+
+func New() *Registry {
+	return &Registry{
+		Conns:     map[*ssh.ServerConn]*Connection{},
+		Endpoints: map[string]map[*Target]struct{}{},
+	}
+}
+
+// Connect registers an authenticated connection, before it opens sessions or requests forwards.
+func (r *Registry) Connect(conn *ssh.ServerConn, keyID string, cancel context.CancelFunc) {
+	r.Lock()
+	defer r.Unlock()
+
+	c := newConnection(keyID)
+	c.Cancel = cancel
+	r.Conns[conn] = c
+}
+
+// ConnectionsOf lists the connections of a key.
+func (r *Registry) ConnectionsOf(keyID string) []*ssh.ServerConn {
+	r.Lock()
+	defer r.Unlock()
+
+	var result []*ssh.ServerConn
+	for conn, c := range r.Conns {
+		if c.KeyID == keyID {
+			result = append(result, conn)
+		}
+	}
+	return result
+}
+
+// Connections lists every connection.
+func (r *Registry) Connections() []*ssh.ServerConn {
+	r.Lock()
+	defer r.Unlock()
+
+	result := make([]*ssh.ServerConn, 0, len(r.Conns))
+	for conn := range r.Conns {
+		result = append(result, conn)
+	}
+	return result
+}
+
+func (r *Registry) StartSession(keyID string, conn *ssh.ServerConn, ch ssh.Channel) {
+	r.Lock()
+	defer r.Unlock()
+
+	if _, found := r.Conns[conn]; !found {
+		r.Conns[conn] = newConnection(keyID)
+	}
+	r.Conns[conn].Sessions[ch] = struct{}{}
+}
+
+// EndSession forgets a session, reporting whether it was the last one of its connection.
+func (r *Registry) EndSession(conn *ssh.ServerConn, ch ssh.Channel) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	c := r.Conns[conn]
+	if c == nil {
+		return false
+	}
+	delete(c.Sessions, ch)
+	return len(c.Sessions) == 0
+}
+
+// Sessions lists the sessions of a connection, to write messages to.
+func (r *Registry) Sessions(conn *ssh.ServerConn) []ssh.Channel {
+	r.Lock()
+	defer r.Unlock()
+
+	var sessions []ssh.Channel
+	if c := r.Conns[conn]; c != nil {
+		for sess := range c.Sessions {
+			sessions = append(sessions, sess)
+		}
+	}
+	return sessions
+}
+
+// NewPort numbers the next channel opened to a connection, as reported in its origin port,
+// skipping those of its channels still open; 0 if it has no other left, or is gone.
+// It is given back with ReleasePort once the channel closes.
+func (r *Registry) NewPort(conn *ssh.ServerConn) uint16 {
+	r.Lock()
+	defer r.Unlock()
+
+	c := r.Conns[conn]
+	if c == nil {
+		return 0
+	}
+	for i := 0; i < math.MaxUint16; i++ {
+		c.lastPort++
+		if _, used := c.ports[c.lastPort]; c.lastPort != 0 && !used {
+			c.ports[c.lastPort] = struct{}{}
+			return c.lastPort
+		}
+	}
+	return 0
+}
+
+func (r *Registry) ReleasePort(conn *ssh.ServerConn, port uint16) {
+	r.Lock()
+	defer r.Unlock()
+
+	if c := r.Conns[conn]; c != nil {
+		delete(c.ports, port)
+	}
+}
+
+// Insert routes endpoint to t, replacing whatever target its connection had for the same forward.
+// A lock is required
+func (r *Registry) Insert(endpoint string, t *Target) {
+	log.Printf("%s(%s) on %s", t.Remote.RemoteAddr(), t.KeyID, endpoint)
+
+	c := r.Conns[t.Remote]
+	if c == nil {
+		// Forwards can be requested before any session is opened.
+		c = newConnection(t.KeyID)
+		r.Conns[t.Remote] = c
+	}
+	ref := RefOf(endpoint, t)
+	if previous := c.Tunnels[ref]; previous != nil && previous != t {
+		delete(r.Endpoints[endpoint], previous)
+		previous.Drain()
+	}
+	c.Tunnels[ref] = t
+	// Targets moved between endpoints take requests again.
+	t.flights.resume()
+
+	if r.Endpoints[endpoint] != nil {
+		r.Endpoints[endpoint][t] = struct{}{}
+	} else {
+		r.Endpoints[endpoint] = map[*Target]struct{}{t: {}}
+	}
+}
+
+// Remove stops routing endpoint to the target its connection registered for the same forward as t, and returns it.
+// t only needs Remote, Host and Port, so it can describe a forward being cancelled.
+// A lock is required
+func (r *Registry) Remove(endpoint string, t *Target) *Target {
+	c := r.Conns[t.Remote]
+	if c == nil {
+		return nil
+	}
+	ref := RefOf(endpoint, t)
+	registered := c.Tunnels[ref]
+	if registered == nil {
+		return nil
+	}
+	log.Printf("%s(%s) off %s", t.Remote.RemoteAddr(), registered.KeyID, endpoint)
+
+	delete(c.Tunnels, ref)
+	delete(r.Endpoints[endpoint], registered)
+	if len(r.Endpoints[endpoint]) == 0 {
+		delete(r.Endpoints, endpoint)
+	}
+	registered.Drain()
+	return registered
+}
+
+// RemoveTunnel stops routing to the tunnel a connection registered for a port, returning its endpoints.
+func (r *Registry) RemoveTunnel(conn *ssh.ServerConn, port uint32) []string {
+	r.Lock()
+	defer r.Unlock()
+
+	c := r.Conns[conn]
+	if c == nil {
+		return nil
+	}
+	var endpoints []string
+	for ref, t := range c.Tunnels {
+		if ref.Port == port {
+			r.Remove(ref.Endpoint, t)
+			endpoints = append(endpoints, ref.Endpoint)
+		}
+	}
+	return endpoints
+}
+
+// Close forgets a connection and stops routing to its tunnels, returning it if it was known.
+func (r *Registry) Close(conn *ssh.ServerConn) *Connection {
+	r.Lock()
+	defer r.Unlock()
+
+	c, found := r.Conns[conn]
+	if !found {
+		return nil
+	}
+	for ref, t := range c.Tunnels {
+		r.Remove(ref.Endpoint, t)
+	}
+	delete(r.Conns, conn)
+	return c
+}
+
+// Foreign lists the targets of an endpoint that belong to other keys.
+// A name belongs to whichever key registered it first, for as long as that key serves it.
+// A lock is required
+func (r *Registry) Foreign(endpoint string, keyID string) []*Target {
+	var result []*Target
+	for t := range r.Endpoints[endpoint] {
+		if t.KeyID != keyID && !t.Shadow {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// served returns the targets of an endpoint or, without any, those of the wildcard covering it,
+// e.g. *.example.com for app.example.com, which catches all the names under it. A lock is required.
+func (r *Registry) served(endpoint string) map[*Target]struct{} {
+	if targets := r.Endpoints[endpoint]; len(targets) > 0 || strings.HasPrefix(endpoint, "*.") {
+		return targets
+	}
+	if _, parent, found := strings.Cut(endpoint, "."); found {
+		return r.Endpoints["*."+parent]
+	}
+	return nil
+}
+
+// Candidates lists the targets serving an endpoint.
+func (r *Registry) Candidates(endpoint string) []*Target {
+	r.Lock()
+	defer r.Unlock()
+
+	var result []*Target
+	for t := range r.served(endpoint) {
+		if !t.Shadow {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// Serving reports whether t still serves an endpoint, not having been removed since it was routed to.
+func (r *Registry) Serving(endpoint string, t *Target) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	_, found := r.served(endpoint)[t]
+	return found
+}
+
+// Shadows lists the shadow targets of an endpoint.
+func (r *Registry) Shadows(endpoint string) []*Target {
+	r.Lock()
+	defer r.Unlock()
+
+	var result []*Target
+	for t := range r.served(endpoint) {
+		if t.Shadow {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// TargetsOf lists the live targets of a key's tunnel on every endpoint.
+// A lock is required
+func (r *Registry) TargetsOf(keyID string, port uint32) []*Target {
+	var result []*Target
+	for _, targets := range r.Endpoints {
+		for t := range targets {
+			if t.KeyID == keyID && t.Port == port {
+				result = append(result, t)
+			}
+		}
+	}
+	return result
+}
+
+func (r *Registry) TunnelCount(conn *ssh.ServerConn) int {
+	r.Lock()
+	defer r.Unlock()
+
+	if c := r.Conns[conn]; c != nil {
+		return len(c.Tunnels)
+	}
+	return 0
+}
+
+// TunnelsOf lists the tunnels of a connection.
+func (r *Registry) TunnelsOf(conn *ssh.ServerConn) map[TunnelRef]*Target {
+	r.Lock()
+	defer r.Unlock()
+
+	result := map[TunnelRef]*Target{}
+	if c := r.Conns[conn]; c != nil {
+		for ref, t := range c.Tunnels {
+			result[ref] = t
+		}
+	}
+	return result
+}
+
+// Forwards reports whether a connection already registered a forward of host and port.
+func (r *Registry) Forwards(conn *ssh.ServerConn, host string, port uint32) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if c := r.Conns[conn]; c != nil {
+		for ref := range c.Tunnels {
+			if ref.Host == host && ref.Port == port {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// FreePort returns the lowest port none of a key's connections forwards, for forwards of port 0.
+func (r *Registry) FreePort(keyID string) uint32 {
+	r.Lock()
+	defer r.Unlock()
+
+	used := map[uint32]bool{}
+	for _, c := range r.Conns {
+		if c.KeyID == keyID {
+			for ref := range c.Tunnels {
+				used[ref.Port] = true
+			}
+		}
+	}
+	port := uint32(1)
+	for used[port] {
+		port++
+	}
+	return port
+}
+
+// Counts returns the number of connections and endpoints.
+func (r *Registry) Counts() (int, int) {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.Conns), len(r.Endpoints)
+}
+
+// TotalTunnels returns the number of tunnels across connections.
+func (r *Registry) TotalTunnels() int {
+	r.Lock()
+	defer r.Unlock()
+	tunnels := 0
+	for _, c := range r.Conns {
+		tunnels += len(c.Tunnels)
+	}
+	return tunnels
+}
+
+type IdleTunnel struct {
+	Conn  *ssh.ServerConn
+	KeyID string
+	Port  uint32
+}
+
+// IdleTunnels lists tunnels whose targets have all been idle since before cutoff.
+func (r *Registry) IdleTunnels(cutoff time.Time) []IdleTunnel {
+	r.Lock()
+	defer r.Unlock()
+
+	var result []IdleTunnel
+	for conn, c := range r.Conns {
+		active := map[uint32]bool{}
+		for ref, t := range c.Tunnels {
+			active[ref.Port] = active[ref.Port] || t.IdleSince().After(cutoff)
+		}
+		for port, isActive := range active {
+			if !isActive {
+				result = append(result, IdleTunnel{Conn: conn, KeyID: c.KeyID, Port: port})
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,120 @@
+package registry
+
+import (
+	"golang.org/x/crypto/ssh"
+	"net"
+	"testing"
+)
+
+// addrConn is a connection that only tells its remote address, all the registry asks of connections.
+type addrConn struct {
+	ssh.Conn
+}
+
+func (addrConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}
+}
+
+func newConn(r *Registry, keyID string) *ssh.ServerConn {
+	conn := &ssh.ServerConn{Conn: addrConn{}}
+	r.Connect(conn, keyID, func() {})
+	return conn
+}
+
+func checked(t *testing.T, r *Registry) {
+	t.Helper()
+	if leaks := r.CheckInvariants(); len(leaks) > 0 {
+		t.Fatalf("leaked %+v", leaks)
+	}
+}
+
+// TestRemoveByValue cancels forwards with targets describing them, as clients do, rather than the registered ones.
+func TestRemoveByValue(t *testing.T) {
+	r := New()
+	conn := newConn(r, "key")
+	registered := &Target{KeyID: "key", Remote: conn, Host: "localhost", Port: 1}
+	r.Lock()
+	r.Insert("a.example.com", registered)
+	r.Insert("b.example.com", registered)
+	removed := r.Remove("a.example.com", &Target{Remote: conn, Host: "localhost", Port: 1})
+	r.Unlock()
+	if removed != registered {
+		t.Fatalf("removed %p, expected %p", removed, registered)
+	}
+	if r.Serving("a.example.com", registered) || !r.Serving("b.example.com", registered) {
+		t.Fatal("removed the wrong endpoint")
+	}
+	if tunnels := r.TunnelsOf(conn); len(tunnels) != 1 {
+		t.Fatalf("kept %v", tunnels)
+	}
+	checked(t, r)
+
+	r.Lock()
+	again := r.Remove("a.example.com", &Target{Remote: conn, Host: "localhost", Port: 1})
+	r.Unlock()
+	if again != nil {
+		t.Fatal("removed a forward twice")
+	}
+	if endpoints := r.RemoveTunnel(conn, 1); len(endpoints) != 1 || endpoints[0] != "b.example.com" {
+		t.Fatalf("removed %v", endpoints)
+	}
+	if _, endpoints := r.Counts(); endpoints != 0 {
+		t.Fatalf("%d endpoints left", endpoints)
+	}
+	checked(t, r)
+}
+
+// TestInsertCollisions forwards what compares equal by value again, and what only differs by host or connection.
+func TestInsertCollisions(t *testing.T) {
+	r := New()
+	conn, other := newConn(r, "key"), newConn(r, "key")
+	first := &Target{KeyID: "key", Remote: conn, Host: "localhost", Port: 1}
+	again := &Target{KeyID: "key", Remote: conn, Host: "localhost", Port: 1}
+	elsewhere := &Target{KeyID: "key", Remote: conn, Host: "127.0.0.1", Port: 1}
+	balanced := &Target{KeyID: "key", Remote: other, Host: "localhost", Port: 1}
+	r.Lock()
+	r.Insert("a.example.com", first)
+	r.Insert("a.example.com", again)
+	r.Insert("a.example.com", elsewhere)
+	r.Insert("a.example.com", balanced)
+	r.Unlock()
+	if r.Serving("a.example.com", first) || !first.Draining() {
+		t.Fatal("kept serving a replaced target")
+	}
+	for _, tgt := range []*Target{again, elsewhere, balanced} {
+		if !r.Serving("a.example.com", tgt) {
+			t.Fatalf("not serving %s:%d of %p", tgt.Host, tgt.Port, tgt.Remote)
+		}
+	}
+	checked(t, r)
+
+	if tunnels := r.TunnelsOf(conn); len(tunnels) != 2 {
+		t.Fatalf("kept %v", tunnels)
+	}
+	if r.Close(conn) == nil {
+		t.Fatal("connection not found")
+	}
+	if candidates := r.Candidates("a.example.com"); len(candidates) != 1 || candidates[0] != balanced {
+		t.Fatalf("left %v", candidates)
+	}
+	checked(t, r)
+}
+
+// TestRepair finds entries left behind by bookkeeping gone wrong, and removes them.
+func TestRepair(t *testing.T) {
+	r := New()
+	conn := newConn(r, "key")
+	tgt := &Target{KeyID: "key", Remote: conn, Host: "localhost", Port: 1}
+	r.Lock()
+	defer r.Unlock()
+	r.Insert("a.example.com", tgt)
+	delete(r.Conns[conn].Tunnels, RefOf("a.example.com", tgt))
+	leaks := r.CheckInvariants()
+	if len(leaks) != 1 {
+		t.Fatalf("found %+v", leaks)
+	}
+	r.Repair(leaks)
+	if leaks := r.CheckInvariants(); len(leaks) > 0 {
+		t.Fatalf("left %+v", leaks)
+	}
+}
@@ -0,0 +1,70 @@
+// Package router picks which target serves a visitor of an endpoint.
+package router
+
+import (
+	"github.com/pcarrier/srv.us/backend/registry"
+	"math/rand"
+)
+
+type Router struct {
+	registry *registry.Registry
+}
+
+func New(r *registry.Registry) *Router {
+	return &Router{registry: r}
+}
+
+// Route returns a target for an endpoint, or nil if none serves it.
+// When several tunnels serve an endpoint, visitors are spread between them randomly,
+// following the split between their tags their owner set, if any.
+func (r *Router) Route(endpoint string) *registry.Target {
+	return r.RouteAvoiding(endpoint, nil)
+}
+
+// RouteAvoiding returns a target for an endpoint as Route does, other than those avoided,
+// e.g. as they just failed; nil if there is none.
+func (r *Router) RouteAvoiding(endpoint string, avoided map[*registry.Target]bool) *registry.Target {
+	var candidates []*registry.Target
+	for _, t := range r.registry.Candidates(endpoint) {
+		if !avoided[t] {
+			candidates = append(candidates, t)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	if picked := pickWeighted(candidates); picked != nil {
+		return picked
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// pickWeighted picks a target with a probability of its tag's weight, shared between the targets of the tag.
+// It returns nil without a split, or when no target's tag has weight, so the endpoint keeps being served.
+func pickWeighted(candidates []*registry.Target) *registry.Target {
+	st := candidates[0].Settings.Load()
+	if st == nil || len(st.Split) == 0 {
+		return nil
+	}
+	perTag := map[string]int{}
+	for _, t := range candidates {
+		perTag[t.Tag]++
+	}
+	weights := make([]float64, len(candidates))
+	total := 0.0
+	for i, t := range candidates {
+		weights[i] = float64(st.Split[t.Tag]) / float64(perTag[t.Tag])
+		total += weights[i]
+	}
+	if total == 0 {
+		return nil
+	}
+	x := rand.Float64() * total
+	for i, w := range weights {
+		if x < w {
+			return candidates[i]
+		}
+		x -= w
+	}
+	return candidates[len(candidates)-1]
+}
@@ -0,0 +1,151 @@
+// Package scan hands request and response bodies to content scanners, such as ClamAV or an HTTP service,
+// so the edge can block malware and phishing kits on endpoints flagged by operators.
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Content is a body to scan, with what we know about it.
+type Content struct {
+	// Endpoint is the name the body went through, Direction "request" or "response".
+	Endpoint    string
+	Direction   string
+	ContentType string
+	Body        []byte
+}
+
+// Verdict is what a scanner found in some content.
+type Verdict struct {
+	Match bool
+	// Name describes the match, e.g. the signature.
+	Name string
+}
+
+// Scanner decides whether content must be blocked. Operators can plug their own, e.g. speaking ICAP,
+// by setting server.Config.Scanner.
+type Scanner interface {
+	Scan(ctx context.Context, c Content) (Verdict, error)
+}
+
+// Open returns the scanner described by spec:
+//   - clamd:unix:/run/clamav/clamd.ctl or clamd:tcp:localhost:3310 streams bodies to ClamAV's daemon;
+//   - an http:// or https:// URL receives bodies as POST requests, see HTTP.
+func Open(spec string) (Scanner, error) {
+	switch {
+	case strings.HasPrefix(spec, "clamd:"):
+		network, addr, found := strings.Cut(strings.TrimPrefix(spec, "clamd:"), ":")
+		if !found || (network != "unix" && network != "tcp") {
+			return nil, fmt.Errorf("invalid clamd address %q, expected clamd:unix:<path> or clamd:tcp:<host>:<port>", spec)
+		}
+		return &Clamd{Network: network, Addr: addr}, nil
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return &HTTP{URL: spec, Client: &http.Client{Timeout: timeout}}, nil
+	default:
+		return nil, fmt.Errorf("unknown scanner %q", spec)
+	}
+}
+
+const (
+	timeout = 30 * time.Second
+	// chunkSize is how much of a body we send clamd at once; its StreamMaxLength still applies.
+	chunkSize = 64 << 10
+)
+
+// Clamd scans with ClamAV's daemon, with its INSTREAM command.
+type Clamd struct {
+	Network, Addr string
+}
+
+func (c *Clamd) Scan(ctx context.Context, content Content) (Verdict, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.Network, c.Addr)
+	if err != nil {
+		return Verdict{}, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(timeout)
+	}
+	_ = conn.SetDeadline(deadline)
+
+	w := bufio.NewWriter(conn)
+	_, _ = w.WriteString("zINSTREAM\x00")
+	for body := content.Body; ; {
+		n := len(body)
+		if n > chunkSize {
+			n = chunkSize
+		}
+		_ = binary.Write(w, binary.BigEndian, uint32(n))
+		if n == 0 {
+			break
+		}
+		_, _ = w.Write(body[:n])
+		body = body[n:]
+	}
+	if err := w.Flush(); err != nil {
+		return Verdict{}, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return Verdict{}, err
+	}
+	reply = strings.TrimSpace(strings.TrimPrefix(strings.TrimSuffix(reply, "\x00"), "stream:"))
+	switch {
+	case reply == "OK":
+		return Verdict{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return Verdict{Match: true, Name: strings.TrimSuffix(reply, " FOUND")}, nil
+	default:
+		return Verdict{}, fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+// HTTP posts bodies to a service, with their Content-Type and the Srvus-Endpoint and Srvus-Direction headers.
+// It answers 200 or 204 for clean content, 403 with a description of the match otherwise.
+type HTTP struct {
+	URL    string
+	Client *http.Client
+}
+
+func (h *HTTP) Scan(ctx context.Context, content Content) (Verdict, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(content.Body))
+	if err != nil {
+		return Verdict{}, err
+	}
+	if content.ContentType != "" {
+		req.Header.Set("Content-Type", content.ContentType)
+	}
+	req.Header.Set("Srvus-Endpoint", content.Endpoint)
+	req.Header.Set("Srvus-Direction", content.Direction)
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return Verdict{}, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return Verdict{}, nil
+	case http.StatusForbidden:
+		name, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return Verdict{Match: true, Name: strings.TrimSpace(string(name))}, nil
+	default:
+		return Verdict{}, fmt.Errorf("scanner answered %s", resp.Status)
+	}
+}
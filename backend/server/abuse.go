@@ -0,0 +1,306 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/registry"
+	"github.com/pcarrier/srv.us/backend/settings"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Visitors report malicious tunnels on https://<domain>/report. Reports are kept per endpoint for operators,
+// the owner hears about them in their sessions, and enough distinct reporters suspend the tunnel until an operator lifts it.
+
+const (
+	reportsNamespace = "abuse-reports"
+	// maxReportsPerEndpoint bounds what we keep; the oldest reports go first.
+	maxReportsPerEndpoint = 100
+	maxReportSize         = 16 << 10
+	// reportWindow is how far back distinct reporters count towards suspension.
+	reportWindow = 24 * time.Hour
+)
+
+// perReporter throttles reports from any one address.
+var perReporter = &settings.RateLimit{PerMinute: 5, Burst: 5}
+
+type abuseReport struct {
+	Endpoint string    `json:"endpoint"`
+	KeyID    string    `json:"key"`
+	Port     uint32    `json:"port"`
+	URL      string    `json:"url"`
+	Reason   string    `json:"reason"`
+	Contact  string    `json:"contact,omitempty"`
+	Reporter string    `json:"reporter"`
+	Time     time.Time `json:"time"`
+}
+
+var reportPage = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en"><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Report a tunnel — {{.Domain}}</title>
+<style>body{font-family:sans-serif;max-width:40em;margin:2em auto;padding:0 1em}input,textarea{width:100%;margin:.3em 0 1em}</style></head>
+<body><h1>Report a tunnel</h1>
+{{if .Message}}<p><strong>{{.Message}}</strong></p>{{end}}
+{{if not .Done}}<p>Found phishing, malware or other abuse served under {{.Domain}}? Tell us where.</p>
+<form method="post" action="/report">
+<label>Address<input name="url" type="url" required placeholder="https://….{{.Domain}}/" value="{{.URL}}"></label>
+<label>What is wrong with it<textarea name="reason" rows="5" required maxlength="2000"></textarea></label>
+<label>Your email, if we may contact you<input name="contact" type="email"></label>
+<button>Report</button>
+</form>{{end}}
+</body></html>
+`))
+
+type reportPageData struct {
+	Domain, URL, Message string
+	Done                 bool
+}
+
+// serveReport answers GET and POST /report on the domain itself.
+func (s *Server) serveReport(ctx context.Context, https *tls.Conn, req *http.Request) error {
+	data := reportPageData{Domain: s.cfg.Domain, URL: req.URL.Query().Get("url")}
+	status := http.StatusOK
+	if req.Method == http.MethodPost {
+		req.Body = io.NopCloser(io.LimitReader(req.Body, maxReportSize))
+		if err := req.ParseForm(); err != nil {
+			return err
+		}
+		reporter, _, _ := net.SplitHostPort(https.RemoteAddr().String())
+		if err := s.fileReport(ctx, req.PostForm.Get("url"), req.PostForm.Get("reason"), req.PostForm.Get("contact"), reporter); err != nil {
+			status, data.Message = http.StatusBadRequest, fmt.Sprintf("Could not file the report: %v.", err)
+			data.URL = req.PostForm.Get("url")
+		} else {
+			data.Done, data.Message = true, "Thank you, we will look into it."
+		}
+	}
+
+	var body strings.Builder
+	if err := reportPage.Execute(&body, data); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(https, "HTTP/1.1 %d %s\r\nContent-Type: text/html; charset=utf-8\r\nContent-Length: %d\r\n\r\n%s",
+		status, http.StatusText(status), body.Len(), body.String())
+	return err
+}
+
+// fileReport records a report about the tunnel serving rawURL, tells its owner, and suspends it past the threshold.
+func (s *Server) fileReport(ctx context.Context, rawURL, reason, contact, reporter string) error {
+	if wait := s.rates.take("", 0, "report "+reporter, perReporter); wait > 0 {
+		return errors.New("too many reports, retry later")
+	}
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || u.Hostname() == "" {
+		return fmt.Errorf("give the full address of the tunnel, e.g. https://….%s/", s.cfg.Domain)
+	}
+	endpoint := strings.ToLower(u.Hostname())
+	if !strings.HasSuffix(endpoint, "."+s.cfg.Domain) {
+		return fmt.Errorf("only addresses under %s can be reported here", s.cfg.Domain)
+	}
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return errors.New("tell us what is wrong with it")
+	}
+	candidates := s.registry.Candidates(endpoint)
+	if len(candidates) == 0 {
+		return errors.New("no tunnel serves this address right now")
+	}
+	tgt := candidates[0]
+
+	report := abuseReport{
+		Endpoint: endpoint,
+		KeyID:    tgt.KeyID,
+		Port:     tgt.Port,
+		URL:      u.String(),
+		Reason:   truncate(reason, 2000),
+		Contact:  truncate(strings.TrimSpace(contact), 200),
+		Reporter: reporter,
+		Time:     time.Now(),
+	}
+	reporters, err := s.storeReport(ctx, report)
+	if err != nil {
+		return errors.New("could not record it, retry later")
+	}
+	s.cfg.Audit.Record("abuse_reported", logs.Fields{"endpoint": endpoint, "key": tgt.KeyID, "port": tgt.Port, "reporter": reporter})
+	for _, conn := range s.registry.ConnectionsOf(tgt.KeyID) {
+		s.notify(conn, fmt.Sprintf("%d: https://%s/ was reported as abusive (%s).", tgt.Port, endpoint, report.Reason))
+	}
+
+	if s.cfg.AbuseReportThreshold > 0 && reporters >= s.cfg.AbuseReportThreshold {
+		if err := s.suspend(ctx, tgt.KeyID, tgt.Port, fmt.Sprintf("reported by %d visitors", reporters)); err != nil {
+			return errors.New("could not record it, retry later")
+		}
+	}
+	return nil
+}
+
+// storeReport appends a report to those of its endpoint, returning how many distinct addresses reported it recently.
+func (s *Server) storeReport(ctx context.Context, report abuseReport) (int, error) {
+	s.settingsLock.Lock()
+	defer s.settingsLock.Unlock()
+
+	reports, err := s.loadReports(ctx, report.Endpoint)
+	if err != nil {
+		return 0, err
+	}
+	reports = append(reports, report)
+	if len(reports) > maxReportsPerEndpoint {
+		reports = reports[len(reports)-maxReportsPerEndpoint:]
+	}
+	raw, err := json.Marshal(reports)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.cfg.Store.Put(ctx, reportsNamespace, report.Endpoint, raw); err != nil {
+		return 0, err
+	}
+
+	reporters := map[string]bool{}
+	for _, r := range reports {
+		if r.KeyID == report.KeyID && r.Port == report.Port && time.Since(r.Time) < reportWindow {
+			reporters[r.Reporter] = true
+		}
+	}
+	return len(reporters), nil
+}
+
+func (s *Server) loadReports(ctx context.Context, endpoint string) ([]abuseReport, error) {
+	raw, err := s.cfg.Store.Get(ctx, reportsNamespace, endpoint)
+	if err != nil || raw == nil {
+		return nil, err
+	}
+	var reports []abuseReport
+	err = json.Unmarshal(raw, &reports)
+	return reports, err
+}
+
+// suspend takes a tunnel down until an operator lifts the suspension, telling its owner.
+func (s *Server) suspend(ctx context.Context, keyID string, port uint32, reason string) error {
+	already := false
+	if _, err := s.updateSettings(ctx, keyID, port, func(st *settings.Endpoint) error {
+		already = st.Suspended != nil
+		if !already {
+			st.Suspended = &settings.Suspension{Reason: reason, Since: time.Now()}
+		}
+		return nil
+	}); err != nil || already {
+		return err
+	}
+	s.cfg.Audit.Record("tunnel_suspended", logs.Fields{"key": keyID, "port": port, "reason": reason})
+	for _, conn := range s.registry.ConnectionsOf(keyID) {
+		s.notify(conn, fmt.Sprintf("%d: suspended (%s); contact the operators of %s to lift it.", port, reason, s.cfg.Domain))
+	}
+	return nil
+}
+
+// suspended returns why a target was suspended, or "".
+func suspended(t *registry.Target) string {
+	if st := t.Settings.Load(); st != nil && st.Suspended != nil {
+		return st.Suspended.Reason
+	}
+	return ""
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+// adminAbuseReports lists reports, all of them or those of ?endpoint=<name>, and dismisses an endpoint's on DELETE.
+func (s *Server) adminAbuseReports(w http.ResponseWriter, r *http.Request) {
+	endpoint := strings.ToLower(r.URL.Query().Get("endpoint"))
+	switch r.Method {
+	case http.MethodGet:
+		if endpoint != "" {
+			reports, err := s.loadReports(r.Context(), endpoint)
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, reports)
+			return
+		}
+		all, err := s.cfg.Store.List(r.Context(), reportsNamespace)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		var reports []abuseReport
+		for _, raw := range all {
+			var some []abuseReport
+			if err := json.Unmarshal(raw, &some); err == nil {
+				reports = append(reports, some...)
+			}
+		}
+		sort.Slice(reports, func(i, j int) bool { return reports[i].Time.After(reports[j].Time) })
+		writeJSON(w, http.StatusOK, reports)
+	case http.MethodDelete:
+		if endpoint == "" {
+			writeJSONError(w, http.StatusBadRequest, errors.New("missing endpoint"))
+			return
+		}
+		if err := s.cfg.Store.Delete(r.Context(), reportsNamespace, endpoint); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"dismissed": endpoint})
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+	}
+}
+
+// adminSuspensions shows, sets (PUT with ?reason=) or lifts (DELETE) the suspension of ?key=<key ID>&port=<port>.
+func (s *Server) adminSuspensions(w http.ResponseWriter, r *http.Request) {
+	keyID := r.URL.Query().Get("key")
+	port, err := parsePort(r.URL.Query().Get("port"))
+	if keyID == "" || err != nil {
+		writeJSONError(w, http.StatusBadRequest, errors.New("missing key or port"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		reason := r.URL.Query().Get("reason")
+		if reason == "" {
+			reason = "suspended by an operator"
+		}
+		if err := s.suspend(r.Context(), keyID, port, reason); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+	case http.MethodDelete:
+		if _, err := s.updateSettings(r.Context(), keyID, port, func(st *settings.Endpoint) error {
+			st.Suspended = nil
+			return nil
+		}); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		for _, conn := range s.registry.ConnectionsOf(keyID) {
+			s.notify(conn, fmt.Sprintf("%d: no longer suspended.", port))
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+		return
+	}
+	st, err := settings.Load(r.Context(), s.cfg.Store, keyID, port)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, st.Suspended)
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/geoip"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/metrics"
+	"github.com/pcarrier/srv.us/backend/settings"
+	"io"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	rpprof "runtime/pprof"
+	"strings"
+)
+
+var errMethodNotAllowed = errors.New("method not allowed")
+
+// AdminHandler exposes the operator API. Every request must carry the admin token as a bearer token,
+// except for /healthz, which liveness probes may not be able to authenticate and reveals nothing sensitive.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/geo-rules", s.adminGeoRules)
+	mux.HandleFunc("/key-limits", s.adminKeyLimits)
+	mux.HandleFunc("/plans", s.adminPlans)
+	mux.HandleFunc("/connections", s.adminConnections)
+	mux.HandleFunc("/abuse-reports", s.adminAbuseReports)
+	mux.HandleFunc("/suspensions", s.adminSuspensions)
+	mux.HandleFunc("/scans", s.adminScans)
+	mux.HandleFunc("/notice", s.adminNotice)
+	mux.HandleFunc("/broadcast", s.adminBroadcast)
+	mux.HandleFunc("/incident", s.adminIncident)
+	mux.HandleFunc("/dns", s.adminDNS)
+	mux.HandleFunc("/reservations", s.adminReservations)
+	mux.HandleFunc("/orgs", s.adminOrgs)
+	mux.HandleFunc("/usage", s.adminUsage)
+	mux.HandleFunc("/host-keys", s.adminHostKeys)
+	mux.HandleFunc("/metrics", metrics.Serve)
+	mux.HandleFunc("/goroutines", adminGoroutines)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	root := http.NewServeMux()
+	root.Handle("/", s.adminAuth(mux))
+	root.HandleFunc("/healthz", s.adminHealth)
+	return root
+}
+
+func (s *Server) adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.AdminToken)) != 1 {
+			s.cfg.Audit.Record("admin_denied", logs.Fields{"remote": r.RemoteAddr, "method": r.Method, "path": r.URL.Path})
+			s.cfg.Security.Record("auth_failure", r.RemoteAddr, "admin api")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			s.cfg.Audit.Record("admin_action", logs.Fields{"remote": r.RemoteAddr, "method": r.Method, "path": r.URL.Path, "query": r.URL.RawQuery})
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminGoroutines dumps the stacks of every goroutine, to find what leaks or blocks.
+func adminGoroutines(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = fmt.Fprintf(w, "%d goroutines\n\n", runtime.NumGoroutine())
+	if err := rpprof.Lookup("goroutine").WriteTo(w, 2); err != nil {
+		log.Printf("Could not dump goroutines (%v)", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Could not write admin response (%v)", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// adminGeoRules manages the global rules, or those of one tunnel given ?key=<key ID>&port=<port>.
+func (s *Server) adminGeoRules(w http.ResponseWriter, r *http.Request) {
+	keyID := r.URL.Query().Get("key")
+	var port uint32
+	if keyID != "" {
+		var err error
+		if port, err = parsePort(r.URL.Query().Get("port")); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if keyID == "" {
+			writeJSON(w, http.StatusOK, s.globalGeo.Load())
+			return
+		}
+		st, err := settings.Load(r.Context(), s.cfg.Store, keyID, port)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, st.Geo)
+	case http.MethodPut, http.MethodDelete:
+		rules := &geoip.Rules{}
+		if r.Method == http.MethodPut {
+			if err := json.NewDecoder(r.Body).Decode(rules); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := rules.Normalize(); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := s.cfg.GeoIP.Check(rules); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		if keyID == "" {
+			if err := s.setGlobalGeoRules(r.Context(), rules); err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, rules)
+			return
+		}
+		_, err := s.updateSettings(r.Context(), keyID, port, func(st *settings.Endpoint) error {
+			st.Geo = rules
+			if rules.Empty() {
+				st.Geo = nil
+			}
+			return nil
+		})
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rules)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+	}
+}
+
+// adminKeyLimits manages the lifetime overrides of the key given as ?key=<key ID>.
+func (s *Server) adminKeyLimits(w http.ResponseWriter, r *http.Request) {
+	keyID := r.URL.Query().Get("key")
+	if keyID == "" {
+		writeJSONError(w, http.StatusBadRequest, errors.New("missing key"))
+		return
+	}
+
+	limits := &keyLimits{}
+	switch r.Method {
+	case http.MethodGet:
+		var err error
+		if limits, err = s.loadKeyLimits(r.Context(), keyID); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+	case http.MethodPut, http.MethodDelete:
+		if r.Method == http.MethodPut {
+			if err := json.NewDecoder(r.Body).Decode(limits); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		if err := s.storeKeyLimits(r.Context(), keyID, limits); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, limits)
+}
+
+// adminConnections lists the connections of the key given as ?key=<key ID>, or force-closes them on DELETE.
+func (s *Server) adminConnections(w http.ResponseWriter, r *http.Request) {
+	keyID := r.URL.Query().Get("key")
+	if keyID == "" {
+		writeJSONError(w, http.StatusBadRequest, errors.New("missing key"))
+		return
+	}
+
+	conns := s.registry.ConnectionsOf(keyID)
+	remotes := make([]string, 0, len(conns))
+	for _, conn := range conns {
+		remotes = append(remotes, conn.RemoteAddr().String())
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		for _, conn := range conns {
+			s.notify(conn, "Disconnected by an operator.")
+			s.closeConnection(conn)
+		}
+		s.cfg.Audit.Record("connections_closed", logs.Fields{"key": keyID, "remotes": remotes})
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"remotes": remotes, "connections": s.statsOf(keyID)})
+}
+
+// maxBroadcast keeps broadcasts to what fits on a screen.
+const maxBroadcast = 4 << 10
+
+// adminBroadcast sends the body of a POST to every session of every connected client, e.g. "Restarting in 5 minutes."
+func (s *Server) adminBroadcast(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+		return
+	}
+	raw, err := io.ReadAll(io.LimitReader(r.Body, maxBroadcast+1))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	msg := strings.TrimSpace(string(raw))
+	if msg == "" || len(raw) > maxBroadcast {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("the message must be between 1 and %d bytes", maxBroadcast))
+		return
+	}
+	connections := s.broadcast(msg)
+	s.cfg.Audit.Record("broadcast", logs.Fields{"message": msg, "connections": connections})
+	writeJSON(w, http.StatusOK, map[string]int{"connections": connections})
+}
@@ -0,0 +1,409 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/identity"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/settings"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Keys mint tokens with `ssh srv.us token new [<name>]`, so dashboards and bots can manage their tunnels
+// without holding the key, calling https://srv.us/api/ with `Authorization: Bearer <token>`:
+//
+//	GET    /api/tunnels                 the tunnels of every connection of the key
+//	GET    /api/stats                   what `ssh srv.us stats` shows, as JSON
+//	GET    /api/tunnels/<port>/options  the edge options of a tunnel, as settings.HTTP
+//	PUT    /api/tunnels/<port>/options  replaces them
+//	DELETE /api/tunnels/<port>/options  removes them
+//	DELETE /api/tunnels/<port>          stops serving a tunnel from every connection forwarding it
+//	GET    /api/reservations            the names reserved for the key's tunnels
+//	PUT    /api/reservations/<id>       reserves a name, with {"port": 1, "name": "docs"}
+//	DELETE /api/reservations/<id>       releases it
+//	…      /api/orgs/<org>/reservations the same, for an organization the key belongs to
+//
+// Only hashes of tokens are stored; they last until revoked with `ssh srv.us token revoke <id>`.
+
+const (
+	apiTokensNamespace = "api-tokens"
+	apiTokenPrefix     = "srvus_"
+	maxAPITokens       = 10
+	maxAPIRequestSize  = 64 << 10
+)
+
+var errNotFound = errors.New("not found")
+
+// apiToken is stored under the SHA-256 hash of the token it describes.
+type apiToken struct {
+	KeyID   string    `json:"key"`
+	Name    string    `json:"name,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+func hashAPIToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// apiTokenID is how owners refer to a token: the start of its hash.
+func apiTokenID(hash string) string {
+	return hash[:12]
+}
+
+// apiTokensOf returns the tokens of a key, by hash.
+func (s *Server) apiTokensOf(ctx context.Context, keyID string) (map[string]*apiToken, error) {
+	all, err := s.cfg.Store.List(ctx, apiTokensNamespace)
+	if err != nil {
+		return nil, err
+	}
+	tokens := map[string]*apiToken{}
+	for hash, raw := range all {
+		t := &apiToken{}
+		if err := json.Unmarshal(raw, t); err != nil {
+			return nil, err
+		}
+		if t.KeyID == keyID {
+			tokens[hash] = t
+		}
+	}
+	return tokens, nil
+}
+
+// authenticateAPI returns the token a request carries, and its hash, nil if it is unknown.
+func (s *Server) authenticateAPI(r *http.Request) (*apiToken, string, error) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || !strings.HasPrefix(token, apiTokenPrefix) {
+		return nil, "", nil
+	}
+	hash := hashAPIToken(token)
+	raw, err := s.cfg.Store.Get(r.Context(), apiTokensNamespace, hash)
+	if err != nil || raw == nil {
+		return nil, "", err
+	}
+	t := &apiToken{}
+	if err := json.Unmarshal(raw, t); err != nil {
+		return nil, "", err
+	}
+	return t, hash, nil
+}
+
+// serveAPI answers a request under /api/ of the domain itself.
+func (s *Server) serveAPI(ctx context.Context, https *tls.Conn, req *http.Request) error {
+	defer func() {
+		_ = req.Body.Close()
+	}()
+	req.Body = io.NopCloser(io.LimitReader(req.Body, maxAPIRequestSize))
+	return serveBuffered(ctx, https, req, s.apiHandler())
+}
+
+// serveBuffered answers a request to the domain with h, whose response is buffered, then closes the connection.
+func serveBuffered(ctx context.Context, https *tls.Conn, req *http.Request, h http.Handler) error {
+	req.RemoteAddr = https.RemoteAddr().String()
+	w := &bufferedResponse{header: http.Header{}, status: http.StatusOK}
+	h.ServeHTTP(w, req.WithContext(ctx))
+	resp := &http.Response{
+		StatusCode:    w.status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        w.header,
+		Body:          io.NopCloser(&w.body),
+		ContentLength: int64(w.body.Len()),
+		Close:         true,
+	}
+	// Answers to HEAD requests have no body, but the length of the one GET would get.
+	if length, err := strconv.ParseInt(w.header.Get("Content-Length"), 10, 64); err == nil && req.Method == http.MethodHead {
+		resp.Body, resp.ContentLength = nil, length
+	}
+	return resp.Write(https)
+}
+
+func (s *Server) apiHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, hash, err := s.authenticateAPI(r)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if t == nil {
+			s.cfg.Audit.Record("api_denied", logs.Fields{"remote": r.RemoteAddr, "method": r.Method, "path": r.URL.Path})
+			s.cfg.Security.Record("auth_failure", r.RemoteAddr, "api")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, fmt.Errorf("missing or unknown token, mint one with ssh %s token new", s.cfg.Domain))
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			s.cfg.Audit.Record("api_action", logs.Fields{"remote": r.RemoteAddr, "key": t.KeyID, "token": apiTokenID(hash), "method": r.Method, "path": r.URL.Path})
+		}
+
+		switch parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/"), "/"), "/"); {
+		case len(parts) == 1 && parts[0] == "tunnels":
+			s.apiTunnels(w, r, t.KeyID)
+		case len(parts) == 1 && parts[0] == "stats":
+			if r.Method != http.MethodGet {
+				w.Header().Set("Allow", "GET")
+				writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+				return
+			}
+			writeJSON(w, http.StatusOK, s.statsOf(t.KeyID))
+		case len(parts) == 2 && parts[0] == "tunnels":
+			s.apiTunnel(w, r, t.KeyID, parts[1])
+		case len(parts) == 1 && parts[0] == "plan":
+			if r.Method != http.MethodGet {
+				w.Header().Set("Allow", "GET")
+				writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+				return
+			}
+			name, plan := s.planOf(t.KeyID)
+			writeJSON(w, http.StatusOK, PlanAssignment{KeyID: t.KeyID, Plan: name, Limits: plan})
+		case len(parts) == 1 && parts[0] == "reservations":
+			if r.Method != http.MethodGet {
+				w.Header().Set("Allow", "GET")
+				writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+				return
+			}
+			writeJSON(w, http.StatusOK, s.reservationsOf(owner{keyID: t.KeyID}))
+		case len(parts) == 2 && parts[0] == "reservations":
+			s.serveReservation(w, r, owner{keyID: t.KeyID}, parts[1], false)
+		case len(parts) >= 3 && parts[0] == "orgs":
+			s.apiOrg(w, r, t.KeyID, parts[1:])
+		case len(parts) == 3 && parts[0] == "tunnels" && parts[2] == "options":
+			s.apiOptions(w, r, t.KeyID, parts[1])
+		default:
+			writeJSONError(w, http.StatusNotFound, errNotFound)
+		}
+	})
+}
+
+// APITunnel is a tunnel as listed by the API.
+type APITunnel struct {
+	Port uint32   `json:"port"`
+	URLs []string `json:"urls"`
+	// Remote is the address of the connection forwarding the tunnel, up since Connected.
+	Remote    string    `json:"remote"`
+	Connected time.Time `json:"connected"`
+}
+
+func (s *Server) apiTunnels(w http.ResponseWriter, r *http.Request, keyID string) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+		return
+	}
+	conns := s.registry.ConnectionsOf(keyID)
+	sort.Slice(conns, func(i, j int) bool { return s.stateOf(conns[i]).since.Before(s.stateOf(conns[j]).since) })
+	tunnels := []APITunnel{}
+	for _, conn := range conns {
+		for _, m := range s.tunnelMessages(conn) {
+			tunnels = append(tunnels, APITunnel{Port: m.Port, URLs: m.URLs, Remote: conn.RemoteAddr().String(), Connected: s.stateOf(conn).since})
+		}
+	}
+	writeJSON(w, http.StatusOK, tunnels)
+}
+
+// closeTunnel stops serving a tunnel of a connection, telling it how it was closed and disconnecting it if it was its last,
+// and returns the endpoints it served.
+func (s *Server) closeTunnel(conn *ssh.ServerConn, keyID string, port uint32, how string) []string {
+	endpoints := s.registry.RemoveTunnel(conn, port)
+	s.forwardDown(conn, port)
+	if len(endpoints) == 0 {
+		return nil
+	}
+	s.cfg.Audit.Record("tunnel_closed", logs.Fields{"remote": conn.RemoteAddr().String(), "key": keyID, "port": port, "endpoints": endpoints})
+	s.callHook(keyID, hookEvent{Event: "tunnel_down", Port: port, URLs: urlsOf(endpoints), Reason: "closed"})
+	s.notify(conn, fmt.Sprintf("%d: closed %s.", port, how))
+	if s.registry.TunnelCount(conn) == 0 {
+		s.notify(conn, "No tunnels left, disconnecting.")
+		s.closeConnection(conn)
+	}
+	return endpoints
+}
+
+// apiTunnel closes a tunnel on DELETE, as if it had been idle.
+func (s *Server) apiTunnel(w http.ResponseWriter, r *http.Request, keyID, rawPort string) {
+	port, err := parsePort(rawPort)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+		return
+	}
+	closed := map[string]bool{}
+	for _, conn := range s.registry.ConnectionsOf(keyID) {
+		for _, endpoint := range s.closeTunnel(conn, keyID, port, "through the API") {
+			closed[endpoint] = true
+		}
+	}
+	if len(closed) == 0 {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no tunnel up on port %d", port))
+		return
+	}
+	endpoints := make([]string, 0, len(closed))
+	for endpoint := range closed {
+		endpoints = append(endpoints, endpoint)
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"urls": urlsOf(endpoints)})
+}
+
+// apiOptions manages the edge options of a tunnel, as `ssh srv.us apply` does for all of them.
+func (s *Server) apiOptions(w http.ResponseWriter, r *http.Request, keyID, rawPort string) {
+	port, err := parsePort(rawPort)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	rules := &settings.HTTP{}
+	switch r.Method {
+	case http.MethodGet:
+		st, err := settings.Load(r.Context(), s.cfg.Store, keyID, port)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if st.HTTP != nil {
+			rules = st.HTTP
+		}
+	case http.MethodPut, http.MethodDelete:
+		if r.Method == http.MethodPut {
+			dec := json.NewDecoder(r.Body)
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(rules); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := rules.Validate(); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		if err := s.setEdgeOptions(r.Context(), keyID, port, rules); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, rules)
+}
+
+// setEdgeOptions replaces the edge options of a tunnel, removing them if rules are empty.
+func (s *Server) setEdgeOptions(ctx context.Context, keyID string, port uint32, rules *settings.HTTP) error {
+	_, err := s.updateSettings(ctx, keyID, port, func(st *settings.Endpoint) error {
+		st.HTTP = rules
+		if rules.Empty() {
+			st.HTTP = nil
+		}
+		return nil
+	})
+	return err
+}
+
+// bufferedResponse holds what a handler answers to a request read off a raw connection, until it is written back.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
+
+func runToken(s *Server, c *commandContext, args []string) error {
+	switch {
+	case len(args) == 0 || (len(args) == 1 && args[0] == "list"):
+		tokens, err := s.apiTokensOf(c.ctx, c.keyID)
+		if err != nil {
+			return err
+		}
+		if len(tokens) == 0 {
+			c.printf("No tokens, mint one with `ssh %s token new [<name>]`.", s.cfg.Domain)
+			return nil
+		}
+		hashes := make([]string, 0, len(tokens))
+		for hash := range tokens {
+			hashes = append(hashes, hash)
+		}
+		sort.Slice(hashes, func(i, j int) bool { return tokens[hashes[i]].Created.Before(tokens[hashes[j]].Created) })
+		for _, hash := range hashes {
+			t := tokens[hash]
+			c.printf("%s %s %s", apiTokenID(hash), t.Created.Format(time.RFC3339), t.Name)
+		}
+		return nil
+	case len(args) <= 2 && args[0] == "new":
+		tokens, err := s.apiTokensOf(c.ctx, c.keyID)
+		if err != nil {
+			return err
+		}
+		if len(tokens) >= maxAPITokens {
+			return fmt.Errorf("at most %d tokens, revoke one first", maxAPITokens)
+		}
+		secret := make([]byte, 20)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		token := apiTokenPrefix + identity.Base32.EncodeToString(secret)
+		t := &apiToken{KeyID: c.keyID, Created: time.Now().UTC()}
+		if len(args) == 2 {
+			t.Name = truncate(args[1], 64)
+		}
+		raw, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		hash := hashAPIToken(token)
+		if err := s.cfg.Store.Put(c.ctx, apiTokensNamespace, hash, raw); err != nil {
+			return err
+		}
+		s.cfg.Audit.Record("api_token_created", logs.Fields{"key": c.keyID, "token": apiTokenID(hash), "name": t.Name})
+		c.printf("Token %s: %s", apiTokenID(hash), token)
+		c.printf("It is only shown now. Use it as `Authorization: Bearer %s` with https://%s/api/tunnels.", token, s.cfg.Domain)
+		return nil
+	case len(args) == 2 && args[0] == "revoke":
+		tokens, err := s.apiTokensOf(c.ctx, c.keyID)
+		if err != nil {
+			return err
+		}
+		for hash := range tokens {
+			if apiTokenID(hash) != args[1] {
+				continue
+			}
+			if err := s.cfg.Store.Delete(c.ctx, apiTokensNamespace, hash); err != nil {
+				return err
+			}
+			s.cfg.Audit.Record("api_token_revoked", logs.Fields{"key": c.keyID, "token": apiTokenID(hash)})
+			c.printf("Token %s revoked.", apiTokenID(hash))
+			return nil
+		}
+		return fmt.Errorf("no token %s, list them with `ssh %s token`", args[1], s.cfg.Domain)
+	default:
+		return errUsage
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/geoip"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/settings"
+	"github.com/pcarrier/srv.us/backend/wire"
+	"gopkg.in/yaml.v3"
+	"io"
+	"sort"
+)
+
+// maxDocumentSize bounds what `ssh srv.us apply -` reads.
+const maxDocumentSize = 64 << 10
+
+// document declares every option of a key's tunnels at once, e.g.
+//
+//	tunnels:
+//	  1:
+//	    geo: {allow: [FR, BE]}
+//	    auth: {users: {alice: s3cret}}
+//	    rate_limit: {per_minute: 600}
+//	    rewrite: [{from: ^/api/(.*), to: /$1}]
+//	    compress: true
+type document struct {
+	Tunnels map[uint32]*tunnelDocument `yaml:"tunnels"`
+}
+
+type tunnelDocument struct {
+	Geo           *geoip.Rules `yaml:"geo,omitempty"`
+	settings.HTTP `yaml:",inline"`
+}
+
+func runApply(s *Server, c *commandContext, args []string) error {
+	if len(args) != 1 || args[0] != "-" {
+		return errUsage
+	}
+	raw, err := readInput(c.ctx, c.in, maxDocumentSize)
+	if err != nil {
+		return err
+	}
+
+	var doc document
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	if err := dec.Decode(&doc); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid document (%v)", err)
+	}
+	for port, t := range doc.Tunnels {
+		if port == 0 || port > wire.MaxBindPort {
+			return fmt.Errorf("invalid port %d", port)
+		}
+		if t == nil {
+			doc.Tunnels[port] = &tunnelDocument{}
+			continue
+		}
+		if t.Geo != nil {
+			if s.cfg.GeoIP == nil {
+				return errors.New("GeoIP is not enabled on this server")
+			}
+			if err := t.Geo.Normalize(); err != nil {
+				return fmt.Errorf("%d: %w", port, err)
+			}
+			if err := s.cfg.GeoIP.Check(t.Geo); err != nil {
+				return fmt.Errorf("%d: %w", port, err)
+			}
+		}
+		if err := t.HTTP.Validate(); err != nil {
+			return fmt.Errorf("%d: %w", port, err)
+		}
+	}
+
+	var declared []uint32
+	for port := range doc.Tunnels {
+		declared = append(declared, port)
+	}
+	// Tunnels left out of the document lose their options.
+	changed, err := s.replaceSettings(c.ctx, c.keyID, declared, func(port uint32, st *settings.Endpoint) {
+		st.Geo, st.HTTP = nil, nil
+		if t := doc.Tunnels[port]; t != nil {
+			if !t.Geo.Empty() {
+				st.Geo = t.Geo
+			}
+			if !t.HTTP.Empty() {
+				rules := t.HTTP
+				st.HTTP = &rules
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	ports := make([]uint32, 0, len(changed))
+	for port := range changed {
+		ports = append(ports, port)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+	for _, port := range ports {
+		st := changed[port]
+		c.printf("%d: geo %s; %s", port, st.Geo, st.HTTP)
+	}
+	s.cfg.Audit.Record("settings_applied", logs.Fields{"key": c.keyID, "ports": ports})
+	return nil
+}
+
+// readInput reads what the client sends until it closes its input, up to limit bytes.
+func readInput(ctx context.Context, in io.Reader, limit int64) ([]byte, error) {
+	type result struct {
+		raw []byte
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		raw, err := io.ReadAll(io.LimitReader(in, limit+1))
+		done <- result{raw, err}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, errors.New("timed out reading input; pipe the document in")
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+		if int64(len(r.raw)) > limit {
+			return nil, fmt.Errorf("input larger than %d bytes", limit)
+		}
+		return r.raw, nil
+	}
+}
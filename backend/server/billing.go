@@ -0,0 +1,285 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operators billing their users export the usage of every key with -usage-export, every -usage-export-interval:
+// how long its tunnels were up, the bytes they moved and the requests they served. A directory gets a file per
+// interval, e.g. usage-20241001T130000Z.csv, and month-to-date rollups, e.g. usage-2024-10.csv, rewritten every time;
+// an http(s) URL gets a UsageReport POSTed as JSON. Rollups survive restarts in the store.
+
+// UsageExportFormats are the values of Config.UsageExportFormat.
+var UsageExportFormats = map[string]bool{"csv": true, "json": true}
+
+const (
+	usageNamespace = "usage"
+	usageTimeout   = 30 * time.Second
+)
+
+var usageClient = &http.Client{Timeout: usageTimeout}
+
+// KeyUsage is what the tunnels of a key did over a period.
+type KeyUsage struct {
+	KeyID       string  `json:"key"`
+	TunnelHours float64 `json:"tunnel_hours"`
+	Bytes       int64   `json:"bytes"`
+	Requests    int64   `json:"requests"`
+}
+
+func (u *KeyUsage) add(other *KeyUsage) {
+	u.TunnelHours += other.TunnelHours
+	u.Bytes += other.Bytes
+	u.Requests += other.Requests
+}
+
+// UsageReport is exported at the end of every period.
+type UsageReport struct {
+	Start time.Time  `json:"start"`
+	End   time.Time  `json:"end"`
+	Keys  []KeyUsage `json:"keys"`
+	// Month is the month of Start, and MonthToDate its usage up to End.
+	Month       string     `json:"month"`
+	MonthToDate []KeyUsage `json:"month_to_date"`
+}
+
+// meter adds up the usage of keys since the last export.
+type meter struct {
+	lock  sync.Mutex
+	start time.Time
+	keys  map[string]*KeyUsage
+	// rollups serializes the updates of monthly usage in the store.
+	rollups sync.Mutex
+}
+
+func (m *meter) add(u *KeyUsage) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.keys == nil {
+		m.keys = map[string]*KeyUsage{}
+	}
+	total := m.keys[u.KeyID]
+	if total == nil {
+		total = &KeyUsage{KeyID: u.KeyID}
+		m.keys[u.KeyID] = total
+	}
+	total.add(u)
+}
+
+// take resets the meter, returning what it added up since start.
+func (m *meter) take(now time.Time) (time.Time, map[string]*KeyUsage) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	start, keys := m.start, m.keys
+	m.start, m.keys = now, map[string]*KeyUsage{}
+	return start, keys
+}
+
+// unbilled returns what a forward did since it was last metered, as of now.
+func (f *forwardStats) unbilled(keyID string, now time.Time) *KeyUsage {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	since := f.billedUntil
+	if since.IsZero() {
+		since = f.since
+	}
+	u := &KeyUsage{
+		KeyID:       keyID,
+		TunnelHours: now.Sub(since).Hours(),
+		Bytes:       f.usage.bytes - f.billedBytes,
+		Requests:    f.usage.requests - f.billedRequests,
+	}
+	f.billedUntil, f.billedBytes, f.billedRequests = now, f.usage.bytes, f.usage.requests
+	return u
+}
+
+// meterForward adds what a forward did since it was last metered to the usage of its key.
+func (s *Server) meterForward(keyID string, f *forwardStats) {
+	if s.cfg.UsageExport == "" || keyID == "" {
+		return
+	}
+	s.meter.add(f.unbilled(keyID, time.Now()))
+}
+
+// meterForwards meters every forward of a connection.
+func (s *Server) meterForwards(keyID string, st *connState) {
+	st.forwards.Range(func(_, v any) bool {
+		s.meterForward(keyID, v.(*forwardStats))
+		return true
+	})
+}
+
+// exportUsage exports the usage of keys at every UsageExportInterval, and once more when ctx ends.
+func (s *Server) exportUsage(ctx context.Context) {
+	if s.cfg.UsageExport == "" || s.cfg.UsageExportInterval <= 0 {
+		return
+	}
+	s.meter.take(time.Now())
+	export := func(ctx context.Context) {
+		if err := s.flushUsage(ctx); err != nil {
+			log.Printf("Could not export usage (%v)", err)
+		}
+	}
+	every(ctx, s.cfg.UsageExportInterval, func() { export(ctx) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), usageTimeout)
+	defer cancel()
+	export(ctx)
+}
+
+// flushUsage meters the forwards still up, adds the usage of the period to its month's, and exports both.
+func (s *Server) flushUsage(ctx context.Context) error {
+	s.conns.Range(func(_, v any) bool {
+		st := v.(*connState)
+		s.meterForwards(st.keyID, st)
+		return true
+	})
+	end := time.Now().UTC()
+	start, keys := s.meter.take(end)
+	report := &UsageReport{Start: start.UTC(), End: end, Month: start.UTC().Format("2006-01"), Keys: sortedUsage(keys)}
+
+	s.meter.rollups.Lock()
+	defer s.meter.rollups.Unlock()
+	month, err := s.loadMonthlyUsage(ctx, report.Month)
+	if err != nil {
+		return err
+	}
+	for keyID, u := range keys {
+		total := month[keyID]
+		if total == nil {
+			total = &KeyUsage{KeyID: keyID}
+			month[keyID] = total
+		}
+		total.add(u)
+	}
+	raw, err := json.Marshal(month)
+	if err != nil {
+		return err
+	}
+	if err := s.cfg.Store.Put(ctx, usageNamespace, report.Month, raw); err != nil {
+		return err
+	}
+	report.MonthToDate = sortedUsage(month)
+
+	if strings.HasPrefix(s.cfg.UsageExport, "http://") || strings.HasPrefix(s.cfg.UsageExport, "https://") {
+		return postUsage(ctx, s.cfg.UsageExport, report)
+	}
+	return writeUsage(s.cfg.UsageExport, s.cfg.UsageExportFormat, report)
+}
+
+func (s *Server) loadMonthlyUsage(ctx context.Context, month string) (map[string]*KeyUsage, error) {
+	usage := map[string]*KeyUsage{}
+	raw, err := s.cfg.Store.Get(ctx, usageNamespace, month)
+	if err != nil || raw == nil {
+		return usage, err
+	}
+	if err := json.Unmarshal(raw, &usage); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+func sortedUsage(keys map[string]*KeyUsage) []KeyUsage {
+	result := make([]KeyUsage, 0, len(keys))
+	for _, u := range keys {
+		result = append(result, *u)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].KeyID < result[j].KeyID })
+	return result
+}
+
+func postUsage(ctx context.Context, url string, report *UsageReport) error {
+	raw, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := usageClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return nil
+}
+
+// writeUsage writes the file of a period, and replaces that of its month.
+func writeUsage(dir, format string, report *UsageReport) error {
+	period := fmt.Sprintf("usage-%s.%s", report.End.Format("20060102T150405Z"), format)
+	if err := writeFileAtomically(filepath.Join(dir, period), encodeUsage(format, report.Keys, report.Start, report.End)); err != nil {
+		return err
+	}
+	monthly := fmt.Sprintf("usage-%s.%s", report.Month, format)
+	monthStart, _ := time.Parse("2006-01", report.Month)
+	return writeFileAtomically(filepath.Join(dir, monthly), encodeUsage(format, report.MonthToDate, monthStart, report.End))
+}
+
+// encodeUsage formats the usage of keys between start and end as CSV with a header, or a JSON object.
+func encodeUsage(format string, keys []KeyUsage, start, end time.Time) []byte {
+	var buf bytes.Buffer
+	if format == "json" {
+		_ = json.NewEncoder(&buf).Encode(map[string]any{"start": start, "end": end, "keys": keys})
+		return buf.Bytes()
+	}
+	w := csv.NewWriter(&buf)
+	_ = w.Write([]string{"start", "end", "key", "tunnel_hours", "bytes", "requests"})
+	for _, u := range keys {
+		_ = w.Write([]string{
+			start.Format(time.RFC3339), end.Format(time.RFC3339), u.KeyID,
+			strconv.FormatFloat(u.TunnelHours, 'f', 4, 64), strconv.FormatInt(u.Bytes, 10), strconv.FormatInt(u.Requests, 10),
+		})
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+// writeFileAtomically replaces a file, so readers never see parts of it.
+func writeFileAtomically(path string, content []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// adminUsage returns the usage of keys during ?month=YYYY-MM, the current month by default, up to the last export.
+func (s *Server) adminUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+		return
+	}
+	month := r.URL.Query().Get("month")
+	if month == "" {
+		month = time.Now().UTC().Format("2006-01")
+	}
+	if _, err := time.Parse("2006-01", month); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid month %q, expected e.g. 2024-10", month))
+		return
+	}
+	usage, err := s.loadMonthlyUsage(r.Context(), month)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"month": month, "keys": sortedUsage(usage)})
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"log"
+	"strings"
+	"text/template"
+)
+
+// Self-hosters white-label the service with a branding bundle (-branding-path), such as
+//
+//	name: Example Tunnels
+//	docs_url: https://tunnels.example.com/docs
+//	usage: "Usage: ssh {{.Domain}} -R 1:localhost:3000, see {{.DocsURL}}"
+//	motd: "Welcome to {{.Name}}, {{.Clients}} clients connected."
+//	pages:
+//	  no_tunnel: "Nothing is served here, see {{.DocsURL}} to change that."
+//
+// Usage and pages are templates of brandingData, shown to sessions opened without forwards and to visitors whose
+// requests fail, as the bodies of error pages; banner and motd are greetings (see ParseGreeting), used unless
+// -banner-path and -motd-path are set. Whatever the bundle leaves out reads as on srv.us.
+
+const defaultDocsURL = "https://docs.srv.us"
+
+// defaultPages are the error pages visitors get, by name.
+var defaultPages = map[string]string{
+	"no_tunnel":          "No tunnel available.",
+	"location_forbidden": "Access from your location is not allowed.",
+	"suspended":          "This tunnel was suspended after abuse reports.",
+	"busy":               "The tunnel is busy, retry later.",
+	"timeout":            "Timed out reaching the tunnel.",
+	"unreachable":        "Could not reach the tunnel.",
+	"path_down":          "The tunnel serving this path is down.",
+}
+
+const defaultUsage = "Usage: ssh {{.Domain}} -R 1:localhost:3000 -R 2:192.168.0.1:80 …"
+
+type brandingData struct {
+	// Name is that of the service, the domain unless set.
+	Name, Domain, DocsURL string
+}
+
+// Branding is what users read of the service; see ParseBranding. A nil *Branding reads as srv.us.
+type Branding struct {
+	Name    string
+	DocsURL string
+	// Banner and MOTD stand in for Config.Banner and Config.MOTD if they are nil.
+	Banner, MOTD *template.Template
+
+	usage *template.Template
+	pages map[string]*template.Template
+}
+
+type brandingDocument struct {
+	Name    string            `yaml:"name"`
+	DocsURL string            `yaml:"docs_url"`
+	Usage   string            `yaml:"usage"`
+	Banner  string            `yaml:"banner"`
+	MOTD    string            `yaml:"motd"`
+	Pages   map[string]string `yaml:"pages"`
+}
+
+var defaultBranding = mustParseBranding(brandingDocument{})
+
+// ParseBranding reads a branding bundle, checking its templates render.
+func ParseBranding(raw []byte) (*Branding, error) {
+	var doc brandingDocument
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return parseBranding(doc)
+}
+
+func mustParseBranding(doc brandingDocument) *Branding {
+	b, err := parseBranding(doc)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func parseBranding(doc brandingDocument) (*Branding, error) {
+	b := &Branding{Name: doc.Name, DocsURL: doc.DocsURL, pages: map[string]*template.Template{}}
+	if b.DocsURL == "" {
+		b.DocsURL = defaultDocsURL
+	}
+	var err error
+	if doc.Usage == "" {
+		doc.Usage = defaultUsage
+	}
+	if b.usage, err = parseBrandingText("usage", doc.Usage); err != nil {
+		return nil, err
+	}
+	for name := range doc.Pages {
+		if _, found := defaultPages[name]; !found {
+			return nil, fmt.Errorf("unknown page %q", name)
+		}
+	}
+	for name, text := range defaultPages {
+		if custom := doc.Pages[name]; custom != "" {
+			text = custom
+		}
+		if b.pages[name], err = parseBrandingText(name, text); err != nil {
+			return nil, err
+		}
+	}
+	for _, greeting := range []struct {
+		text string
+		t    **template.Template
+	}{{doc.Banner, &b.Banner}, {doc.MOTD, &b.MOTD}} {
+		if greeting.text == "" {
+			continue
+		}
+		if *greeting.t, err = ParseGreeting(greeting.text); err != nil {
+			return nil, err
+		}
+		if err := (*greeting.t).Execute(&strings.Builder{}, greetingData{}); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func parseBrandingText(name, text string) (*template.Template, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Execute(&strings.Builder{}, brandingData{}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (b *Branding) orDefault() *Branding {
+	if b == nil {
+		return defaultBranding
+	}
+	return b
+}
+
+// serviceName is that of the service, for greetings and branding texts.
+func (s *Server) serviceName() string {
+	if name := s.cfg.Branding.orDefault().Name; name != "" {
+		return name
+	}
+	return s.cfg.Domain
+}
+
+func (s *Server) docsURL() string {
+	return s.cfg.Branding.orDefault().DocsURL
+}
+
+func (s *Server) brandingText(t *template.Template) string {
+	var text strings.Builder
+	if err := t.Execute(&text, brandingData{Name: s.serviceName(), Domain: s.cfg.Domain, DocsURL: s.docsURL()}); err != nil {
+		log.Printf("Could not render %s (%v)", t.Name(), err)
+	}
+	return strings.TrimSpace(text.String())
+}
+
+// page is the body of an error page visitors get.
+func (s *Server) page(name string) string {
+	return s.brandingText(s.cfg.Branding.orDefault().pages[name])
+}
+
+// usage is shown to sessions opened without forwards.
+func (s *Server) usage() string {
+	return s.brandingText(s.cfg.Branding.orDefault().usage)
+}
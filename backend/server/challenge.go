@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/settings"
+	"html/template"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Owners setting a challenge on a tunnel make browsers solve a proof of work before their requests are forwarded.
+// The page served instead of the tunnel hashes a nonce we signed until it finds enough leading zero bits,
+// stores the solution in a cookie and reloads; we then trade it for a signed pass, valid for passValidity.
+
+const (
+	passCookie     = "srvus-pass"
+	solutionCookie = "srvus-pow"
+	passValidity   = 24 * time.Hour
+	// nonceValidity is how long visitors have to solve a challenge.
+	nonceValidity = 10 * time.Minute
+	// challengeSecretKey is where the secret signing nonces and passes is kept, so restarts do not invalidate them.
+	challengeSecretKey = "challenge-secret"
+)
+
+var challengePage = template.Must(template.New("challenge").Parse(`<!DOCTYPE html>
+<html lang="en"><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex"><title>Checking your browser…</title>
+<style>body{font-family:sans-serif;max-width:40em;margin:2em auto;padding:0 1em}</style></head>
+<body><h1>Checking your browser…</h1>
+<p>This site gets too many automated visits, so your browser has to do a little work first. It takes a few seconds.</p>
+<noscript><p><strong>Enable JavaScript to continue.</strong></p></noscript>
+<script>
+const nonce = "{{.Nonce}}", bits = {{.Bits}}, encoder = new TextEncoder();
+function solves(digest) {
+  let left = bits;
+  for (const b of new Uint8Array(digest)) {
+    if (left <= 0) return true;
+    if (left < 8) return (b >> (8 - left)) === 0;
+    if (b !== 0) return false;
+    left -= 8;
+  }
+  return left <= 0;
+}
+(async () => {
+  for (let i = 0; ; i++) {
+    if (solves(await crypto.subtle.digest("SHA-256", encoder.encode(nonce + ":" + i)))) {
+      document.cookie = "{{.Cookie}}=" + nonce + ":" + i + "; path=/; secure; samesite=lax";
+      location.reload();
+      return;
+    }
+  }
+})();
+</script>
+</body></html>
+`))
+
+type challengePageData struct {
+	Nonce, Cookie string
+	Bits          int
+}
+
+// loadChallengeSecret reads the secret signing challenges, or stores the one we started with.
+func (s *Server) loadChallengeSecret(ctx context.Context) error {
+	raw, err := s.cfg.Store.Get(ctx, globalSettingsNamespace, challengeSecretKey)
+	if err != nil {
+		return err
+	}
+	if raw != nil {
+		s.challengeSecret = raw
+		return nil
+	}
+	return s.cfg.Store.Put(ctx, globalSettingsNamespace, challengeSecretKey, s.challengeSecret)
+}
+
+func newChallengeSecret() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+// sign returns <time>.<signature of what, name and time>, valid in cookies.
+func (s *Server) sign(what, name string, t time.Time) string {
+	stamp := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, s.challengeSecret)
+	_, _ = fmt.Fprintf(mac, "%s\x00%s\x00%s", what, name, stamp)
+	return stamp + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// signed returns the time of a value made by sign, or false if it was not.
+func (s *Server) signed(value, what, name string) (time.Time, bool) {
+	stamp, _, _ := strings.Cut(value, ".")
+	unix, err := strconv.ParseInt(stamp, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	t := time.Unix(unix, 0)
+	return t, hmac.Equal([]byte(value), []byte(s.sign(what, name, t)))
+}
+
+// challenged answers a browser that did not prove its work yet with the challenge, returning false;
+// those that did have our cookies removed from their request, and get a pass if they just solved it.
+func (s *Server) challenged(w http.ResponseWriter, r *http.Request, name string, c *settings.Challenge) bool {
+	if cookie, err := r.Cookie(passCookie); err == nil {
+		if expiry, ok := s.signed(cookie.Value, "pass", name); ok && time.Now().Before(expiry) {
+			dropCookies(r, passCookie, solutionCookie)
+			return true
+		}
+	}
+	if cookie, err := r.Cookie(solutionCookie); err == nil && s.solves(cookie.Value, name, c.Bits()) {
+		expiry := time.Now().Add(passValidity)
+		http.SetCookie(w, &http.Cookie{Name: passCookie, Value: s.sign("pass", name, expiry), Path: "/", Expires: expiry, Secure: true, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+		http.SetCookie(w, &http.Cookie{Name: solutionCookie, Path: "/", MaxAge: -1, Secure: true})
+		dropCookies(r, passCookie, solutionCookie)
+		return true
+	}
+
+	httpRulesRefused.Inc("challenge")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	_ = challengePage.Execute(w, challengePageData{Nonce: s.sign("nonce", name, time.Now()), Cookie: solutionCookie, Bits: c.Bits()})
+	return false
+}
+
+// solves checks a <nonce>:<counter> solution: we signed the nonce recently, and its hash has enough leading zero bits.
+func (s *Server) solves(solution, name string, difficulty int) bool {
+	nonce, _, found := strings.Cut(solution, ":")
+	if !found {
+		return false
+	}
+	issued, ok := s.signed(nonce, "nonce", name)
+	if !ok || time.Since(issued) > nonceValidity {
+		return false
+	}
+	sum := sha256.Sum256([]byte(solution))
+	zeros := 0
+	for _, b := range sum {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return zeros >= difficulty
+}
+
+// dropCookies removes cookies of ours from a request, so the service never sees them.
+func dropCookies(r *http.Request, names ...string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		drop := false
+		for _, name := range names {
+			drop = drop || c.Name == name
+		}
+		if !drop {
+			r.AddCookie(c)
+		}
+	}
+}
+
+func runChallenge(s *Server, c *commandContext, args []string) error {
+	if len(args) < 2 || len(args) > 3 || (args[1] != "on" && args[1] != "off") || (args[1] == "off" && len(args) == 3) {
+		return errUsage
+	}
+	port, err := parsePort(args[0])
+	if err != nil {
+		return err
+	}
+	challenge := &settings.Challenge{}
+	if len(args) == 3 {
+		if challenge.Difficulty, err = strconv.Atoi(args[2]); err != nil || challenge.Difficulty <= 0 || challenge.Difficulty > settings.MaxDifficulty {
+			return fmt.Errorf("difficulty must be between 1 and %d", settings.MaxDifficulty)
+		}
+	}
+
+	st, err := s.updateSettings(c.ctx, c.keyID, port, func(st *settings.Endpoint) error {
+		if st.HTTP == nil {
+			st.HTTP = &settings.HTTP{}
+		}
+		st.HTTP.Challenge = nil
+		if args[1] == "on" {
+			st.HTTP.Challenge = challenge
+		}
+		if st.HTTP.Empty() {
+			st.HTTP = nil
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.cfg.Audit.Record("challenge_changed", logs.Fields{"key": c.keyID, "port": port, "enabled": args[1] == "on"})
+	c.printf("%d: %s", port, st.HTTP)
+	return nil
+}
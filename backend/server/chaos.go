@@ -0,0 +1,58 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// Chaos degrades proxying on purpose, so tunnel owners and maintainers can see how applications
+// and reconnection logic behave over a bad link. It is meant for development servers only, e.g.
+// `make run RUNFLAGS="-chaos-latency 300ms -chaos-reset-rate 0.001"`.
+type Chaos struct {
+	// Every proxied read is delayed by a random duration up to Latency.
+	Latency time.Duration
+	// Share of visitor connections failing as if the tunnel could not be reached.
+	OpenFailureRate float64
+	// Probability for every proxied read to reset the connection.
+	ResetRate float64
+}
+
+var errChaosReset = errors.New("reset by chaos mode")
+
+func (c Chaos) Enabled() bool {
+	return c.Latency > 0 || c.OpenFailureRate > 0 || c.ResetRate > 0
+}
+
+func (c Chaos) Log() {
+	if c.Enabled() {
+		log.Printf("Chaos mode enabled (latency up to %s, open failure rate %g, reset rate %g), do not use in production",
+			c.Latency, c.OpenFailureRate, c.ResetRate)
+	}
+}
+
+// openFails decides whether to pretend a tunnel could not be reached.
+func (c Chaos) openFails() bool {
+	return c.OpenFailureRate > 0 && rand.Float64() < c.OpenFailureRate
+}
+
+// read is called by pump for every read; it may delay forwarding, or return errChaosReset to abort the connection.
+func (c Chaos) read() error {
+	if c.Latency > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(c.Latency))))
+	}
+	if c.ResetRate > 0 && rand.Float64() < c.ResetRate {
+		return errChaosReset
+	}
+	return nil
+}
+
+// resetConnection aborts a visitor connection with a TCP reset rather than an orderly close.
+func resetConnection(raw net.Conn) {
+	if tcp, ok := raw.(*net.TCPConn); ok {
+		_ = tcp.SetLinger(0)
+	}
+	_ = raw.Close()
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Anyone reaching a connection, e.g. through the socket of an SSH ControlMaster, runs commands as its key.
+// With -confirm-with-agent, sensitive commands, those losing data or handing out access, also need the session
+// running them to forward an agent (ssh -A) that signs a fresh challenge with that key, proving it is still at hand.
+
+// agentChannel is what OpenSSH opens to reach the agent of a session that asked for it (auth-agent-req@openssh.com).
+const agentChannel = "auth-agent@openssh.com"
+
+var errNoAgent = errors.New("no agent forwarded")
+
+// confirmWithAgent asks the agent forwarded to a session for a signature of a fresh challenge with the key of its connection.
+func (s *Server) confirmWithAgent(c *commandContext, line string) error {
+	key, err := ssh.ParsePublicKey([]byte(c.conn.Permissions.Extensions["key"]))
+	if err != nil {
+		return err
+	}
+	return withAgent(c, func(a agent.Agent) error {
+		return s.signChallenge(a, key, line)
+	})
+}
+
+// withAgent runs use with the agent forwarded to a session, giving up once the command does.
+func withAgent(c *commandContext, use func(agent.Agent) error) error {
+	if !c.agent {
+		return errNoAgent
+	}
+	ch, reqs, err := c.conn.OpenChannel(agentChannel, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = ch.Close()
+	}()
+	go ssh.DiscardRequests(reqs)
+	used := make(chan error, 1)
+	go func() {
+		used <- use(agent.NewClient(ch))
+	}()
+	select {
+	case err := <-used:
+		return err
+	case <-c.ctx.Done():
+		return c.ctx.Err()
+	}
+}
+
+// signChallenge has an agent sign a fresh challenge naming line with key, and checks the signature.
+func (s *Server) signChallenge(a agent.Agent, key ssh.PublicKey, line string) error {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	challenge := append([]byte(fmt.Sprintf("%s confirms %q with nonce ", s.cfg.Domain, line)), nonce...)
+	sig, err := a.Sign(key, challenge)
+	if err != nil {
+		return err
+	}
+	return key.Verify(challenge, sig)
+}
+
+// confirm runs confirmWithAgent for sensitive commands when it is required, telling why it failed.
+func (s *Server) confirm(cmd *command, c *commandContext, args []string, line string) bool {
+	if !s.cfg.ConfirmWithAgent || cmd.sensitive == nil || !cmd.sensitive(args) {
+		return true
+	}
+	err := s.confirmWithAgent(c, line)
+	if err == nil {
+		return true
+	}
+	s.cfg.Audit.Record("confirmation_failed", logs.Fields{"remote": c.conn.RemoteAddr().String(), "key": c.keyID, "command": line, "error": err.Error()})
+	if errors.Is(err, errNoAgent) {
+		c.printf("This command needs your key at hand: run it again with ssh -A, forwarding the agent holding it.")
+	} else {
+		c.printf("Your agent did not confirm this command with your key (%v).", err)
+	}
+	return false
+}
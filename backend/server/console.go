@@ -0,0 +1,364 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/geoip"
+	"github.com/pcarrier/srv.us/backend/identity"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/registry"
+	"github.com/pcarrier/srv.us/backend/settings"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commandContext is what a console command knows about who runs it.
+type commandContext struct {
+	ctx   context.Context
+	keyID string
+	conn  *ssh.ServerConn
+	in    io.Reader
+	out   io.Writer
+	// agent tells whether the session forwarded an agent (ssh -A).
+	agent bool
+}
+
+func (c *commandContext) printf(format string, args ...any) {
+	_, _ = fmt.Fprintf(c.out, format+"\n", args...)
+}
+
+type command struct {
+	usage string
+	help  string
+	// lasting commands run until they return or the connection ends, instead of giving up after 10 seconds.
+	lasting bool
+	// sensitive tells whether arguments make the command lose data or hand out access, see confirm.go.
+	sensitive func(args []string) bool
+	run       func(s *Server, c *commandContext, args []string) error
+}
+
+var errUsage = errors.New("usage")
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"help": {
+			usage: "help",
+			help:  "List available commands",
+			run:   runHelp,
+		},
+		"rotate": {
+			usage:     "rotate <port>",
+			help:      "Give a tunnel a new hashed URL; the previous one stops working",
+			sensitive: func([]string) bool { return true },
+			run:       runRotate,
+		},
+		"geo": {
+			usage: "geo [list <port> | allow <port> <rule>… | block <port> <rule>… | clear <port>]",
+			help:  "Restrict visitors of a tunnel by country code (FR) or AS number (AS13335)",
+			run:   runGeo,
+		},
+		"pause": {
+			usage: "pause <port> [message…]",
+			help:  "Serve a maintenance page instead of a tunnel, until resumed",
+			run:   runPause,
+		},
+		"resume": {
+			usage: "resume <port>",
+			help:  "Let visitors reach a paused tunnel again",
+			run:   runResume,
+		},
+		"split": {
+			usage: "split <port> [<tag>=<weight>… | clear]",
+			help:  "Weigh the traffic of a tunnel between connections tagged as user+tag=<tag>@ (untagged ones are default)",
+			run:   runSplit,
+		},
+		"route": {
+			usage: "route <port> [<prefix>=<port>… | clear]",
+			help:  "Serve path prefixes of a tunnel from your other tunnels, e.g. route 1 /api=2 sends /api and below to tunnel 2",
+			run:   runRoute,
+		},
+		"host": {
+			usage: "host <port> [public | local | <host>[:<port>]]",
+			help:  "Choose the Host header your service gets: the public name (default), localhost, or another",
+			run:   runHost,
+		},
+		"timeouts": {
+			usage: "timeouts <port> [connect=<duration>] [header=<duration>] [request=<duration>] [retries=<n>] [backoff=<duration>] | clear",
+			help:  "Bound how long visitors wait on a tunnel, and retry channels to it that fail, e.g. timeouts 1 connect=5s retries=2",
+			run:   runTimeouts,
+		},
+		"challenge": {
+			usage: "challenge <port> [on [<difficulty>] | off]",
+			help:  "Make browsers solve a proof of work before reaching a tunnel, to slow bots down",
+			run:   runChallenge,
+		},
+		"urls": {
+			usage: "urls",
+			help:  "List the URLs of your tunnels, e.g. for connections made with ssh -N that get no announcements",
+			run:   runURLs,
+		},
+		"stats": {
+			usage: "stats",
+			help:  "Show how long your connections and tunnels have been up, and their latencies: keepalives, and channels to your services",
+			run:   runStats,
+		},
+		"webhook": {
+			usage: "webhook [<url> | off]",
+			help:  "Show, set or remove the URL notified when your tunnels go up, down, or get their first request",
+			run:   runWebhook,
+		},
+		"preview": {
+			usage:   "preview <ttl> [<label>=<value>…]",
+			help:    "For CI: print the tunnels of this connection as JSON, then disconnect after ttl, e.g. preview 2h branch=main pr=42",
+			lasting: true,
+			run:     runPreview,
+		},
+		"indexing": {
+			usage: "indexing <port> [on | off]",
+			help:  "Let search engines index the hashed URL of a tunnel, or keep them away (the default)",
+			run:   runIndexing,
+		},
+		"token": {
+			usage: "token [list | new [<name>] | revoke <id>]",
+			help:  "Mint tokens for dashboards and bots to list, tune and close your tunnels through the REST API at /api/",
+			sensitive: func(args []string) bool {
+				return len(args) > 0 && (args[0] == "new" || args[0] == "revoke")
+			},
+			run: runToken,
+		},
+		"apply": {
+			usage:     "apply -",
+			help:      "Replace the options of all your tunnels with a YAML document read from stdin",
+			sensitive: func([]string) bool { return true },
+			run:       runApply,
+		},
+		"share": {
+			usage: "share [list | new <port> <ttl> [<hits>] | revoke <url>]",
+			help:  "Mint links to a tunnel that stop working after a while, or a number of hits, to share a demo without its URL",
+			sensitive: func(args []string) bool {
+				return len(args) > 0 && args[0] == "new"
+			},
+			run: runShare,
+		},
+		"transfer": {
+			usage:     "transfer --to <fingerprint>",
+			help:      "Hand your reservations, plan and usage to a new key held by your forwarded agent (ssh -A), e.g. once this one leaked",
+			sensitive: func([]string) bool { return true },
+			run:       runTransfer,
+		},
+	}
+}
+
+// runCommand executes a console command sent with `ssh srv.us <command> <args…>` and returns its exit status.
+// Commands give up after 10 seconds unless they are lasting, or once ctx ends.
+func (s *Server) runCommand(ctx context.Context, keyID string, conn *ssh.ServerConn, line string, in io.Reader, out io.Writer, agent bool) byte {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		args = []string{"help"}
+	}
+	cmd, found := commands[args[0]]
+	c := &commandContext{keyID: keyID, conn: conn, in: in, out: out, agent: agent}
+	if !found {
+		c.printf("Unknown command %s, try `ssh %s help`.", args[0], s.cfg.Domain)
+		return 1
+	}
+
+	if !cmd.lasting {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+	}
+	c.ctx = ctx
+
+	if !s.confirm(cmd, c, args[1:], line) {
+		return 1
+	}
+	if err := cmd.run(s, c, args[1:]); err != nil {
+		if errors.Is(err, errUsage) {
+			c.printf("Usage: ssh %s %s", s.cfg.Domain, cmd.usage)
+		} else {
+			c.printf("Error: %v", err)
+		}
+		return 1
+	}
+	return 0
+}
+
+func runHelp(s *Server, c *commandContext, _ []string) error {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c.printf("ssh %s %s\n    %s", s.cfg.Domain, commands[name].usage, commands[name].help)
+	}
+	return nil
+}
+
+func parsePort(s string) (uint32, error) {
+	port, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return uint32(port), nil
+}
+
+func runGeo(s *Server, c *commandContext, args []string) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	if s.cfg.GeoIP == nil {
+		return errors.New("GeoIP is not enabled on this server")
+	}
+	port, err := parsePort(args[1])
+	if err != nil {
+		return err
+	}
+
+	var change func(*geoip.Rules) error
+	switch args[0] {
+	case "list":
+		st, err := settings.Load(c.ctx, s.cfg.Store, c.keyID, port)
+		if err != nil {
+			return err
+		}
+		c.printf("%d: %s", port, st.Geo)
+		return nil
+	case "allow", "block":
+		if len(args) < 3 {
+			return errUsage
+		}
+		rules, err := geoip.ParseRules(args[2:])
+		if err != nil {
+			return err
+		}
+		if err := s.cfg.GeoIP.Check(&geoip.Rules{Allow: rules}); err != nil {
+			return err
+		}
+		change = func(r *geoip.Rules) error {
+			if args[0] == "allow" {
+				r.Allow = appendMissing(r.Allow, rules...)
+			} else {
+				r.Block = appendMissing(r.Block, rules...)
+			}
+			return nil
+		}
+	case "clear":
+		change = func(r *geoip.Rules) error {
+			*r = geoip.Rules{}
+			return nil
+		}
+	default:
+		return errUsage
+	}
+
+	st, err := s.updateSettings(c.ctx, c.keyID, port, func(st *settings.Endpoint) error {
+		if st.Geo == nil {
+			st.Geo = &geoip.Rules{}
+		}
+		if err := change(st.Geo); err != nil {
+			return err
+		}
+		if st.Geo.Empty() {
+			st.Geo = nil
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.cfg.Audit.Record("geo_rules_changed", logs.Fields{"key": c.keyID, "port": port, "rules": st.Geo})
+	c.printf("%d: %s", port, st.Geo)
+	return nil
+}
+
+func appendMissing(list []string, items ...string) []string {
+	for _, item := range items {
+		found := false
+		for _, existing := range list {
+			if existing == item {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// crlfWriter turns \n into \r\n, for sessions with a pseudo-terminal.
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (c crlfWriter) Write(p []byte) (int, error) {
+	if _, err := c.w.Write(bytes.ReplaceAll(p, []byte("\n"), []byte("\r\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func runRotate(s *Server, c *commandContext, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	port, err := parsePort(args[0])
+	if err != nil {
+		return err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(c.keyID)
+	if err != nil {
+		return err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	var previous string
+	if _, err := s.updateSettings(c.ctx, c.keyID, port, func(st *settings.Endpoint) error {
+		previous = identity.HashedEndpoint(s.cfg.Domain, key, port, st.Salt)
+		st.Salt = identity.Base32.EncodeToString(salt)
+		return nil
+	}); err != nil {
+		return err
+	}
+	next := identity.HashedEndpoint(s.cfg.Domain, key, port, identity.Base32.EncodeToString(salt))
+
+	s.registry.Lock()
+	var moved []*registry.Target
+	for t := range s.registry.Endpoints[previous] {
+		if t.KeyID == c.keyID && t.Port == port {
+			moved = append(moved, t)
+		}
+	}
+	for _, t := range moved {
+		s.registry.Remove(previous, t)
+		s.registry.Insert(next, t)
+	}
+	s.registry.Unlock()
+
+	notified := map[*ssh.ServerConn]bool{}
+	for _, t := range moved {
+		if !notified[t.Remote] {
+			notified[t.Remote] = true
+			s.notify(t.Remote, fmt.Sprintf("%d: rotated, now https://%s/", port, next))
+		}
+	}
+	s.cfg.Audit.Record("endpoint_rotated", logs.Fields{"key": c.keyID, "port": port, "previous": previous, "endpoint": next})
+	c.printf("%d: https://%s/ replaces https://%s/", port, next, previous)
+	return nil
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/identity"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/settings"
+	"github.com/pcarrier/srv.us/backend/wire"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"log"
+	"time"
+)
+
+// Official clients manage their tunnels over the srvus subsystem of a session (ssh -s srv.us srvus) instead of
+// parsing lines: both ends write frames, each a JSON object after its length as a 4-byte big-endian integer.
+// Clients send requests such as {"id": 1, "op": "register", "port": 1, "options": {"tag": "canary"}};
+// we answer each with a frame of the same id holding its "result" or "error", and send events, framed without id,
+// as {"event": "message", "result": …} for what other sessions get as lines, and {"event": "stats", "result": …}.
+//
+//	hello                  the protocol version, domain, key fingerprint and plan
+//	register  port options options for the forwards of port the connection requests next, in place of the login's
+//	tunnels                the tunnels of the connection, as listed by the API
+//	stats                  what `ssh srv.us stats` shows, as the API does
+//	watch     interval     streams stats every interval seconds, until unwatch
+//	unwatch
+//	options   port         the edge options of a tunnel, as settings.HTTP
+//	set_options port http  replaces them
+//	close     port         stops serving a tunnel of the connection
+//
+// Plain -R keeps working as it did; only sessions asking for the subsystem speak it.
+
+const (
+	controlSubsystem = "srvus"
+	controlVersion   = 1
+	// maxControlFrame bounds what a frame holds, in bytes.
+	maxControlFrame = 1 << 16
+	// defaultWatchInterval is how often stats stream when watch names no interval.
+	defaultWatchInterval = 5 * time.Second
+)
+
+// forwardOptionNames are the options of the login that register takes, those applying to forwards.
+var forwardOptionNames = map[string]bool{"drain": true, "http": true, "noprobe": true, "shadow": true, "tag": true, "takeover": true}
+
+type controlRequest struct {
+	ID   uint64 `json:"id"`
+	Op   string `json:"op"`
+	Port uint32 `json:"port,omitempty"`
+	// Options are those register takes, written as in the login: {"http": "", "tag": "canary"}.
+	Options identity.Options `json:"options,omitempty"`
+	// HTTP are the edge options set_options sets.
+	HTTP *settings.HTTP `json:"http,omitempty"`
+	// Interval is how often watch streams stats, in seconds.
+	Interval int `json:"interval,omitempty"`
+}
+
+// controlFrame is what we send: the answer to the request of ID, or an event.
+type controlFrame struct {
+	ID     uint64 `json:"id,omitempty"`
+	Event  string `json:"event,omitempty"`
+	Result any    `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// control is a session speaking the subsystem.
+type control struct {
+	s     *Server
+	conn  *ssh.ServerConn
+	ch    ssh.Channel
+	keyID string
+	// frames are written in order by run; events are dropped when it falls behind by sessionBacklog.
+	frames chan controlFrame
+	// unwatch stops the stats stream, nil while none runs.
+	unwatch context.CancelFunc
+}
+
+func newControl(s *Server, conn *ssh.ServerConn, ch ssh.Channel, keyID string) *control {
+	return &control{s: s, conn: conn, ch: ch, keyID: keyID, frames: make(chan controlFrame, sessionBacklog)}
+}
+
+// event sends an event unless the session fell behind.
+func (c *control) event(name string, result any) {
+	select {
+	case c.frames <- controlFrame{Event: name, Result: result}:
+	default:
+		messagesDropped.Inc("stalled")
+	}
+}
+
+func writeControlFrame(w io.Writer, f controlFrame) error {
+	body, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	frame := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(body)), uint32(len(body)))
+	_, err = w.Write(append(frame, body...))
+	return err
+}
+
+func readControlFrame(r io.Reader, req *controlRequest) error {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxControlFrame {
+		return fmt.Errorf("frame of %d bytes, at most %d", n, maxControlFrame)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+	*req = controlRequest{}
+	return json.Unmarshal(body, req)
+}
+
+// run answers requests until the session or the connection ends.
+func (c *control) run(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case f := <-c.frames:
+				if err := writeControlFrame(c.ch, f); err != nil {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		var req controlRequest
+		if err := readControlFrame(c.ch, &req); err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("%s(%s) sent an invalid control frame (%v)", c.conn.RemoteAddr(), c.keyID, err)
+			}
+			return
+		}
+		result, err := c.handle(ctx, &req)
+		f := controlFrame{ID: req.ID, Result: result}
+		if err != nil {
+			f.Error = err.Error()
+		}
+		select {
+		case c.frames <- f:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *control) handle(ctx context.Context, req *controlRequest) (any, error) {
+	switch req.Op {
+	case "hello", "tunnels", "stats", "options", "watch", "unwatch":
+	default:
+		c.s.cfg.Audit.Record("control_action", logs.Fields{"remote": c.conn.RemoteAddr().String(), "key": c.keyID, "op": req.Op, "port": req.Port})
+	}
+
+	switch req.Op {
+	case "hello":
+		plan, _ := c.s.planOf(c.keyID)
+		return map[string]any{"version": controlVersion, "domain": c.s.cfg.Domain, "key": fingerprintOf(c.keyID), "plan": plan}, nil
+	case "register":
+		if err := validControlPort(req.Port); err != nil {
+			return nil, err
+		}
+		for name := range req.Options {
+			if !forwardOptionNames[name] {
+				return nil, fmt.Errorf("unknown option %q for forwards", name)
+			}
+		}
+		opts := req.Options
+		if opts == nil {
+			opts = identity.Options{}
+		}
+		c.s.stateOf(c.conn).registered.Store(req.Port, opts)
+		return nil, nil
+	case "tunnels":
+		tunnels := []APITunnel{}
+		for _, m := range c.s.tunnelMessages(c.conn) {
+			tunnels = append(tunnels, APITunnel{Port: m.Port, URLs: m.URLs, Remote: c.conn.RemoteAddr().String(), Connected: c.s.stateOf(c.conn).since})
+		}
+		return tunnels, nil
+	case "stats":
+		return c.s.statsOf(c.keyID), nil
+	case "watch":
+		interval := defaultWatchInterval
+		if req.Interval < 0 {
+			return nil, fmt.Errorf("invalid interval %d, expected a number of seconds", req.Interval)
+		} else if req.Interval > 0 {
+			interval = time.Duration(req.Interval) * time.Second
+		}
+		if c.unwatch != nil {
+			c.unwatch()
+		}
+		var watching context.Context
+		watching, c.unwatch = context.WithCancel(ctx)
+		go every(watching, interval, func() {
+			c.event("stats", c.s.statsOf(c.keyID))
+		})
+		return nil, nil
+	case "unwatch":
+		if c.unwatch != nil {
+			c.unwatch()
+			c.unwatch = nil
+		}
+		return nil, nil
+	case "options":
+		if err := validControlPort(req.Port); err != nil {
+			return nil, err
+		}
+		st, err := settings.Load(ctx, c.s.cfg.Store, c.keyID, req.Port)
+		if err != nil {
+			return nil, err
+		}
+		if st.HTTP == nil {
+			return &settings.HTTP{}, nil
+		}
+		return st.HTTP, nil
+	case "set_options":
+		if err := validControlPort(req.Port); err != nil {
+			return nil, err
+		}
+		rules := req.HTTP
+		if rules == nil {
+			rules = &settings.HTTP{}
+		}
+		if err := rules.Validate(); err != nil {
+			return nil, err
+		}
+		if err := c.s.setEdgeOptions(ctx, c.keyID, req.Port, rules); err != nil {
+			return nil, err
+		}
+		return rules, nil
+	case "close":
+		endpoints := c.s.closeTunnel(c.conn, c.keyID, req.Port, "by your client")
+		if len(endpoints) == 0 {
+			return nil, fmt.Errorf("no tunnel up on port %d", req.Port)
+		}
+		return map[string][]string{"urls": urlsOf(endpoints)}, nil
+	default:
+		return nil, fmt.Errorf("unknown op %q", req.Op)
+	}
+}
+
+func validControlPort(port uint32) error {
+	if port == 0 || port > wire.MaxBindPort {
+		return fmt.Errorf("invalid port %d, expected 1 to %d", port, wire.MaxBindPort)
+	}
+	return nil
+}
+
+// forwardOptions returns the options of the forward of a port: those a control session registered for it,
+// or else those of the login.
+func (st *connState) forwardOptions(port uint32, login identity.Options) identity.Options {
+	if opts, found := st.registered.Load(port); found {
+		return opts.(identity.Options)
+	}
+	return login
+}
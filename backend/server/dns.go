@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/nameserver"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Operators running the built-in name server manage the records it serves beyond endpoints, such as
+// verification TXTs or the addresses of other nodes, through the admin API; they survive restarts in the store.
+
+const (
+	dnsNamespace  = "dns"
+	maxDNSRecords = 64
+)
+
+// serves reports whether a name is an endpoint with a target serving visitors, for the name server to resolve it.
+func (s *Server) serves(name string) bool {
+	return len(s.registry.Candidates(name)) > 0
+}
+
+func (s *Server) loadDNSRecords(ctx context.Context) error {
+	if s.cfg.DNS == nil {
+		return nil
+	}
+	s.cfg.DNS.Serves = s.serves
+	stored, err := s.cfg.Store.List(ctx, dnsNamespace)
+	if err != nil {
+		return err
+	}
+	for name, raw := range stored {
+		var records []nameserver.Record
+		if err := json.Unmarshal(raw, &records); err != nil {
+			return fmt.Errorf("records of %s: %w", name, err)
+		}
+		s.cfg.DNS.SetRecords(name, records)
+	}
+	return nil
+}
+
+// adminDNS lists the records set (GET), sets those of ?name=<name> (PUT, with a JSON array of records)
+// or removes them (DELETE).
+func (s *Server) adminDNS(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.DNS == nil {
+		writeJSONError(w, http.StatusConflict, errors.New("the name server is not enabled"))
+		return
+	}
+	name := strings.ToLower(strings.TrimSuffix(r.URL.Query().Get("name"), "."))
+	if r.Method != http.MethodGet && name != s.cfg.Domain && !strings.HasSuffix(name, "."+s.cfg.Domain) {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("name must be within %s", s.cfg.Domain))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var records []nameserver.Record
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&records); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		if len(records) > maxDNSRecords {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("at most %d records per name", maxDNSRecords))
+			return
+		}
+		for _, record := range records {
+			if err := record.Validate(); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		raw, err := json.Marshal(records)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if err := s.cfg.Store.Put(r.Context(), dnsNamespace, name, raw); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		s.cfg.DNS.SetRecords(name, records)
+		s.cfg.Audit.Record("dns_records_set", logs.Fields{"name": name, "records": records})
+	case http.MethodDelete:
+		if err := s.cfg.Store.Delete(r.Context(), dnsNamespace, name); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		s.cfg.DNS.SetRecords(name, nil)
+		s.cfg.Audit.Record("dns_records_removed", logs.Fields{"name": name})
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.cfg.DNS.Records())
+}
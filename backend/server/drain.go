@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/identity"
+	"github.com/pcarrier/srv.us/backend/registry"
+	"golang.org/x/crypto/ssh"
+	"log"
+	"time"
+)
+
+// Drain hands the tunnels over to a process that took over our listeners, once they are closed:
+// it waits up to timeout for the visitors in flight, then disconnects every client,
+// which reconnects to the new process.
+func (s *Server) Drain(ctx context.Context, timeout time.Duration) {
+	for _, conn := range s.registry.Connections() {
+		s.notify(conn, "The server is being upgraded, you will be disconnected once requests in flight complete.")
+	}
+
+	if !s.waitForVisitors(ctx, timeout) {
+		log.Printf("Still %d visitors after %s, disconnecting anyway", s.visitors.Load(), timeout)
+	}
+
+	conns := s.registry.Connections()
+	log.Printf("Drained, disconnecting %d clients", len(conns))
+	for _, conn := range conns {
+		s.closeConnection(conn)
+	}
+}
+
+// waitForVisitors reports whether every HTTPS connection ended before timeout and ctx.
+func (s *Server) waitForVisitors(ctx context.Context, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for s.visitors.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-deadline:
+			return false
+		case <-t.C:
+		}
+	}
+	return true
+}
+
+const (
+	// defaultDrainTimeout is how long user+drain@ waits for visitors of a cancelled forward.
+	defaultDrainTimeout = 30 * time.Second
+	maxDrainTimeout     = 5 * time.Minute
+)
+
+// drainTimeout returns how long to wait for visitors of cancelled forwards, as asked with user+drain[=10s]@,
+// or 0 to answer cancellations right away.
+func drainTimeout(opts identity.Options) time.Duration {
+	value, asked := opts["drain"]
+	if !asked {
+		return 0
+	}
+	wait, err := time.ParseDuration(value)
+	if err != nil || wait <= 0 {
+		return defaultDrainTimeout
+	}
+	if wait > maxDrainTimeout {
+		return maxDrainTimeout
+	}
+	return wait
+}
+
+// drainForward waits up to wait for the visitors of removed targets, no longer routed to, to be done,
+// telling the client how it went.
+func (s *Server) drainForward(ctx context.Context, conn *ssh.ServerConn, port uint32, removed []*registry.Target, wait time.Duration) {
+	inFlight := 0
+	for _, t := range removed {
+		inFlight += t.InFlight()
+	}
+	if inFlight == 0 {
+		s.notify(conn, fmt.Sprintf("%d: cancelled, no visitor was connected.", port))
+		return
+	}
+	s.notify(conn, fmt.Sprintf("%d: draining %d visitor connections or requests, for up to %s.", port, inFlight, wait))
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	for _, t := range removed {
+		select {
+		case <-t.Drain():
+		case <-ctx.Done():
+		}
+	}
+
+	left := 0
+	for _, t := range removed {
+		left += t.InFlight()
+	}
+	if left > 0 {
+		s.notify(conn, fmt.Sprintf("%d: %d still in flight after %s; they go on until they end.", port, left, wait))
+	} else {
+		s.notify(conn, fmt.Sprintf("%d: drained in %s.", port, time.Since(start).Round(time.Millisecond)))
+	}
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/registry"
+	"github.com/pcarrier/srv.us/backend/wire"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Some requests are answered at the edge instead of by the tunnel: robots.txt of unindexed endpoints,
+// the interstitial warning, and everything under /.srv.us/, such as the status of tunnels, which never reaches services
+// so its paths cannot collide with theirs. Tunnels proxied byte by byte only get their first request looked at,
+// but their connections are watched for requests under /.srv.us/, answered once the channel to the tunnel is closed.
+
+// firstRequestTimeout is how long we wait for a visitor to send a request we might answer,
+// before proxying its connection as is, e.g. for protocols where the server speaks first.
+const firstRequestTimeout = 5 * time.Second
+
+// edgePrefix is the namespace of the edge on every endpoint.
+const edgePrefix = "/.srv.us/"
+
+// edgePaths answer the requests under edgePrefix; others get a 404.
+var edgePaths = map[string]func(s *Server, r *http.Request, name string, tgt *registry.Target) *edgeAnswer{
+	statusPath: (*Server).answerStatus,
+}
+
+// edgePath returns the path of a request target under edgePrefix, as services would read it once decoded and cleaned.
+func edgePath(target string) (string, bool) {
+	p := target
+	if u, err := url.ParseRequestURI(target); err == nil {
+		p = u.Path
+	}
+	p = path.Clean("/" + p)
+	if lower := strings.ToLower(p); lower+"/" != edgePrefix && !strings.HasPrefix(lower, edgePrefix) {
+		return "", false
+	}
+	return p, true
+}
+
+// edgeAnswer is a response given by the edge instead of the tunnel.
+type edgeAnswer struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// answerAtEdge returns how the edge answers a request to name instead of the tunnel, or nil to proxy it.
+func (s *Server) answerAtEdge(r *http.Request, name string, tgt *registry.Target) *edgeAnswer {
+	if p, reserved := edgePath(r.RequestURI); reserved {
+		if answer := edgePaths[p]; answer != nil {
+			return answer(s, r, name, tgt)
+		}
+		return &edgeAnswer{status: http.StatusNotFound, header: http.Header{"Content-Type": {"text/plain; charset=utf-8"}}, body: []byte("Not found.\n")}
+	}
+	if s.unindexed(name, tgt) && r.URL.Path == "/robots.txt" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		return &edgeAnswer{status: http.StatusOK, header: http.Header{"Content-Type": {"text/plain; charset=utf-8"}}, body: []byte(denyAllRobots)}
+	}
+	if s.cfg.Interstitial && needsWarning(r) {
+		header, body, err := s.warning(r, name)
+		if err != nil {
+			log.Printf("Could not render the warning for %s (%v)", name, err)
+			return nil
+		}
+		return &edgeAnswer{status: http.StatusOK, header: header, body: body}
+	}
+	return nil
+}
+
+func (a *edgeAnswer) write(w http.ResponseWriter, r *http.Request) {
+	for k, v := range a.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(a.status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(a.body)
+	}
+}
+
+// answerFirstRequest answers the first request of a visitor proxied byte by byte if the edge has to, or rejects it if its
+// head exceeds wire.MaxRequestHead, returning true if so. Otherwise, it returns what the visitor sent and will send, to be proxied as is.
+func (s *Server) answerFirstRequest(https *tls.Conn, name string, tgt *registry.Target) (io.Reader, bool) {
+	// Only visitors we know speak HTTP get answers from the edge, so others do not wait for firstRequestTimeout.
+	if !s.cfg.Interstitial && https.ConnectionState().NegotiatedProtocol != "http/1.1" {
+		return https, false
+	}
+	var seen bytes.Buffer
+	replay := io.MultiReader(&seen, https)
+
+	// What is seen is held until the tunnel takes it, so no more than a head is read.
+	_ = https.SetReadDeadline(time.Now().Add(firstRequestTimeout))
+	r, err := http.ReadRequest(bufio.NewReader(io.TeeReader(io.LimitReader(https, wire.MaxRequestHead), &seen)))
+	_ = https.SetReadDeadline(time.Time{})
+	if err != nil && seen.Len() >= wire.MaxRequestHead {
+		tooLarge := &edgeAnswer{status: http.StatusRequestHeaderFieldsTooLarge, header: http.Header{"Content-Type": {"text/plain; charset=utf-8"}}, body: []byte("Request headers too large.\n")}
+		tooLarge.writeLast(https, &http.Request{Method: http.MethodGet})
+		return nil, true
+	}
+	if err != nil {
+		return replay, false
+	}
+	a := s.answerAtEdge(r, name, tgt)
+	if a == nil {
+		return replay, false
+	}
+	a.writeLast(https, r)
+	return nil, true
+}
+
+// writeLast writes the answer as the last response of a connection proxied byte by byte.
+func (a *edgeAnswer) writeLast(w io.Writer, r *http.Request) {
+	a.header.Set("Connection", "close")
+	var head strings.Builder
+	_ = a.header.Write(&head)
+	body := a.body
+	if r.Method == http.MethodHead {
+		body = nil
+	}
+	_, _ = fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n%sContent-Length: %d\r\n\r\n%s", a.status, http.StatusText(a.status), head.String(), len(a.body), body)
+}
+
+// answerWithheld answers a request under edgePrefix that a watcher kept from the tunnel, given its head.
+func (s *Server) answerWithheld(w io.Writer, head []byte, name string, tgt *registry.Target) {
+	r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil {
+		return
+	}
+	if a := s.answerAtEdge(r, name, tgt); a != nil {
+		a.writeLast(w, r)
+	}
+}
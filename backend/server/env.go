@@ -0,0 +1,37 @@
+package server
+
+// Sessions pass the options of how we talk to them as variables too, with ssh -o SetEnv=SRVUS_FORMAT=json or SendEnv,
+// so they stay out of the login and of ~/.ssh/config host aliases: SRVUS_FORMAT=json or text, SRVUS_VERBOSE=1 or 0,
+// and SRVUS_QR and SRVUS_TUI (qrcodes.go, tui.go). The format and verbosity are those of the connection, as with
+// user+json@ and user+verbose@, and change from the next message on. Options of tunnels stay in the login, as OpenSSH
+// asks for its forwards before its session sends variables.
+
+const (
+	formatEnv  = "SRVUS_FORMAT"
+	verboseEnv = "SRVUS_VERBOSE"
+)
+
+// enabled tells whether a variable turns its option on, as anything but empty or 0 does.
+func enabled(value string) bool {
+	return value != "" && value != "0"
+}
+
+// setEnv applies a variable a session sent to the options of its connection, reporting whether it is one we know.
+func (st *connState) setEnv(name, value string) bool {
+	switch name {
+	case formatEnv:
+		switch value {
+		case "json":
+			st.json.Store(true)
+		case "text":
+			st.json.Store(false)
+		default:
+			return false
+		}
+	case verboseEnv:
+		st.verbose.Store(enabled(value))
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"sort"
+	"strings"
+	"time"
+)
+
+const keyLimitsNamespace = "key-limits"
+
+// jsonDuration is a time.Duration written as "1h30m" in JSON.
+type jsonDuration time.Duration
+
+func (d jsonDuration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *jsonDuration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = jsonDuration(parsed)
+	return nil
+}
+
+// keyLimits are operator overrides for one key; unset fields fall back to the server-wide limits, 0 means unlimited.
+type keyLimits struct {
+	MaxConnection *jsonDuration `json:"max_connection,omitempty"`
+	MaxTunnel     *jsonDuration `json:"max_tunnel,omitempty"`
+}
+
+func (s *Server) loadKeyLimits(ctx context.Context, keyID string) (*keyLimits, error) {
+	limits := &keyLimits{}
+	raw, err := s.cfg.Store.Get(ctx, keyLimitsNamespace, keyID)
+	if err != nil || raw == nil {
+		return limits, err
+	}
+	if err := json.Unmarshal(raw, limits); err != nil {
+		return nil, err
+	}
+	return limits, nil
+}
+
+func (s *Server) storeKeyLimits(ctx context.Context, keyID string, limits *keyLimits) error {
+	if limits.MaxConnection == nil && limits.MaxTunnel == nil {
+		return s.cfg.Store.Delete(ctx, keyLimitsNamespace, keyID)
+	}
+	raw, err := json.Marshal(limits)
+	if err != nil {
+		return err
+	}
+	return s.cfg.Store.Put(ctx, keyLimitsNamespace, keyID, raw)
+}
+
+func (s *Server) connectionLifetime(l *keyLimits) time.Duration {
+	if l != nil && l.MaxConnection != nil {
+		return time.Duration(*l.MaxConnection)
+	}
+	return s.cfg.MaxConnectionDuration
+}
+
+func (s *Server) tunnelLifetime(l *keyLimits) time.Duration {
+	if l != nil && l.MaxTunnel != nil {
+		return time.Duration(*l.MaxTunnel)
+	}
+	return s.cfg.MaxTunnelDuration
+}
+
+// ParseWarnings reads a comma-separated list of durations, returned longest first.
+func ParseWarnings(s string) ([]time.Duration, error) {
+	var result []time.Duration
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		d, err := time.ParseDuration(part)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, d)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] > result[j] })
+	return result, nil
+}
+
+// expireAfter calls expire once lifetime has elapsed, warning the connection's sessions beforehand,
+// unless ctx ends first. what names what expires, e.g. "1" for tunnel 1.
+func (s *Server) expireAfter(ctx context.Context, conn *ssh.ServerConn, what string, lifetime time.Duration, expire func()) {
+	deadline := time.Now().Add(lifetime)
+	for _, warning := range s.cfg.ExpiryWarnings {
+		if warning >= lifetime {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(deadline.Add(-warning))):
+			s.notify(conn, fmt.Sprintf("%s: expires in %s.", what, warning))
+		}
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Until(deadline)):
+		s.notify(conn, fmt.Sprintf("%s: expired after %s.", what, lifetime))
+		expire()
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/pcarrier/srv.us/backend/registry"
+	"golang.org/x/crypto/ssh"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Traffic shapers (tc, eBPF/XDP programs and their loaders) prioritize or throttle tunnels knowing which flows carry
+// them. Every client of the connections socket (-connections-socket) reads JSON lines: first one per connection open,
+// then one per connection opened or closed, as
+//
+//	{"event": "open", "id": 7, "kind": "visitor", "proto": "tcp", "src": "203.0.113.5:51234", "dst": "198.51.100.1:443",
+//	 "endpoint": "docs.srv.us", "key": "…", "port": 1, "tunnel": "192.0.2.7:40222", "time": "…"}
+//
+// where tunnel is the source of the SSH connection the visitor was routed to, itself listed with "kind": "ssh".
+// Close events repeat their open event. Clients reading too slowly are disconnected, and read the snapshot again.
+
+// exportBacklog is how many lines a client of the socket may fall behind by.
+const exportBacklog = 1024
+
+// ConnectionExport is a line of the connections socket.
+type ConnectionExport struct {
+	Event string `json:"event"`
+	// ID is the same in the open and close events of a connection.
+	ID    uint64 `json:"id"`
+	Kind  string `json:"kind"`
+	Proto string `json:"proto"`
+	Src   string `json:"src"`
+	Dst   string `json:"dst"`
+	Key   string `json:"key"`
+	// Endpoint, Port and Tunnel are those of visitor connections.
+	Endpoint string    `json:"endpoint,omitempty"`
+	Port     uint32    `json:"port,omitempty"`
+	Tunnel   string    `json:"tunnel,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// exports tracks the connections open while the socket is served, and who reads their events.
+type exports struct {
+	enabled atomic.Bool
+	lock    sync.Mutex
+	lastID  uint64
+	open    map[uint64]*ConnectionExport
+	readers map[chan []byte]void
+}
+
+// exported records a connection as open, returning what records it closed; both do nothing without a socket.
+func (s *Server) exported(e ConnectionExport) func() {
+	x := &s.exports
+	if !x.enabled.Load() {
+		return func() {}
+	}
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	x.lastID++
+	e.ID, e.Event, e.Time = x.lastID, "open", time.Now().UTC()
+	if x.open == nil {
+		x.open = map[uint64]*ConnectionExport{}
+	}
+	x.open[e.ID] = &e
+	x.publish(e)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			x.lock.Lock()
+			defer x.lock.Unlock()
+			delete(x.open, e.ID)
+			closed := e
+			closed.Event, closed.Time = "close", time.Now().UTC()
+			x.publish(closed)
+		})
+	}
+}
+
+// publish sends a line to every reader, the lock held, dropping those falling behind.
+func (x *exports) publish(e ConnectionExport) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	for r := range x.readers {
+		select {
+		case r <- line:
+		default:
+			delete(x.readers, r)
+			close(r)
+		}
+	}
+}
+
+// exportVisitor records a visitor connection routed to a target.
+func (s *Server) exportVisitor(raw net.Conn, name string, tgt *registry.Target) func() {
+	return s.exported(ConnectionExport{Kind: "visitor", Proto: raw.RemoteAddr().Network(), Src: raw.RemoteAddr().String(), Dst: raw.LocalAddr().String(),
+		Endpoint: name, Key: tgt.KeyID, Port: tgt.Port, Tunnel: tgt.Remote.RemoteAddr().String()})
+}
+
+// exportSSH records an SSH connection.
+func (s *Server) exportSSH(conn *ssh.ServerConn, keyID string) func() {
+	return s.exported(ConnectionExport{Kind: "ssh", Proto: conn.RemoteAddr().Network(), Src: conn.RemoteAddr().String(), Dst: conn.LocalAddr().String(), Key: keyID})
+}
+
+// ServeConnectionExport writes the connections to the clients accepted on listener, until it closes or ctx ends.
+// Connections are only tracked once it is called.
+func (s *Server) ServeConnectionExport(ctx context.Context, listener net.Listener) {
+	s.exports.enabled.Store(true)
+	go closeWhenDone(ctx, listener)
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to accept on the connections socket (%v)", err)
+			continue
+		}
+		go s.exportTo(ctx, conn)
+	}
+}
+
+func (s *Server) exportTo(ctx context.Context, conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+	x := &s.exports
+	lines := make(chan []byte, exportBacklog)
+	x.lock.Lock()
+	snapshot := make([]ConnectionExport, 0, len(x.open))
+	for _, e := range x.open {
+		snapshot = append(snapshot, *e)
+	}
+	if x.readers == nil {
+		x.readers = map[chan []byte]void{}
+	}
+	x.readers[lines] = v
+	x.lock.Unlock()
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].ID < snapshot[j].ID })
+	defer func() {
+		x.lock.Lock()
+		defer x.lock.Unlock()
+		if _, found := x.readers[lines]; found {
+			delete(x.readers, lines)
+			close(lines)
+		}
+	}()
+
+	enc := json.NewEncoder(conn)
+	for _, e := range snapshot {
+		if err := enc.Encode(e); err != nil {
+			return
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+			if _, err := conn.Write(line); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// Operators talk to users through the banner SSH clients show before authenticating, and the message of the day
+// given to every connection once its first session opens. Both are templates of greetingData, so they can say
+// how busy we are and relay the notice set through the admin API, e.g. "Maintenance at 5pm UTC."
+
+const (
+	noticeKey = "notice"
+	maxNotice = 4 << 10
+)
+
+type greetingData struct {
+	// Name and DocsURL are those of the branding.
+	Name, Domain, DocsURL string
+	Clients, Endpoints    int
+	// Notice is the one set through the admin API, if any.
+	Notice string
+}
+
+// ParseGreeting reads the template of a banner or message of the day.
+func ParseGreeting(text string) (*template.Template, error) {
+	return template.New("greeting").Option("missingkey=error").Parse(text)
+}
+
+// greeting renders a banner or message of the day, "" if there is nothing to say.
+func (s *Server) greeting(t *template.Template) string {
+	if t == nil {
+		return ""
+	}
+	clients, endpoints := s.registry.Counts()
+	data := greetingData{Name: s.serviceName(), Domain: s.cfg.Domain, DocsURL: s.docsURL(), Clients: clients, Endpoints: endpoints}
+	if notice := s.notice.Load(); notice != nil {
+		data.Notice = *notice
+	}
+	var text strings.Builder
+	if err := t.Execute(&text, data); err != nil {
+		log.Printf("Could not render greeting (%v)", err)
+		return ""
+	}
+	return strings.TrimSpace(text.String())
+}
+
+// banner is shown by clients before they authenticate.
+func (s *Server) banner(ssh.ConnMetadata) string {
+	if text := s.greeting(s.cfg.Banner); text != "" {
+		return text + "\r\n"
+	}
+	return ""
+}
+
+func (s *Server) loadNotice(ctx context.Context) error {
+	raw, err := s.cfg.Store.Get(ctx, globalSettingsNamespace, noticeKey)
+	if err != nil || raw == nil {
+		return err
+	}
+	notice := string(raw)
+	s.notice.Store(&notice)
+	return nil
+}
+
+// adminNotice shows, sets (PUT, with the notice as body) or clears (DELETE) the notice greetings relay.
+func (s *Server) adminNotice(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		raw, err := io.ReadAll(io.LimitReader(r.Body, maxNotice+1))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		if len(raw) > maxNotice {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, errors.New("notice too long"))
+			return
+		}
+		notice := strings.TrimSpace(string(raw))
+		if err := s.cfg.Store.Put(r.Context(), globalSettingsNamespace, noticeKey, []byte(notice)); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		s.notice.Store(&notice)
+		s.cfg.Audit.Record("notice_set", logs.Fields{"notice": notice})
+	case http.MethodDelete:
+		if err := s.cfg.Store.Delete(r.Context(), globalSettingsNamespace, noticeKey); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		s.notice.Store(nil)
+		s.cfg.Audit.Record("notice_cleared", nil)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+		return
+	}
+	notice := ""
+	if n := s.notice.Load(); n != nil {
+		notice = *n
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"notice": notice})
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// healthTTL spares us probing our own listeners for every liveness probe.
+	healthTTL          = 10 * time.Second
+	healthProbeTimeout = 2 * time.Second
+	// certificateCheckInterval is how often we look for renewed certificates.
+	certificateCheckInterval = time.Minute
+)
+
+type healthReport struct {
+	OK bool `json:"ok"`
+	// Listeners maps the listeners we serve on to "ok" or why connecting through them failed.
+	Listeners   map[string]string `json:"listeners"`
+	Certificate certificateHealth `json:"certificate"`
+	Checked     time.Time         `json:"checked"`
+}
+
+type certificateHealth struct {
+	NotAfter time.Time `json:"not_after,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type healthCache struct {
+	sync.Mutex
+	report *healthReport
+}
+
+// serving records a listener we accept on under name, for health checks, until the returned function is called.
+func (s *Server) serving(name string, l net.Listener) func() {
+	s.listening.Store(name, l)
+	return func() {
+		s.listening.CompareAndDelete(name, l)
+	}
+}
+
+// adminHealth reports whether we accept SSH and HTTPS connections with a valid certificate,
+// by connecting to our own listeners; it answers 503 otherwise, for liveness probes.
+func (s *Server) adminHealth(w http.ResponseWriter, _ *http.Request) {
+	report := s.currentHealth()
+	status := http.StatusOK
+	if !report.OK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+// currentHealth is the last report, checked again if older than healthTTL.
+func (s *Server) currentHealth() *healthReport {
+	s.health.Lock()
+	defer s.health.Unlock()
+	if s.health.report == nil || time.Since(s.health.report.Checked) > healthTTL {
+		s.health.report = s.checkHealth()
+	}
+	return s.health.report
+}
+
+func (s *Server) checkCertificate() certificateHealth {
+	var h certificateHealth
+	if pair, err := s.cfg.Certificate(); err != nil {
+		h.Error = err.Error()
+	} else if cert, err := x509.ParseCertificate(pair.Certificate[0]); err != nil {
+		h.Error = err.Error()
+	} else {
+		h.NotAfter = cert.NotAfter
+		if time.Now().After(cert.NotAfter) {
+			h.Error = "expired"
+		}
+	}
+	return h
+}
+
+// watchCertificate audits renewals of the certificate, and changes in what is wrong with it, until ctx ends.
+func (s *Server) watchCertificate(ctx context.Context) {
+	if s.cfg.Certificate == nil {
+		return
+	}
+	last := s.checkCertificate()
+	every(ctx, certificateCheckInterval, func() {
+		h := s.checkCertificate()
+		if !h.NotAfter.IsZero() && !last.NotAfter.IsZero() && !h.NotAfter.Equal(last.NotAfter) {
+			s.cfg.Audit.Record("certificate_renewed", logs.Fields{"not_after": h.NotAfter, "previous_not_after": last.NotAfter})
+		}
+		if h.Error != last.Error {
+			s.cfg.Audit.Record("certificate_checked", logs.Fields{"not_after": h.NotAfter, "error": h.Error})
+		}
+		last = h
+	})
+}
+
+func (s *Server) checkHealth() *healthReport {
+	report := &healthReport{OK: true, Listeners: map[string]string{}, Checked: time.Now()}
+	report.Certificate = s.checkCertificate()
+	report.OK = report.Certificate.Error == ""
+
+	for _, name := range []string{"https", "ssh"} {
+		l, found := s.listening.Load(name)
+		if !found {
+			report.Listeners[name] = "not serving"
+			report.OK = false
+			continue
+		}
+		probe := probeSSH
+		if name == "https" {
+			probe = s.probeHTTPS
+		}
+		if err := probe(loopback(l.(net.Listener).Addr())); err != nil {
+			report.Listeners[name] = err.Error()
+			report.OK = false
+		} else {
+			report.Listeners[name] = "ok"
+		}
+	}
+	return report
+}
+
+// loopback turns the address of a listener, possibly on every interface, into one we can dial.
+func loopback(addr net.Addr) string {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return addr.String()
+	}
+	ip := tcp.IP
+	if ip == nil || ip.IsUnspecified() {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(tcp.Port))
+}
+
+// probeSSH connects to addr and reads the server's version, without going through a handshake.
+func probeSSH(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, healthProbeTimeout)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(healthProbeTimeout))
+	version, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(version, "SSH-2.0-") {
+		return errors.New("unexpected version " + strings.TrimSpace(version))
+	}
+	return nil
+}
+
+// probeHTTPS completes a TLS handshake with addr, for a name no tunnel serves.
+func (s *Server) probeHTTPS(addr string) error {
+	dialer := &net.Dialer{Timeout: healthProbeTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{
+		ServerName: "healthz." + s.cfg.Domain,
+		// The certificate is checked separately; this checks connections get served.
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
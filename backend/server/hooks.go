@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/metrics"
+	"github.com/pcarrier/srv.us/backend/registry"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// Keys register a webhook with the webhook command, so CI pipelines can wait for their preview URLs:
+// we POST a JSON hookEvent when their tunnels go up, down, or serve their first request.
+// Deliveries are signed with the secret given on registration, never retried, and dropped when too many are in flight.
+
+const (
+	hooksNamespace   = "hooks"
+	hookTimeout      = 10 * time.Second
+	maxHooksInFlight = 64
+	// signatureHeader carries sha256=<hex HMAC-SHA256 of the body by the webhook secret>.
+	signatureHeader = "Srvus-Signature"
+)
+
+var (
+	hookDeliveries = metrics.NewCounter("srvus_webhook_deliveries_total", "Webhook deliveries, by result", "result")
+
+	errPrivateAddress = errors.New("webhooks cannot reach private addresses")
+
+	// hookClient refuses to reach our own network on behalf of users, and does not follow redirects.
+	hookClient = &http.Client{
+		Timeout: hookTimeout,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{Timeout: hookTimeout, Control: refusePrivate}).DialContext,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+)
+
+type hook struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
+type hookEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Port  uint32    `json:"port"`
+	URLs  []string  `json:"urls"`
+	// Reason tells why a tunnel went down: cancelled, closed (through the API), expired, idle or disconnected.
+	Reason string `json:"reason,omitempty"`
+}
+
+func refusePrivate(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+func (s *Server) loadHook(ctx context.Context, keyID string) (*hook, error) {
+	raw, err := s.cfg.Store.Get(ctx, hooksNamespace, keyID)
+	if err != nil || raw == nil {
+		return nil, err
+	}
+	h := &hook{}
+	if err := json.Unmarshal(raw, h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// callHook delivers an event to the webhook of a key in the background, if it registered one.
+func (s *Server) callHook(keyID string, e hookEvent) {
+	select {
+	case s.hooks <- void{}:
+	default:
+		hookDeliveries.Inc("overloaded")
+		return
+	}
+	e.Time = time.Now().UTC()
+	go func() {
+		defer func() {
+			<-s.hooks
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+		defer cancel()
+		h, err := s.loadHook(ctx, keyID)
+		if err != nil {
+			log.Printf("Could not load the webhook of %s (%v)", keyID, err)
+			return
+		}
+		if h == nil {
+			return
+		}
+		if err := h.deliver(ctx, e); err != nil {
+			hookDeliveries.Inc("failed")
+			log.Printf("Could not deliver %s to the webhook of %s (%v)", e.Event, keyID, err)
+			return
+		}
+		hookDeliveries.Inc("delivered")
+	}()
+}
+
+func (h *hook) deliver(ctx context.Context, e hookEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, []byte(h.Secret))
+	_, _ = mac.Write(body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(signatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	resp, err := hookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// tunnelsDown tells the webhook of a closed connection its remaining tunnels went down, one event per port.
+func (s *Server) tunnelsDown(keyID string, tunnels map[registry.TunnelRef]*registry.Target) {
+	endpoints := map[uint32][]string{}
+	for ref := range tunnels {
+		endpoints[ref.Port] = append(endpoints[ref.Port], ref.Endpoint)
+	}
+	for port, names := range endpoints {
+		s.callHook(keyID, hookEvent{Event: "tunnel_down", Port: port, URLs: urlsOf(names), Reason: "disconnected"})
+	}
+}
+
+// firstRequest tells the webhook of a target's key it is being visited, the first time it is.
+func (s *Server) firstRequest(name string, tgt *registry.Target) {
+	if tgt.FirstVisit() {
+		s.callHook(tgt.KeyID, hookEvent{Event: "first_request", Port: tgt.Port, URLs: urlsOf([]string{name})})
+	}
+}
+
+func runWebhook(s *Server, c *commandContext, args []string) error {
+	switch {
+	case len(args) == 0:
+		h, err := s.loadHook(c.ctx, c.keyID)
+		if err != nil {
+			return err
+		}
+		if h == nil {
+			c.printf("No webhook.")
+		} else {
+			c.printf("Webhook: %s", h.URL)
+		}
+		return nil
+	case len(args) == 1 && args[0] == "off":
+		if err := s.cfg.Store.Delete(c.ctx, hooksNamespace, c.keyID); err != nil {
+			return err
+		}
+		s.cfg.Audit.Record("webhook_removed", logs.Fields{"key": c.keyID})
+		c.printf("Webhook removed.")
+		return nil
+	case len(args) == 1:
+		u, err := url.Parse(args[0])
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return errors.New("expected an http:// or https:// URL")
+		}
+		secret := make([]byte, 16)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		h := &hook{URL: u.String(), Secret: hex.EncodeToString(secret)}
+		raw, err := json.Marshal(h)
+		if err != nil {
+			return err
+		}
+		if err := s.cfg.Store.Put(c.ctx, hooksNamespace, c.keyID, raw); err != nil {
+			return err
+		}
+		s.cfg.Audit.Record("webhook_set", logs.Fields{"key": c.keyID, "url": h.URL})
+		c.printf("Webhook: %s", h.URL)
+		c.printf("Deliveries carry %s: sha256=<HMAC-SHA256 of the body by %s>.", signatureHeader, h.Secret)
+		return nil
+	default:
+		return errUsage
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/registry"
+	"github.com/pcarrier/srv.us/backend/settings"
+	"net/http"
+)
+
+// rewriteHost replaces the Host header of a request as the tunnel asks, keeping the public one in X-Forwarded-Host.
+func rewriteHost(r *http.Request, tgt *registry.Target) {
+	st := tgt.Settings.Load()
+	if st == nil || st.HTTP == nil || st.HTTP.Host == "" {
+		return
+	}
+	r.Header.Set("X-Forwarded-Host", r.Host)
+	r.Host = st.HTTP.Host
+}
+
+func runHost(s *Server, c *commandContext, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+	port, err := parsePort(args[0])
+	if err != nil {
+		return err
+	}
+
+	var st *settings.Endpoint
+	if len(args) == 1 {
+		if st, err = settings.Load(c.ctx, s.cfg.Store, c.keyID, port); err != nil {
+			return err
+		}
+	} else {
+		host := args[1]
+		switch host {
+		case "public":
+			host = ""
+		case "local":
+			host = settings.LocalHost
+		}
+		if st, err = s.updateSettings(c.ctx, c.keyID, port, func(st *settings.Endpoint) error {
+			if st.HTTP == nil {
+				st.HTTP = &settings.HTTP{}
+			}
+			st.HTTP.Host = host
+			if err := st.HTTP.Validate(); err != nil {
+				return err
+			}
+			if st.HTTP.Empty() {
+				st.HTTP = nil
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		s.cfg.Audit.Record("host_changed", logs.Fields{"key": c.keyID, "port": port, "host": host})
+	}
+	c.printf("%d: %s", port, describeHost(st))
+	return nil
+}
+
+func describeHost(st *settings.Endpoint) string {
+	if st.HTTP == nil || st.HTTP.Host == "" {
+		return "your service gets the public name in the Host header"
+	}
+	return "your service gets Host: " + st.HTTP.Host + ", the public name in X-Forwarded-Host"
+}
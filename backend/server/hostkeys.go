@@ -0,0 +1,147 @@
+package server
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/nameserver"
+	"golang.org/x/crypto/ssh"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Host keys come from Config.HostKeyPaths: files, or directories holding ssh_host_*_key files as OpenSSH lays them out.
+// Missing or unreadable keys are logged and skipped, so long as one loads. Clients only ever get one key per type,
+// so a key replaces those of its type listed before it. To rotate, add the new key to a path and POST /host-keys on
+// the admin API: new connections get it, established ones keep the key they checked. Encrypted keys are decrypted
+// with Config.HostKeyPassphrase. With the name server, the apex serves their SSHFP records for VerifyHostKeyDNS.
+
+// hostKeyPattern is what keys are named in directories.
+const hostKeyPattern = "ssh_host_*_key"
+
+var errNoHostKeys = errors.New("no host key found")
+
+// LoadHostKeys reads the host keys found at paths, in order, decrypting those that are with passphrase.
+func LoadHostKeys(paths []string, passphrase []byte) ([]ssh.Signer, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("Skipping host keys at %s (%v)", path, err)
+			continue
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		found, err := filepath.Glob(filepath.Join(path, hostKeyPattern))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(found)
+		files = append(files, found...)
+	}
+
+	byType := map[string]int{}
+	var keys []ssh.Signer
+	for _, file := range files {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			log.Printf("Skipping host key %s (%v)", file, err)
+			continue
+		}
+		key, err := ssh.ParsePrivateKey(raw)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) && passphrase != nil {
+			key, err = ssh.ParsePrivateKeyWithPassphrase(raw, passphrase)
+		}
+		if err != nil {
+			log.Printf("Skipping host key %s (%v)", file, err)
+			continue
+		}
+		t := key.PublicKey().Type()
+		if i, found := byType[t]; found {
+			log.Printf("Host key %s replaces another %s key", file, t)
+			keys[i] = key
+			continue
+		}
+		byType[t] = len(keys)
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w in %v", errNoHostKeys, paths)
+	}
+	return keys, nil
+}
+
+// SetHostKeys makes new SSH connections use keys.
+func (s *Server) SetHostKeys(keys []ssh.Signer) {
+	c := s.NewSSHConfig()
+	for _, key := range keys {
+		c.AddHostKey(key)
+	}
+	s.hostKeys.Store(&keys)
+	s.sshConfig.Store(c)
+	if s.cfg.DNS != nil {
+		s.cfg.DNS.SetHostKeys(SSHFPRecords(keys))
+	}
+}
+
+// sshfpAlgorithms are the SSHFP numbers of key types.
+var sshfpAlgorithms = map[string]int{
+	ssh.KeyAlgoRSA:      1,
+	ssh.KeyAlgoDSA:      2,
+	ssh.KeyAlgoECDSA256: 3,
+	ssh.KeyAlgoECDSA384: 3,
+	ssh.KeyAlgoECDSA521: 3,
+	ssh.KeyAlgoED25519:  4,
+}
+
+// SSHFPRecords are the SSHFP records of keys, with their SHA-256 fingerprints.
+func SSHFPRecords(keys []ssh.Signer) []nameserver.Record {
+	var records []nameserver.Record
+	for _, key := range keys {
+		algorithm, found := sshfpAlgorithms[key.PublicKey().Type()]
+		if !found {
+			continue
+		}
+		fingerprint := sha256.Sum256(key.PublicKey().Marshal())
+		records = append(records, nameserver.Record{Type: "SSHFP", Value: fmt.Sprintf("%d 2 %x", algorithm, fingerprint)})
+	}
+	return records
+}
+
+// hostKeyFingerprints lists the fingerprints of the keys new connections get, by type.
+func (s *Server) hostKeyFingerprints() map[string]string {
+	fingerprints := map[string]string{}
+	if keys := s.hostKeys.Load(); keys != nil {
+		for _, key := range *keys {
+			fingerprints[key.PublicKey().Type()] = ssh.FingerprintSHA256(key.PublicKey())
+		}
+	}
+	return fingerprints
+}
+
+// adminHostKeys lists the host keys, or reloads them from Config.HostKeyPaths on POST.
+func (s *Server) adminHostKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		keys, err := LoadHostKeys(s.cfg.HostKeyPaths, s.cfg.HostKeyPassphrase)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		s.SetHostKeys(keys)
+		s.cfg.Audit.Record("host_keys_reloaded", logs.Fields{"fingerprints": s.hostKeyFingerprints()})
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.hostKeyFingerprints())
+}
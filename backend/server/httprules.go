@@ -0,0 +1,307 @@
+package server
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/metrics"
+	"github.com/pcarrier/srv.us/backend/registry"
+	"github.com/pcarrier/srv.us/backend/settings"
+	"github.com/pcarrier/srv.us/backend/wire"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The HTTP options owners set on their tunnels (settings.HTTP) are enforced by the request-by-request proxy.
+
+var (
+	httpRulesRefused   = metrics.NewCounter("srvus_http_rules_refused_total", "Requests refused by the HTTP options of their tunnel", "reason")
+	preflightsAnswered = metrics.NewCounter("srvus_cors_preflights_total", "CORS preflight requests answered at the edge", "result")
+)
+
+// transportFor returns the transport proxying a target request by request, or nil to proxy it byte by byte.
+// Targets are only proxied request by request when their settings need it, unless required.
+func (s *Server) transportFor(tgt *registry.Target, required bool) *http.Transport {
+	if tgt.HTTP != nil {
+		return tgt.HTTP
+	}
+	if st := tgt.Settings.Load(); !required && (st == nil || st.HTTP.Empty()) {
+		return nil
+	}
+	if t := tgt.OnDemandHTTP.Load(); t != nil {
+		return t
+	}
+	tgt.OnDemandHTTP.CompareAndSwap(nil, s.newTransport(tgt.Remote, tgt.Host, tgt.Port))
+	return tgt.OnDemandHTTP.Load()
+}
+
+// admitRequest enforces the tunnel's HTTP options on a request before it is proxied,
+// answering it and returning false if it must not be.
+func (s *Server) admitRequest(w http.ResponseWriter, r *http.Request, name string, tgt *registry.Target) bool {
+	st := tgt.Settings.Load()
+	if st == nil || st.HTTP.Empty() {
+		return true
+	}
+	rules := st.HTTP
+
+	if rules.RateLimit != nil {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if wait := s.rates.take(tgt.KeyID, tgt.Port, host, rules.RateLimit); wait > 0 {
+			httpRulesRefused.Inc("rate_limit")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many requests, retry later.", http.StatusTooManyRequests)
+			return false
+		}
+	}
+
+	// Browsers never send credentials with preflights.
+	if rules.CORS != nil && r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != "" {
+		answerPreflight(w, r, rules.CORS)
+		return false
+	}
+
+	if rules.Challenge != nil && !s.challenged(w, r, name, rules.Challenge) {
+		return false
+	}
+
+	if rules.Auth != nil {
+		user, ok := s.passwords.check(r, rules.Auth)
+		if !ok {
+			httpRulesRefused.Inc("auth")
+			realm := rules.Auth.Realm
+			if realm == "" {
+				realm = s.cfg.Domain
+			}
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm))
+			http.Error(w, "Log in to reach this tunnel.", http.StatusUnauthorized)
+			return false
+		}
+		// The credentials are ours, not the service's.
+		r.Header.Del("Authorization")
+		r.Header.Set("X-Forwarded-User", user)
+	}
+
+	for _, rw := range rules.Rewrite {
+		re := compiledRewrite(rw.From)
+		if re != nil && re.MatchString(r.URL.Path) {
+			r.URL.Path = re.ReplaceAllString(r.URL.Path, rw.To)
+			r.URL.RawPath = ""
+			break
+		}
+	}
+	return true
+}
+
+// defaultPreflightMaxAge is how long browsers may cache our answers to preflights, unless the tunnel says otherwise.
+const defaultPreflightMaxAge = 10 * 60
+
+// answerPreflight answers a CORS preflight request without bothering the service.
+func answerPreflight(w http.ResponseWriter, r *http.Request, cors *settings.CORS) {
+	h := w.Header()
+	h.Add("Vary", "Access-Control-Request-Method, Access-Control-Request-Headers")
+	origin := r.Header.Get("Origin")
+	// Without the headers, browsers refuse the actual request.
+	if !cors.Allows(origin) {
+		preflightsAnswered.Inc("refused")
+		h.Add("Vary", "Origin")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	preflightsAnswered.Inc("allowed")
+	allowOrigin(h, origin, cors)
+
+	methods := r.Header.Get("Access-Control-Request-Method")
+	if len(cors.Methods) > 0 {
+		methods = strings.Join(cors.Methods, ", ")
+	}
+	h.Set("Access-Control-Allow-Methods", methods)
+	headers := r.Header.Get("Access-Control-Request-Headers")
+	if len(cors.Headers) > 0 {
+		headers = strings.Join(cors.Headers, ", ")
+	}
+	if headers != "" {
+		h.Set("Access-Control-Allow-Headers", headers)
+	}
+	maxAge := cors.MaxAge
+	if maxAge == 0 {
+		maxAge = defaultPreflightMaxAge
+	}
+	h.Set("Access-Control-Max-Age", strconv.Itoa(maxAge))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// allowOrigin shares a response with origin; unless any origin may read it anonymously, the answer depends on it.
+func allowOrigin(h http.Header, origin string, cors *settings.CORS) {
+	if cors.Credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	for _, o := range cors.Origins {
+		if o == "*" && !cors.Credentials {
+			h.Set("Access-Control-Allow-Origin", "*")
+			return
+		}
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Add("Vary", "Origin")
+}
+
+var rewrites sync.Map
+
+// compiledRewrite caches the expressions of rewrites, which were checked when applied.
+func compiledRewrite(expr string) *regexp.Regexp {
+	if re, found := rewrites.Load(expr); found {
+		return re.(*regexp.Regexp)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil
+	}
+	rewrites.Store(expr, re)
+	return re
+}
+
+// addHeaders sets the response headers the tunnel asks for over those of its service; empty values remove them.
+func addHeaders(resp *http.Response, tgt *registry.Target) {
+	st := tgt.Settings.Load()
+	if st == nil || st.HTTP == nil {
+		return
+	}
+	if cors, origin := st.HTTP.CORS, resp.Request.Header.Get("Origin"); cors != nil && origin != "" && cors.Allows(origin) {
+		allowOrigin(resp.Header, origin, cors)
+	}
+	for name, value := range st.HTTP.Headers {
+		if value == "" {
+			resp.Header.Del(name)
+		} else {
+			resp.Header.Set(name, value)
+		}
+	}
+}
+
+// compressResponse gzips a response if the tunnel asks for it and the visitor accepts it,
+// unless it is already encoded, streamed or unlikely to shrink.
+func compressResponse(resp *http.Response, tgt *registry.Target) {
+	st := tgt.Settings.Load()
+	if st == nil || st.HTTP == nil || !st.HTTP.Compress {
+		return
+	}
+	if !strings.Contains(resp.Request.Header.Get("Accept-Encoding"), "gzip") ||
+		resp.Header.Get("Content-Encoding") != "" ||
+		resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified || resp.StatusCode == http.StatusPartialContent ||
+		resp.Request.Method == http.MethodHead ||
+		wire.IsStreamingResponse(resp) || !compressible(resp.Header.Get("Content-Type")) {
+		return
+	}
+
+	body := resp.Body
+	r, w := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(w)
+		_, err := io.Copy(gz, body)
+		if err == nil {
+			err = gz.Close()
+		}
+		_ = body.Close()
+		_ = w.CloseWithError(err)
+	}()
+	resp.Body = r
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.Header.Add("Vary", "Accept-Encoding")
+}
+
+func compressible(contentType string) bool {
+	for _, prefix := range []string{"text/", "application/json", "application/javascript", "application/xml", "image/svg+xml"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimiter holds a token bucket per visitor address of every rate-limited tunnel.
+type rateLimiter struct {
+	sync.Mutex
+	buckets map[rateKey]*bucket
+	swept   time.Time
+}
+
+type rateKey struct {
+	keyID string
+	port  uint32
+	addr  string
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// take spends a token of a visitor's bucket, or returns how long until one is available.
+func (l *rateLimiter) take(keyID string, port uint32, addr string, limit *settings.RateLimit) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	if l.buckets == nil {
+		l.buckets = map[rateKey]*bucket{}
+	}
+	perSecond := float64(limit.PerMinute) / 60
+	if now.Sub(l.swept) > time.Minute {
+		// Forget visitors idle for an hour, whose buckets are mostly full again anyway.
+		for k, b := range l.buckets {
+			if now.Sub(b.updated) > time.Hour {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+
+	k := rateKey{keyID: keyID, port: port, addr: addr}
+	b := l.buckets[k]
+	if b == nil {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		l.buckets[k] = b
+	}
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*perSecond)
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+}
+
+// passwordCache remembers credentials that matched, as bcrypt is meant to be too slow to check on every request.
+type passwordCache struct {
+	sync.Map
+}
+
+func (c *passwordCache) check(r *http.Request, auth *settings.BasicAuth) (string, bool) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	hash, found := auth.Users[user]
+	if !found {
+		return "", false
+	}
+	k := sha256.Sum256([]byte(hash + "\x00" + password))
+	if _, found := c.Load(k); found {
+		return user, true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return "", false
+	}
+	c.Store(k, void{})
+	return user, true
+}
@@ -0,0 +1,341 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/pcarrier/srv.us/backend/registry"
+	"github.com/pcarrier/srv.us/backend/tracing"
+	"github.com/pcarrier/srv.us/backend/wire"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const handshakeTimeout = 10 * time.Second
+
+var errNoTunnel = errors.New("no tunnel available")
+
+// closeWhenDone closes c once ctx ends, interrupting whoever is blocked on it.
+func closeWhenDone(ctx context.Context, c io.Closer) {
+	<-ctx.Done()
+	_ = c.Close()
+}
+
+// ServeHTTPS proxies visitors accepted on listener to the tunnels serving the name they ask for,
+// until it closes or ctx ends; ending ctx also aborts the connections in flight.
+func (s *Server) ServeHTTPS(ctx context.Context, listener net.Listener) {
+	go closeWhenDone(ctx, listener)
+	defer s.serving("https", listener)()
+	defer func() {
+		err := listener.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Could not close HTTPS listener (%v)", err)
+		}
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to accept HTTPS connection (%s)", err)
+			continue
+		}
+
+		go s.serveHTTPSConnection(ctx, conn)
+	}
+}
+
+func (s *Server) serveHTTPSConnection(ctx context.Context, raw net.Conn) {
+	s.visitors.Add(1)
+	defer s.visitors.Add(-1)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go closeWhenDone(ctx, raw)
+
+	ctx, span := s.cfg.Tracer.StartTrace(ctx, tracing.SpanContext{}, "visitor", tracing.Server)
+	defer span.End()
+	span.Set("client.address", raw.RemoteAddr().String())
+
+	name := ""
+
+	cert, err := s.cfg.Certificate()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		GetConfigForClient: func(i *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = i.ServerName
+			return nil, nil
+		},
+		NextProtos: []string{
+			"http/1.1",
+		},
+	}
+
+	https := tls.Server(raw, c)
+
+	defer func() {
+		_ = https.Close()
+	}()
+
+	handshakeCtx, handshakeDone := context.WithTimeout(ctx, handshakeTimeout)
+	defer handshakeDone()
+	_, handshake := s.cfg.Tracer.Start(handshakeCtx, "tls.handshake", tracing.Internal)
+	err = https.HandshakeContext(handshakeCtx)
+	handshake.Fail(err)
+	handshake.End()
+	if err != nil {
+		span.Fail(err)
+		return
+	}
+	span.Set("server.address", name)
+
+	if name == s.cfg.Domain {
+		err = s.serveRoot(ctx, https)
+		if err != nil {
+			log.Printf("root failed (%d)", err)
+		}
+		return
+	}
+
+	endpoint, gone := s.resolveShare(ctx, name)
+	if gone != "" {
+		_ = wire.ErrorOut(https, "410 Gone", gone)
+		return
+	}
+	name = endpoint
+
+	_, routing := s.cfg.Tracer.Start(ctx, "route", tracing.Internal)
+	tgt := s.router.Route(name)
+	routing.End()
+	if tgt == nil {
+		span.Fail(errNoTunnel)
+		_ = wire.ErrorOut(https, "503 Service Unavailable", s.page("no_tunnel"))
+		return
+	}
+	routing.Set("srvus.port", tgt.Port)
+
+	if !s.admits(tgt, s.cfg.GeoIP.LookupAddr(raw.RemoteAddr())) {
+		_ = wire.ErrorOut(https, "403 Forbidden", s.page("location_forbidden"))
+		return
+	}
+
+	if reason := suspended(tgt); reason != "" {
+		_ = wire.ErrorOut(https, "403 Forbidden", s.page("suspended"))
+		return
+	}
+
+	if status, refusal := s.overPlan(name, tgt.KeyID); refusal != "" {
+		_ = wire.ErrorOut(https, status, refusal)
+		return
+	}
+
+	if page := paused(tgt); page != "" {
+		_ = wire.ErrorOutWithHeader(https, "503 Service Unavailable", retryLaterHeader(), page)
+		return
+	}
+
+	if s.cfg.Chaos.openFails() {
+		_ = wire.ErrorOut(https, "502 Bad Gateway", "Could not reach the tunnel (chaos mode).")
+		return
+	}
+
+	s.firstRequest(name, tgt)
+	defer s.exportVisitor(raw, name, tgt)()
+
+	// Requests can only be copied to shadows, or scanned, one by one.
+	if transport := s.transportFor(tgt, len(s.registry.Shadows(name)) > 0 || s.scanned(tgt)); transport != nil {
+		s.serveMultiplexed(ctx, https, name, tgt, transport)
+		return
+	}
+
+	release, err := s.admitMemory(tgt.Remote, 2*pumpBuffer)
+	if err != nil {
+		_ = wire.ErrorOutWithHeader(https, "503 Service Unavailable", retryLaterHeader(), s.page("busy"))
+		return
+	}
+	defer release()
+
+	in, answered := s.answerFirstRequest(https, name, tgt)
+	if answered {
+		return
+	}
+
+	sshChannel, reqs, tgt, err := s.openFailingOver(ctx, name, tgt, raw.RemoteAddr())
+	span.Fail(err)
+	// The first request may have been read already; in replays it.
+	visitor := struct {
+		io.Reader
+		io.Writer
+	}{in, https}
+	if isBusy(err) {
+		_ = wire.ErrorOutWithHeader(visitor, "503 Service Unavailable", retryLaterHeader(), s.page("busy"))
+		return
+	}
+	if errors.Is(err, errConnectTimeout) {
+		_ = wire.ErrorOut(visitor, "504 Gateway Timeout", s.page("timeout"))
+		return
+	}
+	if err != nil {
+		// What the client says is for its owner, who is told in its sessions.
+		log.Printf("%v:%s→%v open failed (%v)", tgt.Remote.RemoteAddr(), name, raw.RemoteAddr(), err)
+		_ = wire.ErrorOut(visitor, "502 Bad Gateway", s.page("unreachable"))
+		return
+	}
+
+	// Requests under the namespace of the edge must not reach the service, first or later ones.
+	watcher := wire.NewWatcher(https, in, func(target string) bool {
+		_, reserved := edgePath(target)
+		return reserved
+	})
+	cut := make(chan void)
+
+	defer tgt.Hold()()
+	usage := s.usageOf(tgt)
+	usage.visited(raw.RemoteAddr())
+
+	defer func() {
+		if err := sshChannel.Close(); err != nil && !errors.Is(err, io.EOF) {
+			log.Printf("%v:%s→%v channel close failed (%d)", tgt.Remote.RemoteAddr(), name, raw.RemoteAddr(), err)
+		}
+	}()
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+
+	go func() {
+		for req := range reqs {
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+		}
+	}()
+
+	_, transfer := s.cfg.Tracer.Start(ctx, "transfer", tracing.Internal)
+	defer transfer.End()
+	moved := s.traffic.of(name)
+	logged := s.transfers.sampled()
+	var sent, received int64
+	progress := &transferProgress{}
+	progressCtx, transferred := context.WithCancel(ctx)
+	defer transferred()
+	go s.reportProgress(progressCtx, tgt, raw.RemoteAddr(), progress)
+	p := &proxied{}
+	location := s.cfg.GeoIP.LookupAddr(raw.RemoteAddr())
+	obs := wire.NewObserver(func(ex *wire.Exchange) {
+		if wire.IsStreamingResponse(ex.Response) && !p.streaming.Swap(true) {
+			log.Printf("%v:%s→%v streaming (%s)", tgt.Remote.RemoteAddr(), name, raw.RemoteAddr(), ex.Response.Header.Get("Content-Type"))
+		}
+	}, func(ex *wire.Exchange) {
+		// Requests relayed as bytes get no ID from us, so any the visitor sent is not logged as one.
+		// The observer may still be reading the request, so it is stripped from a copy.
+		logged := *ex
+		logged.Request = ex.Request.Clone(ctx)
+		logged.Request.Header.Del(requestIDHeader)
+		s.cfg.Access.Record(name, tgt.KeyID, raw.RemoteAddr(), &logged)
+		usage.requested(logged.Request.URL.Path)
+		s.fed(tgt, &logged, location)
+	})
+
+	go func() {
+		b, err := s.pump(https, sshChannel, obs.Responses, tgt, proxiedOut, moved, &progress.sent)
+		obs.Responses.Close()
+		select {
+		case <-cut:
+			s.answerWithheld(https, watcher.Withheld(), name, tgt)
+			err = nil
+		default:
+		}
+		sent = b
+		if logged {
+			log.Printf("%v:%s→%v xfer %d", tgt.Remote.RemoteAddr(), name, raw.RemoteAddr(), b)
+		}
+		if errors.Is(err, errChaosReset) {
+			resetConnection(raw)
+			_ = sshChannel.Close()
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			log.Printf("%v:%s→%v copy failed (%v)", tgt.Remote.RemoteAddr(), name, raw.RemoteAddr(), err)
+		}
+		if err := https.CloseWrite(); err != nil && !errors.Is(err, io.EOF) {
+			log.Printf("%v:%s→%v close failed (%v)", tgt.Remote.RemoteAddr(), name, raw.RemoteAddr(), err)
+		}
+		wg.Done()
+	}()
+
+	go func() {
+		b, err := s.pump(sshChannel, watcher, obs.Requests, tgt, proxiedIn, moved, &progress.received)
+		obs.Requests.Close()
+		received = b
+		if logged {
+			log.Printf("%v:%s←%v xfer %d", tgt.Remote.RemoteAddr(), name, raw.RemoteAddr(), b)
+		}
+		if watcher.Rejected() != nil {
+			// Visitors only send a request once they got the previous response, so the edge answers after closing the channel.
+			close(cut)
+			_ = sshChannel.Close()
+			wg.Done()
+			return
+		}
+		if errors.Is(err, errChaosReset) {
+			resetConnection(raw)
+			_ = sshChannel.Close()
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			log.Printf("%v:%s←%v copy failed (%v)", tgt.Remote.RemoteAddr(), name, raw.RemoteAddr(), err)
+		}
+		if err := sshChannel.CloseWrite(); err != nil && !errors.Is(err, io.EOF) {
+			log.Printf("%v:%s←%v close failed (%v)", tgt.Remote.RemoteAddr(), name, raw.RemoteAddr(), err)
+		}
+		wg.Done()
+	}()
+
+	wg.Wait()
+	transferred()
+	transfer.Set("srvus.bytes_received", received)
+	transfer.Set("srvus.bytes_sent", sent)
+	s.transfers.add(name, received, sent)
+	usage.moved(received + sent)
+}
+
+// proxied tracks what we learn about a proxied connection while it is open,
+// so that a streaming response is only logged once.
+type proxied struct {
+	streaming atomic.Bool
+}
+
+// pump copies src to dst, writing every read out immediately so nothing is ever held back,
+// and mirrors what it forwards to the observer tap. counters add up the bytes written.
+func (s *Server) pump(dst io.Writer, src io.Reader, t *wire.Tap, tgt *registry.Target, counters ...*atomic.Int64) (int64, error) {
+	buf := make([]byte, pumpBuffer)
+	var written int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if cerr := s.cfg.Chaos.read(); cerr != nil {
+				return written, cerr
+			}
+			w, werr := dst.Write(buf[:n])
+			written += int64(w)
+			for _, c := range counters {
+				c.Add(int64(w))
+			}
+			if werr != nil {
+				return written, werr
+			}
+			_, _ = t.Write(buf[:n])
+			tgt.Touch()
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"log"
+	"time"
+)
+
+// reapIdleTunnels periodically removes tunnels that carried no traffic for the idle tunnel timeout,
+// closing connections left without any tunnel.
+func (s *Server) reapIdleTunnels(ctx context.Context) {
+	interval := s.cfg.IdleTunnelTimeout / 4
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	every(ctx, interval, func() {
+		for _, idle := range s.registry.IdleTunnels(time.Now().Add(-s.cfg.IdleTunnelTimeout)) {
+			endpoints := s.registry.RemoveTunnel(idle.Conn, idle.Port)
+			s.forwardDown(idle.Conn, idle.Port)
+			if len(endpoints) == 0 {
+				continue
+			}
+			log.Printf("%s port %d idle, removed", idle.Conn.RemoteAddr(), idle.Port)
+			s.cfg.Audit.Record("tunnel_idle", logs.Fields{"remote": idle.Conn.RemoteAddr().String(), "port": idle.Port, "endpoints": endpoints})
+			s.callHook(idle.KeyID, hookEvent{Event: "tunnel_down", Port: idle.Port, URLs: urlsOf(endpoints), Reason: "idle"})
+			s.notify(idle.Conn, fmt.Sprintf("%d: removed after %s without traffic.", idle.Port, s.cfg.IdleTunnelTimeout))
+			if s.registry.TunnelCount(idle.Conn) == 0 {
+				s.notify(idle.Conn, "No tunnels left, disconnecting.")
+				s.closeConnection(idle.Conn)
+			}
+		}
+	})
+}
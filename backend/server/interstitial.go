@@ -0,0 +1,68 @@
+package server
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// On deployments enabling Config.Interstitial, browsers get a warning page before their first visit of a tunnel,
+// so phishing victims learn they are about to reach a service anybody can run. Its response sets a cookie for the
+// tunnel's name, which skips the page from then on; other clients skip it with the Srvus-Skip-Browser-Warning header.
+
+const (
+	warnedCookie      = "srvus-warned"
+	skipWarningHeader = "Srvus-Skip-Browser-Warning"
+	// warnedFor is how long a browser is not warned again about the same tunnel.
+	warnedFor = 7 * 24 * time.Hour
+)
+
+var warningPage = template.Must(template.New("warning").Parse(`<!DOCTYPE html>
+<html lang="en"><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex"><title>You are about to visit {{.Host}}</title>
+<style>body{font-family:sans-serif;max-width:40em;margin:2em auto;padding:0 1em}a.button{display:inline-block;padding:.5em 1em;border:1px solid;text-decoration:none}</style></head>
+<body><h1>You are about to visit {{.Host}}</h1>
+<p>This site is served through a tunnel of {{.Domain}}, by whoever set it up; {{.Domain}} did not write or check it.</p>
+<p>Do not enter passwords, payment details or other personal information unless you trust who sent you here.
+Sites impersonating banks, shops or your employer are phishing.</p>
+<p><a class="button" href="{{.Path}}">Visit the site</a></p>
+<p>Is it abusive? <a href="https://{{.Domain}}/report?url={{.URL}}">Report it</a>.</p>
+</body></html>
+`))
+
+type warningPageData struct {
+	Domain, Host, Path, URL string
+}
+
+// needsWarning reports whether a request is a browser visiting a tunnel for the first time.
+func needsWarning(r *http.Request) bool {
+	if r.Method != http.MethodGet || !strings.Contains(r.Header.Get("Accept"), "text/html") || r.Header.Get(skipWarningHeader) != "" {
+		return false
+	}
+	_, err := r.Cookie(warnedCookie)
+	return err != nil
+}
+
+// warning renders the page warning a visitor about name, with the headers to send along.
+func (s *Server) warning(r *http.Request, name string) (http.Header, []byte, error) {
+	target := url.URL{Scheme: "https", Host: name, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+	var body bytes.Buffer
+	if err := warningPage.Execute(&body, warningPageData{
+		Domain: s.cfg.Domain,
+		Host:   name,
+		Path:   r.URL.RequestURI(),
+		URL:    target.String(),
+	}); err != nil {
+		return nil, nil, err
+	}
+	cookie := &http.Cookie{Name: warnedCookie, Value: "1", Path: "/", MaxAge: int(warnedFor.Seconds()), Secure: true, HttpOnly: true, SameSite: http.SameSiteLaxMode}
+	header := http.Header{
+		"Content-Type":  {"text/html; charset=utf-8"},
+		"Cache-Control": {"no-store"},
+		"Set-Cookie":    {cookie.String()},
+	}
+	return header, body.Bytes(), nil
+}
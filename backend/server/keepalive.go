@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"github.com/pcarrier/srv.us/backend/metrics"
+	"golang.org/x/crypto/ssh"
+	"time"
+)
+
+// maxKeepaliveSlack caps the round-trip allowance added to the keepalive timeout.
+const maxKeepaliveSlack = 30 * time.Second
+
+var keepaliveTimeouts = metrics.NewCounter("srvus_keepalive_timeouts_total", "Clients disconnected for not answering keepalives.", "")
+
+// rttEstimator smooths the round-trip times of keepalives, as TCP does (RFC 6298).
+type rttEstimator struct {
+	srtt, rttvar time.Duration
+}
+
+func (e *rttEstimator) update(sample time.Duration) {
+	if e.srtt == 0 {
+		e.srtt, e.rttvar = sample, sample/2
+		return
+	}
+	delta := e.srtt - sample
+	if delta < 0 {
+		delta = -delta
+	}
+	e.rttvar = (3*e.rttvar + delta) / 4
+	e.srtt = (7*e.srtt + sample) / 8
+}
+
+// slack is how much longer than usual an answer may take before it is surely lost.
+func (e *rttEstimator) slack() time.Duration {
+	slack := e.srtt + 4*e.rttvar
+	if slack > maxKeepaliveSlack {
+		return maxKeepaliveSlack
+	}
+	return slack
+}
+
+// keepaliveTimeout is how long a connection may stay silent: several keepalives may go unanswered,
+// and clients with slow links get their usual round-trip time on top, so brief hiccups are tolerated.
+func (s *Server) keepaliveTimeout(rtt *rttEstimator) time.Duration {
+	return time.Duration(s.cfg.KeepaliveMissed)*s.cfg.KeepaliveInterval + rtt.slack()
+}
+
+// keepalive pings the client every keepalive interval, reporting the round-trip time of every answer,
+// until ctx ends or the connection fails, which closes rtts.
+func (s *Server) keepalive(ctx context.Context, conn *ssh.ServerConn, rtts chan<- time.Duration) {
+	defer close(rtts)
+	t := time.NewTicker(s.cfg.KeepaliveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		start := time.Now()
+		if _, _, err := conn.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+			return
+		}
+		select {
+		case rtts <- time.Since(start):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
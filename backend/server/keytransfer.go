@@ -0,0 +1,221 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/identity"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/settings"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"strings"
+	"time"
+)
+
+// Owners rotate a compromised key without losing their URLs: `ssh -A srv.us transfer --to SHA256:…`, run with the
+// old key while the forwarded agent holds the new one, has the new key sign a challenge, then hands it the
+// reservations of the old key, custom domains included, its plan, its usage history and copies of the options of its
+// tunnels, suspensions included. Tokens of the old key are revoked, as whoever holds it may have minted some.
+// Hashed names derive from keys, so those of the new key differ; operators update organizations and limits.
+
+// transferred is what moved to the new key.
+type transferred struct {
+	reservations, options, months, tokens int
+	plan                                  string
+}
+
+func runTransfer(s *Server, c *commandContext, args []string) error {
+	var fingerprint string
+	switch {
+	case len(args) == 2 && args[0] == "--to":
+		fingerprint = args[1]
+	case len(args) == 1 && strings.HasPrefix(args[0], "--to="):
+		fingerprint = strings.TrimPrefix(args[0], "--to=")
+	default:
+		return errUsage
+	}
+	if fingerprint == fingerprintOf(c.keyID) {
+		return fmt.Errorf("%s is the key you are connected with", fingerprint)
+	}
+
+	var to string
+	line := "transfer --to " + fingerprint
+	err := withAgent(c, func(a agent.Agent) error {
+		keys, err := a.List()
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			key, err := ssh.ParsePublicKey(k.Blob)
+			if err != nil || ssh.FingerprintSHA256(key) != fingerprint {
+				continue
+			}
+			if err := s.signChallenge(a, key, line); err != nil {
+				return fmt.Errorf("%s did not confirm the transfer (%w)", fingerprint, err)
+			}
+			to = identity.KeyID(key)
+			return nil
+		}
+		return fmt.Errorf("your agent does not hold %s, add the new key with ssh-add", fingerprint)
+	})
+	if errors.Is(err, errNoAgent) {
+		return errors.New("the new key must confirm the transfer: run it again with ssh -A, forwarding an agent holding it")
+	}
+	if err != nil {
+		return err
+	}
+
+	if held := s.reservationsOf(owner{keyID: to}); len(held) > 0 {
+		return fmt.Errorf("%s already holds %d reservations, release them first", fingerprint, len(held))
+	}
+	if ports, err := settings.Ports(c.ctx, s.cfg.Store, to); err != nil {
+		return err
+	} else if len(ports) > 0 {
+		return fmt.Errorf("%s already has options for %d tunnels, clear them first", fingerprint, len(ports))
+	}
+
+	t, err := s.transferKey(c.ctx, c.keyID, to)
+	s.cfg.Audit.Record("key_transferred", logs.Fields{"remote": c.conn.RemoteAddr().String(), "key": c.keyID, "to": to,
+		"reservations": t.reservations, "options": t.options, "plan": t.plan, "months": t.months, "tokens": t.tokens})
+	if err != nil {
+		return err
+	}
+	c.printf("Transferred %d reservations, the options of %d tunnels and %d months of usage to %s.", t.reservations, t.options, t.months, fingerprint)
+	if t.plan != "" {
+		c.printf("It is now on the %s plan.", t.plan)
+	}
+	if t.tokens > 0 {
+		c.printf("Revoked the %d tokens of this key, mint new ones with the new key.", t.tokens)
+	}
+	c.printf("Connect with the new key to serve the reserved names; its hashed URLs differ from those of this key.")
+	return nil
+}
+
+// transferKey hands what the key from owns to the key to, returning what moved so far even if it fails midway.
+func (s *Server) transferKey(ctx context.Context, from, to string) (*transferred, error) {
+	t := &transferred{}
+	now := time.Now().UTC()
+
+	s.reservations.Lock()
+	for name, r := range s.reservations.byName {
+		if !(owner{keyID: from}).owns(r) {
+			continue
+		}
+		moved := *r
+		moved.KeyID, moved.Updated = to, now
+		raw, err := json.Marshal(&moved)
+		if err != nil {
+			s.reservations.Unlock()
+			return t, err
+		}
+		if err := s.cfg.Store.Put(ctx, reservationsNamespace, name, raw); err != nil {
+			s.reservations.Unlock()
+			return t, err
+		}
+		s.unrouteReservation(r)
+		s.reservations.byName[name] = &moved
+		s.routeReservation(&moved)
+		t.reservations++
+	}
+	s.reservations.Unlock()
+
+	ports, err := settings.Ports(ctx, s.cfg.Store, from)
+	if err != nil {
+		return t, err
+	}
+	for _, port := range ports {
+		st, err := settings.Load(ctx, s.cfg.Store, from, port)
+		if err != nil {
+			return t, err
+		}
+		if _, err := s.updateSettings(ctx, to, port, func(e *settings.Endpoint) error {
+			*e = *st
+			// The salt only mattered to the hashed names of the old key.
+			e.Salt = ""
+			return nil
+		}); err != nil {
+			return t, err
+		}
+		t.options++
+	}
+
+	raw, err := s.cfg.Store.Get(ctx, keyPlansNamespace, from)
+	if err != nil {
+		return t, err
+	}
+	if raw != nil {
+		kp := &keyPlan{}
+		if err := json.Unmarshal(raw, kp); err != nil {
+			return t, err
+		}
+		if err := s.cfg.Store.Put(ctx, keyPlansNamespace, to, raw); err != nil {
+			return t, err
+		}
+		if err := s.cfg.Store.Delete(ctx, keyPlansNamespace, from); err != nil {
+			return t, err
+		}
+		s.keyPlans.Lock()
+		if s.keyPlans.byKey == nil {
+			s.keyPlans.byKey = map[string]string{}
+		}
+		s.keyPlans.byKey[to] = kp.Plan
+		delete(s.keyPlans.byKey, from)
+		s.keyPlans.Unlock()
+		t.plan = kp.Plan
+	}
+
+	if t.months, err = s.transferUsage(ctx, from, to); err != nil {
+		return t, err
+	}
+
+	tokens, err := s.apiTokensOf(ctx, from)
+	if err != nil {
+		return t, err
+	}
+	for hash := range tokens {
+		if err := s.cfg.Store.Delete(ctx, apiTokensNamespace, hash); err != nil {
+			return t, err
+		}
+		t.tokens++
+	}
+	return t, nil
+}
+
+// transferUsage adds the monthly usage of the key from to that of the key to, returning how many months had some.
+func (s *Server) transferUsage(ctx context.Context, from, to string) (int, error) {
+	s.meter.rollups.Lock()
+	defer s.meter.rollups.Unlock()
+	stored, err := s.cfg.Store.List(ctx, usageNamespace)
+	if err != nil {
+		return 0, err
+	}
+	months := 0
+	for month, raw := range stored {
+		usage := map[string]*KeyUsage{}
+		if err := json.Unmarshal(raw, &usage); err != nil {
+			return months, fmt.Errorf("usage of %s: %w", month, err)
+		}
+		u := usage[from]
+		if u == nil {
+			continue
+		}
+		total := usage[to]
+		if total == nil {
+			total = &KeyUsage{KeyID: to}
+			usage[to] = total
+		}
+		total.add(u)
+		delete(usage, from)
+		raw, err := json.Marshal(usage)
+		if err != nil {
+			return months, err
+		}
+		if err := s.cfg.Store.Put(ctx, usageNamespace, month, raw); err != nil {
+			return months, err
+		}
+		months++
+	}
+	return months, nil
+}
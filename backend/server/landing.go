@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// The domain serves a landing page rather than redirecting to docs on someone else's site: the page built in under
+// landing/, or a directory of the operator's (-landing-path) laid out the same way, whose *.html files are templates
+// of brandingData and other files served as they are. / is index.html, and only GET and HEAD requests for files it has
+// are answered, other paths being those of shared files.
+
+//go:embed landing
+var embeddedLanding embed.FS
+
+// landingMaxAge is how long browsers cache the assets of the landing page.
+const landingMaxAge = "max-age=3600"
+
+// Landing is the site of the domain; see OpenLanding.
+type Landing struct {
+	files     fs.FS
+	templates map[string]*template.Template
+}
+
+// OpenLanding reads the landing site in dir, the built-in one if empty, parsing its templates.
+func OpenLanding(dir string) (*Landing, error) {
+	var files fs.FS
+	if dir == "" {
+		var err error
+		if files, err = fs.Sub(embeddedLanding, "landing"); err != nil {
+			return nil, err
+		}
+	} else {
+		files = os.DirFS(dir)
+	}
+	l := &Landing{files: files, templates: map[string]*template.Template{}}
+	pages, err := fs.Glob(files, "*.html")
+	if err != nil {
+		return nil, err
+	}
+	for _, page := range pages {
+		if l.templates[page], err = template.ParseFS(files, page); err != nil {
+			return nil, err
+		}
+	}
+	if l.templates["index.html"] == nil {
+		return nil, fs.ErrNotExist
+	}
+	return l, nil
+}
+
+// landingFile is the file of the landing site a request is for, "" if none.
+func (l *Landing) landingFile(r *http.Request) string {
+	if l == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return ""
+	}
+	name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+	if name == "" {
+		return "index.html"
+	}
+	if l.templates[name] != nil {
+		return name
+	}
+	if info, err := fs.Stat(l.files, name); err != nil || info.IsDir() {
+		return ""
+	}
+	return name
+}
+
+// landingHandler serves a file of the landing site.
+func (s *Server) landingHandler(name string) http.Handler {
+	l := s.cfg.Landing
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if t := l.templates[name]; t != nil {
+			var page bytes.Buffer
+			if err := t.Execute(&page, brandingData{Name: s.serviceName(), Domain: s.cfg.Domain, DocsURL: s.docsURL()}); err != nil {
+				log.Printf("Could not render the landing page %s (%v)", name, err)
+				http.Error(w, "Could not render this page.", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(page.Bytes()))
+			return
+		}
+		raw, err := fs.ReadFile(l.files, name)
+		if err != nil {
+			http.Error(w, "Not found.", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Cache-Control", landingMaxAge)
+		http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(raw))
+	})
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/metrics"
+	"golang.org/x/crypto/ssh"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Owners wondering whether slowness comes from us or from their uplink get the round-trip time of keepalives
+// to their client, and how long channels to each forward take to open, which includes the client connecting to
+// its service. Both are measured all along: at every keepalive interval, and on every channel opened.
+// A client refusing channel after channel most likely forwards to a service that is not running:
+// its visitors get a plain 502, and its sessions are told, at most once a minute per forward.
+
+const (
+	refusalsBeforeWarning  = 3
+	refusalWarningInterval = time.Minute
+)
+
+var (
+	clientRefusals   = metrics.NewCounter("srvus_client_refusals_total", "Channels refused by clients, by reason.", "reason")
+	refusalsReported = metrics.NewCounter("srvus_refusals_reported_total", "Owners told their client keeps refusing channels.", "")
+)
+
+type forwardKey struct {
+	host string
+	port uint32
+}
+
+// forwardStats measures a forward of a connection.
+type forwardStats struct {
+	since          time.Time
+	lock           sync.Mutex
+	open           rttEstimator
+	opened, failed int
+	usage          tunnelUsage
+	// refusedInARow counts the channels refused since the last one opened; warned is when the owner was last told.
+	refusedInARow int
+	warned        time.Time
+	// billedUntil, billedBytes and billedRequests are how far usage was metered, see unbilled.
+	billedUntil                 time.Time
+	billedBytes, billedRequests int64
+}
+
+// record accounts for a channel opened to the forward, or refused by the client,
+// returning whether its owner should be told it keeps refusing them.
+func (f *forwardStats) record(took time.Duration, err error) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var refused *ssh.OpenChannelError
+	switch {
+	case err == nil:
+		f.opened++
+		f.refusedInARow = 0
+		f.open.update(took)
+	case errors.As(err, &refused):
+		f.failed++
+		f.refusedInARow++
+		if now := time.Now(); f.refusedInARow >= refusalsBeforeWarning && now.Sub(f.warned) >= refusalWarningInterval {
+			f.warned = now
+			return true
+		}
+	}
+	return false
+}
+
+// ConnectionStats describe a connection for its owner and operators.
+type ConnectionStats struct {
+	Remote string    `json:"remote"`
+	Since  time.Time `json:"since"`
+	// RoundTripMs is the smoothed round-trip time of keepalives, 0 until one is answered.
+	RoundTripMs float64 `json:"round_trip_ms"`
+	// MemoryBytes is what its visitors make us hold.
+	MemoryBytes int64          `json:"memory_bytes"`
+	Forwards    []ForwardStats `json:"forwards"`
+}
+
+type ForwardStats struct {
+	Port  uint32    `json:"port"`
+	Since time.Time `json:"since"`
+	// OpenMs is the smoothed time channels take to open, 0 until one is.
+	OpenMs float64 `json:"open_ms"`
+	Opened int     `json:"opened"`
+	Failed int     `json:"failed"`
+}
+
+func (s *Server) forwardUp(conn *ssh.ServerConn, host string, port uint32) {
+	s.stateOf(conn).forwards.LoadOrStore(forwardKey{host, port}, &forwardStats{since: time.Now()})
+}
+
+// forwardDown forgets the forwards of a port, whatever their bind address, closing their spare channels.
+func (s *Server) forwardDown(conn *ssh.ServerConn, port uint32) {
+	s.closeSpares(conn, port)
+	st := s.stateOf(conn)
+	forwards := &st.forwards
+	forwards.Range(func(k, v any) bool {
+		if k.(forwardKey).port == port {
+			s.meterForward(st.keyID, v.(*forwardStats))
+			forwards.Delete(k)
+		}
+		return true
+	})
+}
+
+// recordOpen accounts for a channel opened to a forward, if it is still up.
+func (s *Server) recordOpen(conn *ssh.ServerConn, host string, port uint32, took time.Duration, err error) {
+	var refused *ssh.OpenChannelError
+	if errors.As(err, &refused) {
+		switch refused.Reason {
+		case ssh.ConnectionFailed:
+			clientRefusals.Inc("connect_failed")
+		case ssh.Prohibited:
+			clientRefusals.Inc("prohibited")
+		default:
+			clientRefusals.Inc("other")
+		}
+	}
+	if f, found := s.stateOf(conn).forwards.Load(forwardKey{host, port}); found && f.(*forwardStats).record(took, err) {
+		refusalsReported.Inc("")
+		go s.notify(conn, fmt.Sprintf("%d: visitors get 502s, your service is unreachable (%s); is it running, and forwarded to the right local port?",
+			port, refusalReason(refused)))
+	}
+}
+
+// statsOf describes the connections of a key, oldest first.
+func (s *Server) statsOf(keyID string) []ConnectionStats {
+	var result []ConnectionStats
+	for _, conn := range s.registry.ConnectionsOf(keyID) {
+		st := s.stateOf(conn)
+		cs := ConnectionStats{
+			Remote:      conn.RemoteAddr().String(),
+			Since:       st.since,
+			RoundTripMs: milliseconds(time.Duration(st.rtt.Load())),
+			MemoryBytes: st.memory.Load(),
+			Forwards:    []ForwardStats{},
+		}
+		st.forwards.Range(func(k, v any) bool {
+			f := v.(*forwardStats)
+			f.lock.Lock()
+			cs.Forwards = append(cs.Forwards, ForwardStats{
+				Port:   k.(forwardKey).port,
+				Since:  f.since,
+				OpenMs: milliseconds(f.open.srtt),
+				Opened: f.opened,
+				Failed: f.failed,
+			})
+			f.lock.Unlock()
+			return true
+		})
+		sort.Slice(cs.Forwards, func(i, j int) bool { return cs.Forwards[i].Port < cs.Forwards[j].Port })
+		result = append(result, cs)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Since.Before(result[j].Since) })
+	return result
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func runStats(s *Server, c *commandContext, _ []string) error {
+	shown := 0
+	for _, cs := range s.statsOf(c.keyID) {
+		if cs.Remote == c.conn.RemoteAddr().String() {
+			// The connection running this command.
+			continue
+		}
+		line := fmt.Sprintf("%s: up %s, %s, visitors holding %s", cs.Remote, uptime(cs.Since), describeLatency("round-trip", cs.RoundTripMs), formatBytes(cs.MemoryBytes))
+		for _, f := range cs.Forwards {
+			line += fmt.Sprintf("\n  %d: up %s, %s (%d opened, %d refused)", f.Port, uptime(f.Since), describeLatency("channel opens", f.OpenMs), f.Opened, f.Failed)
+		}
+		c.printf("%s", line)
+		shown++
+	}
+	if shown == 0 {
+		c.printf("No other connection of your key.")
+	}
+	return nil
+}
+
+func uptime(since time.Time) string {
+	return time.Since(since).Truncate(time.Second).String()
+}
+
+func describeLatency(what string, ms float64) string {
+	if ms == 0 {
+		return what + ": not measured yet"
+	}
+	return fmt.Sprintf("%s: %.1fms", what, ms)
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"github.com/pcarrier/srv.us/backend/geoip"
+	"net/http"
+	"strconv"
+)
+
+// Where the server has GeoIP data, requests proxied one by one tell services where their visitor comes from:
+// X-Visitor-Country holds its ISO country code and X-Visitor-ASN its AS number, when known. Copies sent by visitors
+// are dropped, so services can trust them. Tunnels relaying bytes as they come have nowhere to add them.
+
+const (
+	visitorCountryHeader = "X-Visitor-Country"
+	visitorASNHeader     = "X-Visitor-ASN"
+)
+
+// tagLocation replaces the location headers of a request with what we know of its visitor.
+func tagLocation(r *http.Request, info geoip.Info) {
+	r.Header.Del(visitorCountryHeader)
+	r.Header.Del(visitorASNHeader)
+	if info.Country != "" {
+		r.Header.Set(visitorCountryHeader, info.Country)
+	}
+	if info.ASN != 0 {
+		r.Header.Set(visitorASNHeader, strconv.FormatUint(uint64(info.ASN), 10))
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/metrics"
+	"golang.org/x/crypto/ssh"
+	"log"
+	"sync"
+)
+
+// The memory visitors make us hold, mostly copy buffers and the bodies buffered to be mirrored or scanned,
+// is accounted to the connection serving them. A connection over MaxConnectionMemory gets no new visitors
+// until some leave, and once all of them hold more than MaxMemory, the heaviest is disconnected.
+
+// pumpBuffer is what each direction of a visitor connection or request buffers while copying.
+const pumpBuffer = 32 << 10
+
+var (
+	errMemoryExceeded = errors.New("the tunnel holds too much memory")
+
+	memoryRefused   = metrics.NewCounter("srvus_memory_refused_total", "Visitors refused as their tunnel's connection held too much memory.", "")
+	memoryEvictions = metrics.NewCounter("srvus_memory_evictions_total", "Connections closed for holding the most memory while the server held too much.", "")
+)
+
+// admitMemory accounts n bytes to conn for a new visitor or request, unless the connection already holds too much.
+func (s *Server) admitMemory(conn *ssh.ServerConn, n int64) (func(), error) {
+	if limit := s.cfg.MaxConnectionMemory; limit > 0 && s.stateOf(conn).memory.Load()+n > limit {
+		memoryRefused.Inc("")
+		return nil, errMemoryExceeded
+	}
+	return s.holdMemory(conn, n), nil
+}
+
+// holdMemory accounts n bytes already allocated to conn, until the returned function is called.
+func (s *Server) holdMemory(conn *ssh.ServerConn, n int64) func() {
+	st := s.stateOf(conn)
+	st.memory.Add(n)
+	if total := s.memory.Add(n); s.cfg.MaxMemory > 0 && total > s.cfg.MaxMemory {
+		go s.evictHeaviest()
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			st.memory.Add(-n)
+			s.memory.Add(-n)
+		})
+	}
+}
+
+// evictHeaviest disconnects the connection holding the most memory, if the others have not been disconnected
+// for it already: their memory is only released as their visitors unwind.
+func (s *Server) evictHeaviest() {
+	s.evicting.Lock()
+	defer s.evicting.Unlock()
+	var heaviest *ssh.ServerConn
+	var most, total int64
+	for _, conn := range s.registry.Connections() {
+		st := s.stateOf(conn)
+		if st.evicted.Load() {
+			continue
+		}
+		held := st.memory.Load()
+		total += held
+		if held > most {
+			heaviest, most = conn, held
+		}
+	}
+	if heaviest == nil || total <= s.cfg.MaxMemory {
+		return
+	}
+	st := s.stateOf(heaviest)
+	st.evicted.Store(true)
+	memoryEvictions.Inc("")
+	keyID := st.keyID
+	log.Printf("%s(%s) holds the most memory (%s of %s), disconnecting", heaviest.RemoteAddr(), keyID, formatBytes(most), formatBytes(total))
+	s.cfg.Audit.Record("memory_eviction", logs.Fields{"remote": heaviest.RemoteAddr().String(), "key": keyID, "bytes": most})
+	s.notify(heaviest, fmt.Sprintf("Disconnected: your visitors held %s of memory on the server, the most while it was running short.", formatBytes(most)))
+	s.closeConnection(heaviest)
+}
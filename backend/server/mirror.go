@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"github.com/pcarrier/srv.us/backend/metrics"
+	"github.com/pcarrier/srv.us/backend/registry"
+	"github.com/pcarrier/srv.us/backend/wire"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Forwards made by user+shadow@ register shadow targets: visitors never reach them,
+// but they get a copy of every request to the endpoints they shadow, and what they answer is discarded.
+
+const (
+	// maxMirroredBody bounds what we buffer to copy a request; larger requests are not mirrored.
+	maxMirroredBody    = 1 << 20
+	maxMirrorsInFlight = 64
+	mirrorTimeout      = 30 * time.Second
+)
+
+var mirrored = metrics.NewCounter("srvus_mirrored_requests_total", "Requests copied to shadow targets, or why they were not", "result")
+
+// mirror sends copies of a request about to be proxied to tgt to the shadows of endpoint, without waiting for them.
+func (s *Server) mirror(r *http.Request, endpoint string, tgt *registry.Target) {
+	shadows := s.registry.Shadows(endpoint)
+	if len(shadows) == 0 {
+		return
+	}
+	if wire.IsUpgrade(r.Header) {
+		mirrored.Inc("upgrade")
+		return
+	}
+	body, complete, err := bufferBody(r, maxMirroredBody)
+	if err != nil || !complete {
+		mirrored.Inc("too_large")
+		return
+	}
+	// The copies share the body, held until they are all sent.
+	release := s.holdMemory(tgt.Remote, int64(len(body)))
+	var copies sync.WaitGroup
+	defer func() {
+		go func() {
+			copies.Wait()
+			release()
+		}()
+	}()
+
+	for _, shadow := range shadows {
+		shadow := shadow
+		select {
+		case s.mirrors <- void{}:
+		default:
+			mirrored.Inc("overloaded")
+			continue
+		}
+		transport := s.transportFor(shadow, true)
+		ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+		out := r.Clone(ctx)
+		out.RequestURI = ""
+		out.URL.Scheme = "http"
+		out.URL.Host = endpoint
+		out.Body = io.NopCloser(bytes.NewReader(body))
+		out.ContentLength = int64(len(body))
+		copies.Add(1)
+		go func() {
+			defer func() {
+				cancel()
+				<-s.mirrors
+				copies.Done()
+			}()
+			resp, err := transport.RoundTrip(out)
+			if err != nil {
+				mirrored.Inc("failed")
+				log.Printf("Could not mirror %s %s to %v (%v)", out.Method, endpoint, shadow.Remote.RemoteAddr(), err)
+				return
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+			mirrored.Inc("sent")
+		}()
+	}
+}
+
+// bufferBody reads up to limit bytes of a request's body, leaving the request with all of it.
+// It reports whether that was the whole body.
+func bufferBody(r *http.Request, limit int64) ([]byte, bool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if r.ContentLength > limit {
+		return nil, false, nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	rest := r.Body
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buf), rest), rest}
+	if err != nil {
+		return nil, false, err
+	}
+	return buf, int64(len(buf)) <= limit, nil
+}
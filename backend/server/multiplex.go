@@ -0,0 +1,332 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/pcarrier/srv.us/backend/metrics"
+	"github.com/pcarrier/srv.us/backend/registry"
+	"github.com/pcarrier/srv.us/backend/tracing"
+	"github.com/pcarrier/srv.us/backend/wire"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tunnels forwarded by user+http@, or with HTTP options, are proxied request by request rather than byte by byte:
+// the requests of every visitor share a pool of keep-alive channels to the client,
+// instead of each visitor pinning a channel for as long as it stays connected. Visitors keep their connection alive
+// across requests, and once the target they started on stops serving the name, e.g. as its client reconnected,
+// the following requests go to whichever target serves it then.
+// Requests are screened before they are parsed (see wire.Guard), so services read them as the edge does.
+
+var (
+	requestsRejected = metrics.NewCounter("srvus_requests_rejected_total", "Requests rejected as the edge and services could read them differently, by reason", "reason")
+	visitorsRerouted = metrics.NewCounter("srvus_visitors_rerouted_total", "Keep-alive visitors whose next request went to another target, as theirs stopped serving the name.", "")
+)
+
+const (
+	// maxChannelsPerForward bounds the channels a forward's pool opens; further requests wait for one.
+	maxChannelsPerForward = 32
+	idleChannelTimeout    = 30 * time.Second
+	// visitorIdleTimeout is how long a visitor's connection is kept alive between requests.
+	visitorIdleTimeout = 2 * time.Minute
+)
+
+// newTransport pools channels forwarded to a connection's forward of host and port.
+func (s *Server) newTransport(conn *ssh.ServerConn, host string, port uint32) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			ch, reqs, err := retryOpen(ctx, timeoutsFrom(ctx), func(ctx context.Context, retry int) (ssh.Channel, <-chan *ssh.Request, error) {
+				if retry > 0 {
+					openRetries.Inc("same")
+				}
+				return s.takeChannel(ctx, conn, host, port, nil)
+			})
+			if err != nil {
+				return nil, err
+			}
+			go ssh.DiscardRequests(reqs)
+			return &channelConn{Channel: ch, conn: conn, chaos: s.cfg.Chaos}, nil
+		},
+		MaxConnsPerHost:     maxChannelsPerForward,
+		MaxIdleConnsPerHost: maxChannelsPerForward,
+		IdleConnTimeout:     idleChannelTimeout,
+		DisableCompression:  true,
+	}
+}
+
+// reroute returns the target for the next request of a visitor of name served by tgt so far: tgt while it serves
+// the name, otherwise one the router picks. It returns tgt and false if no other target serves the name.
+func (s *Server) reroute(name string, tgt *registry.Target) (*registry.Target, bool) {
+	if s.registry.Serving(name, tgt) {
+		return tgt, true
+	}
+	if next := s.router.Route(name); next != nil {
+		return next, true
+	}
+	return tgt, false
+}
+
+// refusal is why a visitor rerouted to tgt must not reach it, with the status to answer, or "" if it may.
+func (s *Server) refusal(visitor net.Addr, tgt *registry.Target) (int, string) {
+	if !s.admits(tgt, s.cfg.GeoIP.LookupAddr(visitor)) {
+		return http.StatusForbidden, s.page("location_forbidden")
+	}
+	if reason := suspended(tgt); reason != "" {
+		return http.StatusForbidden, s.page("suspended")
+	}
+	if page := paused(tgt); page != "" {
+		return http.StatusServiceUnavailable, page
+	}
+	return 0, ""
+}
+
+// serveMultiplexed proxies the requests of a visitor through the pool of the target's forward, or of the target
+// serving the name after it (see reroute).
+// Requests are traced under the visitor's connection, unless they continue a trace of their own (traceparent).
+func (s *Server) serveMultiplexed(ctx context.Context, https *tls.Conn, name string, tgt *registry.Target, transport *http.Transport) {
+	var handlers sync.WaitGroup
+	// served is the target the visitor's last request went to.
+	var served atomic.Pointer[registry.Target]
+	served.Store(tgt)
+	guard := wire.NewGuard(https)
+	l := &oneConnListener{conn: guard, closed: make(chan void)}
+	location := s.cfg.GeoIP.LookupAddr(https.RemoteAddr())
+	proxy := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = name
+			rewriteHost(r, served.Load())
+			tagLocation(r, location)
+		},
+		Transport:     timeoutTransport{routedTransport{transport}},
+		FlushInterval: -1,
+		ModifyResponse: func(resp *http.Response) error {
+			current := served.Load()
+			untagResponse(resp)
+			s.addRobotsTag(resp, name, current)
+			addHeaders(resp, current)
+			if err := s.scanResponse(resp, name, current); err != nil {
+				return err
+			}
+			compressResponse(resp, current)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if errors.Is(err, errBlocked) {
+				http.Error(w, "Blocked by content scanning.", http.StatusForbidden)
+				return
+			}
+			if isBusy(err) {
+				for k, v := range retryLaterHeader() {
+					w.Header()[k] = v
+				}
+				http.Error(w, s.page("busy"), http.StatusServiceUnavailable)
+				return
+			}
+			if errors.Is(err, errConnectTimeout) || errors.Is(err, errResponseHeaderTimeout) || errors.Is(err, errRequestTimeout) {
+				http.Error(w, s.page("timeout"), http.StatusGatewayTimeout)
+				return
+			}
+			log.Printf("%v:%s→%v request failed (%v)", served.Load().Remote.RemoteAddr(), name, r.RemoteAddr, err)
+			http.Error(w, s.page("unreachable"), http.StatusBadGateway)
+		},
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers.Add(1)
+			defer handlers.Done()
+			current, serving := s.reroute(name, served.Load())
+			if current != served.Load() {
+				if status, refusal := s.refusal(https.RemoteAddr(), current); refusal != "" {
+					w.Header().Set("Connection", "close")
+					http.Error(w, refusal, status)
+					return
+				}
+				visitorsRerouted.Inc("")
+				served.Store(current)
+			}
+			defer current.Hold()()
+			r, span := s.traceRequest(r)
+			defer span.End()
+			span.Set("srvus.request_id", tagRequest(w, r))
+			if !serving || current.Draining() {
+				// Nothing else serves the name: serve this request, then let the visitor reconnect once it does.
+				w.Header().Set("Connection", "close")
+			}
+			current.Touch()
+			cw := &countingWriter{ResponseWriter: w, status: http.StatusOK}
+			start := time.Now()
+			routed := s.route(r, current)
+			release, err := s.admitMemory(current.Remote, pumpBuffer)
+			if err == nil {
+				defer release()
+			}
+			if a := s.answerAtEdge(r, name, current); a != nil {
+				a.write(cw, r)
+			} else if err != nil {
+				for k, v := range retryLaterHeader() {
+					cw.Header()[k] = v
+				}
+				http.Error(cw, s.page("busy"), http.StatusServiceUnavailable)
+			} else if routed == nil {
+				http.Error(cw, s.page("path_down"), http.StatusBadGateway)
+			} else if s.admitRequest(cw, r, name, current) && s.scanRequest(cw, r, name, current) {
+				if routed != current {
+					defer routed.Hold()()
+					routed.Touch()
+				}
+				// The proxy's own transport pools the channels of tgt, the target the visitor started on.
+				if routed != tgt {
+					r = s.withRoute(r, routed)
+				}
+				r = s.withTimeouts(r, routed)
+				s.mirror(r, name, current)
+				proxy.ServeHTTP(cw, r)
+			}
+			current.Touch()
+			span.Set("http.response.status_code", cw.status)
+			received := r.ContentLength
+			if received < 0 {
+				received = 0
+			}
+			proxiedIn.Add(received)
+			proxiedOut.Add(cw.written)
+			s.traffic.of(name).Add(received + cw.written)
+			usage := s.usageOf(current)
+			usage.visited(https.RemoteAddr())
+			usage.requested(r.URL.Path)
+			usage.moved(received + cw.written)
+			ex := &wire.Exchange{
+				Request:       r,
+				Response:      &http.Response{StatusCode: cw.status, Header: cw.Header()},
+				Start:         start,
+				ResponseBytes: cw.written,
+			}
+			s.cfg.Access.Record(name, current.KeyID, https.RemoteAddr(), ex)
+			s.fed(current, ex, location)
+		}),
+		// Serve returns once the visitor is gone, or taken over by an upgraded (e.g. WebSocket) handler.
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateHijacked {
+				guard.Pass()
+			}
+			if state == http.StateClosed || state == http.StateHijacked {
+				l.Close()
+			}
+		},
+		BaseContext: func(net.Listener) context.Context { return ctx },
+		IdleTimeout: visitorIdleTimeout,
+		ErrorLog:    log.New(io.Discard, "", 0),
+	}
+	_ = srv.Serve(l)
+	handlers.Wait()
+	if rejected := guard.Rejected(); rejected != nil {
+		requestsRejected.Inc(rejected.Reason)
+		log.Printf("%v:%s→%v %v", served.Load().Remote.RemoteAddr(), name, https.RemoteAddr(), rejected)
+	}
+}
+
+// channelConn is a forwarded channel used as a connection by the HTTP transport.
+type channelConn struct {
+	ssh.Channel
+	conn  *ssh.ServerConn
+	chaos Chaos
+}
+
+func (c *channelConn) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	if n > 0 {
+		if cerr := c.chaos.read(); cerr != nil {
+			_ = c.Channel.Close()
+			return 0, cerr
+		}
+	}
+	return n, err
+}
+
+func (c *channelConn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *channelConn) RemoteAddr() net.Addr               { return c.conn.RemoteAddr() }
+func (c *channelConn) SetDeadline(_ time.Time) error      { return nil }
+func (c *channelConn) SetReadDeadline(_ time.Time) error  { return nil }
+func (c *channelConn) SetWriteDeadline(_ time.Time) error { return nil }
+
+// oneConnListener hands a single connection to an http.Server, then blocks until closed.
+type oneConnListener struct {
+	lock   sync.Mutex
+	conn   net.Conn
+	once   sync.Once
+	closed chan void
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	l.lock.Lock()
+	c := l.conn
+	l.conn = nil
+	l.lock.Unlock()
+	if c != nil {
+		return c, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *oneConnListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *oneConnListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// countingWriter records the status and size of a response, for the access log.
+type countingWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *countingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController flush and hijack the underlying writer.
+func (w *countingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// traceRequest starts the span of a request, and has the service continue its trace.
+func (s *Server) traceRequest(r *http.Request) (*http.Request, *tracing.Span) {
+	var ctx context.Context
+	var span *tracing.Span
+	if remote := tracing.ParseTraceparent(r.Header.Get("Traceparent")); remote.Valid() {
+		ctx, span = s.cfg.Tracer.StartTrace(r.Context(), remote, "request", tracing.Server)
+	} else {
+		ctx, span = s.cfg.Tracer.Start(r.Context(), "request", tracing.Server)
+	}
+	if span == nil {
+		return r, nil
+	}
+	span.Set("http.request.method", r.Method)
+	span.Set("url.path", r.URL.Path)
+	r.Header.Set("Traceparent", span.Context().Traceparent())
+	return r.WithContext(ctx), span
+}
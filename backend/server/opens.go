@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/pcarrier/srv.us/backend/metrics"
+	"github.com/pcarrier/srv.us/backend/tracing"
+	"github.com/pcarrier/srv.us/backend/wire"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errOpenQueueFull = errors.New("too many visitors waiting for the tunnel")
+	errOpenTimedOut  = errors.New("timed out waiting for the tunnel")
+
+	refusedOpens = metrics.NewCounter("srvus_channel_opens_refused_total", "Visitors turned away because their tunnel's client was busy opening channels.", "reason")
+)
+
+// channelOpenRetryAfter is suggested to visitors turned away by a busy client.
+const channelOpenRetryAfter = 5 * time.Second
+
+// openLimiter bounds the channel opens in flight to a connection, and the visitors waiting for one.
+type openLimiter struct {
+	slots   chan void
+	waiting atomic.Int32
+}
+
+func newOpenLimiter(slots int) *openLimiter {
+	return &openLimiter{slots: make(chan void, slots)}
+}
+
+// acquire waits for an open slot, unless the queue is full, the wait times out or ctx ends.
+func (l *openLimiter) acquire(ctx context.Context, queue int, timeout time.Duration) error {
+	select {
+	case l.slots <- v:
+		return nil
+	default:
+	}
+	if l.waiting.Add(1) > int32(queue) {
+		l.waiting.Add(-1)
+		refusedOpens.Inc("queue_full")
+		return errOpenQueueFull
+	}
+	defer l.waiting.Add(-1)
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case l.slots <- v:
+		return nil
+	case <-t.C:
+		refusedOpens.Inc("timeout")
+		return errOpenTimedOut
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *openLimiter) release() {
+	<-l.slots
+}
+
+// openChannel opens a channel forwarded to a connection's forward of host and port,
+// queueing behind the opens already in flight to it. Its origin is the address of the visitor it serves,
+// if only one, or ours and a port numbering it, as for pooled channels, probes, and SyntheticOrigins.
+func (s *Server) openChannel(ctx context.Context, conn *ssh.ServerConn, host string, port uint32, origin net.Addr) (ssh.Channel, <-chan *ssh.Request, error) {
+	_, span := s.cfg.Tracer.Start(ctx, "ssh.channel_open", tracing.Client)
+	defer span.End()
+	span.Set("srvus.port", port)
+	var l *openLimiter
+	if s.cfg.MaxChannelOpens > 0 {
+		l = s.stateOf(conn).opens
+		if err := l.acquire(ctx, s.cfg.ChannelOpenQueue, s.cfg.ChannelOpenTimeout); err != nil {
+			span.Fail(err)
+			return nil, nil, err
+		}
+	}
+	data := &wire.ForwardedChannelData{DestAddr: host, DestPort: port}
+	release := func() {}
+	if tcp, ok := origin.(*net.TCPAddr); ok && !s.cfg.SyntheticOrigins {
+		data.OriginAddr, data.OriginPort = tcp.IP.String(), uint32(tcp.Port)
+	} else {
+		originPort := s.registry.NewPort(conn)
+		data.OriginAddr, data.OriginPort = s.cfg.Domain, uint32(originPort)
+		release = func() { s.registry.ReleasePort(conn, originPort) }
+	}
+
+	// The client may take its time answering, so we give up once ctx ends; the open still holds its slot until then.
+	type opened struct {
+		ch   ssh.Channel
+		reqs <-chan *ssh.Request
+		err  error
+	}
+	done := make(chan opened, 1)
+	go func() {
+		if l != nil {
+			defer l.release()
+		}
+		start := time.Now()
+		ch, reqs, err := conn.OpenChannel("forwarded-tcpip", ssh.Marshal(data))
+		s.recordOpen(conn, host, port, time.Since(start), err)
+		if err != nil {
+			release()
+			done <- opened{err: err}
+			return
+		}
+		done <- opened{ch: &originChannel{Channel: ch, release: release}, reqs: reqs}
+	}()
+	select {
+	case o := <-done:
+		span.Fail(o.err)
+		return o.ch, o.reqs, o.err
+	case <-ctx.Done():
+		span.Fail(ctx.Err())
+		go func() {
+			if o := <-done; o.err == nil {
+				go ssh.DiscardRequests(o.reqs)
+				_ = o.ch.Close()
+			}
+		}()
+		return nil, nil, ctx.Err()
+	}
+}
+
+// originChannel gives its origin port back, if numbered, once closed.
+type originChannel struct {
+	ssh.Channel
+	once    sync.Once
+	release func()
+}
+
+func (c *originChannel) Close() error {
+	c.once.Do(c.release)
+	return c.Channel.Close()
+}
+
+// isBusy reports whether an open failed because the client could not keep up.
+func isBusy(err error) bool {
+	return errors.Is(err, errOpenQueueFull) || errors.Is(err, errOpenTimedOut)
+}
+
+func retryLaterHeader() http.Header {
+	return http.Header{"Retry-After": {strconv.Itoa(int(channelOpenRetryAfter.Seconds()))}}
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Operators group the keys of a team into an organization through the admin API, listing member keys,
+// or verified accounts (github:<login>, gitlab:<login>) whose keys are members. Members connecting as
+// user+org=<org>@ serve its names together, <org>.org.srv.us for port 1 and <org>--<port>.org.srv.us for others,
+// and the names reserved for it, which they manage through the API within the quota of the organization.
+
+const (
+	orgsNamespace = "orgs"
+	// orgLabel holds the names of organizations under the domain.
+	orgLabel = "org"
+	// maxOrgReservations bounds the reservations of an organization without its own quota.
+	maxOrgReservations = 50
+	maxOrgMembers      = 1000
+)
+
+var orgNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,38}[a-z0-9])?$`)
+
+type Org struct {
+	Name string `json:"name"`
+	// Keys are the IDs of member keys.
+	Keys []string `json:"keys,omitempty"`
+	// Accounts are verified accounts whose keys are members, github:<login> or gitlab:<login>.
+	Accounts []string `json:"accounts,omitempty"`
+	// MaxReservations bounds what members reserve for the organization, maxOrgReservations if 0.
+	MaxReservations int       `json:"max_reservations,omitempty"`
+	Created         time.Time `json:"created"`
+}
+
+func (o *Org) validate() error {
+	if !orgNamePattern.MatchString(o.Name) || strings.Contains(o.Name, "--") {
+		return fmt.Errorf("invalid organization %q, expected up to 40 lowercase letters, digits and single dashes", o.Name)
+	}
+	if len(o.Keys)+len(o.Accounts) > maxOrgMembers {
+		return fmt.Errorf("at most %d members", maxOrgMembers)
+	}
+	for i, account := range o.Accounts {
+		provider, login, found := strings.Cut(strings.ToLower(account), ":")
+		if !found || (provider != "github" && provider != "gitlab") || login == "" {
+			return fmt.Errorf("invalid account %q, expected github:<login> or gitlab:<login>", account)
+		}
+		o.Accounts[i] = provider + ":" + login
+	}
+	if o.MaxReservations < 0 {
+		return errors.New("the reservation quota cannot be negative")
+	}
+	return nil
+}
+
+// admits tells whether a key is a member, as listed or through the accounts its connection verified.
+func (o *Org) admits(keyID, login string, github, gitlab bool) bool {
+	login = strings.ToLower(login)
+	return contains(o.Keys, keyID) ||
+		(github && contains(o.Accounts, "github:"+login)) ||
+		(gitlab && contains(o.Accounts, "gitlab:"+login))
+}
+
+func (o *Org) reservationQuota() int {
+	if o.MaxReservations > 0 {
+		return o.MaxReservations
+	}
+	return maxOrgReservations
+}
+
+func (s *Server) loadOrg(ctx context.Context, name string) (*Org, error) {
+	raw, err := s.cfg.Store.Get(ctx, orgsNamespace, name)
+	if err != nil || raw == nil {
+		return nil, err
+	}
+	o := &Org{}
+	if err := json.Unmarshal(raw, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// orgEndpoints lists the names members of an organization serve for a port.
+func (s *Server) orgEndpoints(org string, port uint32) []string {
+	if port == 1 {
+		return []string{fmt.Sprintf("%s.%s.%s", org, orgLabel, s.cfg.Domain)}
+	}
+	return []string{fmt.Sprintf("%s--%d.%s.%s", org, port, orgLabel, s.cfg.Domain)}
+}
+
+// orgNames lists the names members of an organization serve together for a port: its own, then those reserved for it.
+func (s *Server) orgNames(org string, port uint32) []string {
+	if org == "" {
+		return nil
+	}
+	return append(s.orgEndpoints(org, port), s.reservedNames(owner{org: org}, port)...)
+}
+
+// joinOrg checks that a connection asking to serve an organization may, returning its name, or why it may not.
+func (s *Server) joinOrg(ctx context.Context, name, keyID, login string, github, gitlab bool) (string, error) {
+	name = strings.ToLower(name)
+	o, err := s.loadOrg(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if o == nil || !o.admits(keyID, login, github, gitlab) {
+		return "", fmt.Errorf("not a member of the organization %s, serving your own names only", name)
+	}
+	return name, nil
+}
+
+// memberKey tells whether a key may manage the reservations of an organization through the API:
+// it must be listed, or have a connection that joined it.
+func (s *Server) memberKey(ctx context.Context, org, keyID string) (bool, error) {
+	o, err := s.loadOrg(ctx, org)
+	if err != nil || o == nil {
+		return false, err
+	}
+	if contains(o.Keys, keyID) {
+		return true, nil
+	}
+	for _, conn := range s.registry.ConnectionsOf(keyID) {
+		if s.stateOf(conn).orgName() == org {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// apiOrg serves /api/orgs/<org>/reservations[/<id>] for members.
+func (s *Server) apiOrg(w http.ResponseWriter, r *http.Request, keyID string, parts []string) {
+	org := parts[0]
+	member, err := s.memberKey(r.Context(), org, keyID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	switch {
+	case !member:
+		writeJSONError(w, http.StatusForbidden, fmt.Errorf("not a member of the organization %s", org))
+	case len(parts) == 2 && parts[1] == "reservations":
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.reservationsOf(owner{org: org}))
+	case len(parts) == 3 && parts[1] == "reservations":
+		s.serveReservation(w, r, owner{keyID: keyID, org: org}, parts[2], false)
+	default:
+		writeJSONError(w, http.StatusNotFound, errNotFound)
+	}
+}
+
+// adminOrgs lists the organizations (GET), sets the one given as ?name=<name> (PUT, with a JSON Org) or removes it (DELETE),
+// once its reservations are released.
+func (s *Server) adminOrgs(w http.ResponseWriter, r *http.Request) {
+	name := strings.ToLower(r.URL.Query().Get("name"))
+	switch r.Method {
+	case http.MethodGet:
+		stored, err := s.cfg.Store.List(r.Context(), orgsNamespace)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		orgs := []*Org{}
+		for _, raw := range stored {
+			o := &Org{}
+			if err := json.Unmarshal(raw, o); err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if name == "" || o.Name == name {
+				orgs = append(orgs, o)
+			}
+		}
+		sort.Slice(orgs, func(i, j int) bool { return orgs[i].Name < orgs[j].Name })
+		writeJSON(w, http.StatusOK, orgs)
+	case http.MethodPut:
+		o := &Org{}
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(o); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		o.Name = name
+		if err := o.validate(); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		previous, err := s.loadOrg(r.Context(), name)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		o.Created = time.Now().UTC()
+		if previous != nil {
+			o.Created = previous.Created
+		}
+		raw, err := json.Marshal(o)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if err := s.cfg.Store.Put(r.Context(), orgsNamespace, name, raw); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		s.cfg.Audit.Record("org_set", logs.Fields{"name": name, "keys": o.Keys, "accounts": o.Accounts, "max_reservations": o.MaxReservations})
+		writeJSON(w, http.StatusOK, o)
+	case http.MethodDelete:
+		if held := s.reservationsOf(owner{org: name}); len(held) > 0 {
+			writeJSONError(w, http.StatusConflict, fmt.Errorf("release the %d reservations of %s first", len(held), name))
+			return
+		}
+		if err := s.cfg.Store.Delete(r.Context(), orgsNamespace, name); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		s.cfg.Audit.Record("org_removed", logs.Fields{"name": name})
+		writeJSON(w, http.StatusOK, map[string]string{"name": name})
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/registry"
+	"github.com/pcarrier/srv.us/backend/settings"
+	"strings"
+	"time"
+)
+
+const defaultPauseMessage = "This service is down for maintenance, retry later."
+
+// maxPauseMessage keeps maintenance pages short; they are plain text anyway.
+const maxPauseMessage = 1024
+
+func runPause(s *Server, c *commandContext, args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	port, err := parsePort(args[0])
+	if err != nil {
+		return err
+	}
+	message := strings.Join(args[1:], " ")
+	if len(message) > maxPauseMessage {
+		message = message[:maxPauseMessage]
+	}
+
+	st, err := s.updateSettings(c.ctx, c.keyID, port, func(st *settings.Endpoint) error {
+		st.Paused = &settings.Pause{Message: message, Since: time.Now()}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.cfg.Audit.Record("tunnel_paused", logs.Fields{"key": c.keyID, "port": port})
+	c.printf("%d: paused, visitors get: %s", port, pauseMessage(st.Paused))
+	return nil
+}
+
+func runResume(s *Server, c *commandContext, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	port, err := parsePort(args[0])
+	if err != nil {
+		return err
+	}
+
+	var since time.Time
+	if _, err := s.updateSettings(c.ctx, c.keyID, port, func(st *settings.Endpoint) error {
+		if st.Paused != nil {
+			since = st.Paused.Since
+		}
+		st.Paused = nil
+		return nil
+	}); err != nil {
+		return err
+	}
+	if since.IsZero() {
+		c.printf("%d: was not paused", port)
+		return nil
+	}
+	s.cfg.Audit.Record("tunnel_resumed", logs.Fields{"key": c.keyID, "port": port})
+	c.printf("%d: resumed after %s", port, time.Since(since).Round(time.Second))
+	return nil
+}
+
+// paused returns the maintenance page of a target whose owner paused it, or "".
+func paused(t *registry.Target) string {
+	if st := t.Settings.Load(); st != nil && st.Paused != nil {
+		return pauseMessage(st.Paused)
+	}
+	return ""
+}
+
+func pauseMessage(p *settings.Pause) string {
+	if p.Message == "" {
+		return defaultPauseMessage
+	}
+	return p.Message
+}
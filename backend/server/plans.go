@@ -0,0 +1,261 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/settings"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operators of paid instances sort keys into plans with a YAML file (-plans-path), e.g.
+//
+//	default: free
+//	plans:
+//	  free:
+//	    max_tunnels: 3
+//	    max_reservations: 1
+//	    connections_per_minute: 600
+//	  pro:
+//	    max_reservations: 50
+//	    custom_domains: true
+//
+// and assign them to keys through the admin API (PUT /plans?key=<key ID> with {"plan": "pro"}); other keys are on
+// the default plan. Forwards past the tunnels of a plan are refused, and so are reservations past its names or for
+// custom domains it lacks; at the edge, visitors past its connections are asked to retry later, and custom domains
+// reserved before a downgrade are no longer served. Without plans, keys are only bound by the server-wide limits.
+
+const keyPlansNamespace = "key-plans"
+
+// Plans are what operators offer.
+type Plans struct {
+	// Default is the plan of keys without one.
+	Default string           `yaml:"default"`
+	Plans   map[string]*Plan `yaml:"plans"`
+}
+
+// Plan bounds what the keys on it do; 0 means unlimited, unless stated otherwise.
+type Plan struct {
+	// MaxTunnels bounds the ports a key forwards at once, across its connections.
+	MaxTunnels int `yaml:"max_tunnels" json:"max_tunnels"`
+	// MaxReservations bounds the names a key reserves, maxReservations if 0.
+	MaxReservations int `yaml:"max_reservations" json:"max_reservations"`
+	// CustomDomains lets a key reserve and serve names outside the domain.
+	CustomDomains bool `yaml:"custom_domains" json:"custom_domains"`
+	// ConnectionsPerMinute bounds the visitor connections the tunnels of a key accept, in bursts of as many.
+	ConnectionsPerMinute int `yaml:"connections_per_minute" json:"connections_per_minute"`
+}
+
+// unplanned is what keys may do without plans: custom domains are then left to operators.
+var unplanned = &Plan{}
+
+// ParsePlans reads plans, checking them.
+func ParsePlans(raw []byte) (*Plans, error) {
+	var p Plans
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	if err := dec.Decode(&p); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if p.Plans[p.Default] == nil {
+		return nil, fmt.Errorf("the default plan %q is not defined", p.Default)
+	}
+	for name, plan := range p.Plans {
+		if plan == nil {
+			return nil, fmt.Errorf("plan %s: empty", name)
+		}
+		if plan.MaxTunnels < 0 || plan.MaxReservations < 0 || plan.ConnectionsPerMinute < 0 {
+			return nil, fmt.Errorf("plan %s: limits cannot be negative", name)
+		}
+	}
+	return &p, nil
+}
+
+func (p *Plan) reservationQuota() int {
+	if p.MaxReservations > 0 {
+		return p.MaxReservations
+	}
+	return maxReservations
+}
+
+// keyPlan is stored under the ID of a key assigned a plan.
+type keyPlan struct {
+	Plan    string    `json:"plan"`
+	Updated time.Time `json:"updated"`
+}
+
+// keyPlans holds the plans assigned to keys, as they are looked up by every visitor connection.
+type keyPlans struct {
+	sync.Mutex
+	byKey map[string]string
+}
+
+func (s *Server) loadKeyPlans(ctx context.Context) error {
+	stored, err := s.cfg.Store.List(ctx, keyPlansNamespace)
+	if err != nil {
+		return err
+	}
+	s.keyPlans.Lock()
+	defer s.keyPlans.Unlock()
+	s.keyPlans.byKey = map[string]string{}
+	for keyID, raw := range stored {
+		kp := &keyPlan{}
+		if err := json.Unmarshal(raw, kp); err != nil {
+			return fmt.Errorf("plan of %s: %w", keyID, err)
+		}
+		s.keyPlans.byKey[keyID] = kp.Plan
+	}
+	return nil
+}
+
+// planOf returns the name and limits of the plan of a key. Keys assigned a plan the operator since removed are on the default one.
+func (s *Server) planOf(keyID string) (string, *Plan) {
+	if s.cfg.Plans == nil {
+		return "", unplanned
+	}
+	s.keyPlans.Lock()
+	name := s.keyPlans.byKey[keyID]
+	s.keyPlans.Unlock()
+	if plan := s.cfg.Plans.Plans[name]; plan != nil {
+		return name, plan
+	}
+	return s.cfg.Plans.Default, s.cfg.Plans.Plans[s.cfg.Plans.Default]
+}
+
+// exceedsTunnels tells whether forwarding a port would take a key past the tunnels of its plan.
+// Ports it already forwards, e.g. from other connections for load balancing, do not count again.
+func (s *Server) exceedsTunnels(keyID string, port uint32) (string, int, bool) {
+	name, plan := s.planOf(keyID)
+	if plan.MaxTunnels == 0 {
+		return name, 0, false
+	}
+	ports := map[uint32]void{}
+	for _, conn := range s.registry.ConnectionsOf(keyID) {
+		for ref := range s.registry.TunnelsOf(conn) {
+			ports[ref.Port] = void{}
+		}
+	}
+	if _, found := ports[port]; found {
+		return name, plan.MaxTunnels, false
+	}
+	return name, plan.MaxTunnels, len(ports) >= plan.MaxTunnels
+}
+
+// customDomain tells whether a name lies outside the domain.
+func (s *Server) customDomain(name string) bool {
+	return name != s.cfg.Domain && !strings.HasSuffix(name, "."+s.cfg.Domain)
+}
+
+// overPlan tells visitors of a tunnel why the plan of its key keeps them out, if it does, with the status to answer.
+func (s *Server) overPlan(name, keyID string) (string, string) {
+	if s.cfg.Plans == nil {
+		return "", ""
+	}
+	_, plan := s.planOf(keyID)
+	if !plan.CustomDomains && s.customDomain(name) {
+		s.reservations.Lock()
+		r := s.reservations.byName[name]
+		if _, parent, _ := strings.Cut(name, "."); r == nil {
+			r = s.reservations.byName["*."+parent]
+		}
+		s.reservations.Unlock()
+		// Organizations get custom domains from operators, whatever the plans of their members.
+		if r == nil || r.Org == "" {
+			return "404 Not Found", "This domain is not served by the plan of its tunnel."
+		}
+	}
+	if plan.ConnectionsPerMinute > 0 {
+		limit := &settings.RateLimit{PerMinute: plan.ConnectionsPerMinute, Burst: plan.ConnectionsPerMinute}
+		if wait := s.rates.take(keyID, 0, "", limit); wait > 0 {
+			return "429 Too Many Requests", "The tunnel is over the connections of its plan, retry later."
+		}
+	}
+	return "", ""
+}
+
+// PlanAssignment is the plan of a key, as the admin API shows it.
+type PlanAssignment struct {
+	KeyID  string `json:"key"`
+	Plan   string `json:"plan"`
+	Limits *Plan  `json:"limits"`
+}
+
+// adminPlans lists the plans (GET without ?key=), or shows (GET), assigns (PUT, with {"plan": "<name>"}) or unassigns (DELETE)
+// the plan of the key given as ?key=<key ID>.
+func (s *Server) adminPlans(w http.ResponseWriter, r *http.Request) {
+	keyID := r.URL.Query().Get("key")
+	if s.cfg.Plans == nil {
+		writeJSONError(w, http.StatusNotFound, errors.New("no plans, see -plans-path"))
+		return
+	}
+	if keyID == "" {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusBadRequest, errors.New("missing key"))
+			return
+		}
+		writeJSON(w, http.StatusOK, s.cfg.Plans.Plans)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		kp := &keyPlan{}
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(kp); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		if s.cfg.Plans.Plans[kp.Plan] == nil {
+			names := make([]string, 0, len(s.cfg.Plans.Plans))
+			for name := range s.cfg.Plans.Plans {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("unknown plan %q, expected one of %s", kp.Plan, strings.Join(names, ", ")))
+			return
+		}
+		kp.Updated = time.Now().UTC()
+		raw, err := json.Marshal(kp)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if err := s.cfg.Store.Put(r.Context(), keyPlansNamespace, keyID, raw); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		s.keyPlans.Lock()
+		if s.keyPlans.byKey == nil {
+			s.keyPlans.byKey = map[string]string{}
+		}
+		s.keyPlans.byKey[keyID] = kp.Plan
+		s.keyPlans.Unlock()
+		s.cfg.Audit.Record("plan_set", logs.Fields{"key": keyID, "plan": kp.Plan})
+	case http.MethodDelete:
+		if err := s.cfg.Store.Delete(r.Context(), keyPlansNamespace, keyID); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		s.keyPlans.Lock()
+		delete(s.keyPlans.byKey, keyID)
+		s.keyPlans.Unlock()
+		s.cfg.Audit.Record("plan_set", logs.Fields{"key": keyID, "plan": s.cfg.Plans.Default})
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+		return
+	}
+	name, plan := s.planOf(keyID)
+	writeJSON(w, http.StatusOK, PlanAssignment{KeyID: keyID, Plan: name, Limits: plan})
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/wire"
+	"gopkg.in/yaml.v3"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Operators reserve parts of the endpoint namespace with a YAML policy (-label-policy-path), e.g.
+//
+//	rules:
+//	  - ports: 1000-65535
+//	    allow: verified
+//	  - names: [www, admin]
+//	    keys: ["SHA256:…"]
+//	    message: reserved for the project's own sites
+//
+// The first rule matching a forward decides whether it may go on. Rules with names reserve the
+// subdomains of those accounts: others keep their hashed names, and cannot reserve them under the domain either.
+// Rules without refuse the forward.
+
+// LabelPolicy reserves ports and account names for some keys.
+type LabelPolicy struct {
+	Rules []*LabelRule `yaml:"rules"`
+}
+
+// LabelRule matches forwards of Ports and the accounts of Names, and lets through those it allows.
+type LabelRule struct {
+	// Ports is a port or range of them, e.g. 1000-65535, every port if empty.
+	Ports string `yaml:"ports"`
+	// Names are the logins of accounts, e.g. www for www.gh.srv.us, any if empty.
+	Names []string `yaml:"names"`
+	// Allow is verified for keys GitHub or GitLab vouched for, or empty for none but Keys, SHA256 fingerprints.
+	Allow string   `yaml:"allow"`
+	Keys  []string `yaml:"keys"`
+	// Message explains refusals to clients.
+	Message string `yaml:"message"`
+
+	from, to uint32
+}
+
+// ParseLabelPolicy reads a policy, checking its rules.
+func ParseLabelPolicy(raw []byte) (*LabelPolicy, error) {
+	var p LabelPolicy
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	if err := dec.Decode(&p); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	for i, r := range p.Rules {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+	return &p, nil
+}
+
+func (r *LabelRule) validate() error {
+	if r.Ports == "" && len(r.Names) == 0 {
+		return errors.New("expected ports, names, or both")
+	}
+	if r.Allow != "" && r.Allow != "verified" {
+		return fmt.Errorf("invalid allow %q, expected verified or nothing", r.Allow)
+	}
+	r.from, r.to = 1, wire.MaxBindPort
+	if r.Ports != "" {
+		from, to, isRange := strings.Cut(r.Ports, "-")
+		if !isRange {
+			to = from
+		}
+		first, err := strconv.ParseUint(from, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid ports %q", r.Ports)
+		}
+		last, err := strconv.ParseUint(to, 10, 32)
+		if err != nil || first == 0 || last > wire.MaxBindPort || first > last {
+			return fmt.Errorf("invalid ports %q, expected e.g. 1000-65535", r.Ports)
+		}
+		r.from, r.to = uint32(first), uint32(last)
+	}
+	for i, name := range r.Names {
+		r.Names[i] = strings.ToLower(name)
+	}
+	return nil
+}
+
+// labelClaim is what a forward would take from the namespace.
+type labelClaim struct {
+	port        uint32
+	login       string
+	fingerprint string
+	// accounts is whether the forward gets subdomains of login, which verified it.
+	accounts bool
+}
+
+// rule returns the first rule matching a claim, nil if none does.
+func (p *LabelPolicy) rule(c labelClaim) *LabelRule {
+	if p == nil {
+		return nil
+	}
+	for _, r := range p.Rules {
+		if c.port < r.from || c.port > r.to {
+			continue
+		}
+		if len(r.Names) > 0 && (!c.accounts || !contains(r.Names, strings.ToLower(c.login))) {
+			continue
+		}
+		return r
+	}
+	return nil
+}
+
+func (r *LabelRule) allows(c labelClaim) bool {
+	return (r.Allow == "verified" && c.accounts) || contains(r.Keys, c.fingerprint)
+}
+
+// check tells whether a claim may go on: refused if the forward may not, withheld if only its account subdomains may not.
+func (p *LabelPolicy) check(c labelClaim) (refused, withheld string) {
+	r := p.rule(c)
+	if r == nil || r.allows(c) {
+		return "", ""
+	}
+	if len(r.Names) > 0 {
+		explanation := fmt.Sprintf("%d: the subdomains of %s are reserved, only your hashed name is served", c.port, c.login)
+		return "", r.explain(explanation)
+	}
+	explanation := fmt.Sprintf("%d: not forwarded, the port is reserved", c.port)
+	if r.Allow == "verified" {
+		explanation += " for keys of verified GitHub or GitLab accounts"
+	}
+	return r.explain(explanation), ""
+}
+
+// reserves tells whether the names of a rule keep a label under the domain from being reserved by a key.
+func (p *LabelPolicy) reserves(label, fingerprint string) bool {
+	if p == nil {
+		return false
+	}
+	for _, r := range p.Rules {
+		if contains(r.Names, label) {
+			return !contains(r.Keys, fingerprint)
+		}
+	}
+	return false
+}
+
+func (r *LabelRule) explain(explanation string) string {
+	if r.Message != "" {
+		explanation += " (" + r.Message + ")"
+	}
+	return explanation + "."
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CI pipelines expose preview environments with `ssh -R 0:localhost:3000 srv.us preview 2h branch=main pr=42`:
+// the command waits for the forwards of its connection, prints them as one JSON line on standard output,
+// then keeps the connection up until the TTL passes, so forgotten previews go away on their own.
+
+const (
+	// previewWait is how long preview waits for the forwards of its connection.
+	previewWait = 10 * time.Second
+	maxLabels   = 16
+	maxLabel    = 128
+)
+
+var labelName = regexp.MustCompile(`^[a-z][a-z0-9_.-]{0,31}$`)
+
+type previewTunnel struct {
+	Port uint32   `json:"port"`
+	URLs []string `json:"urls"`
+}
+
+type preview struct {
+	// URL is the first URL of the lowest port, for pipelines with a single tunnel.
+	URL     string            `json:"url"`
+	Tunnels []previewTunnel   `json:"tunnels"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Expires time.Time         `json:"expires"`
+}
+
+func parseLabels(args []string) (map[string]string, error) {
+	if len(args) > maxLabels {
+		return nil, fmt.Errorf("at most %d labels", maxLabels)
+	}
+	labels := map[string]string{}
+	for _, arg := range args {
+		name, value, found := strings.Cut(arg, "=")
+		if !found || !labelName.MatchString(name) || len(value) > maxLabel {
+			return nil, fmt.Errorf("invalid label %q, expected e.g. branch=main", arg)
+		}
+		labels[name] = value
+	}
+	return labels, nil
+}
+
+// previewTunnels waits for the connection to serve tunnels, listing them by port.
+func (s *Server) previewTunnels(c *commandContext) []previewTunnel {
+	deadline := time.After(previewWait)
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for {
+		endpoints := map[uint32][]string{}
+		for ref, tgt := range s.registry.TunnelsOf(c.conn) {
+			if !tgt.Shadow {
+				endpoints[ref.Port] = append(endpoints[ref.Port], ref.Endpoint)
+			}
+		}
+		if len(endpoints) > 0 {
+			tunnels := make([]previewTunnel, 0, len(endpoints))
+			for port, names := range endpoints {
+				tunnels = append(tunnels, previewTunnel{Port: port, URLs: urlsOf(names)})
+			}
+			sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].Port < tunnels[j].Port })
+			return tunnels
+		}
+		select {
+		case <-c.ctx.Done():
+			return nil
+		case <-deadline:
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+func runPreview(s *Server, c *commandContext, args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	ttl, err := time.ParseDuration(args[0])
+	if err != nil || ttl <= 0 {
+		return fmt.Errorf("invalid ttl %q, expected e.g. 2h", args[0])
+	}
+	limits, err := s.loadKeyLimits(c.ctx, c.keyID)
+	if err != nil {
+		return err
+	}
+	if limit := s.tunnelLifetime(limits); limit > 0 && ttl > limit {
+		return fmt.Errorf("ttl cannot exceed %s", limit)
+	}
+	labels, err := parseLabels(args[1:])
+	if err != nil {
+		return err
+	}
+
+	tunnels := s.previewTunnels(c)
+	if tunnels == nil {
+		return errors.New("no tunnel to preview, forward one with e.g. -R 0:localhost:3000")
+	}
+	p := preview{URL: tunnels[0].URLs[0], Tunnels: tunnels, Labels: labels, Expires: time.Now().Add(ttl).UTC().Truncate(time.Second)}
+	line, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	c.printf("%s", line)
+	s.cfg.Audit.Record("preview_started", logs.Fields{"remote": c.conn.RemoteAddr().String(), "key": c.keyID, "url": p.URL, "labels": labels, "ttl": ttl.String()})
+
+	s.expireAfter(c.ctx, c.conn, "preview", ttl, func() {
+		s.cfg.Audit.Record("preview_expired", logs.Fields{"remote": c.conn.RemoteAddr().String(), "key": c.keyID, "url": p.URL, "labels": labels})
+		s.closeConnection(c.conn)
+	})
+	return nil
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/metrics"
+	"golang.org/x/crypto/ssh"
+	"strings"
+	"time"
+)
+
+// Forwards pointing at the wrong local port only fail once visited, with a 502 their owner may never see:
+// the edge opens a channel to every new forward and tells its session whether the client reached its service.
+// Connecting as nomatch+noprobe@ skips it, for services that mind empty connections.
+
+const probeTimeout = 5 * time.Second
+
+var forwardProbes = metrics.NewCounter("srvus_forward_probes_total", "Channels opened to new forwards to check their service is reachable", "result")
+
+// probe checks a new forward reaches its service, and tells the connection how it went.
+func (s *Server) probe(ctx context.Context, conn *ssh.ServerConn, host string, port uint32) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	ch, reqs, err := s.openChannel(ctx, conn, host, port, nil)
+	if err == nil {
+		go ssh.DiscardRequests(reqs)
+		_ = ch.Close()
+		forwardProbes.Inc("reachable")
+		s.notify(conn, fmt.Sprintf("%d: your service is reachable.", port))
+		return
+	}
+	var refused *ssh.OpenChannelError
+	switch {
+	case errors.As(err, &refused):
+		forwardProbes.Inc("unreachable")
+		s.notify(conn, fmt.Sprintf("%d: your service is unreachable (%s); is it running, and forwarded to the right local port?", port, refusalReason(refused)))
+	case isBusy(err), ctx.Err() != nil:
+		forwardProbes.Inc("timeout")
+	default:
+		forwardProbes.Inc("failed")
+	}
+}
+
+// refusalReason is what a client said refusing a channel, e.g. connection refused.
+func refusalReason(refused *ssh.OpenChannelError) string {
+	if reason := strings.ToLower(strings.TrimSuffix(refused.Message, ".")); reason != "" {
+		return reason
+	}
+	return refused.Reason.String()
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/registry"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Connecting as nomatch+verbose@ streams the progress of large transfers through tunnels relaying bytes
+// to the sessions of the connection serving them, e.g. `1: 203.0.113.5:51234 got 48.0MiB at 5.2MiB/s, sent 1.2KiB at 0B/s`.
+
+const (
+	progressInterval = 2 * time.Second
+	// largeTransfer is how many bytes a visitor connection moves before its progress is reported.
+	largeTransfer = 1 << 20
+)
+
+// transferProgress counts the bytes a visitor connection moves, as pump counters.
+type transferProgress struct {
+	sent, received atomic.Int64
+}
+
+// reportProgress tells a verbose connection how the transfer of a visitor goes until ctx ends, then how it ended,
+// once it is large.
+func (s *Server) reportProgress(ctx context.Context, tgt *registry.Target, visitor net.Addr, p *transferProgress) {
+	if !s.stateOf(tgt.Remote).verbose.Load() {
+		return
+	}
+	t := time.NewTicker(progressInterval)
+	defer t.Stop()
+	start := time.Now()
+	last, lastSent, lastReceived := start, int64(0), int64(0)
+	reported := false
+	for {
+		select {
+		case <-ctx.Done():
+			if reported {
+				s.notify(tgt.Remote, fmt.Sprintf("%d: %s done, got %s and sent %s in %s", tgt.Port, visitor,
+					formatBytes(p.sent.Load()), formatBytes(p.received.Load()), time.Since(start).Round(time.Second)))
+			}
+			return
+		case now := <-t.C:
+			sent, received := p.sent.Load(), p.received.Load()
+			if sent+received < largeTransfer {
+				continue
+			}
+			elapsed := now.Sub(last).Seconds()
+			s.notify(tgt.Remote, fmt.Sprintf("%d: %s got %s at %s/s, sent %s at %s/s", tgt.Port, visitor,
+				formatBytes(sent), formatBytes(int64(float64(sent-lastSent)/elapsed)),
+				formatBytes(received), formatBytes(int64(float64(received-lastReceived)/elapsed))))
+			last, lastSent, lastReceived = now, sent, received
+			reported = true
+		}
+	}
+}
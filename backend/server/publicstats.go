@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Communities display how the service is doing from GET /stats on the domain, with Config.PublicStats:
+//
+//	{"clients": 120, "tunnels": 310, "endpoints": 540, "transfer_today_bytes": 7301234567,
+//	 "since": "2026-10-14T00:00:00Z", "time": "2026-10-14T19:17:03Z"}
+//
+// Only totals are given, nothing about keys or endpoints. Transfer counts the bytes proxied either way since midnight
+// UTC, or since the start of the process if later. Browsers may fetch it from any origin.
+
+const publicStatsPath = "/stats"
+
+type publicStats struct {
+	Clients       int       `json:"clients"`
+	Tunnels       int       `json:"tunnels"`
+	Endpoints     int       `json:"endpoints"`
+	TransferToday int64     `json:"transfer_today_bytes"`
+	Since         time.Time `json:"since"`
+	Time          time.Time `json:"time"`
+}
+
+// dailyTransfer is where the proxied byte counters stood when the day began.
+type dailyTransfer struct {
+	lock  sync.Mutex
+	since time.Time
+	bytes int64
+}
+
+func (d *dailyTransfer) reset(now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.since, d.bytes = now.Truncate(time.Second), proxiedIn.Load()+proxiedOut.Load()
+}
+
+func (d *dailyTransfer) today() (int64, time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return proxiedIn.Load() + proxiedOut.Load() - d.bytes, d.since
+}
+
+// rollDailyTransfer starts the day over at every midnight UTC, until ctx ends.
+func (s *Server) rollDailyTransfer(ctx context.Context) {
+	s.daily.reset(time.Now().UTC())
+	for {
+		now := time.Now().UTC()
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(midnight.Sub(now)):
+			s.daily.reset(midnight)
+		}
+	}
+}
+
+func (s *Server) publicStatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+			return
+		}
+		clients, endpoints := s.registry.Counts()
+		transfer, since := s.daily.today()
+		writeJSON(w, http.StatusOK, publicStats{
+			Clients:       clients,
+			Tunnels:       s.registry.TotalTunnels(),
+			Endpoints:     endpoints,
+			TransferToday: transfer,
+			Since:         since,
+			Time:          time.Now().UTC().Truncate(time.Second),
+		})
+	})
+}
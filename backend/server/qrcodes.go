@@ -0,0 +1,39 @@
+package server
+
+import (
+	"github.com/pcarrier/srv.us/backend/qr"
+	"golang.org/x/crypto/ssh"
+	"strings"
+)
+
+// Sessions with a terminal, such as that of `ssh srv.us -R 1:localhost:3000`, get QR codes of the URLs we announce
+// when connecting as user+qr@ or setting SRVUS_QR=1 (ssh -o SetEnv=SRVUS_QR=1), so testing on a phone is one scan away; codes wider than their terminal are left out.
+
+// qrEnv is the variable sessions set to draw QR codes, or to stop drawing them with 0.
+const qrEnv = "SRVUS_QR"
+
+// qrQuietZone is the margin qr.Code.Terminal draws around codes, in modules.
+const qrQuietZone = 2
+
+// qrCodes draws the codes of the URLs of an announcement for a terminal of some columns, leaving out those too wide.
+func (m message) qrCodes(columns int) string {
+	var b strings.Builder
+	for _, url := range m.URLs {
+		// Names too long for the versions we draw go without.
+		if code, err := qr.Encode(url); err == nil && code.Size+2*qrQuietZone <= columns {
+			b.WriteString(strings.ReplaceAll(code.Terminal(), "\n", "\r\n"))
+		}
+	}
+	return b.String()
+}
+
+// render formats a message for a session of the connection, with the QR codes of its URLs if the session draws them.
+func (st *connState) render(sess ssh.Channel, m message) []byte {
+	line := m.format(st.json.Load())
+	term, drawn := st.drawsQR.Load(sess)
+	if !drawn || st.json.Load() || m.URLs == nil {
+		return line
+	}
+	columns, _ := term.(*terminal).size()
+	return append(line, m.qrCodes(columns)...)
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"context"
+	"github.com/pcarrier/srv.us/backend/metrics"
+	"log"
+)
+
+var leakedEntries = metrics.NewCounter("srvus_leaked_entries_total", "Inconsistent entries found in the connection and endpoint tables.", "kind")
+
+// reconcile periodically checks the tables for leaked entries, counts them, and repairs them if asked to.
+func (s *Server) reconcile(ctx context.Context) {
+	if s.cfg.ReconcileInterval <= 0 {
+		return
+	}
+	every(ctx, s.cfg.ReconcileInterval, func() {
+		s.registry.Lock()
+		leaks := s.registry.CheckInvariants()
+		if s.cfg.ReconcileRepair {
+			s.registry.Repair(leaks)
+		}
+		s.registry.Unlock()
+
+		for _, l := range leaks {
+			leakedEntries.Inc(l.Kind)
+			log.Printf("Leaked %s on %s (repaired: %v)", l.Kind, l.Endpoint, s.cfg.ReconcileRepair)
+		}
+	})
+}
+
+func (s *Server) registerMetrics() {
+	metrics.RegisterRuntime()
+	metrics.NewGaugeFunc("srvus_connections", "Connected SSH clients.", func() float64 {
+		conns, _ := s.registry.Counts()
+		return float64(conns)
+	})
+	metrics.NewGaugeFunc("srvus_endpoints", "Endpoints with at least one target.", func() float64 {
+		_, endpoints := s.registry.Counts()
+		return float64(endpoints)
+	})
+	metrics.NewGaugeFunc("srvus_visitor_memory_bytes", "Memory accounted to the visitors of all connections.", func() float64 {
+		return float64(s.memory.Load())
+	})
+	metrics.NewGaugeFunc("srvus_ssh_banned", "Addresses refused SSH connections for now, for failing too often.", func() float64 {
+		return float64(s.sshBanned())
+	})
+}
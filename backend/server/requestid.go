@@ -0,0 +1,50 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+)
+
+// Requests proxied one by one carry an X-Request-Id, which both the service and the visitor see, and access logs
+// record, so reports can be matched with the logs of either side. One sent by the visitor or a proxy in front of it
+// is kept if well-formed, and replaced otherwise. Services answering with an ID of their own have it passed on to
+// the visitor, and recorded, as X-Service-Request-Id. Tunnels relaying bytes as they come, without HTTP options,
+// have nowhere to add it, so their requests are not covered.
+
+const (
+	requestIDHeader        = "X-Request-Id"
+	serviceRequestIDHeader = "X-Service-Request-Id"
+)
+
+// requestIDPattern is what IDs we keep look like, e.g. UUIDs, or the hexadecimal IDs we make.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+func newRequestID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// tagRequest gives a request its ID, keeping the one it came with if well-formed, also set on whatever response it gets.
+func tagRequest(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if len(r.Header.Values(requestIDHeader)) != 1 || !requestIDPattern.MatchString(id) {
+		id = newRequestID()
+	}
+	r.Header.Set(requestIDHeader, id)
+	w.Header().Set(requestIDHeader, id)
+	return id
+}
+
+// untagResponse keeps the visitor getting the ID of its request, moving any other the service answers with
+// to X-Service-Request-Id.
+func untagResponse(resp *http.Response) {
+	id := resp.Header.Get(requestIDHeader)
+	resp.Header.Del(requestIDHeader)
+	resp.Header.Del(serviceRequestIDHeader)
+	if id != "" && (resp.Request == nil || id != resp.Request.Header.Get(requestIDHeader)) {
+		resp.Header.Set(serviceRequestIDHeader, id)
+	}
+}
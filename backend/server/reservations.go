@@ -0,0 +1,461 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/identity"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/registry"
+	"github.com/pcarrier/srv.us/backend/wire"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reservations keep a name for the tunnel a key forwards on a port, whichever connection forwards it, or for those
+// of an organization (see orgs.go): a label under the domain, e.g. docs for docs.srv.us, or a custom domain whose
+// CNAME points at the domain, covered by the certificate (see -acme-domains). Owners prove they hold a custom domain
+// with a TXT record _srvus.<domain> holding the fingerprint of their key, or org:<name> for an organization.
+// Owners manage theirs through the API, operators any through the admin API, both with PUT requests naming the
+// reservation by an ID of their choosing, so tools such as Terraform can apply the same declaration again and again.
+// Reserved names are served from then on. A custom domain can be reserved as a wildcard, e.g. *.preview.example.com,
+// for its tunnel to catch all the names under it that nothing else serves, instead of visitors getting a 503.
+
+const (
+	reservationsNamespace = "reservations"
+	maxReservations       = 10
+	ownershipLabel        = "_srvus"
+	ownershipTimeout      = 5 * time.Second
+)
+
+var (
+	reservationIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+	hostLabelPattern     = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+	errReservationConflict = errors.New("the name is reserved by another reservation")
+	errOwnershipUnproven   = errors.New("the ownership of the domain is not proven")
+
+	// lookupTXT resolves the records proving the ownership of custom domains.
+	lookupTXT = net.DefaultResolver.LookupTXT
+)
+
+// Reservation is stored under the name it reserves.
+type Reservation struct {
+	ID string `json:"id"`
+	// KeyID is the key owning it, or the member that made it for Org (empty if an operator did).
+	KeyID   string    `json:"key"`
+	Org     string    `json:"org,omitempty"`
+	Port    uint32    `json:"port"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// reservations indexes what the store holds by name, as it is looked up by every forward.
+type reservations struct {
+	sync.Mutex
+	byName map[string]*Reservation
+}
+
+func (s *Server) loadReservations(ctx context.Context) error {
+	stored, err := s.cfg.Store.List(ctx, reservationsNamespace)
+	if err != nil {
+		return err
+	}
+	s.reservations.Lock()
+	defer s.reservations.Unlock()
+	s.reservations.byName = map[string]*Reservation{}
+	for name, raw := range stored {
+		r := &Reservation{}
+		if err := json.Unmarshal(raw, r); err != nil {
+			return fmt.Errorf("reservation of %s: %w", name, err)
+		}
+		s.reservations.byName[name] = r
+	}
+	return nil
+}
+
+// owner is who reservations belong to: an organization if org is set, a key otherwise.
+// keyID is then the member acting for it, if any.
+type owner struct {
+	keyID, org string
+}
+
+func (o owner) owns(r *Reservation) bool {
+	if o.org != "" {
+		return r.Org == o.org
+	}
+	return r.Org == "" && r.KeyID == o.keyID
+}
+
+// reservedNames lists the names reserved by an owner for a port.
+func (s *Server) reservedNames(o owner, port uint32) []string {
+	s.reservations.Lock()
+	defer s.reservations.Unlock()
+	var names []string
+	for name, r := range s.reservations.byName {
+		if r.Port == port && o.owns(r) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// reservationsOf lists the reservations of an owner, or all of them for the zero owner, by ID.
+func (s *Server) reservationsOf(o owner) []*Reservation {
+	s.reservations.Lock()
+	defer s.reservations.Unlock()
+	result := []*Reservation{}
+	for _, r := range s.reservations.byName {
+		if o == (owner{}) || o.owns(r) {
+			result = append(result, r)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Org != result[j].Org {
+			return result[i].Org < result[j].Org
+		}
+		if result[i].KeyID != result[j].KeyID {
+			return result[i].KeyID < result[j].KeyID
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// find returns the reservation of an owner with an ID, nil if there is none. A lock is required.
+func (rs *reservations) find(o owner, id string) *Reservation {
+	for _, r := range rs.byName {
+		if o.owns(r) && r.ID == id {
+			return r
+		}
+	}
+	return nil
+}
+
+// reservableName normalizes a name to reserve: a label is taken under the domain.
+func (s *Server) reservableName(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+	if parent, wildcard := strings.CutPrefix(name, "*."); wildcard {
+		if strings.HasPrefix(parent, "*.") || !strings.Contains(parent, ".") || !s.customDomain(parent) {
+			return "", errors.New("only custom domains can be reserved as wildcards, e.g. *.preview.example.com")
+		}
+		if _, err := s.reservableName(parent); err != nil {
+			return "", err
+		}
+		return name, nil
+	}
+	if name != "" && !strings.Contains(name, ".") {
+		name += "." + s.cfg.Domain
+	}
+	if name == s.cfg.Domain {
+		return "", errors.New("the domain itself cannot be reserved")
+	}
+	if label, under := strings.CutSuffix(name, "."+s.cfg.Domain); under {
+		switch {
+		case strings.Contains(label, "."):
+			return "", fmt.Errorf("only one label can be reserved under %s", s.cfg.Domain)
+		case identity.IsHashed(s.cfg.Domain, name) || label == "gh" || label == "gl" || label == orgLabel:
+			return "", fmt.Errorf("%s is kept for hashed names and accounts", name)
+		case isShareName(label):
+			return "", fmt.Errorf("%s is kept for share links", name)
+		}
+	}
+	labels := strings.Split(name, ".")
+	if len(name) > 253 || len(labels) < 2 {
+		return "", fmt.Errorf("invalid name %q, expected a label such as docs or a domain such as app.example.com", name)
+	}
+	for _, label := range labels {
+		if !hostLabelPattern.MatchString(label) {
+			return "", fmt.Errorf("invalid name %q, expected a label such as docs or a domain such as app.example.com", name)
+		}
+	}
+	return name, nil
+}
+
+// provesOwnership checks that the TXT records of _srvus.<name>, or _srvus.<parent> for the wildcard *.<parent>,
+// name the owner of a custom domain: the fingerprint of its key, or org:<name> for an organization.
+func provesOwnership(ctx context.Context, o owner, name string) error {
+	proof := fingerprintOf(o.keyID)
+	if o.org != "" {
+		proof = "org:" + o.org
+	}
+	challenge := ownershipLabel + "." + strings.TrimPrefix(name, "*.")
+	ctx, cancel := context.WithTimeout(ctx, ownershipTimeout)
+	defer cancel()
+	records, _ := lookupTXT(ctx, challenge)
+	for _, record := range records {
+		if strings.TrimSpace(record) == proof {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w, expected a TXT record %s holding %s", errOwnershipUnproven, challenge, proof)
+}
+
+// putReservation creates or replaces the reservation of an owner with an ID, reporting whether it created it.
+// Replacing it with the same port and name changes nothing. Only operators bypass the label policy and the proof
+// of ownership of custom domains.
+func (s *Server) putReservation(ctx context.Context, o owner, id string, port uint32, name string, operator bool) (*Reservation, bool, error) {
+	if !reservationIDPattern.MatchString(id) {
+		return nil, false, fmt.Errorf("invalid ID %q, expected up to 64 lowercase letters, digits, - and _", id)
+	}
+	if port == 0 || port > wire.MaxBindPort {
+		return nil, false, fmt.Errorf("invalid port %d", port)
+	}
+	name, err := s.reservableName(name)
+	if err != nil {
+		return nil, false, err
+	}
+	if label, under := strings.CutSuffix(name, "."+s.cfg.Domain); under && !operator && s.cfg.LabelPolicy.reserves(label, fingerprintOf(o.keyID)) {
+		return nil, false, fmt.Errorf("%s is reserved by the operator", name)
+	}
+	plan, limits := s.planOf(o.keyID)
+	quota := limits.reservationQuota()
+	if o.org == "" && !operator && !limits.CustomDomains && s.customDomain(name) {
+		if plan == "" {
+			return nil, false, errors.New("custom domains are only reserved by operators without plans")
+		}
+		return nil, false, fmt.Errorf("custom domains are not part of the %s plan", plan)
+	}
+	if o.org != "" {
+		org, err := s.loadOrg(ctx, o.org)
+		if err != nil {
+			return nil, false, err
+		}
+		if org == nil {
+			return nil, false, fmt.Errorf("no organization %s", o.org)
+		}
+		quota = org.reservationQuota()
+	}
+	if !operator && s.customDomain(name) {
+		if err := provesOwnership(ctx, o, name); err != nil {
+			return nil, false, err
+		}
+	}
+
+	s.reservations.Lock()
+	defer s.reservations.Unlock()
+	previous := s.reservations.find(o, id)
+	if other := s.reservations.byName[name]; other != nil && other != previous {
+		return nil, false, errReservationConflict
+	}
+	if previous != nil && previous.Port == port && previous.Name == name {
+		return previous, false, nil
+	}
+	if previous == nil {
+		held := 0
+		for _, other := range s.reservations.byName {
+			if o.owns(other) {
+				held++
+			}
+		}
+		if held >= quota {
+			return nil, false, fmt.Errorf("at most %d reservations", quota)
+		}
+	}
+
+	now := time.Now().UTC()
+	r := &Reservation{ID: id, KeyID: o.keyID, Org: o.org, Port: port, Name: name, Created: now, Updated: now}
+	if previous != nil {
+		r.Created = previous.Created
+	}
+	raw, err := json.Marshal(r)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := s.cfg.Store.Put(ctx, reservationsNamespace, name, raw); err != nil {
+		return nil, false, err
+	}
+	if previous != nil && previous.Name != name {
+		if err := s.cfg.Store.Delete(ctx, reservationsNamespace, previous.Name); err != nil {
+			return nil, false, err
+		}
+		delete(s.reservations.byName, previous.Name)
+	}
+	s.reservations.byName[name] = r
+	if previous != nil {
+		s.unrouteReservation(previous)
+	}
+	s.routeReservation(r)
+	s.cfg.Audit.Record("reservation_set", logs.Fields{"key": o.keyID, "org": o.org, "id": id, "port": port, "name": name})
+	return r, previous == nil, nil
+}
+
+// deleteReservation releases the reservation of an owner with an ID, returning it, nil if there was none.
+func (s *Server) deleteReservation(ctx context.Context, o owner, id string) (*Reservation, error) {
+	s.reservations.Lock()
+	defer s.reservations.Unlock()
+	r := s.reservations.find(o, id)
+	if r == nil {
+		return nil, nil
+	}
+	if err := s.cfg.Store.Delete(ctx, reservationsNamespace, r.Name); err != nil {
+		return nil, err
+	}
+	delete(s.reservations.byName, r.Name)
+	s.unrouteReservation(r)
+	s.cfg.Audit.Record("reservation_released", logs.Fields{"key": o.keyID, "org": o.org, "id": id, "port": r.Port, "name": r.Name})
+	return r, nil
+}
+
+// reservationConns lists the connections that may serve a reservation: those of its key, or that joined its organization.
+func (s *Server) reservationConns(r *Reservation) []*ssh.ServerConn {
+	if r.Org == "" {
+		return s.registry.ConnectionsOf(r.KeyID)
+	}
+	var conns []*ssh.ServerConn
+	for _, conn := range s.registry.Connections() {
+		if s.stateOf(conn).orgName() == r.Org {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
+
+// routeReservation serves a reserved name from the connections already forwarding its port.
+func (s *Server) routeReservation(r *Reservation) {
+	conns := s.reservationConns(r)
+	s.registry.Lock()
+	defer s.registry.Unlock()
+	for _, conn := range conns {
+		c := s.registry.Conns[conn]
+		if c == nil {
+			continue
+		}
+		forwarded := map[string]*registry.Target{}
+		for ref, t := range c.Tunnels {
+			if ref.Port == r.Port {
+				forwarded[ref.Host] = t
+			}
+		}
+		for _, existing := range forwarded {
+			t := &registry.Target{
+				KeyID:  existing.KeyID,
+				Remote: existing.Remote,
+				Host:   existing.Host,
+				Port:   existing.Port,
+				HTTP:   existing.HTTP,
+				Shadow: existing.Shadow,
+				Tag:    existing.Tag,
+			}
+			t.Settings.Store(existing.Settings.Load())
+			t.Touch()
+			s.registry.Insert(r.Name, t)
+		}
+	}
+}
+
+// unrouteReservation stops serving a name that is no longer reserved.
+func (s *Server) unrouteReservation(r *Reservation) {
+	conns := s.reservationConns(r)
+	s.registry.Lock()
+	defer s.registry.Unlock()
+	for _, conn := range conns {
+		c := s.registry.Conns[conn]
+		if c == nil {
+			continue
+		}
+		for ref, t := range c.Tunnels {
+			if ref.Endpoint == r.Name {
+				s.registry.Remove(ref.Endpoint, t)
+			}
+		}
+	}
+}
+
+type reservationRequest struct {
+	Port uint32 `json:"port"`
+	Name string `json:"name"`
+}
+
+// serveReservation answers GET, PUT and DELETE requests about the reservation of an owner with an ID.
+func (s *Server) serveReservation(w http.ResponseWriter, r *http.Request, o owner, id string, operator bool) {
+	switch r.Method {
+	case http.MethodGet:
+		s.reservations.Lock()
+		found := s.reservations.find(o, id)
+		s.reservations.Unlock()
+		if found == nil {
+			writeJSONError(w, http.StatusNotFound, errNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, found)
+	case http.MethodPut:
+		var req reservationRequest
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		res, created, err := s.putReservation(r.Context(), o, id, req.Port, req.Name, operator)
+		switch {
+		case errors.Is(err, errReservationConflict):
+			writeJSONError(w, http.StatusConflict, err)
+		case errors.Is(err, errOwnershipUnproven):
+			writeJSONError(w, http.StatusForbidden, err)
+		case err != nil:
+			writeJSONError(w, http.StatusBadRequest, err)
+		case created:
+			writeJSON(w, http.StatusCreated, res)
+		default:
+			writeJSON(w, http.StatusOK, res)
+		}
+	case http.MethodDelete:
+		res, err := s.deleteReservation(r.Context(), o, id)
+		switch {
+		case err != nil:
+			writeJSONError(w, http.StatusInternalServerError, err)
+		case res == nil:
+			writeJSONError(w, http.StatusNotFound, errNotFound)
+		default:
+			writeJSON(w, http.StatusOK, res)
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+	}
+}
+
+// adminReservations lists every reservation, or those of ?key=<key ID> or ?org=<organization>,
+// and manages one given with &id=<ID> as the API does.
+func (s *Server) adminReservations(w http.ResponseWriter, r *http.Request) {
+	o := owner{keyID: r.URL.Query().Get("key"), org: r.URL.Query().Get("org")}
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.reservationsOf(o))
+		return
+	}
+	if o == (owner{}) {
+		writeJSONError(w, http.StatusBadRequest, errors.New("missing key or org"))
+		return
+	}
+	s.serveReservation(w, r, o, id, true)
+}
+
+// fingerprintOf returns the SHA256 fingerprint of the key a key ID encodes, empty if it is invalid.
+func fingerprintOf(keyID string) string {
+	raw, err := base64.RawStdEncoding.DecodeString(keyID)
+	if err != nil {
+		return ""
+	}
+	key, err := ssh.ParsePublicKey(raw)
+	if err != nil {
+		return ""
+	}
+	return ssh.FingerprintSHA256(key)
+}
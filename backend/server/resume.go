@@ -0,0 +1,68 @@
+package server
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// idleAfter is how long without traffic before a tunnel is reported idle.
+const idleAfter = time.Minute
+
+// announceTunnels writes the tunnels a connection already serves to one of its sessions,
+// for sessions opened after the forwards were announced, e.g. through a ControlMaster.
+func (s *Server) announceTunnels(conn *ssh.ServerConn, ch ssh.Channel) {
+	st := s.stateOf(conn)
+	for _, m := range s.tunnelMessages(conn) {
+		if _, err := ch.Write(st.render(ch, m)); err != nil {
+			log.Printf("Could not send message %s (%v)", m.Text, err)
+			return
+		}
+	}
+}
+
+// tunnelMessages announces the tunnels a connection serves, by port.
+func (s *Server) tunnelMessages(conn *ssh.ServerConn) []message {
+	endpoints := map[uint32][]string{}
+	idleSince := map[uint32]time.Time{}
+	for ref, t := range s.registry.TunnelsOf(conn) {
+		endpoints[ref.Port] = append(endpoints[ref.Port], ref.Endpoint)
+		if since := t.IdleSince(); since.After(idleSince[ref.Port]) {
+			idleSince[ref.Port] = since
+		}
+	}
+	ports := make([]uint32, 0, len(endpoints))
+	for port := range endpoints {
+		ports = append(ports, port)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+
+	msgs := make([]message, 0, len(ports))
+	for _, port := range ports {
+		m := message{Port: port, URLs: urlsOf(endpoints[port])}
+		if idle := time.Since(idleSince[port]); idle > idleAfter {
+			m.Text = fmt.Sprintf("idle for %s", idle.Round(time.Second))
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+// urlsOf orders endpoints as they are announced, hashed names first, and turns them into URLs.
+func urlsOf(endpoints []string) []string {
+	sort.Slice(endpoints, func(i, j int) bool {
+		di, dj := strings.Count(endpoints[i], "."), strings.Count(endpoints[j], ".")
+		if di != dj {
+			return di < dj
+		}
+		return endpoints[i] < endpoints[j]
+	})
+	urls := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		urls = append(urls, "https://"+endpoint+"/")
+	}
+	return urls
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"github.com/pcarrier/srv.us/backend/identity"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/registry"
+	"github.com/pcarrier/srv.us/backend/settings"
+	"net/http"
+)
+
+// Hashed names are mostly transient development tunnels, which have no business in search indexes:
+// the edge answers their robots.txt and marks their responses noindex, unless their owner opts out.
+
+const denyAllRobots = "User-agent: *\nDisallow: /\n"
+
+// unindexed reports whether the edge keeps search engines away from a target's name.
+func (s *Server) unindexed(name string, tgt *registry.Target) bool {
+	if st := tgt.Settings.Load(); st != nil && st.Indexable {
+		return false
+	}
+	return identity.IsHashed(s.cfg.Domain, name)
+}
+
+// addRobotsTag marks the responses of unindexed names noindex, unless the tunnel already says otherwise.
+func (s *Server) addRobotsTag(resp *http.Response, name string, tgt *registry.Target) {
+	if s.unindexed(name, tgt) && resp.Header.Get("X-Robots-Tag") == "" {
+		resp.Header.Set("X-Robots-Tag", "noindex")
+	}
+}
+
+func runIndexing(s *Server, c *commandContext, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+	port, err := parsePort(args[0])
+	if err != nil {
+		return err
+	}
+
+	var st *settings.Endpoint
+	if len(args) == 1 {
+		if st, err = settings.Load(c.ctx, s.cfg.Store, c.keyID, port); err != nil {
+			return err
+		}
+	} else {
+		if args[1] != "on" && args[1] != "off" {
+			return errUsage
+		}
+		if st, err = s.updateSettings(c.ctx, c.keyID, port, func(st *settings.Endpoint) error {
+			st.Indexable = args[1] == "on"
+			return nil
+		}); err != nil {
+			return err
+		}
+		s.cfg.Audit.Record("indexing_changed", logs.Fields{"key": c.keyID, "port": port, "indexable": st.Indexable})
+	}
+	c.printf("%d: %s", port, describeIndexing(st))
+	return nil
+}
+
+func describeIndexing(st *settings.Endpoint) string {
+	if st.Indexable {
+		return "search engines may index the hashed URL"
+	}
+	return "search engines are kept away from the hashed URL (robots.txt and X-Robots-Tag: noindex)"
+}
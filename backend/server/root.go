@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/identity"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// serveRoot answers requests to the domain itself: echo, abuse reports, the API, stats, the status page, the landing page,
+// and sharing files.
+func (s *Server) serveRoot(ctx context.Context, https *tls.Conn) error {
+	r := bufio.NewReader(https)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return err
+	}
+	if req.URL.Path == "/report" {
+		return s.serveReport(ctx, https, req)
+	}
+	if strings.HasPrefix(req.URL.Path, "/api/") {
+		return s.serveAPI(ctx, https, req)
+	}
+	if s.cfg.PublicStats && req.URL.Path == publicStatsPath {
+		defer func() {
+			_ = req.Body.Close()
+		}()
+		return serveBuffered(ctx, https, req, s.publicStatsHandler())
+	}
+	if s.cfg.StatusPage && req.URL.Path == statusPagePath {
+		defer func() {
+			_ = req.Body.Close()
+		}()
+		return serveBuffered(ctx, https, req, s.statusPageHandler())
+	}
+	if file := s.cfg.Landing.landingFile(req); file != "" {
+		defer func() {
+			_ = req.Body.Close()
+		}()
+		return serveBuffered(ctx, https, req, s.landingHandler(file))
+	}
+	if req.URL.Path == "/echo" {
+		defer func() {
+			_ = req.Body.Close()
+		}()
+		ct := req.Header.Get("Content-Type")
+		if ct == "" {
+			ct = "text/plain"
+		}
+		_, _ = https.Write([]byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: %s\r\n\r\n", ct)))
+		_, _ = io.Copy(https, req.Body)
+	} else if req.Method == "POST" && s.cfg.Pastes == nil {
+		_ = req.Body.Close()
+		_, _ = https.Write([]byte("HTTP/1.1 503 Service Unavailable\r\n\r\nSharing files is unavailable.\r\n"))
+	} else if req.Method == "POST" {
+		defer func() {
+			_ = req.Body.Close()
+		}()
+		content, err := io.ReadAll(req.Body)
+		if err != nil {
+			return err
+		}
+		hash := sha1.Sum(content)
+		code := identity.Base32.EncodeToString(hash[:])
+		rows, _ := s.cfg.Pastes.Query(ctx, "INSERT INTO pastes(code, content) VALUES ($1, $2) ON CONFLICT DO NOTHING", code, content)
+		if rows != nil {
+			rows.Close()
+		}
+		_, _ = https.Write([]byte(fmt.Sprintf("HTTP/1.1 200 OK\r\n\r\nhttps://%s/%s\r\n", s.cfg.Domain, code)))
+	} else if req.URL.Path == "/" {
+		_, _ = https.Write([]byte("HTTP/1.1 307 Temporary Redirect\r\nLocation: " + s.docsURL() + "\r\n\r\n"))
+	} else if s.cfg.Pastes == nil {
+		_, _ = https.Write([]byte("HTTP/1.1 404 Not Found\r\n\r\n"))
+	} else {
+		code := req.URL.Path[1:]
+		res, _ := s.cfg.Pastes.Query(ctx, "SELECT content FROM pastes WHERE code = $1", code)
+		if res != nil {
+			defer res.Close()
+			if res.Next() {
+				cols, err := res.Values()
+				if err != nil {
+					_, _ = https.Write([]byte("HTTP/1.1 404 Not Found\r\n\r\n"))
+					return err
+				}
+				content := cols[0].([]byte)
+				_, _ = https.Write([]byte(fmt.Sprintf("HTTP/1.1 200 OK\r\n\r\n%s", content)))
+			} else {
+				_, _ = https.Write([]byte("HTTP/1.1 404 Not Found\r\n\r\n"))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/registry"
+	"github.com/pcarrier/srv.us/backend/settings"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Routes (settings.HTTP.Routes) let the name of a tunnel serve path prefixes from other forwards of the same key,
+// e.g. /api from a backend next to the frontend, without CORS. They are dispatched by the request-by-request proxy.
+
+type routedKey struct{}
+
+// routedTransport sends requests routed to another forward through its pool, the others through the tunnel's own.
+type routedTransport struct {
+	http.RoundTripper
+}
+
+func (t routedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if routed, ok := r.Context().Value(routedKey{}).(http.RoundTripper); ok {
+		return routed.RoundTrip(r)
+	}
+	return t.RoundTripper.RoundTrip(r)
+}
+
+// route picks the target serving a request by the routes of tgt, preferring forwards of the same connection.
+// It returns tgt itself if no route matches, or nil if the forward routed to is not up.
+func (s *Server) route(r *http.Request, tgt *registry.Target) *registry.Target {
+	st := tgt.Settings.Load()
+	if st == nil || st.HTTP == nil {
+		return tgt
+	}
+	port, found := st.HTTP.Route(r.URL.Path)
+	if !found || port == tgt.Port {
+		return tgt
+	}
+	s.registry.Lock()
+	targets := s.registry.TargetsOf(tgt.KeyID, port)
+	s.registry.Unlock()
+	var live []*registry.Target
+	for _, t := range targets {
+		if t.Shadow || t.Draining() {
+			continue
+		}
+		if t.Remote == tgt.Remote {
+			return t
+		}
+		live = append(live, t)
+	}
+	if len(live) == 0 {
+		return nil
+	}
+	return live[rand.Intn(len(live))]
+}
+
+// withRoute has the proxy send a request to routed rather than to the tunnel's own forward.
+func (s *Server) withRoute(r *http.Request, routed *registry.Target) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), routedKey{}, http.RoundTripper(s.transportFor(routed, true))))
+}
+
+func runRoute(s *Server, c *commandContext, args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	port, err := parsePort(args[0])
+	if err != nil {
+		return err
+	}
+
+	var routes map[string]uint32
+	switch {
+	case len(args) == 1:
+		st, err := settings.Load(c.ctx, s.cfg.Store, c.keyID, port)
+		if err != nil {
+			return err
+		}
+		c.printf("%d: %s", port, describeRoutes(st.HTTP))
+		return nil
+	case len(args) == 2 && args[1] == "clear":
+	default:
+		routes = map[string]uint32{}
+		for _, arg := range args[1:] {
+			prefix, value, found := strings.Cut(arg, "=")
+			to, err := strconv.ParseUint(value, 10, 32)
+			if !found || err != nil {
+				return fmt.Errorf("invalid route %q, expected prefix=port such as /api=2", arg)
+			}
+			routes[prefix] = uint32(to)
+		}
+	}
+
+	st, err := s.updateSettings(c.ctx, c.keyID, port, func(st *settings.Endpoint) error {
+		if st.HTTP == nil {
+			st.HTTP = &settings.HTTP{}
+		}
+		st.HTTP.Routes = routes
+		if err := st.HTTP.Validate(); err != nil {
+			return err
+		}
+		if st.HTTP.Empty() {
+			st.HTTP = nil
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.cfg.Audit.Record("routes_changed", logs.Fields{"key": c.keyID, "port": port, "routes": routes})
+	c.printf("%d: %s", port, describeRoutes(st.HTTP))
+	return nil
+}
+
+func describeRoutes(h *settings.HTTP) string {
+	if h == nil || len(h.Routes) == 0 {
+		return "no routes, every request reaches this tunnel"
+	}
+	var prefixes []string
+	for prefix := range h.Routes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	var parts []string
+	for _, prefix := range prefixes {
+		parts = append(parts, fmt.Sprintf("%s → %d", prefix, h.Routes[prefix]))
+	}
+	return strings.Join(parts, ", ")
+}
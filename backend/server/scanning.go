@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/metrics"
+	"github.com/pcarrier/srv.us/backend/registry"
+	"github.com/pcarrier/srv.us/backend/scan"
+	"github.com/pcarrier/srv.us/backend/settings"
+	"github.com/pcarrier/srv.us/backend/wire"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Operators flag endpoints for scanning through the admin API. Flagged endpoints are proxied request by request,
+// the bodies of their requests and responses go through Config.Scanner, and the edge blocks what it matches.
+// Scanner failures let content through, so an unavailable scanner does not take tunnels down.
+
+const (
+	// maxScannedBody is how much of a body is scanned; the rest goes through unscanned.
+	maxScannedBody = 10 << 20
+	scanTimeout    = 30 * time.Second
+)
+
+var (
+	scans = metrics.NewCounter("srvus_scans_total", "Bodies of flagged endpoints scanned, by result", "result")
+
+	errBlocked = errors.New("blocked by content scanning")
+)
+
+// scanned reports whether operators flagged a target for scanning, and there is a scanner.
+func (s *Server) scanned(t *registry.Target) bool {
+	st := t.Settings.Load()
+	return s.cfg.Scanner != nil && st != nil && st.Scanned
+}
+
+// scanBody scans the beginning of body, returning what to proxy instead: all of it, unless it must be blocked.
+func (s *Server) scanBody(ctx context.Context, tgt *registry.Target, c scan.Content, body io.ReadCloser) (io.ReadCloser, error) {
+	if body == nil || body == http.NoBody {
+		return body, nil
+	}
+	head, err := io.ReadAll(io.LimitReader(body, maxScannedBody))
+	rest := &heldBody{Reader: io.MultiReader(bytes.NewReader(head), body), Closer: body, release: s.holdMemory(tgt.Remote, int64(len(head)))}
+	if err != nil {
+		return rest, err
+	}
+	if len(head) == 0 {
+		return rest, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, scanTimeout)
+	defer cancel()
+	c.Body = head
+	verdict, err := s.cfg.Scanner.Scan(ctx, c)
+	if err != nil {
+		scans.Inc("error")
+		log.Printf("Could not scan the %s of %s (%v)", c.Direction, c.Endpoint, err)
+		return rest, nil
+	}
+	if !verdict.Match {
+		scans.Inc("clean")
+		return rest, nil
+	}
+	scans.Inc("blocked")
+	s.cfg.Audit.Record("content_blocked", logs.Fields{"endpoint": c.Endpoint, "key": tgt.KeyID, "port": tgt.Port, "direction": c.Direction, "match": verdict.Name})
+	return rest, fmt.Errorf("%w (%s)", errBlocked, verdict.Name)
+}
+
+// heldBody is a body partly buffered in memory, accounted to a connection until closed.
+type heldBody struct {
+	io.Reader
+	io.Closer
+	release func()
+}
+
+func (b *heldBody) Close() error {
+	b.release()
+	return b.Closer.Close()
+}
+
+// scanRequest scans the body of a request to a flagged target, answering it and returning false if it is blocked.
+func (s *Server) scanRequest(w http.ResponseWriter, r *http.Request, name string, tgt *registry.Target) bool {
+	if !s.scanned(tgt) || wire.IsUpgrade(r.Header) {
+		return true
+	}
+	body, err := s.scanBody(r.Context(), tgt, scan.Content{Endpoint: name, Direction: "request", ContentType: r.Header.Get("Content-Type")}, r.Body)
+	r.Body = body
+	if errors.Is(err, errBlocked) {
+		http.Error(w, "Blocked by content scanning.", http.StatusForbidden)
+		return false
+	}
+	if err != nil {
+		http.Error(w, "Could not read the request.", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// scanResponse scans the body of a response from a flagged target; ModifyResponse fails with errBlocked for matches.
+func (s *Server) scanResponse(resp *http.Response, name string, tgt *registry.Target) error {
+	if !s.scanned(tgt) || resp.StatusCode == http.StatusSwitchingProtocols || wire.IsStreamingResponse(resp) {
+		return nil
+	}
+	body, err := s.scanBody(resp.Request.Context(), tgt, scan.Content{Endpoint: name, Direction: "response", ContentType: resp.Header.Get("Content-Type")}, resp.Body)
+	resp.Body = body
+	return err
+}
+
+// adminScans shows, sets (PUT) or clears (DELETE) the scanning flag of ?key=<key ID>&port=<port>.
+func (s *Server) adminScans(w http.ResponseWriter, r *http.Request) {
+	keyID := r.URL.Query().Get("key")
+	port, err := parsePort(r.URL.Query().Get("port"))
+	if keyID == "" || err != nil {
+		writeJSONError(w, http.StatusBadRequest, errors.New("missing key or port"))
+		return
+	}
+
+	var st *settings.Endpoint
+	switch r.Method {
+	case http.MethodGet:
+		st, err = settings.Load(r.Context(), s.cfg.Store, keyID, port)
+	case http.MethodPut, http.MethodDelete:
+		if r.Method == http.MethodPut && s.cfg.Scanner == nil {
+			writeJSONError(w, http.StatusConflict, errors.New("no scanner is configured"))
+			return
+		}
+		st, err = s.updateSettings(r.Context(), keyID, port, func(st *settings.Endpoint) error {
+			st.Scanned = r.Method == http.MethodPut
+			return nil
+		})
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"scanned": st.Scanned})
+}
@@ -0,0 +1,476 @@
+// Package server runs the tunnels: the SSH front-end clients connect to, the HTTPS front-end visitors reach,
+// and the console and admin API used to manage them.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pcarrier/srv.us/backend/geoip"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/metrics"
+	"github.com/pcarrier/srv.us/backend/nameserver"
+	"github.com/pcarrier/srv.us/backend/registry"
+	"github.com/pcarrier/srv.us/backend/router"
+	"github.com/pcarrier/srv.us/backend/scan"
+	"github.com/pcarrier/srv.us/backend/store"
+	"github.com/pcarrier/srv.us/backend/tracing"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// Config is everything a Server depends on. The srvus binary fills it from its flags.
+type Config struct {
+	// Domain name under which we run.
+	Domain string
+	// Whether to expose $username.gh and $username.gl subdomains.
+	GitHubSubdomains bool
+	GitLabSubdomains bool
+
+	// Certificate is loaded for every HTTPS connection, so renewed certificates are picked up.
+	Certificate func() (tls.Certificate, error)
+	Store       store.Store
+	// Pastes holds shared files; sharing is unavailable without it.
+	Pastes *pgxpool.Pool
+	Audit  *logs.Audit
+	// HostKeyPaths are the files and directories the admin API reloads host keys from; see LoadHostKeys.
+	HostKeyPaths []string
+	// HostKeyPassphrase decrypts the host keys that are encrypted, if set.
+	HostKeyPassphrase []byte
+	// Security logs what clients fail at, for firewalls; see logs.Security.
+	Security *logs.Security
+	Access   *logs.Access
+	GeoIP    *geoip.DB
+
+	// Lifetimes after which connections and tunnels are closed, 0 for unlimited; keys can override them.
+	MaxConnectionDuration time.Duration
+	MaxTunnelDuration     time.Duration
+	// How long before expiry sessions get warned, longest first.
+	ExpiryWarnings []time.Duration
+	// Duration without traffic after which tunnels are removed, 0 to keep them.
+	IdleTunnelTimeout time.Duration
+	// Interval between keepalives, positive, and how many may go unanswered before a client is disconnected,
+	// at least 1; its usual round-trip time is tolerated on top of that.
+	KeepaliveInterval time.Duration
+	KeepaliveMissed   int
+	// Channels a connection may be asked to open at once; up to ChannelOpenQueue more visitors wait
+	// for ChannelOpenTimeout, after which they get a 503, so slow clients do not pile up opens.
+	MaxChannelOpens    int
+	ChannelOpenQueue   int
+	ChannelOpenTimeout time.Duration
+	// SSH handshakes an address may have in flight at once, and failed handshakes or authentication attempts it may make
+	// before being refused for SSHBanTime, twice as long with every ban up to SSHMaxBanTime; 0 for unlimited, see sshguard.go.
+	MaxSSHHandshakes int
+	MaxSSHFailures   int
+	SSHBanTime       time.Duration
+	SSHMaxBanTime    time.Duration
+	// Memory the visitors of a connection may make us hold before it gets no more (0 for unlimited),
+	// and that of all connections before the heaviest is disconnected (0 to never disconnect).
+	MaxConnectionMemory int64
+	MaxMemory           int64
+	// SyntheticOrigins reports our domain and a counter as the origin of forwarded channels, as we used to,
+	// instead of the address and port of their visitor.
+	SyntheticOrigins bool
+	// SpareChannels is how many channels busy forwards keep opened ahead of time (0 for none), see spares.go.
+	SpareChannels int
+	// Interval between consistency checks of the connection and endpoint tables (0 to disable them),
+	// and whether to remove the inconsistent entries they find.
+	ReconcileInterval time.Duration
+	ReconcileRepair   bool
+	// Interval between summaries of the traffic in the logs (0 to disable them), listing the busiest endpoints.
+	StatsInterval     time.Duration
+	StatsTopEndpoints int
+	// TransferLog is how the bytes moved by each visitor connection are logged (see TransferLogModes).
+	// In "each" mode, TransferLogSampleRate is the share of connections logged;
+	// in "summary" mode, they are added up per endpoint over every TransferLogInterval.
+	TransferLog           string
+	TransferLogSampleRate float64
+	TransferLogInterval   time.Duration
+	// UsageExport is where the usage of each key is exported every UsageExportInterval, for billing:
+	// a directory getting files in UsageExportFormat (see UsageExportFormats), or an http(s) URL getting JSON. Disabled if empty.
+	UsageExport         string
+	UsageExportFormat   string
+	UsageExportInterval time.Duration
+
+	// ResponseHeaderTimeout and RequestTimeout bound requests proxied one by one to tunnels setting no timeouts
+	// of their own (see settings.Timeouts), 0 for never.
+	ResponseHeaderTimeout time.Duration
+	RequestTimeout        time.Duration
+
+	// AbuseReportThreshold is how many distinct addresses reporting a tunnel within a day suspend it, 0 for never.
+	AbuseReportThreshold int
+	// Scanner checks the bodies going through endpoints flagged by operators, if set.
+	Scanner scan.Scanner
+	// Interstitial warns browsers visiting a tunnel for the first time that anybody could be running it.
+	Interstitial bool
+	// PublicStats serves totals of the service at /stats on the domain, for anybody to see.
+	PublicStats bool
+	// StatusPage serves the health of the service and the incident declared through the admin API at /status on the domain.
+	StatusPage bool
+	// StatusNodes are the other nodes the status page checks, as host or host:port of their HTTPS listeners.
+	StatusNodes []string
+	// ConfirmWithAgent makes sensitive console commands need a signature from the agent forwarded to their session.
+	ConfirmWithAgent bool
+	// DNS answers queries for Domain, if set; Start makes it resolve the endpoints being served, and loads its records.
+	DNS *nameserver.Server
+	// Tracer records spans of visitor connections and requests, if set.
+	Tracer *tracing.Tracer
+	// LabelPolicy reserves ports and account names for some keys, if set.
+	LabelPolicy *LabelPolicy
+	// Plans bound what keys do according to the plan operators assign them, if set; see ParsePlans.
+	Plans *Plans
+
+	// Banner is shown by SSH clients before they authenticate, MOTD to connections once their first session opens;
+	// see ParseGreeting. Neither is sent if nil or empty.
+	Banner *template.Template
+	MOTD   *template.Template
+	// Branding is what users read of the service, as on srv.us if nil; see ParseBranding.
+	Branding *Branding
+	// Landing is served at the domain if set, which otherwise redirects to the docs URL; see OpenLanding.
+	Landing *Landing
+
+	// AdminToken is the bearer token required by the admin API.
+	AdminToken string
+
+	Chaos Chaos
+}
+
+// DefaultConfig returns the settings of srv.us, without any storage or certificate.
+func DefaultConfig() Config {
+	return Config{
+		Domain:                "srv.us",
+		GitHubSubdomains:      true,
+		GitLabSubdomains:      true,
+		Store:                 store.NewMemory(),
+		ExpiryWarnings:        []time.Duration{time.Hour, 10 * time.Minute, time.Minute},
+		KeepaliveInterval:     5 * time.Second,
+		KeepaliveMissed:       3,
+		MaxChannelOpens:       16,
+		ChannelOpenQueue:      64,
+		ChannelOpenTimeout:    10 * time.Second,
+		MaxSSHHandshakes:      8,
+		MaxSSHFailures:        20,
+		SSHBanTime:            time.Minute,
+		SSHMaxBanTime:         24 * time.Hour,
+		MaxConnectionMemory:   256 << 20,
+		SpareChannels:         2,
+		ReconcileInterval:     5 * time.Minute,
+		ReconcileRepair:       true,
+		StatsInterval:         time.Minute,
+		StatsTopEndpoints:     5,
+		TransferLog:           "each",
+		TransferLogSampleRate: 1,
+		TransferLogInterval:   time.Minute,
+		UsageExportFormat:     "csv",
+		UsageExportInterval:   time.Hour,
+		AbuseReportThreshold:  5,
+		ResponseHeaderTimeout: 5 * time.Minute,
+	}
+}
+
+type Server struct {
+	cfg      Config
+	registry *registry.Registry
+	router   *router.Router
+
+	settingsLock sync.Mutex
+	globalGeo    atomic.Pointer[geoip.Rules]
+	// notice is relayed by greetings, if set.
+	notice atomic.Pointer[string]
+	// incident is shown on the status page, if declared.
+	incident atomic.Pointer[Incident]
+	// reservations index the names reserved for tunnels.
+	reservations reservations
+	// shares index the share links minted for tunnels.
+	shares shares
+	// keyPlans holds the plans assigned to keys.
+	keyPlans keyPlans
+
+	// conns holds what we track for each *ssh.ServerConn beyond the registry, as *connState.
+	conns sync.Map
+
+	// visitors counts the HTTPS connections being served, so draining can wait for them.
+	visitors atomic.Int64
+
+	// listening holds the listeners we accept on by name (https, ssh), for health checks.
+	listening sync.Map
+	health    healthCache
+	nodes     nodesCache
+
+	rates    rateLimiter
+	sshGuard sshGuard
+	// sshConfig is what new SSH connections get, with hostKeys if SetHostKeys set them.
+	sshConfig atomic.Pointer[ssh.ServerConfig]
+	hostKeys  atomic.Pointer[[]ssh.Signer]
+	// exports tracks connections for the connections socket, if served.
+	exports   exports
+	passwords passwordCache
+	traffic   traffic
+	daily     dailyTransfer
+	transfers transfers
+	// meter adds up the usage of keys between exports.
+	meter meter
+	// challengeSecret signs the nonces and passes of challenges.
+	challengeSecret []byte
+	// mirrors holds a slot for every copy of a request on its way to a shadow.
+	mirrors chan void
+	// hooks holds a slot for every webhook delivery in flight.
+	hooks chan void
+	// memory is what the visitors of all connections make us hold; evicting serializes evictions.
+	memory   atomic.Int64
+	evicting sync.Mutex
+}
+
+func New(cfg Config) *Server {
+	r := registry.New()
+	return &Server{
+		cfg:             cfg,
+		registry:        r,
+		router:          router.New(r),
+		mirrors:         make(chan void, maxMirrorsInFlight),
+		hooks:           make(chan void, maxHooksInFlight),
+		challengeSecret: newChallengeSecret(),
+		transfers: transfers{
+			mode:       cfg.TransferLog,
+			sampleRate: cfg.TransferLogSampleRate,
+			totals:     map[string]*transferTotals{},
+		},
+	}
+}
+
+// Start checks the configuration, loads the operator's settings and runs the periodic maintenance, until ctx ends.
+func (s *Server) Start(ctx context.Context) error {
+	if s.cfg.KeepaliveInterval <= 0 {
+		return errors.New("the keepalive interval must be positive")
+	}
+	if s.cfg.KeepaliveMissed < 1 {
+		return errors.New("clients must be allowed to miss at least one keepalive")
+	}
+	if err := s.loadGlobalGeoRules(ctx); err != nil {
+		return err
+	}
+	if err := s.loadChallengeSecret(ctx); err != nil {
+		return err
+	}
+	if err := s.loadNotice(ctx); err != nil {
+		return err
+	}
+	if err := s.loadIncident(ctx); err != nil {
+		return err
+	}
+	if err := s.loadDNSRecords(ctx); err != nil {
+		return err
+	}
+	if err := s.loadReservations(ctx); err != nil {
+		return err
+	}
+	if err := s.loadKeyPlans(ctx); err != nil {
+		return err
+	}
+	if err := s.loadShares(ctx); err != nil {
+		return err
+	}
+	s.registerMetrics()
+	go s.logStats(ctx)
+	go s.logTransfers(ctx)
+	go s.exportUsage(ctx)
+	go s.reconcile(ctx)
+	go s.sweepShares(ctx)
+	go s.watchCertificate(ctx)
+	if s.cfg.PublicStats {
+		go s.rollDailyTransfer(ctx)
+	}
+	if s.cfg.SpareChannels > 0 {
+		go s.reapSpares(ctx)
+	}
+	if s.cfg.IdleTunnelTimeout > 0 {
+		go s.reapIdleTunnels(ctx)
+	}
+	return nil
+}
+
+// Counts returns the number of connected clients and served endpoints.
+// It waits for the connection tables, so it also proves they are not deadlocked.
+func (s *Server) Counts() (int, int) {
+	return s.registry.Counts()
+}
+
+// connState is what we track for a connection beyond the registry.
+type connState struct {
+	keyID string
+	opens *openLimiter
+	// json writes messages as JSON lines, for clients connecting as user+json@ or setting SRVUS_FORMAT=json.
+	json atomic.Bool
+	// verbose streams the progress of large transfers, for clients connecting as user+verbose@ or setting SRVUS_VERBOSE=1.
+	verbose atomic.Bool
+	// org is the organization the connection serves, as user+org=<org>@, once it is found to be a member.
+	org atomic.Pointer[string]
+	// commands holds the sessions running a console command, as ssh.Channel keys.
+	commands sync.Map
+	since    time.Time
+	// rtt is the smoothed round-trip time of keepalives, in nanoseconds.
+	rtt atomic.Int64
+	// forwards holds the *forwardStats of the connection's forwards, by forwardKey.
+	forwards sync.Map
+	// spares holds the *spareChannels of the connection's forwards, by forwardKey.
+	spares sync.Map
+	// memory is what its visitors make us hold, in bytes; evicted connections were closed for it.
+	memory  atomic.Int64
+	evicted atomic.Bool
+	// stalled holds the sessions still writing a message that timed out, as ssh.Channel keys.
+	stalled sync.Map
+	// drawsQR holds the *terminal of the sessions drawing QR codes of the URLs we announce, by ssh.Channel, see qrcodes.go.
+	drawsQR sync.Map
+	// screens holds the *tui of the sessions drawn as one, by ssh.Channel, and feed the requests they show.
+	screens sync.Map
+	feed    requestFeed
+	// controls holds the *control of the sessions speaking the srvus subsystem, by ssh.Channel, and registered
+	// the identity.Options they registered for the forwards of ports, by uint32; see control.go.
+	controls   sync.Map
+	registered sync.Map
+}
+
+func (st *connState) orgName() string {
+	if org := st.org.Load(); org != nil {
+		return *org
+	}
+	return ""
+}
+
+func (s *Server) stateOf(conn *ssh.ServerConn) *connState {
+	if st, found := s.conns.Load(conn); found {
+		return st.(*connState)
+	}
+	st, _ := s.conns.LoadOrStore(conn, &connState{opens: newOpenLimiter(s.cfg.MaxChannelOpens), since: time.Now()})
+	return st.(*connState)
+}
+
+const (
+	// sessionBacklog is how many messages wait for the sessions of a connection, before any opens or while they are slow.
+	sessionBacklog = 64
+	// sessionWriteTimeout is how long we wait for a session to take a message.
+	sessionWriteTimeout = 5 * time.Second
+)
+
+var messagesDropped = metrics.NewCounter("srvus_session_messages_dropped_total", "Messages to sessions dropped as they could not keep up, by reason.", "reason")
+
+// message is what we tell a connection's sessions: an announcement if it has URLs, in which case Text qualifies them.
+type message struct {
+	Port uint32   `json:"port,omitempty"`
+	URLs []string `json:"urls,omitempty"`
+	Text string   `json:"message,omitempty"`
+}
+
+// format renders a message as a line, in JSON for clients that asked for it.
+func (m message) format(asJSON bool) []byte {
+	if asJSON {
+		line, _ := json.Marshal(m)
+		return append(line, '\r', '\n')
+	}
+	text := strings.ReplaceAll(m.Text, "\n", "\r\n")
+	if m.URLs != nil {
+		text = fmt.Sprintf("%d: %s", m.Port, strings.Join(m.URLs, ", "))
+		if m.Text != "" {
+			text += " (" + m.Text + ")"
+		}
+	}
+	return []byte(text + "\r\n")
+}
+
+// notify writes a message to every session of a connection.
+func (s *Server) notify(conn *ssh.ServerConn, msg string) {
+	s.tell(conn, message{Text: msg})
+}
+
+// broadcast notifies every connection, each on its own so slow sessions do not hold the others up,
+// returning how many there were.
+func (s *Server) broadcast(msg string) int {
+	conns := s.registry.Connections()
+	for _, conn := range conns {
+		go s.notify(conn, msg)
+	}
+	return len(conns)
+}
+
+func (s *Server) tell(conn *ssh.ServerConn, m message) {
+	st := s.stateOf(conn)
+	var wg sync.WaitGroup
+	for _, sess := range s.registry.Sessions(conn) {
+		if screen, found := st.screens.Load(sess); found {
+			screen.(*tui).notice(string(m.format(false)))
+			continue
+		}
+		if ctl, found := st.controls.Load(sess); found {
+			ctl.(*control).event("message", m)
+			continue
+		}
+		line := st.render(sess, m)
+		var w io.Writer = sess
+		if _, found := st.commands.Load(sess); found {
+			w = sess.Stderr()
+		}
+		// A session whose terminal stopped reading misses messages until its write that timed out completes.
+		if _, stalled := st.stalled.Load(sess); stalled {
+			messagesDropped.Inc("stalled")
+			continue
+		}
+		done := make(chan void)
+		go func(sess ssh.Channel) {
+			if _, err := w.Write(line); err != nil {
+				log.Printf("Could not send message %s (%v)", line, err)
+			}
+			close(done)
+			st.stalled.CompareAndDelete(sess, done)
+		}(sess)
+		wg.Add(1)
+		go func(sess ssh.Channel) {
+			defer wg.Done()
+			select {
+			case <-done:
+			case <-time.After(sessionWriteTimeout):
+				messagesDropped.Inc("timeout")
+				st.stalled.Store(sess, done)
+				// The write may have completed meanwhile, too late to clear the mark.
+				select {
+				case <-done:
+					st.stalled.CompareAndDelete(sess, done)
+				default:
+				}
+			}
+		}(sess)
+	}
+	wg.Wait()
+}
+
+// post queues a message for the sessions of a connection without waiting for them,
+// dropping it if they are too far behind, so a slow terminal cannot hold up forwarding.
+func post(msgs chan<- message, m message) {
+	select {
+	case msgs <- m:
+	default:
+		messagesDropped.Inc("backlog")
+	}
+}
+
+// every calls fn at each interval until ctx ends.
+func every(ctx context.Context, interval time.Duration, fn func()) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			fn()
+		}
+	}
+}
@@ -0,0 +1,818 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/client"
+	"github.com/pcarrier/srv.us/backend/geoip"
+	"github.com/pcarrier/srv.us/backend/identity"
+	"github.com/pcarrier/srv.us/backend/store"
+	"github.com/pcarrier/srv.us/backend/wire"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// These tests run the whole visitor → HTTPS → SSH → client → backend path in-process, on ephemeral loopback ports,
+// with generated host keys, client keys and certificates, and an in-memory settings store.
+
+const backendGreeting = "hello from the backend"
+
+type harness struct {
+	server        *Server
+	domain        string
+	httpsListener net.Listener
+	sshListener   net.Listener
+	backend       net.Listener
+	client        *ssh.Client
+	clientKey     ssh.Signer
+	announcements chan string
+	visitor       *http.Client
+	release       chan void
+	// announced is the first line the client's session got, and endpoint the name serving its forward.
+	announced string
+	endpoint  string
+}
+
+var testForward = wire.ForwardRequest{BindAddr: "localhost", BindPort: 1}
+
+// newHarness serves a server with the default configuration, changed by configure, and connects a client
+// forwarding testForward.
+func newHarness(t *testing.T, configure ...func(*Config)) *harness {
+	t.Helper()
+	cfg := DefaultConfig()
+	for _, c := range configure {
+		c(&cfg)
+	}
+	h := &harness{domain: cfg.Domain, announcements: make(chan string, 16), release: make(chan void)}
+
+	cert, roots, err := selfSignedCertificate(cfg.Domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.clientKey, err = ssh.NewSignerFromKey(clientPriv); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Store = store.NewMemory()
+	cfg.Certificate = func() (tls.Certificate, error) { return cert, nil }
+	h.server = New(cfg)
+	sshConfig := h.server.NewSSHConfig()
+	sshConfig.AddHostKey(hostKey)
+
+	h.httpsListener = listen(t)
+	h.sshListener = listen(t)
+	h.backend = listen(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := h.server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	go h.server.ServeHTTPS(ctx, h.httpsListener)
+	go h.server.ServeSSH(ctx, h.sshListener, sshConfig)
+	go h.serveBackend()
+
+	h.visitor = &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots},
+			DisableKeepAlives: true,
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "tcp", h.httpsListener.Addr().String())
+			},
+		},
+	}
+
+	h.client = h.dial(t, "nomatch+noprobe")
+	session, err := h.client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		lines := bufio.NewScanner(stdout)
+		for lines.Scan() {
+			h.announcements <- strings.TrimSpace(lines.Text())
+		}
+	}()
+
+	// Like OpenSSH, and unlike ssh.Client.Listen, accept any origin the server reports.
+	go h.serveForwards(h.client.HandleChannelOpen("forwarded-tcpip"), testForward)
+	h.forward(t, h.client, testForward)
+	h.announced = h.nextAnnouncement(t)
+	h.endpoint = identity.HashedEndpoint(h.domain, h.clientKey.PublicKey().Marshal(), testForward.BindPort, "")
+	return h
+}
+
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	return l
+}
+
+func (h *harness) dial(t *testing.T, user string) *ssh.Client {
+	t.Helper()
+	c, err := ssh.Dial("tcp", h.sshListener.Addr().String(), &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(h.clientKey)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = c.Close()
+	})
+	return c
+}
+
+// serveBackend plays the client's local service.
+func (h *harness) serveBackend() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, backendGreeting)
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		// The visitor only lets us continue once it got the first event, so any buffering on the way deadlocks.
+		select {
+		case <-h.release:
+		case <-time.After(5 * time.Second):
+		}
+		_, _ = io.WriteString(w, "data: second\n\n")
+	})
+	_ = http.Serve(h.backend, mux)
+}
+
+// serveForwards plays the SSH client, connecting channels forwarded for fwd to the backend.
+func (h *harness) serveForwards(forwards <-chan ssh.NewChannel, fwd wire.ForwardRequest) {
+	for nc := range forwards {
+		var payload wire.ForwardedChannelData
+		if err := ssh.Unmarshal(nc.ExtraData(), &payload); err != nil || payload.DestAddr != fwd.BindAddr || payload.DestPort != fwd.BindPort {
+			_ = nc.Reject(ssh.Prohibited, "unknown forward")
+			continue
+		}
+		remote, reqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go ssh.DiscardRequests(reqs)
+		go func() {
+			defer func() {
+				_ = remote.Close()
+			}()
+			local, err := net.Dial("tcp", h.backend.Addr().String())
+			if err != nil {
+				return
+			}
+			defer func() {
+				_ = local.Close()
+			}()
+			go func() {
+				_, _ = io.Copy(local, remote)
+				_ = local.(*net.TCPConn).CloseWrite()
+			}()
+			_, _ = io.Copy(remote, local)
+			_ = remote.CloseWrite()
+		}()
+	}
+}
+
+func (h *harness) forward(t *testing.T, c *ssh.Client, fwd wire.ForwardRequest) {
+	t.Helper()
+	if ok, _, err := c.SendRequest("tcpip-forward", true, ssh.Marshal(&fwd)); err != nil || !ok {
+		t.Fatalf("forward of %d refused (%v)", fwd.BindPort, err)
+	}
+}
+
+func (h *harness) cancelForward(t *testing.T, fwd wire.ForwardRequest) {
+	t.Helper()
+	ok, _, err := h.client.SendRequest("cancel-tcpip-forward", true, ssh.Marshal(&wire.ForwardCancelRequest{BindAddr: fwd.BindAddr, BindPort: fwd.BindPort}))
+	if err != nil || !ok {
+		t.Fatalf("cancel of %d refused (%v)", fwd.BindPort, err)
+	}
+}
+
+func (h *harness) nextAnnouncement(t *testing.T) string {
+	t.Helper()
+	select {
+	case got := <-h.announcements:
+		return got
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing announced")
+		return ""
+	}
+}
+
+func (h *harness) get(t *testing.T, url string) (int, string) {
+	t.Helper()
+	resp, err := h.visitor.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func (h *harness) expect(t *testing.T, url string, status int, body string) {
+	t.Helper()
+	gotStatus, gotBody := h.get(t, url)
+	if gotStatus != status || (body != "" && gotBody != body) {
+		t.Fatalf("GET %s: got %d %q, expected %d %q", url, gotStatus, gotBody, status, body)
+	}
+}
+
+func TestAnnouncement(t *testing.T) {
+	h := newHarness(t)
+	if expected := fmt.Sprintf("1: https://%s/", h.endpoint); h.announced != expected {
+		t.Fatalf("got %q, expected %q", h.announced, expected)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	h := newHarness(t)
+	h.expect(t, "https://"+h.endpoint+"/", http.StatusOK, backendGreeting)
+	h.expect(t, "https://nowhere."+h.domain+"/", http.StatusServiceUnavailable, "")
+}
+
+// TestReserved makes sure requests under the namespace of the edge never reach the backend, however they are spelled,
+// including on connections reused after it answered.
+func TestReserved(t *testing.T) {
+	h := newHarness(t)
+	for _, target := range []string{"/.srv.us/status", "/.srv.us/nothing", "/%2Esrv.us/status", "/elsewhere/../.srv.us/status", "/.SRV.US"} {
+		h.expect(t, "https://"+h.endpoint+"/", http.StatusOK, backendGreeting)
+		status, body := h.get(t, "https://"+h.endpoint+target)
+		if body == backendGreeting || (status != http.StatusUnauthorized && status != http.StatusNotFound) {
+			t.Fatalf("GET %s: got %d %q from the backend", target, status, body)
+		}
+	}
+}
+
+// TestResumption opens another session on the connection, which must be told about its tunnels.
+func TestResumption(t *testing.T) {
+	h := newHarness(t)
+	session, err := h.client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = session.Close()
+	}()
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "1: https://" + h.endpoint + "/"; strings.TrimSpace(line) != expected {
+		t.Fatalf("got %q, expected %q", line, expected)
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	h := newHarness(t)
+	resp, err := h.visitor.Get("https://" + h.endpoint + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	r := bufio.NewReader(resp.Body)
+	first, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(h.release)
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != "data: first\n" || !strings.Contains(string(rest), "data: second") {
+		t.Fatalf("unexpected events %q then %q", first, rest)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	h := newHarness(t)
+	resp, err := h.visitor.Post("https://"+h.domain+"/echo", "text/plain", strings.NewReader("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "ping" {
+		t.Fatalf("echoed %q", body)
+	}
+}
+
+// TestWithoutPastes requests shared files from a server without a database for them, which must keep serving.
+func TestWithoutPastes(t *testing.T) {
+	h := newHarness(t)
+	h.expect(t, "https://"+h.domain+"/abc", http.StatusNotFound, "")
+	resp, err := h.visitor.Post("https://"+h.domain+"/", "text/plain", strings.NewReader("shared"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got %d sharing a file", resp.StatusCode)
+	}
+	h.expect(t, "https://"+h.endpoint+"/", http.StatusOK, backendGreeting)
+}
+
+// TestWithoutReconciliation serves with consistency checks disabled.
+func TestWithoutReconciliation(t *testing.T) {
+	h := newHarness(t, func(cfg *Config) {
+		cfg.ReconcileInterval = 0
+	})
+	h.expect(t, "https://"+h.endpoint+"/", http.StatusOK, backendGreeting)
+}
+
+// TestKeepaliveConfig refuses to start with keepalives that would panic or drop every client.
+func TestKeepaliveConfig(t *testing.T) {
+	for _, configure := range []func(*Config){
+		func(cfg *Config) { cfg.KeepaliveInterval = 0 },
+		func(cfg *Config) { cfg.KeepaliveMissed = 0 },
+	} {
+		cfg := DefaultConfig()
+		cfg.Store = store.NewMemory()
+		configure(&cfg)
+		ctx, cancel := context.WithCancel(context.Background())
+		err := New(cfg).Start(ctx)
+		cancel()
+		if err == nil {
+			t.Errorf("started with an interval of %v and %d missed keepalives", cfg.KeepaliveInterval, cfg.KeepaliveMissed)
+		}
+	}
+}
+
+// TestRefusal requests a forward we cannot serve, which must be explained in the session.
+func TestRefusal(t *testing.T) {
+	h := newHarness(t)
+	ok, _, err := h.client.SendRequest("streamlocal-forward@openssh.com", true, ssh.Marshal(&struct{ Path string }{"/tmp/app.sock"}))
+	if err != nil || ok {
+		t.Fatalf("unix socket forward not refused (%v)", err)
+	}
+	if got := h.nextAnnouncement(t); !strings.Contains(got, "cannot be forwarded") {
+		t.Fatalf("unexpected explanation %q", got)
+	}
+}
+
+// TestAllocation forwards port 0, which must get the next free label.
+func TestAllocation(t *testing.T) {
+	h := newHarness(t)
+	ok, reply, err := h.client.SendRequest("tcpip-forward", true, ssh.Marshal(&wire.ForwardRequest{BindAddr: "localhost"}))
+	if err != nil || !ok {
+		t.Fatalf("forward refused (%v)", err)
+	}
+	var allocated struct{ Port uint32 }
+	if err := ssh.Unmarshal(reply, &allocated); err != nil || allocated.Port != 2 {
+		t.Fatalf("allocated %d, expected 2 (%v)", allocated.Port, err)
+	}
+	if got := h.nextAnnouncement(t); !strings.HasPrefix(got, "2: https://") {
+		t.Fatalf("unexpected announcement %q", got)
+	}
+	h.cancelForward(t, wire.ForwardRequest{BindAddr: "localhost", BindPort: 2})
+}
+
+// TestClient opens a tunnel with the client package, as Go programs and tests would.
+func TestClient(t *testing.T) {
+	h := newHarness(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tunnel, err := client.Open(ctx, h.backend.Addr().String(), client.Options{
+		Server:          h.sshListener.Addr().String(),
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(h.clientKey)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Label:           4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = tunnel.Close()
+	}()
+	expected := "https://" + identity.HashedEndpoint(h.domain, h.clientKey.PublicKey().Marshal(), 4, "") + "/"
+	if tunnel.URL() != expected {
+		t.Fatalf("got %s, expected %s", tunnel.URL(), expected)
+	}
+	h.expect(t, tunnel.URL(), http.StatusOK, backendGreeting)
+}
+
+// TestMultiplexing forwards as user+http+json@, so successive visitors must share a channel,
+// and the announcement must be a JSON line.
+func TestMultiplexing(t *testing.T) {
+	h := newHarness(t)
+	c := h.dial(t, "nomatch+http+json+noprobe")
+
+	// Announcements wait for a session.
+	session, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+
+	var opened atomic.Int32
+	forwards := make(chan ssh.NewChannel)
+	go func() {
+		defer close(forwards)
+		for nc := range c.HandleChannelOpen("forwarded-tcpip") {
+			opened.Add(1)
+			forwards <- nc
+		}
+	}()
+	fwd := wire.ForwardRequest{BindAddr: "localhost", BindPort: 3}
+	go h.serveForwards(forwards, fwd)
+	h.forward(t, c, fwd)
+
+	endpoint := identity.HashedEndpoint(h.domain, h.clientKey.PublicKey().Marshal(), 3, "")
+	line, err := bufio.NewReader(stdout).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var announced message
+	if err := json.Unmarshal(line, &announced); err != nil || announced.Port != 3 || len(announced.URLs) != 1 || announced.URLs[0] != "https://"+endpoint+"/" {
+		t.Fatalf("unexpected announcement %q (%v)", line, err)
+	}
+	for i := 0; i < 3; i++ {
+		h.expect(t, "https://"+endpoint+"/", http.StatusOK, backendGreeting)
+	}
+	if n := opened.Load(); n != 1 {
+		t.Fatalf("%d channels opened for 3 requests", n)
+	}
+}
+
+// TestRotate runs the rotate command from a second connection of the same key.
+func TestRotate(t *testing.T) {
+	h := newHarness(t)
+	session, err := h.dial(t, "nomatch+noprobe").NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := session.Output("rotate 1")
+	if err != nil {
+		t.Fatalf("%v (%s)", err, out)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) < 2 {
+		t.Fatalf("unexpected output %q", out)
+	}
+	rotated := strings.TrimSuffix(strings.TrimPrefix(fields[1], "https://"), "/")
+	if rotated == h.endpoint {
+		t.Fatal("URL did not change")
+	}
+	h.expect(t, "https://"+h.endpoint+"/", http.StatusServiceUnavailable, "")
+	h.expect(t, "https://"+rotated+"/", http.StatusOK, backendGreeting)
+}
+
+func TestCancel(t *testing.T) {
+	h := newHarness(t)
+	h.cancelForward(t, testForward)
+	h.expect(t, "https://"+h.endpoint+"/", http.StatusServiceUnavailable, "")
+}
+
+// TestShareHits mints a share link serving two hits, each visitor connection being one, then answering 410 Gone.
+// Hits are kept in the store, so restarts do not reset them.
+func TestShareHits(t *testing.T) {
+	h := newHarness(t)
+	session, err := h.dial(t, "nomatch+noprobe").NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := session.Output(fmt.Sprintf("share new %d 1h 2", testForward.BindPort))
+	if err != nil {
+		t.Fatalf("%v (%s)", err, out)
+	}
+	link := strings.TrimSpace(string(out))
+	name := strings.TrimSuffix(strings.TrimPrefix(link, "https://"), "/")
+	if !strings.HasPrefix(name, shareLabel) {
+		t.Fatalf("unexpected output %q", out)
+	}
+	h.expect(t, link, http.StatusOK, backendGreeting)
+	h.expect(t, link, http.StatusOK, backendGreeting)
+	h.expect(t, link, http.StatusGone, "")
+	h.expect(t, "https://"+h.endpoint+"/", http.StatusOK, backendGreeting)
+
+	raw, err := h.server.cfg.Store.Get(context.Background(), sharesNamespace, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored shareLink
+	if err := json.Unmarshal(raw, &stored); err != nil || stored.Hits != 2 || stored.MaxHits != 2 {
+		t.Fatalf("stored %s (%v)", raw, err)
+	}
+}
+
+// TestCancelUnknown cancels forwards never requested, which is acknowledged and leaves the others up.
+func TestCancelUnknown(t *testing.T) {
+	h := newHarness(t)
+	h.cancelForward(t, wire.ForwardRequest{BindAddr: "localhost", BindPort: 42})
+	h.cancelForward(t, wire.ForwardRequest{BindAddr: "elsewhere", BindPort: testForward.BindPort})
+	h.expect(t, "https://"+h.endpoint+"/", http.StatusOK, backendGreeting)
+}
+
+// TestCancelTwice cancels a forward again once gone, which must not disturb the connection.
+func TestCancelTwice(t *testing.T) {
+	h := newHarness(t)
+	h.cancelForward(t, testForward)
+	h.cancelForward(t, testForward)
+	h.expect(t, "https://"+h.endpoint+"/", http.StatusServiceUnavailable, "")
+	if _, _, err := h.client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		t.Fatalf("connection lost (%v)", err)
+	}
+}
+
+// TestCancelForwardAgain forwards the same address and port once cancelled, which must serve the same name again.
+func TestCancelForwardAgain(t *testing.T) {
+	h := newHarness(t)
+	for i := 0; i < 2; i++ {
+		h.cancelForward(t, testForward)
+		h.expect(t, "https://"+h.endpoint+"/", http.StatusServiceUnavailable, "")
+		h.forward(t, h.client, testForward)
+		if got, expected := h.nextAnnouncement(t), h.announced; got != expected {
+			t.Fatalf("got %q, expected %q", got, expected)
+		}
+		h.expect(t, "https://"+h.endpoint+"/", http.StatusOK, backendGreeting)
+	}
+}
+
+// rawRequest sends a request head as is to the endpoint, over a connection negotiating HTTP/1.1, and reads the response.
+func (h *harness) rawRequest(t *testing.T, head string) *http.Response {
+	t.Helper()
+	tlsConfig := h.visitor.Transport.(*http.Transport).TLSClientConfig.Clone()
+	tlsConfig.ServerName, tlsConfig.NextProtos = h.endpoint, []string{"http/1.1"}
+	conn, err := tls.Dial("tcp", h.httpsListener.Addr().String(), tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, head); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = resp.Body.Close()
+	})
+	return resp
+}
+
+// TestLargeHead sends first requests with large heads, which the edge holds while looking at them:
+// up to wire.MaxRequestHead they reach the backend, past it they are rejected.
+func TestLargeHead(t *testing.T) {
+	h := newHarness(t)
+	start := "GET / HTTP/1.1\r\nHost: " + h.endpoint + "\r\nConnection: close\r\nX-Padding: "
+	if resp := h.rawRequest(t, start+strings.Repeat("a", 64<<10)+"\r\n\r\n"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d for a head within bounds", resp.StatusCode)
+	}
+	// Exactly as much as the edge reads, so it closes the connection with nothing left unread.
+	if resp := h.rawRequest(t, start+strings.Repeat("a", wire.MaxRequestHead-len(start))); resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("got %d for a head past bounds", resp.StatusCode)
+	}
+}
+
+// TestRequestIDs keeps well-formed IDs requests come with, and passes on those services answer with.
+func TestRequestIDs(t *testing.T) {
+	for sent, kept := range map[string]bool{"": false, "3f2a-uuid.1": true, "bad id": false, strings.Repeat("a", 129): false} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if sent != "" {
+			r.Header.Set(requestIDHeader, sent)
+		}
+		w := httptest.NewRecorder()
+		id := tagRequest(w, r)
+		if (id == sent) != kept || r.Header.Get(requestIDHeader) != id || w.Header().Get(requestIDHeader) != id {
+			t.Errorf("sent %q: got %q", sent, id)
+		}
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Add(requestIDHeader, "first")
+	r.Header.Add(requestIDHeader, "second")
+	if id := tagRequest(httptest.NewRecorder(), r); id == "first" || id == "second" {
+		t.Errorf("kept %q of two IDs", id)
+	}
+
+	for answered, expected := range map[string]string{"": "", "ours": "", "theirs": "theirs"} {
+		resp := &http.Response{Header: http.Header{}, Request: &http.Request{Header: http.Header{requestIDHeader: {"ours"}}}}
+		if answered != "" {
+			resp.Header.Set(requestIDHeader, answered)
+		}
+		untagResponse(resp)
+		if got := resp.Header.Get(serviceRequestIDHeader); got != expected || resp.Header.Get(requestIDHeader) != "" {
+			t.Errorf("answered %q: got %v", answered, resp.Header)
+		}
+	}
+}
+
+// TestTagLocation makes sure services only get the location we found, never one the visitor sent.
+func TestTagLocation(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(visitorCountryHeader, "FR")
+	r.Header.Set(visitorASNHeader, "3215")
+	tagLocation(r, geoip.Info{Country: "BE"})
+	if got := r.Header.Get(visitorCountryHeader); got != "BE" {
+		t.Errorf("got country %q", got)
+	}
+	if got, found := r.Header[visitorASNHeader]; found {
+		t.Errorf("kept ASN %q", got)
+	}
+	tagLocation(r, geoip.Info{})
+	if len(r.Header) != 0 {
+		t.Errorf("kept %v", r.Header)
+	}
+}
+
+// TestCustomDomainOwnership reserves custom domains, which takes a plan allowing them and a TXT record naming the key,
+// unless an operator does.
+func TestCustomDomainOwnership(t *testing.T) {
+	h := newHarness(t)
+	ctx := context.Background()
+	o := owner{keyID: identity.KeyID(h.clientKey.PublicKey())}
+	records := map[string][]string{}
+	lookupTXT = func(_ context.Context, name string) ([]string, error) {
+		return records[name], nil
+	}
+	t.Cleanup(func() {
+		lookupTXT = net.DefaultResolver.LookupTXT
+	})
+
+	if _, _, err := h.server.putReservation(ctx, o, "app", 1, "app.example.com", false); err == nil {
+		t.Fatal("reserved a custom domain without plans")
+	}
+	h.server.cfg.Plans = &Plans{Default: "pro", Plans: map[string]*Plan{"pro": {CustomDomains: true}}}
+	names := map[string]string{"app": "app.example.com", "previews": "*.preview.example.com"}
+	for id, name := range names {
+		if _, _, err := h.server.putReservation(ctx, o, id, 1, name, false); !errors.Is(err, errOwnershipUnproven) {
+			t.Fatalf("reserving %s without proof: got %v", name, err)
+		}
+	}
+	fingerprint := ssh.FingerprintSHA256(h.clientKey.PublicKey())
+	records["_srvus.app.example.com"] = []string{"SHA256:someone-else", fingerprint}
+	records["_srvus.preview.example.com"] = []string{fingerprint}
+	for id, name := range names {
+		if _, _, err := h.server.putReservation(ctx, o, id, 1, name, false); err != nil {
+			t.Fatalf("reserving %s with proof: %v", name, err)
+		}
+	}
+	if _, _, err := h.server.putReservation(ctx, o, "operated", 1, "ops.example.com", true); err != nil {
+		t.Fatalf("reserving as an operator: %v", err)
+	}
+}
+
+// TestCancelTakenOver cancels a forward after one of its names went to another target, which the webhook of the key
+// must not be told went down with it.
+func TestCancelTakenOver(t *testing.T) {
+	h := newHarness(t)
+	ctx := context.Background()
+	keyID := identity.KeyID(h.clientKey.PublicKey())
+	events := make(chan hookEvent, 4)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e hookEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err == nil {
+			events <- e
+		}
+	}))
+	t.Cleanup(receiver.Close)
+	previousClient := hookClient
+	hookClient = receiver.Client()
+	t.Cleanup(func() {
+		hookClient = previousClient
+	})
+	raw, err := json.Marshal(hook{URL: receiver.URL, Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.server.cfg.Store.Put(ctx, hooksNamespace, keyID, raw); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := h.server.putReservation(ctx, owner{keyID: keyID}, "docs", testForward.BindPort, "docs", false); err != nil {
+		t.Fatal(err)
+	}
+	reserved := "docs." + h.domain
+	h.expect(t, "https://"+reserved+"/", http.StatusOK, backendGreeting)
+	// As when another key takes the name over.
+	for _, conn := range h.server.registry.ConnectionsOf(keyID) {
+		for ref, tgt := range h.server.registry.TunnelsOf(conn) {
+			if ref.Endpoint == reserved {
+				h.server.registry.Lock()
+				h.server.registry.Remove(ref.Endpoint, tgt)
+				h.server.registry.Unlock()
+			}
+		}
+	}
+
+	h.cancelForward(t, testForward)
+	for {
+		select {
+		case e := <-events:
+			if e.Event != "tunnel_down" {
+				continue
+			}
+			if expected := "https://" + h.endpoint + "/"; len(e.URLs) != 1 || e.URLs[0] != expected {
+				t.Fatalf("got %v down, expected %s", e.URLs, expected)
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatal("tunnel_down not delivered")
+		}
+	}
+}
+
+func selfSignedCertificate(domain string) (tls.Certificate, *x509.CertPool, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain, "*." + domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(parsed)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: parsed}, roots, nil
+}
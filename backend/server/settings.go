@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pcarrier/srv.us/backend/geoip"
+	"github.com/pcarrier/srv.us/backend/registry"
+	"github.com/pcarrier/srv.us/backend/settings"
+)
+
+const globalSettingsNamespace = "global"
+
+// updateSettings applies change to the stored settings of a tunnel and to its live targets.
+func (s *Server) updateSettings(ctx context.Context, keyID string, port uint32, change func(*settings.Endpoint) error) (*settings.Endpoint, error) {
+	s.settingsLock.Lock()
+	defer s.settingsLock.Unlock()
+
+	st, err := settings.Load(ctx, s.cfg.Store, keyID, port)
+	if err != nil {
+		return nil, err
+	}
+	if err := change(st); err != nil {
+		return nil, err
+	}
+	if err := settings.Save(ctx, s.cfg.Store, keyID, port, st); err != nil {
+		return nil, err
+	}
+
+	s.registry.Lock()
+	defer s.registry.Unlock()
+	for _, t := range s.registry.TargetsOf(keyID, port) {
+		t.Settings.Store(st)
+	}
+	return st, nil
+}
+
+// replaceSettings applies change to the settings of the given ports and of every other port of a key with settings,
+// saving them all before any live target sees them.
+func (s *Server) replaceSettings(ctx context.Context, keyID string, ports []uint32, change func(uint32, *settings.Endpoint)) (map[uint32]*settings.Endpoint, error) {
+	s.settingsLock.Lock()
+	defer s.settingsLock.Unlock()
+
+	stored, err := settings.Ports(ctx, s.cfg.Store, keyID)
+	if err != nil {
+		return nil, err
+	}
+	result := map[uint32]*settings.Endpoint{}
+	for _, port := range append(stored, ports...) {
+		if result[port] != nil {
+			continue
+		}
+		st, err := settings.Load(ctx, s.cfg.Store, keyID, port)
+		if err != nil {
+			return nil, err
+		}
+		change(port, st)
+		result[port] = st
+	}
+	for port, st := range result {
+		if err := settings.Save(ctx, s.cfg.Store, keyID, port, st); err != nil {
+			return nil, err
+		}
+	}
+
+	s.registry.Lock()
+	defer s.registry.Unlock()
+	for port, st := range result {
+		for _, t := range s.registry.TargetsOf(keyID, port) {
+			t.Settings.Store(st)
+		}
+	}
+	return result, nil
+}
+
+// loadGlobalGeoRules reads the operator's rules, which apply to every endpoint.
+func (s *Server) loadGlobalGeoRules(ctx context.Context) error {
+	raw, err := s.cfg.Store.Get(ctx, globalSettingsNamespace, "geo")
+	if err != nil || raw == nil {
+		return err
+	}
+	rules := &geoip.Rules{}
+	if err := json.Unmarshal(raw, rules); err != nil {
+		return err
+	}
+	s.globalGeo.Store(rules)
+	return nil
+}
+
+func (s *Server) setGlobalGeoRules(ctx context.Context, rules *geoip.Rules) error {
+	raw, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+	if err := s.cfg.Store.Put(ctx, globalSettingsNamespace, "geo", raw); err != nil {
+		return err
+	}
+	s.globalGeo.Store(rules)
+	return nil
+}
+
+// admits reports whether a visitor may reach a target, per both the operator's and the owner's rules.
+// Rules needing a database the server lacks admit everyone.
+func (s *Server) admits(t *registry.Target, info geoip.Info) bool {
+	if s.cfg.GeoIP == nil {
+		return true
+	}
+	if !s.cfg.GeoIP.Applicable(s.globalGeo.Load()).Permits(info) {
+		return false
+	}
+	if st := t.Settings.Load(); st != nil && !s.cfg.GeoIP.Applicable(st.Geo).Permits(info) {
+		return false
+	}
+	return true
+}
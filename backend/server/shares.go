@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/identity"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Owners share a demo without handing out the stable URL of its tunnel: `ssh srv.us share new 1 2h 10` mints
+// https://share-<random>.srv.us/, serving tunnel 1 for 2 hours and 10 hits, then answering 410 Gone.
+// Every visitor connection is a hit, and browsers open a few per page. Links survive restarts in the store,
+// hits included, and point at the tunnel rather than a connection, so they keep working as clients reconnect.
+
+const (
+	sharesNamespace = "share-links"
+	shareLabel      = "share-"
+	maxShares       = 20
+	maxShareTTL     = 7 * 24 * time.Hour
+	sharesSweep     = time.Minute
+)
+
+// shareLink is stored under the name it serves.
+type shareLink struct {
+	KeyID string `json:"key"`
+	Port  uint32 `json:"port"`
+	// MaxHits is how many visitor connections it serves, any number if 0; Hits how many it served.
+	MaxHits int       `json:"max_hits,omitempty"`
+	Hits    int       `json:"hits"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+func (l *shareLink) gone(now time.Time) bool {
+	return !now.Before(l.Expires) || (l.MaxHits > 0 && l.Hits >= l.MaxHits)
+}
+
+// shares indexes what the store holds by name, as it is looked up by every visitor connection to a share link.
+type shares struct {
+	sync.Mutex
+	byName map[string]*shareLink
+}
+
+func (s *Server) loadShares(ctx context.Context) error {
+	stored, err := s.cfg.Store.List(ctx, sharesNamespace)
+	if err != nil {
+		return err
+	}
+	s.shares.Lock()
+	defer s.shares.Unlock()
+	s.shares.byName = map[string]*shareLink{}
+	for name, raw := range stored {
+		l := &shareLink{}
+		if err := json.Unmarshal(raw, l); err != nil {
+			return fmt.Errorf("share link %s: %w", name, err)
+		}
+		s.shares.byName[name] = l
+	}
+	return nil
+}
+
+// isShareName tells whether a name under the domain has the shape of share links, which cannot be reserved.
+func isShareName(label string) bool {
+	return strings.HasPrefix(label, shareLabel)
+}
+
+// resolveShare returns the hashed name of the tunnel a share link serves, counting a hit, or why it no longer does.
+// Other names, and links whose tunnel is down, are returned as they are.
+func (s *Server) resolveShare(ctx context.Context, name string) (string, string) {
+	label, under := strings.CutSuffix(name, "."+s.cfg.Domain)
+	if !under || !isShareName(label) {
+		return name, ""
+	}
+	s.shares.Lock()
+	l := s.shares.byName[name]
+	if l == nil || l.gone(time.Now()) {
+		s.shares.Unlock()
+		return "", "This share link expired."
+	}
+	endpoint := s.hashedEndpointOf(l.KeyID, l.Port)
+	if endpoint == "" {
+		s.shares.Unlock()
+		return name, ""
+	}
+	l.Hits++
+	var raw []byte
+	if l.MaxHits > 0 {
+		raw, _ = json.Marshal(l)
+	}
+	s.shares.Unlock()
+
+	// Hits are counted in memory, so visitors of other links do not wait for the store.
+	if raw != nil {
+		if err := s.cfg.Store.Put(ctx, sharesNamespace, name, raw); err != nil {
+			log.Printf("Could not count a hit of %s (%v)", name, err)
+		}
+	}
+	return endpoint, ""
+}
+
+// hashedEndpointOf returns the hashed name a key serves a port on, "" if no connection of the key forwards it.
+func (s *Server) hashedEndpointOf(keyID string, port uint32) string {
+	for _, conn := range s.registry.ConnectionsOf(keyID) {
+		for ref, t := range s.registry.TunnelsOf(conn) {
+			if ref.Port == port && !t.Shadow && identity.IsHashed(s.cfg.Domain, ref.Endpoint) {
+				return ref.Endpoint
+			}
+		}
+	}
+	return ""
+}
+
+// sweepShares forgets the links that expired or served all their hits, every sharesSweep.
+func (s *Server) sweepShares(ctx context.Context) {
+	every(ctx, sharesSweep, func() {
+		now := time.Now()
+		s.shares.Lock()
+		defer s.shares.Unlock()
+		for name, l := range s.shares.byName {
+			if !l.gone(now) {
+				continue
+			}
+			if err := s.cfg.Store.Delete(ctx, sharesNamespace, name); err != nil {
+				log.Printf("Could not delete share link %s (%v)", name, err)
+				continue
+			}
+			delete(s.shares.byName, name)
+		}
+	})
+}
+
+// sharesOf lists the live share links of a key, by name.
+func (s *Server) sharesOf(keyID string) []string {
+	now := time.Now()
+	s.shares.Lock()
+	defer s.shares.Unlock()
+	var names []string
+	for name, l := range s.shares.byName {
+		if l.KeyID == keyID && !l.gone(now) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func runShare(s *Server, c *commandContext, args []string) error {
+	switch {
+	case len(args) == 0 || (len(args) == 1 && args[0] == "list"):
+		names := s.sharesOf(c.keyID)
+		if len(names) == 0 {
+			c.printf("No share links, mint one with `ssh %s share new <port> <ttl> [<hits>]`.", s.cfg.Domain)
+			return nil
+		}
+		s.shares.Lock()
+		defer s.shares.Unlock()
+		for _, name := range names {
+			l := s.shares.byName[name]
+			if l == nil {
+				continue
+			}
+			hits := strconv.Itoa(l.Hits)
+			if l.MaxHits > 0 {
+				hits += "/" + strconv.Itoa(l.MaxHits)
+			}
+			c.printf("https://%s/ %d until %s, %s hits", name, l.Port, l.Expires.Format(time.RFC3339), hits)
+		}
+		return nil
+	case (len(args) == 3 || len(args) == 4) && args[0] == "new":
+		port, err := parsePort(args[1])
+		if err != nil {
+			return err
+		}
+		ttl, err := time.ParseDuration(args[2])
+		if err != nil || ttl <= 0 || ttl > maxShareTTL {
+			return fmt.Errorf("invalid ttl %q, expected e.g. 2h, up to %s", args[2], maxShareTTL)
+		}
+		maxHits := 0
+		if len(args) == 4 {
+			if maxHits, err = strconv.Atoi(args[3]); err != nil || maxHits <= 0 {
+				return fmt.Errorf("invalid hits %q, expected a positive number", args[3])
+			}
+		}
+		if len(s.sharesOf(c.keyID)) >= maxShares {
+			return fmt.Errorf("at most %d share links, revoke one first", maxShares)
+		}
+		slug := make([]byte, 10)
+		if _, err := rand.Read(slug); err != nil {
+			return err
+		}
+		name := shareLabel + identity.Base32.EncodeToString(slug) + "." + s.cfg.Domain
+		now := time.Now().UTC()
+		l := &shareLink{KeyID: c.keyID, Port: port, MaxHits: maxHits, Created: now, Expires: now.Add(ttl).Truncate(time.Second)}
+		raw, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		if err := s.cfg.Store.Put(c.ctx, sharesNamespace, name, raw); err != nil {
+			return err
+		}
+		s.shares.Lock()
+		if s.shares.byName == nil {
+			s.shares.byName = map[string]*shareLink{}
+		}
+		s.shares.byName[name] = l
+		s.shares.Unlock()
+		s.cfg.Audit.Record("share_created", logs.Fields{"key": c.keyID, "port": port, "name": name, "ttl": ttl.String(), "max_hits": maxHits})
+		c.printf("https://%s/", name)
+		return nil
+	case len(args) == 2 && args[0] == "revoke":
+		name := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(args[1], "https://"), "http://"), "/")
+		if !strings.Contains(name, ".") {
+			name += "." + s.cfg.Domain
+		}
+		s.shares.Lock()
+		defer s.shares.Unlock()
+		l := s.shares.byName[name]
+		if l == nil || l.KeyID != c.keyID {
+			return fmt.Errorf("no share link %s, list them with `ssh %s share`", args[1], s.cfg.Domain)
+		}
+		if err := s.cfg.Store.Delete(c.ctx, sharesNamespace, name); err != nil {
+			return err
+		}
+		delete(s.shares.byName, name)
+		s.cfg.Audit.Record("share_revoked", logs.Fields{"key": c.keyID, "name": name})
+		c.printf("Share link %s revoked.", name)
+		return nil
+	default:
+		return errUsage
+	}
+}
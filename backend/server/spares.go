@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"github.com/pcarrier/srv.us/backend/metrics"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"sync"
+	"time"
+)
+
+// Opening a channel takes a round trip to the client and its connecting to the service, which visitors of distant
+// clients wait for whenever a new channel is needed. Forwards asked for hotDemand channels within a minute keep up to
+// Config.SpareChannels more opened ahead of time: pools take one when they grow, and so do visitors proxied byte by
+// byte when origins are synthetic anyway (Config.SyntheticOrigins), as a spare cannot carry the address of a visitor
+// yet to come. Spares unused for spareIdleTimeout are closed, and only replaced once the forward is asked for more.
+
+const (
+	hotDemand        = 10
+	spareIdleTimeout = 30 * time.Second
+	spareOpenTimeout = 10 * time.Second
+)
+
+var sparesTaken = metrics.NewCounter("srvus_spare_channels_total", "Channels asked of hot forwards, by whether a spare was ready.", "result")
+
+// spareChannel is a channel opened ahead of time. Its requests are discarded all along; reqs closes with it.
+type spareChannel struct {
+	ssh.Channel
+	reqs   chan *ssh.Request
+	opened time.Time
+}
+
+// spareChannels are those of a forward, with how many channels it was asked for lately.
+type spareChannels struct {
+	lock    sync.Mutex
+	idle    []*spareChannel
+	opening int
+	closed  bool
+	// demand counts the channels asked for since window began, and lastDemand those of the window before.
+	window             time.Time
+	demand, lastDemand int
+}
+
+// want records a channel asked for, returning a spare if one is ready and whether to open another, counted as opening.
+func (sp *spareChannels) want(now time.Time, max int) (*spareChannel, bool) {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	if elapsed := now.Sub(sp.window); elapsed >= time.Minute {
+		sp.lastDemand = 0
+		if elapsed < 2*time.Minute {
+			sp.lastDemand = sp.demand
+		}
+		sp.window, sp.demand = now, 0
+	}
+	sp.demand++
+	var spare *spareChannel
+	if n := len(sp.idle); n > 0 {
+		spare, sp.idle = sp.idle[n-1], sp.idle[:n-1]
+	}
+	more := !sp.closed && sp.demand+sp.lastDemand >= hotDemand && len(sp.idle)+sp.opening < max
+	if more {
+		sp.opening++
+	}
+	return spare, more
+}
+
+// add keeps a spare once opened, returning false if it is not wanted anymore.
+func (sp *spareChannels) add(spare *spareChannel) bool {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	sp.opening--
+	if sp.closed {
+		return false
+	}
+	sp.idle = append(sp.idle, spare)
+	return true
+}
+
+// drop forgets a spare closed by the client.
+func (sp *spareChannels) drop(spare *spareChannel) {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	for i, s := range sp.idle {
+		if s == spare {
+			sp.idle = append(sp.idle[:i], sp.idle[i+1:]...)
+			return
+		}
+	}
+}
+
+// reap removes the spares opened before cutoff, or all of them once the forward is down, for the caller to close.
+func (sp *spareChannels) reap(cutoff time.Time, down bool) []*spareChannel {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	sp.closed = sp.closed || down
+	var reaped, kept []*spareChannel
+	for _, s := range sp.idle {
+		if sp.closed || s.opened.Before(cutoff) {
+			reaped = append(reaped, s)
+		} else {
+			kept = append(kept, s)
+		}
+	}
+	sp.idle = kept
+	return reaped
+}
+
+// takeChannel opens a channel as openChannel does, or takes a spare of the forward if the origin allows it.
+func (s *Server) takeChannel(ctx context.Context, conn *ssh.ServerConn, host string, port uint32, origin net.Addr) (ssh.Channel, <-chan *ssh.Request, error) {
+	if _, visitor := origin.(*net.TCPAddr); s.cfg.SpareChannels <= 0 || (visitor && !s.cfg.SyntheticOrigins) {
+		return s.openChannel(ctx, conn, host, port, origin)
+	}
+	st := s.stateOf(conn)
+	if _, up := st.forwards.Load(forwardKey{host, port}); !up {
+		return s.openChannel(ctx, conn, host, port, origin)
+	}
+	v, _ := st.spares.LoadOrStore(forwardKey{host, port}, &spareChannels{})
+	sp := v.(*spareChannels)
+	spare, more := sp.want(time.Now(), s.cfg.SpareChannels)
+	if more {
+		go s.openSpare(conn, host, port, sp)
+	}
+	if spare != nil {
+		sparesTaken.Inc("ready")
+		return spare.Channel, spare.reqs, nil
+	}
+	if more {
+		sparesTaken.Inc("missed")
+	}
+	return s.openChannel(ctx, conn, host, port, origin)
+}
+
+// openSpare opens a channel to the forward ahead of time, and keeps it until taken, reaped, or closed by the client.
+func (s *Server) openSpare(conn *ssh.ServerConn, host string, port uint32, sp *spareChannels) {
+	ctx, cancel := context.WithTimeout(context.Background(), spareOpenTimeout)
+	defer cancel()
+	ch, reqs, err := s.openChannel(ctx, conn, host, port, nil)
+	if err != nil {
+		sp.lock.Lock()
+		sp.opening--
+		sp.lock.Unlock()
+		return
+	}
+	spare := &spareChannel{Channel: ch, reqs: make(chan *ssh.Request), opened: time.Now()}
+	if !sp.add(spare) {
+		go ssh.DiscardRequests(reqs)
+		_ = ch.Close()
+		return
+	}
+	go func() {
+		ssh.DiscardRequests(reqs)
+		sp.drop(spare)
+		close(spare.reqs)
+	}()
+}
+
+// closeSpares closes the spares of the forwards of a port, once down.
+func (s *Server) closeSpares(conn *ssh.ServerConn, port uint32) {
+	spares := &s.stateOf(conn).spares
+	spares.Range(func(k, v any) bool {
+		if k.(forwardKey).port == port {
+			spares.Delete(k)
+			for _, spare := range v.(*spareChannels).reap(time.Time{}, true) {
+				_ = spare.Close()
+			}
+		}
+		return true
+	})
+}
+
+// reapSpares closes the spares left unused for spareIdleTimeout, until ctx ends.
+func (s *Server) reapSpares(ctx context.Context) {
+	every(ctx, spareIdleTimeout/2, func() {
+		cutoff := time.Now().Add(-spareIdleTimeout)
+		s.conns.Range(func(_, st any) bool {
+			st.(*connState).spares.Range(func(_, v any) bool {
+				for _, spare := range v.(*spareChannels).reap(cutoff, false) {
+					_ = spare.Close()
+				}
+				return true
+			})
+			return true
+		})
+	})
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/registry"
+	"github.com/pcarrier/srv.us/backend/settings"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var validTag = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+func runSplit(s *Server, c *commandContext, args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	port, err := parsePort(args[0])
+	if err != nil {
+		return err
+	}
+
+	var split map[string]int
+	switch {
+	case len(args) == 1:
+		st, err := settings.Load(c.ctx, s.cfg.Store, c.keyID, port)
+		if err != nil {
+			return err
+		}
+		c.printf("%d: %s", port, describeSplit(st.Split))
+		return nil
+	case len(args) == 2 && args[1] == "clear":
+	default:
+		split = map[string]int{}
+		total := 0
+		for _, arg := range args[1:] {
+			tag, value, found := strings.Cut(arg, "=")
+			weight, err := strconv.Atoi(value)
+			if !found || !validTag.MatchString(tag) || err != nil || weight < 0 {
+				return fmt.Errorf("invalid weight %q, expected tag=weight such as %s=90", arg, registry.DefaultTag)
+			}
+			split[tag] = weight
+			total += weight
+		}
+		if total == 0 {
+			return errors.New("weights cannot all be 0")
+		}
+	}
+
+	st, err := s.updateSettings(c.ctx, c.keyID, port, func(st *settings.Endpoint) error {
+		st.Split = split
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.cfg.Audit.Record("split_changed", logs.Fields{"key": c.keyID, "port": port, "split": st.Split})
+	c.printf("%d: %s", port, describeSplit(st.Split))
+	return nil
+}
+
+// describeSplit renders weights as shares of the traffic.
+func describeSplit(split map[string]int) string {
+	if len(split) == 0 {
+		return "no split, visitors are spread evenly"
+	}
+	total := 0
+	var tags []string
+	for tag, weight := range split {
+		tags = append(tags, tag)
+		total += weight
+	}
+	sort.Strings(tags)
+	var parts []string
+	for _, tag := range tags {
+		parts = append(parts, fmt.Sprintf("%s %.4g%%", tag, float64(split[tag])*100/float64(total)))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,671 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/identity"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/registry"
+	"github.com/pcarrier/srv.us/backend/settings"
+	"github.com/pcarrier/srv.us/backend/wire"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+type void struct{}
+
+var v void
+
+// NewSSHConfig accepts any public key, remembering which one authenticated the connection; host keys are added by the caller.
+func (s *Server) NewSSHConfig() *ssh.ServerConfig {
+	return &ssh.ServerConfig{
+		ServerVersion:  "SSH-2.0-" + s.cfg.Domain + "-1.0",
+		BannerCallback: s.banner,
+		AuthLogCallback: func(conn ssh.ConnMetadata, method string, err error) {
+			// Clients start with none to learn the methods we take.
+			if err != nil && method != "none" {
+				s.sshFailed(conn.RemoteAddr(), "auth", "ssh "+method)
+			}
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, k ssh.PublicKey) (*ssh.Permissions, error) {
+			return &ssh.Permissions{Extensions: map[string]string{"key": string(k.Marshal())}}, nil
+		},
+	}
+}
+
+// ServeSSH serves the clients accepted on listener with sshConfig, or if nil the keys given to SetHostKeys,
+// until it closes or ctx ends; ending ctx also disconnects every client.
+func (s *Server) ServeSSH(ctx context.Context, listener net.Listener, sshConfig *ssh.ServerConfig) {
+	if sshConfig != nil {
+		s.sshConfig.Store(sshConfig)
+	}
+	go closeWhenDone(ctx, listener)
+	defer s.serving("ssh", listener)()
+	for {
+		tcpConn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to accept (%s)", err)
+		} else if handshaken, refused := s.admitSSH(tcpConn.RemoteAddr()); refused != "" {
+			_ = tcpConn.Close()
+		} else {
+			go s.serveSSHConnection(ctx, s.sshConfig.Load(), &tcpConn, handshaken)
+		}
+	}
+}
+
+func (s *Server) endSession(conn *ssh.ServerConn, ch ssh.Channel, status byte) {
+	s.tellUsage(conn, ch)
+	reportStatus(ch, status)
+	if st, found := s.conns.Load(conn); found {
+		st.(*connState).commands.Delete(ch)
+		st.(*connState).drawsQR.Delete(ch)
+	}
+	if err := ch.Close(); err != nil && !errors.Is(err, io.EOF) {
+		log.Printf("Could not end SSH session (%v)", err)
+	}
+
+	if s.registry.EndSession(conn, ch) {
+		go func() {
+			_ = conn.Close()
+		}()
+	}
+}
+
+// closeConnection stops routing to a connection's tunnels, cancels its work in flight and disconnects it.
+func (s *Server) closeConnection(conn *ssh.ServerConn) {
+	st, found := s.conns.LoadAndDelete(conn)
+	tunnels := s.registry.TunnelsOf(conn)
+	c := s.registry.Close(conn)
+	if c == nil {
+		return
+	}
+	sshConnections.Inc("closed")
+	if found {
+		s.logUsage(conn, st.(*connState))
+		s.meterForwards(c.KeyID, st.(*connState))
+	}
+	s.tunnelsDown(c.KeyID, tunnels)
+	if c.Cancel != nil {
+		c.Cancel()
+	}
+	go func() {
+		_ = conn.Close()
+		log.Printf("%s(%s) disconnected", conn.RemoteAddr(), c.KeyID)
+	}()
+}
+
+// serveSSHConnection serves a client, calling handshaken once its handshake is over.
+func (s *Server) serveSSHConnection(ctx context.Context, sshConfig *ssh.ServerConfig, tcpConn *net.Conn, handshaken func()) {
+	_ = (*tcpConn).SetDeadline(time.Now().Add(sshHandshakeTimeout))
+	conn, newChans, reqs, err := ssh.NewServerConn(*tcpConn, sshConfig)
+	handshaken()
+	if err != nil {
+		s.cfg.Audit.Record("ssh_handshake_failed", logs.Fields{"remote": (*tcpConn).RemoteAddr().String(), "error": err.Error()})
+		if !errors.Is(err, io.EOF) {
+			s.sshFailed((*tcpConn).RemoteAddr(), "handshake", "ssh")
+		}
+		return
+	}
+	_ = (*tcpConn).SetDeadline(time.Time{})
+	if conn.Permissions == nil {
+		_ = conn.Close()
+		return
+	}
+	key, err := ssh.ParsePublicKey([]byte(conn.Permissions.Extensions["key"]))
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	keyID := identity.KeyID(key)
+	login, opts := identity.ParseUser(conn.User())
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go closeWhenDone(ctx, conn)
+	s.registry.Connect(conn, keyID, cancel)
+	sshConnections.Inc("opened")
+	st := &connState{keyID: keyID, opens: newOpenLimiter(s.cfg.MaxChannelOpens), since: time.Now()}
+	st.json.Store(opts.Has("json"))
+	st.verbose.Store(opts.Has("verbose"))
+	s.conns.Store(conn, st)
+	defer s.exportSSH(conn, keyID)()
+
+	s.cfg.Audit.Record("ssh_auth", logs.Fields{
+		"remote":      conn.RemoteAddr().String(),
+		"user":        conn.User(),
+		"key":         keyID,
+		"fingerprint": ssh.FingerprintSHA256(key),
+		"client":      string(conn.ClientVersion()),
+		"decision":    "accepted",
+		"geo":         s.cfg.GeoIP.LookupAddr(conn.RemoteAddr()),
+	})
+
+	githubEnabled := false
+	if s.cfg.GitHubSubdomains && login != "nomatch" {
+		githubEnabled = identity.KeyMatchesAccount(ctx, "github.com", login, keyID)
+		s.cfg.Audit.Record("account_verification", logs.Fields{"key": keyID, "provider": "github.com", "user": login, "granted": githubEnabled})
+	}
+	gitlabEnabled := false
+	if s.cfg.GitLabSubdomains && login != "nomatch" {
+		gitlabEnabled = identity.KeyMatchesAccount(ctx, "gitlab.com", login, keyID)
+		s.cfg.Audit.Record("account_verification", logs.Fields{"key": keyID, "provider": "gitlab.com", "user": login, "granted": gitlabEnabled})
+	}
+
+	log.Printf("%s(%s) connected (%s, %s, gh:%v, gl:%v)",
+		conn.RemoteAddr(), keyID, conn.ClientVersion(), conn.User(), githubEnabled, gitlabEnabled)
+
+	limits, err := s.loadKeyLimits(ctx, keyID)
+	if err != nil {
+		log.Printf("Could not load limits for %s(%s) (%v)", conn.RemoteAddr(), keyID, err)
+	}
+	if lifetime := s.connectionLifetime(limits); lifetime > 0 {
+		go s.expireAfter(ctx, conn, "connection", lifetime, func() {
+			log.Printf("%s(%s) expired", conn.RemoteAddr(), keyID)
+			s.cfg.Audit.Record("connection_expired", logs.Fields{"remote": conn.RemoteAddr().String(), "key": keyID, "lifetime": lifetime.String()})
+			s.closeConnection(conn)
+		})
+	}
+	tunnelExpiries := map[uint32]context.CancelFunc{}
+
+	// We want to have at least one session opened so we can send messages to it;
+	// connections made with -N may never open one, see urls.go.
+	outputReady := false
+	outputReadyCh := make(chan void)
+	keepalives := make(chan time.Duration)
+	rtt := &rttEstimator{}
+	// Messages wait there for the first session, and for slow ones; see post.
+	msgs := make(chan message, sessionBacklog)
+	requested := int32(0)
+
+	org := ""
+	if name := opts["org"]; name != "" {
+		if org, err = s.joinOrg(ctx, name, keyID, login, githubEnabled, gitlabEnabled); err != nil {
+			post(msgs, message{Text: err.Error()})
+		} else {
+			s.stateOf(conn).org.Store(&org)
+		}
+	}
+
+	defer func() {
+		close(msgs)
+		s.closeConnection(conn)
+		s.cfg.Audit.Record("ssh_disconnect", logs.Fields{"remote": conn.RemoteAddr().String(), "key": keyID})
+	}()
+
+	go s.keepalive(ctx, conn, keepalives)
+
+	go func() {
+		for nc := range newChans {
+			newChannel := nc
+			go func() {
+				if t := newChannel.ChannelType(); t != "session" {
+					log.Printf("Rejecting channel type %s", t)
+					err := newChannel.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type: %s", t))
+					if err != nil {
+						log.Printf("Failed to reject channel type %s (%s)", t, err)
+					}
+					return
+				}
+
+				channel, sessionReqs, err := newChannel.Accept()
+				if err != nil {
+					log.Printf("Could not accept channel (%s)", err)
+					return
+				}
+
+				s.registry.StartSession(keyID, conn, channel)
+				defer s.endSession(conn, channel, 0)
+				watching, agent := false, false
+				// term is the terminal of the session, nil without one.
+				var term *terminal
+				drawQR, drawTUI := opts.Has("qr"), opts.Has("tui")
+				// Sessions with a terminal draw QR codes as they start, if asked.
+				drawIfAsked := func() {
+					if term != nil && drawQR {
+						s.stateOf(conn).drawsQR.Store(channel, term)
+					}
+				}
+
+				// Sessions get messages once they run a shell or a command;
+				// later sessions, e.g. through a ControlMaster, missed the announcements.
+				resumed, started := false, false
+				startOutput := func() {
+					if started {
+						return
+					}
+					started = true
+					resumed = outputReady
+					if !outputReady {
+						outputReadyCh <- v
+						outputReady = true
+					}
+				}
+
+				go func() {
+					<-time.After(1 * time.Second)
+					if atomic.LoadInt32(&requested) == 0 {
+						s.failWithUsage(channel)
+					}
+				}()
+
+				for req := range sessionReqs {
+					if req.Type == "pty-req" {
+						var payload wire.PtyRequest
+						if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+							_ = req.Reply(false, nil)
+							continue
+						}
+						term = newTerminal(payload.Columns, payload.Rows)
+						if err := req.Reply(true, nil); err != nil {
+							log.Printf("Could not accept request of type %s (%v)", req.Type, err)
+						}
+					} else if req.Type == "window-change" {
+						var payload wire.WindowChangeRequest
+						if err := ssh.Unmarshal(req.Payload, &payload); err == nil && term != nil {
+							term.resize(payload.Columns, payload.Rows)
+						}
+						if req.WantReply {
+							_ = req.Reply(false, nil)
+						}
+					} else if req.Type == "shell" {
+						if err := req.Reply(true, nil); err != nil {
+							log.Printf("Could not accept request of type %s (%v)", req.Type, err)
+						}
+						if !watching && term != nil && drawTUI {
+							watching = true
+							screen := newTUI(s, conn, channel, keyID, term)
+							s.stateOf(conn).screens.Store(channel, screen)
+							startOutput()
+							go func() {
+								screen.run(ctx)
+								s.stateOf(conn).screens.Delete(channel)
+								s.endSession(conn, channel, 0)
+							}()
+							continue
+						}
+						drawIfAsked()
+						startOutput()
+						if !watching {
+							// Commands read their input from the channel, shells only end on ctrl-c & ctrl-d.
+							watching = true
+							go func() {
+								buf := make([]byte, 256)
+								for {
+									read, err := channel.Read(buf)
+									if err != nil && errors.Is(err, io.EOF) {
+										return
+									}
+									if bytes.ContainsAny(buf[:read], "\x03\x04") {
+										s.endSession(conn, channel, 0)
+										break
+									}
+								}
+							}()
+						}
+						if resumed {
+							s.announceTunnels(conn, channel)
+						}
+					} else if req.Type == "env" {
+						var payload wire.EnvRequest
+						if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+							_ = req.Reply(false, nil)
+							continue
+						}
+						switch {
+						case payload.Name == qrEnv:
+							drawQR = enabled(payload.Value)
+						case payload.Name == tuiEnv:
+							drawTUI = enabled(payload.Value)
+						case !s.stateOf(conn).setEnv(payload.Name, payload.Value):
+							_ = req.Reply(false, nil)
+							continue
+						}
+						if req.WantReply {
+							_ = req.Reply(true, nil)
+						}
+					} else if req.Type == "subsystem" {
+						var payload wire.SubsystemRequest
+						if err := ssh.Unmarshal(req.Payload, &payload); err != nil || payload.Name != controlSubsystem {
+							_ = req.Reply(false, nil)
+							continue
+						}
+						atomic.AddInt32(&requested, 1)
+						if err := req.Reply(true, nil); err != nil {
+							log.Printf("Could not accept request of type %s (%v)", req.Type, err)
+						}
+						ctl := newControl(s, conn, channel, keyID)
+						s.stateOf(conn).controls.Store(channel, ctl)
+						startOutput()
+						go func() {
+							ctl.run(ctx)
+							s.stateOf(conn).controls.Delete(channel)
+							s.endSession(conn, channel, 0)
+						}()
+					} else if req.Type == "auth-agent-req@openssh.com" {
+						agent = true
+						if req.WantReply {
+							_ = req.Reply(true, nil)
+						}
+					} else if req.Type == "exec" {
+						var payload wire.ExecRequest
+						if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+							_ = req.Reply(false, nil)
+							continue
+						}
+						atomic.AddInt32(&requested, 1)
+						if err := req.Reply(true, nil); err != nil {
+							log.Printf("Could not accept request of type %s (%v)", req.Type, err)
+						}
+						// Messages go to the standard error of commands, so their output can be parsed.
+						s.stateOf(conn).commands.Store(channel, v)
+						drawIfAsked()
+						startOutput()
+						var out io.Writer = channel
+						if term != nil {
+							out = crlfWriter{channel}
+						}
+						forwarded := agent
+						go func() {
+							log.Printf("%s(%s) runs %q", conn.RemoteAddr(), keyID, payload.Command)
+							s.endSession(conn, channel, s.runCommand(ctx, keyID, conn, payload.Command, channel, out, forwarded))
+						}()
+					} else {
+						if err := req.Reply(false, nil); err != nil {
+							return
+						}
+					}
+				}
+			}()
+		}
+	}()
+
+	go func() {
+		<-outputReadyCh
+
+		if motd := s.greeting(s.cfg.MOTD); motd != "" {
+			s.tell(conn, message{Text: motd})
+		}
+		for msg := range msgs {
+			s.tell(conn, msg)
+		}
+	}()
+
+	for {
+		select {
+		case req := <-reqs:
+			if req == nil {
+				return
+			}
+			switch req.Type {
+			case "tcpip-forward":
+				var payload wire.ForwardRequest
+				if err = ssh.Unmarshal(req.Payload, &payload); err != nil {
+					log.Printf("Invalid new tcpip-forward request (%v)", err)
+					refuse(req, msgs, "Invalid forwarding request; forward ports with -R 1:localhost:3000.")
+				} else if payload.BindPort > wire.MaxBindPort {
+					atomic.AddInt32(&requested, 1)
+					refuse(req, msgs, fmt.Sprintf("%d: invalid port; it only labels your tunnel, so pick one from 1 to %d, or 0 for the next free one.", payload.BindPort, wire.MaxBindPort))
+				} else if !wire.ValidBindAddr(payload.BindAddr) {
+					atomic.AddInt32(&requested, 1)
+					refuse(req, msgs, fmt.Sprintf("%d: invalid bind address %q; leave it out, e.g. -R %d:localhost:3000.", payload.BindPort, payload.BindAddr, payload.BindPort))
+				} else if payload.BindPort != 0 && s.registry.Forwards(conn, payload.BindAddr, payload.BindPort) {
+					// Registering it again would only add a target competing with itself for visitors.
+					atomic.AddInt32(&requested, 1)
+					log.Printf("%s(%s) forwards port %d twice", conn.RemoteAddr(), keyID, payload.BindPort)
+					post(msgs, message{Text: fmt.Sprintf("%d: already forwarded by this connection, ignoring the duplicate.", payload.BindPort)})
+					if req.WantReply {
+						if err := req.Reply(true, ssh.Marshal(struct{ uint32 }{443})); err != nil {
+							log.Printf("Could not accept new channel request of type %s (%v)", req.Type, err)
+						}
+					}
+				} else {
+					allocated := payload.BindPort == 0
+					if allocated {
+						payload.BindPort = s.registry.FreePort(keyID)
+					}
+					gh, gl := githubEnabled, gitlabEnabled
+					refused, withheld := s.cfg.LabelPolicy.check(labelClaim{port: payload.BindPort, login: login, fingerprint: ssh.FingerprintSHA256(key), accounts: gh || gl})
+					if refused != "" {
+						atomic.AddInt32(&requested, 1)
+						s.cfg.Audit.Record("tunnel_refused", logs.Fields{"remote": conn.RemoteAddr().String(), "key": keyID, "port": payload.BindPort, "policy": refused})
+						refuse(req, msgs, refused)
+						break
+					}
+					if plan, most, exceeded := s.exceedsTunnels(keyID, payload.BindPort); exceeded {
+						atomic.AddInt32(&requested, 1)
+						s.cfg.Audit.Record("tunnel_refused", logs.Fields{"remote": conn.RemoteAddr().String(), "key": keyID, "port": payload.BindPort, "plan": plan})
+						refuse(req, msgs, fmt.Sprintf("%d: not forwarded, the %s plan allows %d tunnels at once; close one first.", payload.BindPort, plan, most))
+						break
+					}
+					if withheld != "" {
+						gh, gl = false, false
+						post(msgs, message{Text: withheld})
+					}
+					st, err := settings.Load(ctx, s.cfg.Store, keyID, payload.BindPort)
+					if err != nil {
+						log.Printf("Could not load settings for %s(%s) port %d (%v)", conn.RemoteAddr(), keyID, payload.BindPort, err)
+						st = &settings.Endpoint{}
+					}
+					endpoints := append(identity.Endpoints(s.cfg.Domain, login, key, payload.BindPort, st.Salt, gh, gl), s.reservedNames(owner{keyID: keyID}, payload.BindPort)...)
+					// Members of an organization serve its names together.
+					shared := s.orgNames(org, payload.BindPort)
+					endpoints = append(endpoints, shared...)
+					atomic.AddInt32(&requested, 1)
+
+					opts := s.stateOf(conn).forwardOptions(payload.BindPort, opts)
+					tag := opts["tag"]
+					if tag == "" {
+						tag = registry.DefaultTag
+					}
+
+					var transport *http.Transport
+					if opts.Has("http") {
+						transport = s.newTransport(conn, payload.BindAddr, payload.BindPort)
+					}
+
+					var granted, taken []string
+					var evicted []*registry.Target
+					s.registry.Lock()
+					for _, endpoint := range endpoints {
+						// Shadows never take names from who serves them.
+						if others := s.registry.Foreign(endpoint, keyID); len(others) > 0 && !opts.Has("shadow") && !contains(shared, endpoint) {
+							if !opts.Has("takeover") {
+								taken = append(taken, endpoint)
+								continue
+							}
+							for _, other := range others {
+								s.registry.Remove(endpoint, other)
+							}
+							evicted = append(evicted, others...)
+						}
+						t := &registry.Target{
+							KeyID:  keyID,
+							Remote: conn,
+							Host:   payload.BindAddr,
+							Port:   payload.BindPort,
+							HTTP:   transport,
+							Shadow: opts.Has("shadow"),
+							Tag:    tag,
+						}
+						t.Settings.Store(st)
+						t.Touch()
+						s.registry.Insert(endpoint, t)
+						granted = append(granted, endpoint)
+					}
+					s.registry.Unlock()
+
+					for _, endpoint := range taken {
+						post(msgs, message{Text: fmt.Sprintf("%d: %s is served by another key; connect as %s+takeover@%s to take it over.", payload.BindPort, endpoint, login, s.cfg.Domain)})
+					}
+					if len(granted) == 0 {
+						s.cfg.Audit.Record("tunnel_refused", logs.Fields{"remote": conn.RemoteAddr().String(), "key": keyID, "port": payload.BindPort, "refused": taken})
+						refuse(req, msgs, fmt.Sprintf("%d: not forwarded, all its addresses are taken; use another port, e.g. -R %d:…", payload.BindPort, payload.BindPort+1))
+						break
+					}
+					s.callHook(keyID, hookEvent{Event: "tunnel_up", Port: payload.BindPort, URLs: urlsOf(append([]string(nil), granted...))})
+					var urls []string
+					for _, endpoint := range granted {
+						urls = append(urls, "https://"+endpoint+"/")
+					}
+					s.forwardUp(conn, payload.BindAddr, payload.BindPort)
+					post(msgs, message{Port: payload.BindPort, URLs: urls})
+					if opts.Has("shadow") {
+						post(msgs, message{Text: fmt.Sprintf("%d: shadowing, gets copies of the requests to these URLs; its responses are discarded.", payload.BindPort)})
+					}
+					for _, other := range evicted {
+						s.notify(other.Remote, fmt.Sprintf("%d: taken over by another key verified for the same account.", other.Port))
+						s.cfg.Audit.Record("endpoint_takeover", logs.Fields{"key": keyID, "previous_key": other.KeyID, "port": payload.BindPort})
+					}
+					s.cfg.Audit.Record("tunnel_open", logs.Fields{"remote": conn.RemoteAddr().String(), "key": keyID, "port": payload.BindPort, "endpoints": granted, "refused": taken})
+
+					if lifetime := s.tunnelLifetime(limits); lifetime > 0 {
+						if stop := tunnelExpiries[payload.BindPort]; stop != nil {
+							stop()
+						}
+						tunnelCtx, stop := context.WithCancel(ctx)
+						tunnelExpiries[payload.BindPort] = stop
+						port := payload.BindPort
+						go s.expireAfter(tunnelCtx, conn, strconv.Itoa(int(port)), lifetime, func() {
+							endpoints := s.registry.RemoveTunnel(conn, port)
+							s.forwardDown(conn, port)
+							s.cfg.Audit.Record("tunnel_expired", logs.Fields{"remote": conn.RemoteAddr().String(), "key": keyID, "port": port, "endpoints": endpoints})
+							if len(endpoints) > 0 {
+								s.callHook(keyID, hookEvent{Event: "tunnel_down", Port: port, URLs: urlsOf(endpoints), Reason: "expired"})
+							}
+						})
+					}
+
+					if req.WantReply {
+						// Clients forwarding port 0 learn the label they got from the reply, and expect it in forwarded channels.
+						reply := uint32(443)
+						if allocated {
+							reply = payload.BindPort
+						}
+						if err := req.Reply(true, ssh.Marshal(struct{ uint32 }{reply})); err != nil {
+							log.Printf("Could not accept new channel request of type %s (%v)", req.Type, err)
+						}
+					}
+					if !opts.Has("noprobe") {
+						go s.probe(ctx, conn, payload.BindAddr, payload.BindPort)
+					}
+				}
+			case "cancel-tcpip-forward":
+				var payload wire.ForwardCancelRequest
+				if err = ssh.Unmarshal(req.Payload, &payload); err != nil {
+					log.Printf("Invalid new tcpip-forward request (%v)", err)
+					refuse(req, msgs, "Invalid request to cancel forwarding.")
+				} else {
+					st, err := settings.Load(ctx, s.cfg.Store, keyID, payload.BindPort)
+					if err != nil {
+						log.Printf("Could not load settings for %s(%s) port %d (%v)", conn.RemoteAddr(), keyID, payload.BindPort, err)
+						st = &settings.Endpoint{}
+					}
+					endpoints := append(identity.Endpoints(s.cfg.Domain, login, key, payload.BindPort, st.Salt, githubEnabled, gitlabEnabled), s.reservedNames(owner{keyID: keyID}, payload.BindPort)...)
+					endpoints = append(endpoints, s.orgNames(org, payload.BindPort)...)
+					atomic.AddInt32(&requested, 1)
+					if stop := tunnelExpiries[payload.BindPort]; stop != nil {
+						stop()
+						delete(tunnelExpiries, payload.BindPort)
+					}
+					s.cfg.Audit.Record("tunnel_close", logs.Fields{"remote": conn.RemoteAddr().String(), "key": keyID, "port": payload.BindPort, "endpoints": endpoints})
+
+					// Only the names the connection held go down, e.g. not those taken over by another key.
+					var removed []*registry.Target
+					var served []string
+					s.registry.Lock()
+					for _, endpoint := range endpoints {
+						if t := s.registry.Remove(endpoint, &registry.Target{
+							KeyID:  keyID,
+							Remote: conn,
+							Host:   payload.BindAddr,
+							Port:   payload.BindPort,
+						}); t != nil {
+							removed = append(removed, t)
+							served = append(served, endpoint)
+						}
+					}
+					s.registry.Unlock()
+					s.forwardDown(conn, payload.BindPort)
+					if len(removed) > 0 {
+						s.callHook(keyID, hookEvent{Event: "tunnel_down", Port: payload.BindPort, URLs: urlsOf(served), Reason: "cancelled"})
+					}
+
+					reply := func() {
+						if req.WantReply {
+							if err := req.Reply(true, ssh.Marshal(struct{ uint32 }{443})); err != nil {
+								log.Printf("Could not accept new channel request of type %s (%v)", req.Type, err)
+							}
+						}
+					}
+					if wait := drainTimeout(s.stateOf(conn).forwardOptions(payload.BindPort, opts)); wait > 0 {
+						// Keep handling other requests while draining.
+						go func(port uint32) {
+							s.drainForward(ctx, conn, port, removed, wait)
+							reply()
+						}(payload.BindPort)
+					} else {
+						reply()
+					}
+				}
+			case "keepalive@openssh.com":
+				if req.WantReply {
+					_ = req.Reply(true, nil)
+				}
+			case "streamlocal-forward@openssh.com":
+				atomic.AddInt32(&requested, 1)
+				refuse(req, msgs, "Unix sockets cannot be forwarded; forward a TCP port instead, e.g. -R 1:localhost:3000.")
+			default:
+				if req.WantReply {
+					if err := req.Reply(false, nil); err != nil {
+						log.Printf("Failed to reply to %v (%v)", req, err)
+					} else {
+						log.Printf("Rejected request of type %v", req.Type)
+					}
+				}
+			}
+		case sample, ok := <-keepalives:
+			if !ok {
+				return
+			}
+			rtt.update(sample)
+			s.stateOf(conn).rtt.Store(int64(rtt.srtt))
+		case <-time.After(s.keepaliveTimeout(rtt)):
+			keepaliveTimeouts.Inc("")
+			log.Printf("%s(%s) timed out (round-trip %s)", conn.RemoteAddr(), keyID, rtt.srtt)
+			return
+		}
+	}
+}
+
+// refuse rejects a global request, explaining why in the connection's sessions:
+// SSH clients only report that remote port forwarding failed.
+func refuse(req *ssh.Request, msgs chan<- message, explanation string) {
+	if req.WantReply {
+		if err := req.Reply(false, nil); err != nil {
+			log.Printf("Could not reject request of type %s (%v)", req.Type, err)
+		}
+	}
+	post(msgs, message{Text: explanation})
+}
+
+func reportStatus(ch ssh.Channel, status byte) {
+	_, _ = ch.SendRequest("exit-status", false, []byte{0, 0, 0, status})
+}
+
+func (s *Server) failWithUsage(ch ssh.Channel) {
+	_, _ = ch.Write([]byte(s.usage() + "\r\n"))
+	reportStatus(ch, 1)
+	_ = ch.Close()
+}
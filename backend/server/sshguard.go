@@ -0,0 +1,167 @@
+package server
+
+import (
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/metrics"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Scanners and brute-forcers hammer every SSH server. Each address may have Config.MaxSSHHandshakes in flight at once,
+// IPv6 addresses counting by /64 as clients get whole prefixes, with a handshake taking sshHandshakeTimeout at most.
+// Past Config.MaxSSHFailures failed handshakes or authentication attempts within sshFailureWindow, it is refused
+// before its handshake for Config.SSHBanTime, doubling with every ban until Config.SSHMaxBanTime; bans are forgotten
+// once they would have lasted that long again. Connections closed without a word, like TCP health checks, never count.
+
+const (
+	sshHandshakeTimeout = 30 * time.Second
+	sshFailureWindow    = 10 * time.Minute
+)
+
+var (
+	sshRefused  = metrics.NewCounter("srvus_ssh_refused_total", "SSH connections refused before their handshake, by reason.", "reason")
+	sshFailures = metrics.NewCounter("srvus_ssh_failures_total", "Failed SSH handshakes and authentication attempts, by kind.", "kind")
+	sshBans     = metrics.NewCounter("srvus_ssh_bans_total", "Addresses refused SSH connections for failing too often.", "")
+)
+
+// sshGuard tracks the handshakes and failures of addresses.
+type sshGuard struct {
+	sync.Mutex
+	peers map[netip.Prefix]*sshPeer
+	swept time.Time
+}
+
+type sshPeer struct {
+	handshakes int
+	// failures are those since failing, within sshFailureWindow.
+	failures int
+	failing  time.Time
+	// bans counts the bans in a row, the last running until banned.
+	bans   int
+	banned time.Time
+}
+
+// sshPrefix is what an address counts as.
+func sshPrefix(addr net.Addr) netip.Prefix {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return netip.Prefix{}
+	}
+	ip, _ := netip.AddrFromSlice(tcp.IP)
+	ip = ip.Unmap()
+	bits := 32
+	if ip.Is6() {
+		bits = 64
+	}
+	prefix, _ := ip.Prefix(bits)
+	return prefix
+}
+
+// peer returns what we know about an address, the guard locked, forgetting every minute those left with nothing to remember.
+func (g *sshGuard) peer(prefix netip.Prefix, maxBan time.Duration) *sshPeer {
+	now := time.Now()
+	if g.peers == nil {
+		g.peers = map[netip.Prefix]*sshPeer{}
+	}
+	if now.Sub(g.swept) > time.Minute {
+		for k, p := range g.peers {
+			if p.handshakes == 0 && now.Sub(p.failing) > sshFailureWindow && now.Sub(p.banned) > maxBan {
+				delete(g.peers, k)
+			}
+		}
+		g.swept = now
+	}
+	p := g.peers[prefix]
+	if p == nil {
+		p = &sshPeer{}
+		g.peers[prefix] = p
+	}
+	return p
+}
+
+// admitSSH starts the handshake of a connection from addr, returning what to call once it is over,
+// or why it is refused.
+func (s *Server) admitSSH(addr net.Addr) (func(), string) {
+	if s.cfg.MaxSSHHandshakes <= 0 && s.cfg.MaxSSHFailures <= 0 {
+		return func() {}, ""
+	}
+	prefix := sshPrefix(addr)
+	g := &s.sshGuard
+	g.Lock()
+	defer g.Unlock()
+	p := g.peer(prefix, s.cfg.SSHMaxBanTime)
+	if time.Now().Before(p.banned) {
+		sshRefused.Inc("banned")
+		s.cfg.Security.Record("banned_hit", addr.String(), "ssh, until "+p.banned.UTC().Format(time.RFC3339))
+		return nil, "banned"
+	}
+	if s.cfg.MaxSSHHandshakes > 0 && p.handshakes >= s.cfg.MaxSSHHandshakes {
+		sshRefused.Inc("handshakes")
+		s.cfg.Security.Record("handshake_flood", addr.String(), fmt.Sprintf("ssh, %d in flight", p.handshakes))
+		return nil, "handshakes"
+	}
+	p.handshakes++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.Lock()
+			defer g.Unlock()
+			p.handshakes--
+		})
+	}, ""
+}
+
+// sshFailed counts a failed handshake or authentication attempt of an address, banning it past Config.MaxSSHFailures.
+// Its kind is handshake or auth, and detail what it tried.
+func (s *Server) sshFailed(addr net.Addr, kind, detail string) {
+	sshFailures.Inc(kind)
+	s.cfg.Security.Record(kind+"_failure", addr.String(), detail)
+	if s.cfg.MaxSSHFailures <= 0 {
+		return
+	}
+	prefix := sshPrefix(addr)
+	now := time.Now()
+	g := &s.sshGuard
+	g.Lock()
+	defer g.Unlock()
+	p := g.peer(prefix, s.cfg.SSHMaxBanTime)
+	if now.Sub(p.failing) > sshFailureWindow {
+		p.failures, p.failing = 0, now
+	}
+	p.failures++
+	if p.failures < s.cfg.MaxSSHFailures {
+		return
+	}
+	if now.Sub(p.banned) > s.cfg.SSHMaxBanTime {
+		p.bans = 0
+	}
+	ban := s.cfg.SSHBanTime
+	for i := 0; i < p.bans && ban < s.cfg.SSHMaxBanTime; i++ {
+		ban *= 2
+	}
+	if ban > s.cfg.SSHMaxBanTime {
+		ban = s.cfg.SSHMaxBanTime
+	}
+	p.bans++
+	p.banned, p.failures = now.Add(ban), 0
+	sshBans.Inc("")
+	s.cfg.Security.Record("banned", addr.String(), "ssh, for "+ban.String())
+	s.cfg.Audit.Record("ssh_banned", logs.Fields{"remote": addr.String(), "prefix": prefix.String(), "duration": ban.String(), "bans": p.bans})
+}
+
+// sshBanned counts the addresses refused for now.
+func (s *Server) sshBanned() int {
+	now := time.Now()
+	s.sshGuard.Lock()
+	defer s.sshGuard.Unlock()
+	banned := 0
+	for _, p := range s.sshGuard.peers {
+		if now.Before(p.banned) {
+			banned++
+		}
+	}
+	return banned
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/metrics"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	sshConnections = metrics.NewCounter("srvus_ssh_connections_total", "SSH connections authenticated, and closed.", "event")
+	proxiedBytes   = metrics.NewCounter("srvus_proxied_bytes_total", "Bytes proxied between visitors and tunnels.", "direction")
+	// Looked up once, as they are added to on every read.
+	proxiedIn  = proxiedBytes.With("in")
+	proxiedOut = proxiedBytes.With("out")
+)
+
+// traffic counts the bytes proxied for each endpoint since the last stats summary.
+type traffic struct {
+	endpoints sync.Map
+}
+
+// of returns the counter of an endpoint's bytes.
+func (t *traffic) of(endpoint string) *atomic.Int64 {
+	if c, found := t.endpoints.Load(endpoint); found {
+		return c.(*atomic.Int64)
+	}
+	c, _ := t.endpoints.LoadOrStore(endpoint, &atomic.Int64{})
+	return c.(*atomic.Int64)
+}
+
+type endpointTraffic struct {
+	endpoint string
+	bytes    int64
+}
+
+// take resets the counters, returning the n endpoints that moved the most bytes.
+func (t *traffic) take(n int) []endpointTraffic {
+	var all []endpointTraffic
+	t.endpoints.Range(func(k, v any) bool {
+		if b := v.(*atomic.Int64).Swap(0); b > 0 {
+			all = append(all, endpointTraffic{endpoint: k.(string), bytes: b})
+		} else {
+			// Quiet endpoints are forgotten; a connection still holding the counter loses at most an interval.
+			t.endpoints.CompareAndDelete(k, v)
+		}
+		return true
+	})
+	sort.Slice(all, func(i, j int) bool { return all[i].bytes > all[j].bytes })
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+// logStats logs a human-readable summary at every StatsInterval, the metrics endpoint having the details.
+func (s *Server) logStats(ctx context.Context) {
+	if s.cfg.StatsInterval <= 0 {
+		return
+	}
+	var opened, closed, in, out int64
+	every(ctx, s.cfg.StatsInterval, func() {
+		conns, endpoints := s.registry.Counts()
+		nowOpened, nowClosed := sshConnections.With("opened").Load(), sshConnections.With("closed").Load()
+		nowIn, nowOut := proxiedIn.Load(), proxiedOut.Load()
+		line := fmt.Sprintf("Stats: %d conns (+%d -%d), %d endpoints, %s in, %s out",
+			conns, nowOpened-opened, nowClosed-closed, endpoints, formatBytes(nowIn-in), formatBytes(nowOut-out))
+		opened, closed, in, out = nowOpened, nowClosed, nowIn, nowOut
+
+		if top := s.traffic.take(s.cfg.StatsTopEndpoints); len(top) > 0 {
+			var busiest []string
+			for _, t := range top {
+				busiest = append(busiest, fmt.Sprintf("%s %s", t.endpoint, formatBytes(t.bytes)))
+			}
+			line += "; busiest: " + strings.Join(busiest, ", ")
+		}
+		log.Print(line)
+	})
+}
+
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/registry"
+	"net/http"
+	"time"
+)
+
+// Monitoring systems checking preview environments get the health of a tunnel from https://<name>/.srv.us/status,
+// answered by the edge with an API token of its key as `Authorization: Bearer <token>`: how many targets serve it,
+// whether any of them answers, and when it last carried traffic.
+
+const statusPath = "/.srv.us/status"
+
+// EndpointStatus is what the edge tells owners about the tunnel of a name.
+type EndpointStatus struct {
+	Name string `json:"name"`
+	Port uint32 `json:"port"`
+	// Healthy is whether a target serves visitors without draining or refusing channel after channel.
+	Healthy bool `json:"healthy"`
+	// Targets counts the connections serving the name, shadows aside, and Draining those leaving.
+	Targets  int `json:"targets"`
+	Draining int `json:"draining"`
+	InFlight int `json:"in_flight"`
+	// Since is when the oldest target came up, and LastActivity when one last carried traffic, if ever.
+	Since        time.Time  `json:"since"`
+	LastActivity *time.Time `json:"last_activity,omitempty"`
+}
+
+// refusing tells whether the client of a forward keeps refusing channels, as its owner is then told.
+func (f *forwardStats) refusing() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.refusedInARow >= refusalsBeforeWarning
+}
+
+func (s *Server) statusOf(name string, tgt *registry.Target) *EndpointStatus {
+	status := &EndpointStatus{Name: name, Port: tgt.Port}
+	for _, t := range s.registry.Candidates(name) {
+		status.Targets++
+		status.InFlight += t.InFlight()
+		f := s.usageOf(t)
+		if t.Draining() {
+			status.Draining++
+		} else if f != nil && !f.refusing() {
+			status.Healthy = true
+		}
+		if f != nil && (status.Since.IsZero() || f.since.Before(status.Since)) {
+			status.Since = f.since
+		}
+		if active := t.IdleSince(); active.UnixNano() > 0 && (status.LastActivity == nil || active.After(*status.LastActivity)) {
+			status.LastActivity = &active
+		}
+	}
+	return status
+}
+
+// answerStatus answers a request for the status of the tunnel of name, if its key's token comes with it.
+func (s *Server) answerStatus(r *http.Request, name string, tgt *registry.Target) *edgeAnswer {
+	header := http.Header{"Content-Type": {"application/json"}, "Cache-Control": {"no-store"}}
+	answer := func(status int, v any) *edgeAnswer {
+		body, _ := json.Marshal(v)
+		return &edgeAnswer{status: status, header: header, body: append(body, '\n')}
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		header.Set("Allow", "GET, HEAD")
+		return answer(http.StatusMethodNotAllowed, map[string]string{"error": errMethodNotAllowed.Error()})
+	}
+	t, _, err := s.authenticateAPI(r)
+	if err != nil {
+		return answer(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	if t == nil || t.KeyID != tgt.KeyID {
+		header.Set("WWW-Authenticate", "Bearer")
+		return answer(http.StatusUnauthorized, map[string]string{
+			"error": fmt.Sprintf("missing or foreign token, the owner mints one with ssh %s token new", s.cfg.Domain),
+		})
+	}
+	return answer(http.StatusOK, s.statusOf(name, tgt))
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"html/template"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With Config.StatusPage, GET /status on the domain tells users whether the service is up: whether our listeners
+// accept connections, when the certificate expires, whether the other nodes (Config.StatusNodes) complete TLS
+// handshakes, and the incident operators declare through the admin API with PUT /incident, e.g.
+// "Tunnels in eu-west drop every few minutes, we are on it." Browsers get a page, and clients asking for
+// application/json the same as JSON.
+
+const (
+	statusPagePath = "/status"
+	incidentKey    = "incident"
+)
+
+// Incident is what operators tell users on the status page while something is wrong.
+type Incident struct {
+	Message string    `json:"message"`
+	Since   time.Time `json:"since"`
+}
+
+type statusReport struct {
+	OK bool `json:"ok"`
+	// Listeners maps the listeners of this node to "ok" or why connecting through them failed, as for /healthz.
+	Listeners   map[string]string `json:"listeners"`
+	Certificate certificateHealth `json:"certificate"`
+	// Nodes maps the other nodes to "ok" or why a TLS handshake with them failed.
+	Nodes    map[string]string `json:"nodes,omitempty"`
+	Incident *Incident         `json:"incident,omitempty"`
+	Checked  time.Time         `json:"checked"`
+}
+
+type nodesCache struct {
+	sync.Mutex
+	nodes   map[string]string
+	checked time.Time
+}
+
+var statusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html lang="en"><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Name}} status</title>
+<style>body{font-family:sans-serif;max-width:45em;margin:2em auto;padding:0 1em;line-height:1.5}
+.incident{padding:.5em 1em;border:1px solid #c60;background:#fff4e5}.ok{color:#070}.failing{color:#b00}
+td{padding:0 1em 0 0}</style></head>
+<body><h1>{{.Name}} is {{if .OK}}<span class="ok">up</span>{{else}}<span class="failing">degraded</span>{{end}}</h1>
+{{with .Incident}}<p class="incident"><strong>Since {{.Since.Format "2006-01-02 15:04 MST"}}:</strong> {{.Message}}</p>{{end}}
+<h2>Listeners</h2>
+<table>{{range $name, $state := .Listeners}}<tr><td>{{$name}}</td><td class="{{if eq $state "ok"}}ok{{else}}failing{{end}}">{{$state}}</td></tr>{{end}}</table>
+<h2>Certificate</h2>
+{{with .Certificate}}{{if .Error}}<p class="failing">{{.Error}}</p>{{else}}<p class="ok">Valid until {{.NotAfter.Format "2006-01-02 15:04 MST"}}.</p>{{end}}{{end}}
+{{if .Nodes}}<h2>Nodes</h2>
+<table>{{range $name, $state := .Nodes}}<tr><td>{{$name}}</td><td class="{{if eq $state "ok"}}ok{{else}}failing{{end}}">{{$state}}</td></tr>{{end}}</table>{{end}}
+<p>Checked {{.Checked.Format "2006-01-02 15:04:05 MST"}}. More in <a href="{{.DocsURL}}">the documentation</a>.</p>
+</body></html>
+`))
+
+type statusPageData struct {
+	*statusReport
+	Name, DocsURL string
+}
+
+func (s *Server) loadIncident(ctx context.Context) error {
+	raw, err := s.cfg.Store.Get(ctx, globalSettingsNamespace, incidentKey)
+	if err != nil || raw == nil {
+		return err
+	}
+	incident := &Incident{}
+	if err := json.Unmarshal(raw, incident); err != nil {
+		return err
+	}
+	s.incident.Store(incident)
+	return nil
+}
+
+// checkNodes attempts a TLS handshake with every other node at once, reusing results younger than healthTTL.
+func (s *Server) checkNodes() map[string]string {
+	if len(s.cfg.StatusNodes) == 0 {
+		return nil
+	}
+	s.nodes.Lock()
+	defer s.nodes.Unlock()
+	if s.nodes.nodes != nil && time.Since(s.nodes.checked) <= healthTTL {
+		return s.nodes.nodes
+	}
+	var (
+		wg   sync.WaitGroup
+		lock sync.Mutex
+	)
+	nodes := make(map[string]string, len(s.cfg.StatusNodes))
+	for _, node := range s.cfg.StatusNodes {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			addr := node
+			if _, _, err := net.SplitHostPort(node); err != nil {
+				addr = net.JoinHostPort(node, "443")
+			}
+			state := "ok"
+			if err := s.probeHTTPS(addr); err != nil {
+				state = err.Error()
+			}
+			lock.Lock()
+			nodes[node] = state
+			lock.Unlock()
+		}(node)
+	}
+	wg.Wait()
+	s.nodes.nodes, s.nodes.checked = nodes, time.Now()
+	return nodes
+}
+
+func (s *Server) checkStatus() *statusReport {
+	health := s.currentHealth()
+	report := &statusReport{
+		OK:          health.OK,
+		Listeners:   health.Listeners,
+		Certificate: health.Certificate,
+		Nodes:       s.checkNodes(),
+		Incident:    s.incident.Load(),
+		Checked:     health.Checked.UTC().Truncate(time.Second),
+	}
+	for _, state := range report.Nodes {
+		if state != "ok" {
+			report.OK = false
+		}
+	}
+	return report
+}
+
+func (s *Server) statusPageHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+			return
+		}
+		report := s.checkStatus()
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			writeJSON(w, http.StatusOK, report)
+			return
+		}
+		var page bytes.Buffer
+		if err := statusPage.Execute(&page, statusPageData{statusReport: report, Name: s.serviceName(), DocsURL: s.docsURL()}); err != nil {
+			log.Printf("Could not render the status page (%v)", err)
+			http.Error(w, "Could not render this page.", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		http.ServeContent(w, r, "status.html", time.Time{}, bytes.NewReader(page.Bytes()))
+	})
+}
+
+// adminIncident shows, declares (PUT, with what users should know as body) or closes (DELETE) the incident
+// shown on the status page. Declaring one while another is open updates its message, keeping when it began.
+func (s *Server) adminIncident(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		raw, err := io.ReadAll(io.LimitReader(r.Body, maxNotice+1))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		if len(raw) > maxNotice {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, errors.New("incident message too long"))
+			return
+		}
+		incident := &Incident{Message: strings.TrimSpace(string(raw)), Since: time.Now().UTC().Truncate(time.Second)}
+		if incident.Message == "" {
+			writeJSONError(w, http.StatusBadRequest, errors.New("missing incident message"))
+			return
+		}
+		if open := s.incident.Load(); open != nil {
+			incident.Since = open.Since
+		}
+		stored, err := json.Marshal(incident)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if err := s.cfg.Store.Put(r.Context(), globalSettingsNamespace, incidentKey, stored); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		s.incident.Store(incident)
+		s.cfg.Audit.Record("incident_declared", logs.Fields{"message": incident.Message, "since": incident.Since})
+	case http.MethodDelete:
+		if err := s.cfg.Store.Delete(r.Context(), globalSettingsNamespace, incidentKey); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		s.incident.Store(nil)
+		s.cfg.Audit.Record("incident_closed", nil)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]*Incident{"incident": s.incident.Load()})
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"sync/atomic"
+)
+
+// Sessions tell the size of their terminal as they ask for it (pty-req), then every time it is resized
+// (window-change): the TUI fills it, and QR codes are only drawn where they fit.
+
+// terminal is the size of the terminal of a session, in characters.
+type terminal struct {
+	columns, rows atomic.Uint32
+	// resized is signalled once the size changes, for the TUI to redraw.
+	resized chan void
+}
+
+func newTerminal(columns, rows uint32) *terminal {
+	t := &terminal{resized: make(chan void, 1)}
+	t.resize(columns, rows)
+	return t
+}
+
+// resize records a new size; clients send 0 for what they do not know.
+func (t *terminal) resize(columns, rows uint32) {
+	if columns > 0 {
+		t.columns.Store(columns)
+	}
+	if rows > 0 {
+		t.rows.Store(rows)
+	}
+	select {
+	case t.resized <- void{}:
+	default:
+	}
+}
+
+// size returns the size of the terminal, assuming defaultColumns by defaultRows for what is unknown.
+func (t *terminal) size() (int, int) {
+	columns, rows := int(t.columns.Load()), int(t.rows.Load())
+	if columns == 0 {
+		columns = defaultColumns
+	}
+	if rows == 0 {
+		rows = defaultRows
+	}
+	return columns, rows
+}
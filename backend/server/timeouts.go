@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/metrics"
+	"github.com/pcarrier/srv.us/backend/registry"
+	"github.com/pcarrier/srv.us/backend/settings"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Owners tune how long we wait on their tunnels with `ssh srv.us timeouts 1 connect=5s header=30s request=1m retries=2`.
+// Channel opens failing or slower than connect are tried again after the backoff, doubled each time:
+// for tunnels relaying bytes, on another connection serving the tunnel if there is one,
+// while pooled channels, bound to their forward, retry it. Timeouts answer visitors with a 504,
+// or abort responses already under way; requests proxied one by one get the operator's defaults for header and request.
+
+var (
+	errConnectTimeout        = errors.New("timed out reaching the tunnel")
+	errResponseHeaderTimeout = errors.New("timed out waiting for the response headers")
+	errRequestTimeout        = errors.New("timed out waiting for the response")
+
+	openRetries = metrics.NewCounter("srvus_channel_open_retries_total", "Channel opens tried again after one failed, by whether on the same connection or another.", "target")
+)
+
+type timeoutsKey struct{}
+
+func timeoutsOf(tgt *registry.Target) *settings.Timeouts {
+	if st := tgt.Settings.Load(); st != nil && st.Timeouts != nil {
+		return st.Timeouts
+	}
+	return &settings.Timeouts{}
+}
+
+// withTimeouts hands the timeouts of the target serving a request to the transport proxying it,
+// with the server-wide defaults for those it does not set.
+func (s *Server) withTimeouts(r *http.Request, tgt *registry.Target) *http.Request {
+	t := *timeoutsOf(tgt)
+	if t.ResponseHeader == 0 {
+		t.ResponseHeader = s.cfg.ResponseHeaderTimeout
+	}
+	if t.Request == 0 {
+		t.Request = s.cfg.RequestTimeout
+	}
+	return r.WithContext(context.WithValue(r.Context(), timeoutsKey{}, &t))
+}
+
+func timeoutsFrom(ctx context.Context) *settings.Timeouts {
+	if t, ok := ctx.Value(timeoutsKey{}).(*settings.Timeouts); ok {
+		return t
+	}
+	return &settings.Timeouts{}
+}
+
+// retryOpen calls open until it opens a channel, each within the connect timeout, as many times as t allows.
+func retryOpen(ctx context.Context, t *settings.Timeouts, open func(ctx context.Context, retry int) (ssh.Channel, <-chan *ssh.Request, error)) (ssh.Channel, <-chan *ssh.Request, error) {
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		if t.Connect > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, t.Connect)
+		}
+		ch, reqs, err := open(attemptCtx, attempt)
+		timedOut := errors.Is(attemptCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil
+		cancel()
+		if err == nil {
+			return ch, reqs, nil
+		}
+		if timedOut {
+			err = errConnectTimeout
+		}
+		if attempt >= t.Retries || ctx.Err() != nil {
+			return nil, nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(t.Wait(attempt)):
+		}
+	}
+}
+
+// openFailingOver opens a channel for a visitor of name, retrying on the other targets serving it, if any,
+// and returns the target it opened it to.
+func (s *Server) openFailingOver(ctx context.Context, name string, tgt *registry.Target, origin net.Addr) (ssh.Channel, <-chan *ssh.Request, *registry.Target, error) {
+	failed := map[*registry.Target]bool{}
+	ch, reqs, err := retryOpen(ctx, timeoutsOf(tgt), func(ctx context.Context, retry int) (ssh.Channel, <-chan *ssh.Request, error) {
+		if retry > 0 {
+			failed[tgt] = true
+			if next := s.router.RouteAvoiding(name, failed); next != nil {
+				openRetries.Inc("other")
+				tgt = next
+			} else {
+				openRetries.Inc("same")
+			}
+		}
+		return s.takeChannel(ctx, tgt.Remote, tgt.Host, tgt.Port, origin)
+	})
+	return ch, reqs, tgt, err
+}
+
+// timeoutTransport fails requests whose response headers take longer than their target allows,
+// and ends those still going past their deadline.
+type timeoutTransport struct {
+	http.RoundTripper
+}
+
+func (t timeoutTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	timeouts := timeoutsFrom(r.Context())
+	if timeouts.ResponseHeader == 0 && timeouts.Request == 0 {
+		return t.RoundTripper.RoundTrip(r)
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	var expired atomic.Value
+	expire := func(err error) func() {
+		return func() {
+			expired.CompareAndSwap(nil, err)
+			cancel()
+		}
+	}
+	stopHeader, stopDeadline := func() bool { return true }, func() bool { return true }
+	if timeouts.ResponseHeader > 0 {
+		stopHeader = time.AfterFunc(timeouts.ResponseHeader, expire(errResponseHeaderTimeout)).Stop
+	}
+	if timeouts.Request > 0 {
+		stopDeadline = time.AfterFunc(timeouts.Request, expire(errRequestTimeout)).Stop
+	}
+	resp, err := t.RoundTripper.RoundTrip(r.WithContext(ctx))
+	stopHeader()
+	if timedOut, _ := expired.Load().(error); timedOut != nil {
+		stopDeadline()
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		cancel()
+		return nil, timedOut
+	}
+	if err != nil {
+		stopDeadline()
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// The proxy needs the upgraded connection as it is; it ends with the request.
+		stopDeadline()
+		return resp, nil
+	}
+	resp.Body = &cancelingBody{ReadCloser: resp.Body, cancel: func() {
+		stopDeadline()
+		cancel()
+	}}
+	return resp, nil
+}
+
+// cancelingBody ends the context of its request once closed.
+type cancelingBody struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (b *cancelingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func runTimeouts(s *Server, c *commandContext, args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	port, err := parsePort(args[0])
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 {
+		st, err := settings.Load(c.ctx, s.cfg.Store, c.keyID, port)
+		if err != nil {
+			return err
+		}
+		c.printf("%d: %s", port, st.Timeouts.String())
+		return nil
+	}
+
+	clear := len(args) == 2 && args[1] == "clear"
+	st, err := s.updateSettings(c.ctx, c.keyID, port, func(st *settings.Endpoint) error {
+		var t settings.Timeouts
+		if st.Timeouts != nil && !clear {
+			t = *st.Timeouts
+		}
+		if !clear {
+			for _, arg := range args[1:] {
+				if err := setTimeout(&t, arg); err != nil {
+					return err
+				}
+			}
+			if err := t.Validate(); err != nil {
+				return err
+			}
+		}
+		st.Timeouts = nil
+		if !t.Empty() {
+			st.Timeouts = &t
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.cfg.Audit.Record("timeouts_changed", logs.Fields{"key": c.keyID, "port": port, "timeouts": st.Timeouts})
+	c.printf("%d: %s", port, st.Timeouts.String())
+	return nil
+}
+
+// setTimeout applies a setting such as connect=5s to t; 0 restores its default.
+func setTimeout(t *settings.Timeouts, arg string) error {
+	name, value, found := strings.Cut(arg, "=")
+	if !found {
+		return fmt.Errorf("invalid setting %q, expected e.g. connect=5s", arg)
+	}
+	if name == "retries" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid retries %q, expected a number", value)
+		}
+		t.Retries = n
+		return nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q, expected e.g. 5s", value)
+	}
+	switch name {
+	case "connect":
+		t.Connect = d
+	case "header":
+		t.ResponseHeader = d
+	case "request":
+		t.Request = d
+	case "backoff":
+		t.Backoff = d
+	default:
+		return fmt.Errorf("unknown setting %q, expected connect, header, request, retries or backoff", name)
+	}
+	return nil
+}
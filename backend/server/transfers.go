@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// TransferLogModes are the values of Config.TransferLog.
+var TransferLogModes = map[string]bool{"each": true, "summary": true, "off": true}
+
+// transfers decides which visitor connections get their byte counts logged, and sums them up in summary mode.
+type transfers struct {
+	mode       string
+	sampleRate float64
+
+	lock   sync.Mutex
+	totals map[string]*transferTotals
+}
+
+type transferTotals struct {
+	conns          int
+	received, sent int64
+}
+
+// sampled reports whether to log the transfers of a new visitor connection as they end.
+func (t *transfers) sampled() bool {
+	return t.mode == "each" && (t.sampleRate >= 1 || rand.Float64() < t.sampleRate)
+}
+
+// add records what a visitor connection to endpoint moved, for the next summary.
+func (t *transfers) add(endpoint string, received, sent int64) {
+	if t.mode != "summary" {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	total := t.totals[endpoint]
+	if total == nil {
+		total = &transferTotals{}
+		t.totals[endpoint] = total
+	}
+	total.conns++
+	total.received += received
+	total.sent += sent
+}
+
+// logTransfers logs a line per endpoint visited during each TransferLogInterval, in summary mode.
+func (s *Server) logTransfers(ctx context.Context) {
+	if s.transfers.mode != "summary" || s.cfg.TransferLogInterval <= 0 {
+		return
+	}
+	every(ctx, s.cfg.TransferLogInterval, func() {
+		s.transfers.lock.Lock()
+		totals := s.transfers.totals
+		s.transfers.totals = map[string]*transferTotals{}
+		s.transfers.lock.Unlock()
+
+		endpoints := make([]string, 0, len(totals))
+		for endpoint := range totals {
+			endpoints = append(endpoints, endpoint)
+		}
+		sort.Strings(endpoints)
+		for _, endpoint := range endpoints {
+			t := totals[endpoint]
+			log.Printf("%s xfer %d conns, %d in, %d out over %s", endpoint, t.conns, t.received, t.sent, s.cfg.TransferLogInterval)
+		}
+	})
+}
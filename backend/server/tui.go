@@ -0,0 +1,377 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/geoip"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/registry"
+	"github.com/pcarrier/srv.us/backend/settings"
+	"github.com/pcarrier/srv.us/backend/wire"
+	"golang.org/x/crypto/ssh"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Shells with a terminal, as user+tui@ or with SRVUS_TUI=1 (ssh -o SetEnv=SRVUS_TUI=1), get a screen redrawn every
+// second instead of lines of text: the tunnels of the connection with what they served, the latest requests through
+// them with the countries of their visitors where known, and our latest messages. ↑ and ↓ (or k and j) select
+// a tunnel, p pauses or resumes it, c closes it, and q, ctrl-c or ctrl-d leave. Sessions without a terminal keep getting lines.
+
+// tuiEnv is the variable sessions set to get a TUI, or to keep lines with 0.
+const tuiEnv = "SRVUS_TUI"
+
+const (
+	tuiRefresh = time.Second
+	// maxFeed bounds the requests a connection remembers for its screens, and maxNotices the messages a screen shows.
+	maxFeed    = 100
+	maxNotices = 3
+	// Terminals are assumed this large when they don't tell.
+	defaultColumns, defaultRows = 80, 24
+)
+
+// requestFeed remembers the latest requests to the tunnels of a connection, while it has screens.
+type requestFeed struct {
+	watchers atomic.Int32
+	lock     sync.Mutex
+	// entries are oldest first.
+	entries []feedEntry
+}
+
+type feedEntry struct {
+	time   time.Time
+	port   uint32
+	method string
+	path   string
+	status int
+	took   time.Duration
+	// country is where the visitor comes from, if known.
+	country string
+}
+
+// fed adds a request proxied for a visitor from location to the feed of the connection serving it, if a screen shows it.
+func (s *Server) fed(tgt *registry.Target, ex *wire.Exchange, location geoip.Info) {
+	st, found := s.conns.Load(tgt.Remote)
+	if !found {
+		return
+	}
+	feed := &st.(*connState).feed
+	if feed.watchers.Load() == 0 {
+		return
+	}
+	e := feedEntry{time: time.Now(), port: tgt.Port, method: ex.Request.Method, path: ex.Request.URL.RequestURI(), took: time.Since(ex.Start), country: location.Country}
+	if ex.Response != nil {
+		e.status = ex.Response.StatusCode
+	}
+	feed.lock.Lock()
+	defer feed.lock.Unlock()
+	if len(feed.entries) >= maxFeed {
+		feed.entries = feed.entries[1:]
+	}
+	feed.entries = append(feed.entries, e)
+}
+
+// latest returns up to n entries, newest first.
+func (f *requestFeed) latest(n int) []feedEntry {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var result []feedEntry
+	for i := len(f.entries) - 1; i >= 0 && len(result) < n; i-- {
+		result = append(result, f.entries[i])
+	}
+	return result
+}
+
+// tui is the screen of a session.
+type tui struct {
+	s       *Server
+	conn    *ssh.ServerConn
+	ch      ssh.Channel
+	keyID   string
+	started time.Time
+
+	term *terminal
+
+	lock sync.Mutex
+	// selected is the port of the selected tunnel, 0 before any is.
+	selected uint32
+	notices  []string
+}
+
+func newTUI(s *Server, conn *ssh.ServerConn, ch ssh.Channel, keyID string, term *terminal) *tui {
+	return &tui{s: s, conn: conn, ch: ch, keyID: keyID, started: time.Now(), term: term}
+}
+
+// notice keeps a message for the bottom of the screen.
+func (t *tui) notice(text string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(text, "\r\n"), "\n") {
+		t.notices = append(t.notices, strings.TrimRight(line, "\r"))
+	}
+	if len(t.notices) > maxNotices {
+		t.notices = t.notices[len(t.notices)-maxNotices:]
+	}
+}
+
+// tuiTunnel is a line of the table of tunnels.
+type tuiTunnel struct {
+	port     uint32
+	urls     []string
+	inFlight int
+	paused   bool
+	usage    TunnelUsage
+}
+
+func (t *tui) tunnels() []tuiTunnel {
+	byPort := map[uint32]*tuiTunnel{}
+	counted := map[*registry.Target]bool{}
+	for ref, tgt := range t.s.registry.TunnelsOf(t.conn) {
+		tt := byPort[ref.Port]
+		if tt == nil {
+			tt = &tuiTunnel{port: ref.Port, usage: TunnelUsage{Port: ref.Port}}
+			byPort[ref.Port] = tt
+		}
+		tt.urls = append(tt.urls, ref.Endpoint)
+		tt.paused = tt.paused || paused(tgt) != ""
+		if !counted[tgt] {
+			counted[tgt] = true
+			tt.inFlight += tgt.InFlight()
+		}
+	}
+	for _, u := range usageSummary(t.s.stateOf(t.conn)) {
+		if tt := byPort[u.Port]; tt != nil {
+			tt.usage = u
+		}
+	}
+	result := make([]tuiTunnel, 0, len(byPort))
+	for _, tt := range byPort {
+		tt.urls = urlsOf(tt.urls)
+		result = append(result, *tt)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].port < result[j].port })
+	return result
+}
+
+// draw renders the whole screen, line by line, each cut to the width of the terminal.
+func (t *tui) draw() error {
+	tunnels := t.tunnels()
+	columns, rows := t.term.size()
+	t.lock.Lock()
+	if len(tunnels) > 0 && t.index(tunnels) < 0 {
+		t.selected = tunnels[0].port
+	}
+	selected := t.selected
+	notices := append([]string(nil), t.notices...)
+	t.lock.Unlock()
+
+	var lines []string
+	lines = append(lines, fmt.Sprintf("\x1b[7m %s · tunnels: %d · up %s ", t.s.cfg.Domain, len(tunnels), time.Since(t.started).Round(time.Second)), "")
+	lines = append(lines, fmt.Sprintf("  %5s %-6s %9s %9s %9s %9s  %s", "PORT", "STATE", "REQUESTS", "BYTES", "VISITORS", "IN FLIGHT", "URL"))
+	for _, tt := range tunnels {
+		marker, state, url := "  ", "up", ""
+		if tt.port == selected {
+			marker = "▶ "
+		}
+		if tt.paused {
+			state = "paused"
+		}
+		if len(tt.urls) > 0 {
+			url = tt.urls[0]
+		}
+		lines = append(lines, fmt.Sprintf("%s%5d %-6s %9d %9s %9d %9d  %s", marker, tt.port, state, tt.usage.Requests, formatBytes(tt.usage.Bytes), tt.usage.Visitors, tt.inFlight, url))
+	}
+	lines = append(lines, "", "Latest requests")
+
+	footer := []string{""}
+	footer = append(footer, notices...)
+	footer = append(footer, "\x1b[2m↑↓ select · p pause/resume · c close · q quit")
+	room := rows - len(lines) - len(footer)
+	for _, e := range t.s.stateOf(t.conn).feed.latest(room) {
+		status := "-"
+		if e.status != 0 {
+			status = fmt.Sprintf("%d", e.status)
+		}
+		lines = append(lines, fmt.Sprintf("  %s %5d %-7s %s %6s %2s  %s", e.time.Format("15:04:05"), e.port, e.method, status, e.took.Round(time.Millisecond), e.country, e.path))
+	}
+	for len(lines)+len(footer) < rows {
+		lines = append(lines, "")
+	}
+	lines = append(lines, footer...)
+	if len(lines) > rows {
+		lines = lines[:rows]
+	}
+
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	for i, line := range lines {
+		b.WriteString(cut(line, columns))
+		b.WriteString("\x1b[0m\x1b[K")
+		if i < len(lines)-1 {
+			b.WriteString("\r\n")
+		}
+	}
+	_, err := t.ch.Write([]byte(b.String()))
+	return err
+}
+
+// index is where the selected tunnel is among tunnels, -1 if it is gone.
+func (t *tui) index(tunnels []tuiTunnel) int {
+	for i, tt := range tunnels {
+		if tt.port == t.selected {
+			return i
+		}
+	}
+	return -1
+}
+
+// cut shortens a line to the columns of the terminal, escape sequences aside.
+func cut(line string, columns int) string {
+	var b strings.Builder
+	width, escaped := 0, false
+	for _, r := range line {
+		switch {
+		case escaped:
+			escaped = r < '@' || r > '~' || r == '['
+		case r == '\x1b':
+			escaped = true
+		case width >= columns:
+			continue
+		default:
+			width++
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// key acts on a key press, reporting whether the session should end.
+func (t *tui) key(ctx context.Context, k string) bool {
+	tunnels := t.tunnels()
+	t.lock.Lock()
+	i := t.index(tunnels)
+	switch k {
+	case "up", "k":
+		if i > 0 {
+			t.selected = tunnels[i-1].port
+		}
+	case "down", "j":
+		if i >= 0 && i < len(tunnels)-1 {
+			t.selected = tunnels[i+1].port
+		}
+	}
+	t.lock.Unlock()
+	if i < 0 && (k == "p" || k == "c") {
+		return false
+	}
+
+	switch k {
+	case "q", "\x03", "\x04":
+		return true
+	case "p":
+		t.togglePause(ctx, tunnels[i])
+	case "c":
+		t.s.closeTunnel(t.conn, t.keyID, tunnels[i].port, "from the terminal")
+	}
+	return false
+}
+
+func (t *tui) togglePause(ctx context.Context, tt tuiTunnel) {
+	resumed := tt.paused
+	if _, err := t.s.updateSettings(ctx, t.keyID, tt.port, func(st *settings.Endpoint) error {
+		if resumed {
+			st.Paused = nil
+		} else {
+			st.Paused = &settings.Pause{Since: time.Now()}
+		}
+		return nil
+	}); err != nil {
+		t.notice(fmt.Sprintf("%d: could not pause or resume (%v)", tt.port, err))
+		return
+	}
+	if resumed {
+		t.s.cfg.Audit.Record("tunnel_resumed", logs.Fields{"key": t.keyID, "port": tt.port})
+		t.notice(fmt.Sprintf("%d: resumed", tt.port))
+	} else {
+		t.s.cfg.Audit.Record("tunnel_paused", logs.Fields{"key": t.keyID, "port": tt.port})
+		t.notice(fmt.Sprintf("%d: paused, visitors get: %s", tt.port, defaultPauseMessage))
+	}
+}
+
+// keys splits what the terminal sent into key presses, arrows named up and down.
+func keys(input []byte) []string {
+	var result []string
+	for i := 0; i < len(input); i++ {
+		if input[i] == '\x1b' && i+2 < len(input) && input[i+1] == '[' {
+			switch input[i+2] {
+			case 'A':
+				result = append(result, "up")
+			case 'B':
+				result = append(result, "down")
+			}
+			i += 2
+			continue
+		}
+		result = append(result, string(input[i]))
+	}
+	return result
+}
+
+// run takes over the terminal until the session ends, redrawing every tuiRefresh and on every key press.
+// It returns once the owner leaves, or the session is gone.
+func (t *tui) run(ctx context.Context) {
+	st := t.s.stateOf(t.conn)
+	st.feed.watchers.Add(1)
+	defer st.feed.watchers.Add(-1)
+
+	pressed, left := make(chan []byte), make(chan void)
+	defer close(left)
+	go func() {
+		defer close(pressed)
+		buf := make([]byte, 256)
+		for {
+			n, err := t.ch.Read(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case pressed <- append([]byte(nil), buf[:n]...):
+			case <-left:
+				return
+			}
+		}
+	}()
+
+	// The alternate screen keeps the shell as it was once we leave.
+	_, _ = t.ch.Write([]byte("\x1b[?1049h\x1b[?25l\x1b[2J"))
+	defer func() {
+		_, _ = t.ch.Write([]byte("\x1b[?25h\x1b[?1049l"))
+	}()
+	tick := time.NewTicker(tuiRefresh)
+	defer tick.Stop()
+	for {
+		if err := t.draw(); err != nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		case <-t.term.resized:
+			// Lines the terminal wrapped or moved would stay.
+			_, _ = t.ch.Write([]byte("\x1b[2J"))
+		case input, ok := <-pressed:
+			if !ok {
+				return
+			}
+			for _, k := range keys(input) {
+				if t.key(ctx, k) {
+					return
+				}
+			}
+		}
+	}
+}
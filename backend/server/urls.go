@@ -0,0 +1,35 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Clients connecting with `ssh -N -R …` open no session, so nothing is announced to them.
+// Their tunnels are listed on demand with `ssh srv.us urls`, from another terminal, or through
+// a ControlMaster, whose first session also gets the messages that were waiting for one.
+
+func runURLs(s *Server, c *commandContext, _ []string) error {
+	conns := s.registry.ConnectionsOf(c.keyID)
+	sort.Slice(conns, func(i, j int) bool { return s.stateOf(conns[i]).since.Before(s.stateOf(conns[j]).since) })
+	asJSON := s.stateOf(c.conn).json.Load()
+	shown := 0
+	for _, conn := range conns {
+		msgs := s.tunnelMessages(conn)
+		if len(msgs) == 0 {
+			continue
+		}
+		if len(conns) > 1 && !asJSON {
+			c.printf("%s, up %s:", conn.RemoteAddr(), uptime(s.stateOf(conn).since))
+		}
+		for _, m := range msgs {
+			c.printf("%s", strings.TrimSuffix(string(m.format(asJSON)), "\r\n"))
+		}
+		shown++
+	}
+	if shown == 0 {
+		return fmt.Errorf("no tunnel up; forward one with e.g. ssh -N -R 1:localhost:3000 %s", s.cfg.Domain)
+	}
+	return nil
+}
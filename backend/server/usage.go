@@ -0,0 +1,191 @@
+package server
+
+import (
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/logs"
+	"github.com/pcarrier/srv.us/backend/registry"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+)
+
+// When the last session of a connection ends, e.g. on ctrl-c, it is told what each of its tunnels did:
+// `1: 42 requests, 3.1MiB, 5 visitors; top paths / (20), /api (15), /favicon.ico (7)`.
+// The same summaries are logged once the connection closes, however it does.
+
+const (
+	// maxUsageVisitors and maxUsagePaths bound what a tunnel remembers; past them, new ones are not counted.
+	maxUsageVisitors = 10000
+	maxUsagePaths    = 1000
+	topPaths         = 3
+)
+
+// tunnelUsage is what the visitors of a forward did, under the lock of its forwardStats.
+type tunnelUsage struct {
+	requests, bytes int64
+	visitors        map[string]struct{}
+	paths           map[string]int64
+}
+
+// TunnelUsage summarizes the traffic of a tunnel while its connection was up.
+type TunnelUsage struct {
+	Port     uint32      `json:"port"`
+	Requests int64       `json:"requests"`
+	Bytes    int64       `json:"bytes"`
+	Visitors int         `json:"visitors"`
+	TopPaths []PathCount `json:"top_paths"`
+}
+
+type PathCount struct {
+	Path     string `json:"path"`
+	Requests int64  `json:"requests"`
+}
+
+// usageOf returns the stats of the forward a target serves, nil if it is down.
+func (s *Server) usageOf(tgt *registry.Target) *forwardStats {
+	st, found := s.conns.Load(tgt.Remote)
+	if !found {
+		return nil
+	}
+	if f, found := st.(*connState).forwards.Load(forwardKey{tgt.Host, tgt.Port}); found {
+		return f.(*forwardStats)
+	}
+	return nil
+}
+
+func (f *forwardStats) visited(addr net.Addr) {
+	if f == nil {
+		return
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.usage.visitors == nil {
+		f.usage.visitors = map[string]struct{}{}
+	}
+	if len(f.usage.visitors) < maxUsageVisitors {
+		f.usage.visitors[host] = struct{}{}
+	}
+}
+
+func (f *forwardStats) requested(path string) {
+	if f == nil {
+		return
+	}
+	if path == "" {
+		path = "/"
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.usage.requests++
+	if f.usage.paths == nil {
+		f.usage.paths = map[string]int64{}
+	}
+	if _, found := f.usage.paths[path]; found || len(f.usage.paths) < maxUsagePaths {
+		f.usage.paths[path]++
+	}
+}
+
+func (f *forwardStats) moved(n int64) {
+	if f == nil {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.usage.bytes += n
+}
+
+// usageSummary lists what the tunnels of a connection did, by port, leaving out those without visitors.
+func usageSummary(st *connState) []TunnelUsage {
+	perPort := map[uint32]*TunnelUsage{}
+	paths := map[uint32]map[string]int64{}
+	st.forwards.Range(func(k, v any) bool {
+		port := k.(forwardKey).port
+		f := v.(*forwardStats)
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		if len(f.usage.visitors) == 0 {
+			return true
+		}
+		u := perPort[port]
+		if u == nil {
+			u = &TunnelUsage{Port: port}
+			perPort[port], paths[port] = u, map[string]int64{}
+		}
+		u.Requests += f.usage.requests
+		u.Bytes += f.usage.bytes
+		u.Visitors += len(f.usage.visitors)
+		for path, n := range f.usage.paths {
+			paths[port][path] += n
+		}
+		return true
+	})
+
+	result := make([]TunnelUsage, 0, len(perPort))
+	for port, u := range perPort {
+		for path, n := range paths[port] {
+			u.TopPaths = append(u.TopPaths, PathCount{Path: path, Requests: n})
+		}
+		sort.Slice(u.TopPaths, func(i, j int) bool {
+			if u.TopPaths[i].Requests != u.TopPaths[j].Requests {
+				return u.TopPaths[i].Requests > u.TopPaths[j].Requests
+			}
+			return u.TopPaths[i].Path < u.TopPaths[j].Path
+		})
+		if len(u.TopPaths) > topPaths {
+			u.TopPaths = u.TopPaths[:topPaths]
+		}
+		result = append(result, *u)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Port < result[j].Port })
+	return result
+}
+
+func (u TunnelUsage) String() string {
+	text := fmt.Sprintf("%d: %d requests, %s, %d visitors", u.Port, u.Requests, formatBytes(u.Bytes), u.Visitors)
+	if len(u.TopPaths) > 0 {
+		parts := make([]string, 0, len(u.TopPaths))
+		for _, p := range u.TopPaths {
+			parts = append(parts, fmt.Sprintf("%s (%d)", p.Path, p.Requests))
+		}
+		text += "; top paths " + strings.Join(parts, ", ")
+	}
+	return text
+}
+
+// tellUsage writes the usage of a connection's tunnels to the last of its sessions, before it ends.
+func (s *Server) tellUsage(conn *ssh.ServerConn, ch ssh.Channel) {
+	st, found := s.conns.Load(conn)
+	if !found {
+		return
+	}
+	sessions := s.registry.Sessions(conn)
+	if len(sessions) != 1 || sessions[0] != ch {
+		return
+	}
+	state := st.(*connState)
+	var w io.Writer = ch
+	if _, found := state.commands.Load(ch); found {
+		w = ch.Stderr()
+	}
+	for _, u := range usageSummary(state) {
+		if _, err := w.Write(message{Text: u.String()}.format(state.json.Load())); err != nil {
+			return
+		}
+	}
+}
+
+// logUsage records the usage of a connection's tunnels as it closes.
+func (s *Server) logUsage(conn *ssh.ServerConn, st *connState) {
+	for _, u := range usageSummary(st) {
+		log.Printf("%s(%s) %s", conn.RemoteAddr(), st.keyID, u)
+		s.cfg.Audit.Record("tunnel_usage", logs.Fields{"remote": conn.RemoteAddr().String(), "key": st.keyID, "port": u.Port,
+			"requests": u.Requests, "bytes": u.Bytes, "visitors": u.Visitors, "top_paths": u.TopPaths})
+	}
+}
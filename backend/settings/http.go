@@ -0,0 +1,248 @@
+package settings
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/wire"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// HTTP holds what an owner asks of the HTTP requests to a tunnel. Tunnels with any are proxied
+// request by request, like those forwarded by user+http@, so they only suit HTTP/1.x services.
+type HTTP struct {
+	Auth      *BasicAuth `json:"auth,omitempty" yaml:"auth,omitempty"`
+	RateLimit *RateLimit `json:"rate_limit,omitempty" yaml:"rate_limit,omitempty"`
+	Rewrite   []Rewrite  `json:"rewrite,omitempty" yaml:"rewrite,omitempty"`
+	Compress  bool       `json:"compress,omitempty" yaml:"compress,omitempty"`
+	// Headers are set on responses, replacing those of the service, e.g. for CORS or HSTS.
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	CORS    *CORS             `json:"cors,omitempty" yaml:"cors,omitempty"`
+	// Challenge makes browsers prove some work before their requests are forwarded, to slow bots down.
+	Challenge *Challenge `json:"challenge,omitempty" yaml:"challenge,omitempty"`
+	// Routes send requests under path prefixes to other ports of the same key, e.g. {"/api": 2}.
+	Routes map[string]uint32 `json:"routes,omitempty" yaml:"routes,omitempty"`
+	// Host replaces the Host header of requests, for services checking it such as dev servers; the public name by default.
+	Host string `json:"host,omitempty" yaml:"host,omitempty"`
+	// RequestIDs has requests proxied one by one even without other options, as that is how they get an X-Request-Id.
+	RequestIDs bool `json:"request_ids,omitempty" yaml:"request_ids,omitempty"`
+}
+
+// LocalHost is the Host header dev servers accept out of the box.
+const LocalHost = "localhost"
+
+// Challenge asks for a SHA-256 hash with Difficulty leading zero bits, DefaultDifficulty if 0.
+type Challenge struct {
+	Difficulty int `json:"difficulty,omitempty" yaml:"difficulty,omitempty"`
+}
+
+const (
+	DefaultDifficulty = 16
+	// MaxDifficulty keeps challenges solvable by phones within seconds.
+	MaxDifficulty = 24
+)
+
+func (c *Challenge) Bits() int {
+	if c.Difficulty == 0 {
+		return DefaultDifficulty
+	}
+	return c.Difficulty
+}
+
+// CORS lets the edge answer preflight requests from Origins itself, and mark responses to them as shared.
+// Empty Methods and Headers allow whatever preflights ask for.
+type CORS struct {
+	Origins     []string `json:"origins" yaml:"origins"`
+	Methods     []string `json:"methods,omitempty" yaml:"methods,omitempty"`
+	Headers     []string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	MaxAge      int      `json:"max_age,omitempty" yaml:"max_age,omitempty"`
+	Credentials bool     `json:"credentials,omitempty" yaml:"credentials,omitempty"`
+}
+
+// Allows reports whether requests from origin may be shared.
+func (c *CORS) Allows(origin string) bool {
+	for _, o := range c.Origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// reservedHeaders frame responses, so owners cannot set them.
+var reservedHeaders = map[string]bool{
+	"Connection": true, "Content-Encoding": true, "Content-Length": true, "Keep-Alive": true, "Proxy-Connection": true,
+	"Te": true, "Trailer": true, "Transfer-Encoding": true, "Upgrade": true,
+}
+
+// BasicAuth requires visitors to log in as one of Users, which maps names to bcrypt hashes.
+type BasicAuth struct {
+	Realm string            `json:"realm,omitempty" yaml:"realm,omitempty"`
+	Users map[string]string `json:"users" yaml:"users"`
+}
+
+// RateLimit bounds the requests of every visitor address to PerMinute, allowing bursts of Burst (PerMinute by default).
+type RateLimit struct {
+	PerMinute int `json:"per_minute" yaml:"per_minute"`
+	Burst     int `json:"burst,omitempty" yaml:"burst,omitempty"`
+}
+
+// Rewrite replaces request paths matching the regular expression From with To, where $1 refers to its first group.
+type Rewrite struct {
+	From string `json:"from" yaml:"from"`
+	To   string `json:"to" yaml:"to"`
+}
+
+func (h *HTTP) Empty() bool {
+	return h == nil || (h.Auth == nil && h.RateLimit == nil && len(h.Rewrite) == 0 && !h.Compress && len(h.Headers) == 0 && h.CORS == nil && h.Challenge == nil && len(h.Routes) == 0 && h.Host == "" && !h.RequestIDs)
+}
+
+// Validate checks the options make sense, hashing passwords given in clear.
+func (h *HTTP) Validate() error {
+	if h.Auth != nil {
+		if len(h.Auth.Users) == 0 {
+			return errors.New("auth needs users")
+		}
+		for user, password := range h.Auth.Users {
+			if user == "" || strings.Contains(user, ":") {
+				return fmt.Errorf("invalid user name %q", user)
+			}
+			if _, err := bcrypt.Cost([]byte(password)); err == nil {
+				continue
+			}
+			if password == "" {
+				return fmt.Errorf("%s needs a password", user)
+			}
+			hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+			if err != nil {
+				return fmt.Errorf("%s: %w", user, err)
+			}
+			h.Auth.Users[user] = string(hash)
+		}
+	}
+	if h.RateLimit != nil {
+		if h.RateLimit.PerMinute <= 0 || h.RateLimit.Burst < 0 {
+			return errors.New("rate_limit needs a positive per_minute, and burst cannot be negative")
+		}
+		if h.RateLimit.Burst == 0 {
+			h.RateLimit.Burst = h.RateLimit.PerMinute
+		}
+	}
+	for _, rw := range h.Rewrite {
+		if !strings.HasPrefix(rw.To, "/") {
+			return fmt.Errorf("rewrite to %q must start with /", rw.To)
+		}
+		if _, err := regexp.Compile(rw.From); err != nil {
+			return fmt.Errorf("rewrite from %q (%w)", rw.From, err)
+		}
+	}
+	for name, value := range h.Headers {
+		if !wire.ValidHeader(name, value) {
+			return fmt.Errorf("invalid header %q", name)
+		}
+		if reservedHeaders[http.CanonicalHeaderKey(name)] {
+			return fmt.Errorf("header %s cannot be set", name)
+		}
+	}
+	if h.CORS != nil {
+		if len(h.CORS.Origins) == 0 {
+			return errors.New("cors needs origins")
+		}
+		for _, o := range h.CORS.Origins {
+			if u, err := url.Parse(o); o != "*" && (err != nil || u.Scheme == "" || u.Host == "" || u.Path != "") {
+				return fmt.Errorf("invalid origin %q, expected * or scheme://host[:port]", o)
+			}
+		}
+		for _, name := range append(append([]string{}, h.CORS.Methods...), h.CORS.Headers...) {
+			if name != "*" && !wire.ValidHeader(name, "") {
+				return fmt.Errorf("invalid method or header %q", name)
+			}
+		}
+		if h.CORS.MaxAge < 0 {
+			return errors.New("cors max_age cannot be negative")
+		}
+	}
+	if h.Challenge != nil && (h.Challenge.Difficulty < 0 || h.Challenge.Difficulty > MaxDifficulty) {
+		return fmt.Errorf("challenge difficulty must be between 1 and %d", MaxDifficulty)
+	}
+	if h.Host != "" {
+		if u, err := url.Parse("http://" + h.Host); err != nil || u.Host != h.Host || u.User != nil || u.Hostname() == "" {
+			return fmt.Errorf("invalid host %q, expected a name or address with an optional port", h.Host)
+		}
+	}
+	for prefix, port := range h.Routes {
+		if !strings.HasPrefix(prefix, "/") || strings.ContainsAny(prefix, "?# ") {
+			return fmt.Errorf("route prefix %q must be a path starting with /", prefix)
+		}
+		if port == 0 {
+			return fmt.Errorf("route %s needs a port", prefix)
+		}
+	}
+	return nil
+}
+
+// Route returns the port serving a path by the longest matching prefix, whole segments only
+// (/api matches /api and /api/users but not /apis), or false if none does.
+func (h *HTTP) Route(path string) (uint32, bool) {
+	var port uint32
+	best := -1
+	for prefix, p := range h.Routes {
+		if len(prefix) > best && strings.HasPrefix(path, prefix) &&
+			(len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/') {
+			port, best = p, len(prefix)
+		}
+	}
+	return port, best >= 0
+}
+
+func (h *HTTP) String() string {
+	if h.Empty() {
+		return "no HTTP options"
+	}
+	var parts []string
+	if h.Auth != nil {
+		parts = append(parts, fmt.Sprintf("auth for %d users", len(h.Auth.Users)))
+	}
+	if h.RateLimit != nil {
+		parts = append(parts, fmt.Sprintf("%d requests/minute (burst %d)", h.RateLimit.PerMinute, h.RateLimit.Burst))
+	}
+	for _, rw := range h.Rewrite {
+		parts = append(parts, fmt.Sprintf("rewrite %s → %s", rw.From, rw.To))
+	}
+	if h.Compress {
+		parts = append(parts, "compress")
+	}
+	if h.CORS != nil {
+		parts = append(parts, "CORS for "+strings.Join(h.CORS.Origins, " "))
+	}
+	if h.Host != "" {
+		parts = append(parts, "host "+h.Host)
+	}
+	if h.RequestIDs {
+		parts = append(parts, "request IDs")
+	}
+	if h.Challenge != nil {
+		parts = append(parts, fmt.Sprintf("challenge of %d bits", h.Challenge.Bits()))
+	}
+	var prefixes []string
+	for prefix := range h.Routes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		parts = append(parts, fmt.Sprintf("route %s → %d", prefix, h.Routes[prefix]))
+	}
+	var names []string
+	for name := range h.Headers {
+		names = append(names, http.CanonicalHeaderKey(name))
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		parts = append(parts, "header "+name)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,88 @@
+// Package settings holds the options owners choose for their tunnels, persisted in a store.
+package settings
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pcarrier/srv.us/backend/geoip"
+	"github.com/pcarrier/srv.us/backend/store"
+	"strings"
+	"time"
+)
+
+const namespace = "endpoint"
+
+// Endpoint are the options an owner chose for one of their tunnels, identified by key and port.
+type Endpoint struct {
+	Geo *geoip.Rules `json:"geo,omitempty"`
+	// Salt is mixed into the hashed name once the owner rotates it.
+	Salt string `json:"salt,omitempty"`
+	HTTP *HTTP  `json:"http,omitempty"`
+	// Split weighs the tags of the targets serving a tunnel, e.g. {"default": 90, "canary": 10}.
+	Split map[string]int `json:"split,omitempty"`
+	// Paused tunnels stay registered, but visitors get a maintenance page instead.
+	Paused *Pause `json:"paused,omitempty"`
+	// Suspended tunnels were taken down after abuse reports; only operators lift suspensions.
+	Suspended *Suspension `json:"suspended,omitempty"`
+	// Scanned tunnels were flagged by operators: the edge scans what goes through them.
+	Scanned bool `json:"scanned,omitempty"`
+	// Indexable tunnels let search engines index their hashed name.
+	Indexable bool `json:"indexable,omitempty"`
+	// Timeouts tune how long the edge waits on the tunnel, and how it tries again, if set.
+	Timeouts *Timeouts `json:"timeouts,omitempty"`
+}
+
+type Suspension struct {
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+}
+
+// Pause is why and since when an owner took a tunnel down for maintenance.
+type Pause struct {
+	Message string    `json:"message,omitempty"`
+	Since   time.Time `json:"since"`
+}
+
+func key(keyID string, port uint32) string {
+	return fmt.Sprintf("%s:%d", keyID, port)
+}
+
+// Load returns the settings of a tunnel, empty if it has none.
+func Load(ctx context.Context, st store.Store, keyID string, port uint32) (*Endpoint, error) {
+	e := &Endpoint{}
+	raw, err := st.Get(ctx, namespace, key(keyID, port))
+	if err != nil || raw == nil {
+		return e, err
+	}
+	if err := json.Unmarshal(raw, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Ports lists the ports of a key's tunnels that have settings.
+func Ports(ctx context.Context, st store.Store, keyID string) ([]uint32, error) {
+	all, err := st.List(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+	var ports []uint32
+	for k := range all {
+		var port uint32
+		if rest, found := strings.CutPrefix(k, keyID+":"); found {
+			if _, err := fmt.Sscan(rest, &port); err == nil {
+				ports = append(ports, port)
+			}
+		}
+	}
+	return ports, nil
+}
+
+func Save(ctx context.Context, st store.Store, keyID string, port uint32, e *Endpoint) error {
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return st.Put(ctx, namespace, key(keyID, port), raw)
+}
@@ -0,0 +1,85 @@
+package settings
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Timeouts bound how long the edge waits on a tunnel, and how many more times it tries to reach it.
+type Timeouts struct {
+	// Connect bounds opening a channel to the client, which connects to the service, including the wait behind other opens.
+	Connect time.Duration `json:"connect,omitempty"`
+	// ResponseHeader bounds the wait for the head of each response, for tunnels proxied request by request.
+	ResponseHeader time.Duration `json:"response_header,omitempty"`
+	// Request bounds each request proxied request by request, from its head to the end of its response;
+	// upgraded connections, e.g. WebSockets, are exempt.
+	Request time.Duration `json:"request,omitempty"`
+	// Retries are the attempts to open a channel after one fails, waiting Backoff (DefaultBackoff if 0), doubled each time.
+	Retries int           `json:"retries,omitempty"`
+	Backoff time.Duration `json:"backoff,omitempty"`
+}
+
+const (
+	MaxConnectTimeout        = 2 * time.Minute
+	MaxResponseHeaderTimeout = 10 * time.Minute
+	MaxRequestTimeout        = time.Hour
+	MaxRetries               = 5
+	DefaultBackoff           = 100 * time.Millisecond
+	MaxBackoff               = 5 * time.Second
+)
+
+func (t *Timeouts) Empty() bool {
+	return t == nil || *t == Timeouts{}
+}
+
+func (t *Timeouts) Validate() error {
+	switch {
+	case t.Connect < 0 || t.Connect > MaxConnectTimeout:
+		return fmt.Errorf("the connect timeout must be within %s", MaxConnectTimeout)
+	case t.ResponseHeader < 0 || t.ResponseHeader > MaxResponseHeaderTimeout:
+		return fmt.Errorf("the response header timeout must be within %s", MaxResponseHeaderTimeout)
+	case t.Request < 0 || t.Request > MaxRequestTimeout:
+		return fmt.Errorf("the request timeout must be within %s", MaxRequestTimeout)
+	case t.Retries < 0 || t.Retries > MaxRetries:
+		return fmt.Errorf("at most %d retries", MaxRetries)
+	case t.Backoff < 0 || t.Backoff > MaxBackoff:
+		return fmt.Errorf("the backoff must be within %s", MaxBackoff)
+	case t.Backoff > 0 && t.Retries == 0:
+		return errors.New("a backoff needs retries")
+	}
+	return nil
+}
+
+// Wait is how long to wait before the retry following attempt, counting from 0.
+func (t *Timeouts) Wait(attempt int) time.Duration {
+	backoff := t.Backoff
+	if backoff == 0 {
+		backoff = DefaultBackoff
+	}
+	return backoff << attempt
+}
+
+func (t *Timeouts) String() string {
+	if t.Empty() {
+		return "default timeouts, no retries"
+	}
+	var parts []string
+	if t.Connect > 0 {
+		parts = append(parts, "connect within "+t.Connect.String())
+	}
+	if t.ResponseHeader > 0 {
+		parts = append(parts, "response headers within "+t.ResponseHeader.String())
+	}
+	if t.Request > 0 {
+		parts = append(parts, "requests within "+t.Request.String())
+	}
+	switch {
+	case t.Retries == 1:
+		parts = append(parts, fmt.Sprintf("1 retry after %s", t.Wait(0)))
+	case t.Retries > 1:
+		parts = append(parts, fmt.Sprintf("%d retries, the first after %s, doubling", t.Retries, t.Wait(0)))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,119 @@
+// Package store persists small settings documents.
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"sync"
+)
+
+// Store persists small settings documents, grouped by namespace.
+type Store interface {
+	// Get returns nil without error if the key is missing.
+	Get(ctx context.Context, namespace, key string) ([]byte, error)
+	Put(ctx context.Context, namespace, key string, value []byte) error
+	Delete(ctx context.Context, namespace, key string) error
+	List(ctx context.Context, namespace string) (map[string][]byte, error)
+}
+
+// Postgres keeps settings in the settings table, created if needed.
+type Postgres struct {
+	pool *pgxpool.Pool
+}
+
+func NewPostgres(ctx context.Context, pool *pgxpool.Pool) (*Postgres, error) {
+	_, err := pool.Exec(ctx, `CREATE TABLE IF NOT EXISTS settings (
+		namespace TEXT NOT NULL,
+		key TEXT NOT NULL,
+		value BYTEA NOT NULL,
+		updated TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (namespace, key)
+	)`)
+	if err != nil {
+		return nil, err
+	}
+	return &Postgres{pool: pool}, nil
+}
+
+func (p *Postgres) Get(ctx context.Context, namespace, key string) ([]byte, error) {
+	var value []byte
+	err := p.pool.QueryRow(ctx, "SELECT value FROM settings WHERE namespace = $1 AND key = $2", namespace, key).Scan(&value)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return value, err
+}
+
+func (p *Postgres) Put(ctx context.Context, namespace, key string, value []byte) error {
+	_, err := p.pool.Exec(ctx, `INSERT INTO settings(namespace, key, value) VALUES ($1, $2, $3)
+		ON CONFLICT (namespace, key) DO UPDATE SET value = EXCLUDED.value, updated = now()`, namespace, key, value)
+	return err
+}
+
+func (p *Postgres) Delete(ctx context.Context, namespace, key string) error {
+	_, err := p.pool.Exec(ctx, "DELETE FROM settings WHERE namespace = $1 AND key = $2", namespace, key)
+	return err
+}
+
+func (p *Postgres) List(ctx context.Context, namespace string) (map[string][]byte, error) {
+	rows, err := p.pool.Query(ctx, "SELECT key, value FROM settings WHERE namespace = $1", namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := map[string][]byte{}
+	for rows.Next() {
+		var key string
+		var value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		result[key] = value
+	}
+	return result, rows.Err()
+}
+
+// Memory keeps everything in memory, for deployments without Postgres.
+type Memory struct {
+	sync.Mutex
+	data map[string]map[string][]byte
+}
+
+func NewMemory() *Memory {
+	return &Memory{data: map[string]map[string][]byte{}}
+}
+
+func (m *Memory) Get(_ context.Context, namespace, key string) ([]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.data[namespace][key], nil
+}
+
+func (m *Memory) Put(_ context.Context, namespace, key string, value []byte) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.data[namespace] == nil {
+		m.data[namespace] = map[string][]byte{}
+	}
+	m.data[namespace][key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (m *Memory) Delete(_ context.Context, namespace, key string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.data[namespace], key)
+	return nil
+}
+
+func (m *Memory) List(_ context.Context, namespace string) (map[string][]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+	result := make(map[string][]byte, len(m.data[namespace]))
+	for k, v := range m.data[namespace] {
+		result[k] = v
+	}
+	return result, nil
+}
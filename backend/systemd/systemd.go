@@ -0,0 +1,87 @@
+// Package systemd implements the parts of the systemd protocols we use:
+// socket activation (sd_listen_fds) and service notifications (sd_notify), including the watchdog.
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// Socket is a listener passed by systemd, named after the FileDescriptorName= of its socket unit.
+type Socket struct {
+	Name     string
+	Listener net.Listener
+}
+
+// Listeners returns the sockets systemd passed to this process, in order, or none if it was not socket-activated.
+func Listeners() ([]Socket, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// Processes we start must not believe the sockets are theirs.
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	sockets := make([]Socket, 0, n)
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		l, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d (%s) is not a listener: %w", i, name, err)
+		}
+		sockets = append(sockets, Socket{Name: name, Listener: l})
+	}
+	return sockets, nil
+}
+
+// Notify sends a state change such as READY=1 to the service manager. It does nothing outside of systemd.
+func Notify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// WatchdogInterval returns the WatchdogSec= of the service, or 0 if the watchdog is disabled.
+// WATCHDOG=1 must be sent more often than that, typically every half.
+func WatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
@@ -0,0 +1,353 @@
+// Package tracing records spans of the proxy path and exports them with OTLP over HTTP, in its JSON encoding,
+// so operators can follow slow requests end to end in any OpenTelemetry backend (Jaeger, Tempo, Honeycomb…).
+// A nil *Tracer records nothing, and the spans it starts are nil and safe to use.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracer batches finished spans and posts them to Endpoint, such as http://collector:4318/v1/traces.
+type Tracer struct {
+	Endpoint string
+	Service  string
+	// SampleRate is the share of traces started here that are recorded; those continued from visitors
+	// announcing a trace follow its sampling decision.
+	SampleRate float64
+
+	queue   chan *Span
+	stop    chan struct{}
+	done    chan struct{}
+	closing sync.Once
+}
+
+const (
+	exportQueue    = 4096
+	exportBatch    = 512
+	exportInterval = 5 * time.Second
+	exportTimeout  = 10 * time.Second
+)
+
+// Kinds of spans, as OTLP numbers them.
+const (
+	Internal = 1
+	Server   = 2
+	Client   = 3
+)
+
+func New(endpoint, service string, sampleRate float64) *Tracer {
+	t := &Tracer{
+		Endpoint:   endpoint,
+		Service:    service,
+		SampleRate: sampleRate,
+		queue:      make(chan *Span, exportQueue),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// SpanContext identifies a span across processes, as in W3C traceparent headers.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent renders the header continuing a trace in the next hop.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// ParseTraceparent reads a W3C traceparent header, returning an invalid context if it cannot.
+func ParseTraceparent(header string) SpanContext {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return SpanContext{}
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}
+	}
+	sc.Sampled = flags[0]&1 == 1
+	if !sc.Valid() {
+		return SpanContext{}
+	}
+	return sc
+}
+
+// Span is an operation being timed, recorded once ended.
+type Span struct {
+	tracer  *Tracer
+	context SpanContext
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+	lock    sync.Mutex
+	end     time.Time
+	attrs   map[string]any
+	failure string
+}
+
+type spanKey struct{}
+
+// FromContext returns the span of ctx, nil if none.
+func FromContext(ctx context.Context) *Span {
+	sp, _ := ctx.Value(spanKey{}).(*Span)
+	return sp
+}
+
+// Start starts a span under the one of ctx, if there is one being recorded.
+func (t *Tracer) Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	if t == nil || parent == nil {
+		return ctx, nil
+	}
+	return t.begin(ctx, parent.context, name, kind)
+}
+
+// StartTrace starts a span continuing the trace of remote if valid, such as one announced by a visitor,
+// or the root span of a new trace, recorded as often as SampleRate says.
+func (t *Tracer) StartTrace(ctx context.Context, remote SpanContext, name string, kind int) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	if !remote.Valid() {
+		remote = SpanContext{Sampled: mathrand.Float64() < t.SampleRate}
+		_, _ = rand.Read(remote.TraceID[:])
+	}
+	if !remote.Sampled {
+		return ctx, nil
+	}
+	return t.begin(ctx, remote, name, kind)
+}
+
+func (t *Tracer) begin(ctx context.Context, parent SpanContext, name string, kind int) (context.Context, *Span) {
+	sp := &Span{tracer: t, context: parent, parent: parent.SpanID, name: name, kind: kind, start: time.Now()}
+	_, _ = rand.Read(sp.context.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, sp), sp
+}
+
+// Context identifies the span for the next hop; it is invalid for nil spans.
+func (sp *Span) Context() SpanContext {
+	if sp == nil {
+		return SpanContext{}
+	}
+	return sp.context
+}
+
+// Set records an attribute: a string, bool, integer or float.
+func (sp *Span) Set(key string, value any) {
+	if sp == nil {
+		return
+	}
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	if sp.attrs == nil {
+		sp.attrs = map[string]any{}
+	}
+	sp.attrs[key] = value
+}
+
+// Fail marks the span as failed by err, if not nil.
+func (sp *Span) Fail(err error) {
+	if sp == nil || err == nil {
+		return
+	}
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	sp.failure = err.Error()
+}
+
+// End records the span, only the first time.
+func (sp *Span) End() {
+	if sp == nil {
+		return
+	}
+	sp.lock.Lock()
+	ended := !sp.end.IsZero()
+	if !ended {
+		sp.end = time.Now()
+	}
+	sp.lock.Unlock()
+	if ended {
+		return
+	}
+	select {
+	case <-sp.tracer.stop:
+	case sp.tracer.queue <- sp:
+	default:
+		log.Println("Trace exporter is not keeping up, dropping a span")
+	}
+}
+
+// Close exports the spans still queued, then stops.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.closing.Do(func() {
+		close(t.stop)
+	})
+	<-t.done
+	return nil
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	tick := time.NewTicker(exportInterval)
+	defer tick.Stop()
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+		defer cancel()
+		if err := t.export(ctx, batch); err != nil {
+			log.Printf("Could not export %d spans (%v)", len(batch), err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case sp := <-t.queue:
+			batch = append(batch, sp)
+			if len(batch) >= exportBatch {
+				flush()
+			}
+		case <-t.stop:
+			for len(t.queue) > 0 {
+				batch = append(batch, <-t.queue)
+			}
+			flush()
+			return
+		case <-tick.C:
+			flush()
+		}
+	}
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	// Code 2 is an error.
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func attribute(key string, value any) otlpAttribute {
+	switch v := value.(type) {
+	case string:
+		return otlpAttribute{key, map[string]any{"stringValue": v}}
+	case bool:
+		return otlpAttribute{key, map[string]any{"boolValue": v}}
+	case int:
+		return otlpAttribute{key, map[string]any{"intValue": strconv.Itoa(v)}}
+	case int64:
+		return otlpAttribute{key, map[string]any{"intValue": strconv.FormatInt(v, 10)}}
+	case uint32:
+		return otlpAttribute{key, map[string]any{"intValue": strconv.FormatUint(uint64(v), 10)}}
+	case float64:
+		return otlpAttribute{key, map[string]any{"doubleValue": v}}
+	default:
+		return otlpAttribute{key, map[string]any{"stringValue": fmt.Sprint(v)}}
+	}
+}
+
+func (sp *Span) encode() otlpSpan {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	o := otlpSpan{
+		TraceID: hex.EncodeToString(sp.context.TraceID[:]),
+		SpanID:  hex.EncodeToString(sp.context.SpanID[:]),
+		Name:    sp.name,
+		Kind:    sp.kind,
+		Start:   strconv.FormatInt(sp.start.UnixNano(), 10),
+		End:     strconv.FormatInt(sp.end.UnixNano(), 10),
+	}
+	if sp.parent != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(sp.parent[:])
+	}
+	for key, value := range sp.attrs {
+		o.Attributes = append(o.Attributes, attribute(key, value))
+	}
+	if sp.failure != "" {
+		o.Status = &otlpStatus{Code: 2, Message: sp.failure}
+	}
+	return o
+}
+
+func (t *Tracer) export(ctx context.Context, batch []*Span) error {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, sp := range batch {
+		spans = append(spans, sp.encode())
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource":   map[string]any{"attributes": []otlpAttribute{attribute("service.name", t.Service)}},
+			"scopeSpans": []any{map[string]any{"scope": map[string]string{"name": t.Service}, "spans": spans}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
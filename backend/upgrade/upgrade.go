@@ -0,0 +1,138 @@
+// Package upgrade replaces the running binary without closing its listening sockets:
+// the new process inherits them, and the old one drains its connections before exiting.
+package upgrade
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// namesEnv lists the names of the inherited listeners, colon-separated, in file descriptor order.
+	namesEnv = "SRVUS_UPGRADE_LISTENERS"
+	// readyFD is where the new process reports it is serving; listeners follow it.
+	readyFD = 3
+	// readyTimeout bounds how long the old process waits for the new one to be serving.
+	readyTimeout = time.Minute
+)
+
+var ready *os.File
+
+// Inherited returns the listeners handed over by the process we replace, by name,
+// or none if we were not started by Start.
+func Inherited() (map[string]net.Listener, error) {
+	env, found := os.LookupEnv(namesEnv)
+	if !found {
+		return nil, nil
+	}
+	_ = os.Unsetenv(namesEnv)
+	ready = os.NewFile(readyFD, "upgrade-ready")
+
+	listeners := map[string]net.Listener{}
+	for i, name := range strings.Split(env, ":") {
+		f := os.NewFile(uintptr(readyFD+1+i), name)
+		l, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited %s is not a listener: %w", name, err)
+		}
+		listeners[name] = l
+	}
+	return listeners, nil
+}
+
+// Upgraded reports whether we replaced another process, which is waiting for Ready.
+func Upgraded() bool {
+	return ready != nil
+}
+
+// Ready tells the process we replace that we are serving, so it can stop accepting and drain.
+func Ready() error {
+	if ready == nil {
+		return nil
+	}
+	defer func() {
+		_ = ready.Close()
+		ready = nil
+	}()
+	_, err := ready.Write([]byte{1})
+	return err
+}
+
+// Start runs the current binary with the same arguments, handing it listeners,
+// and waits until it is serving. It returns the new process ID; the caller is expected
+// to stop accepting on listeners and to drain, since the new process now accepts too.
+func Start(listeners map[string]net.Listener) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr, w}
+	var names []string
+	for name, l := range listeners {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			_ = w.Close()
+			return 0, fmt.Errorf("cannot hand over %s listener %T", name, l)
+		}
+		f, err := fl.File()
+		if err != nil {
+			_ = w.Close()
+			return 0, err
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		files = append(files, f)
+		names = append(names, name)
+	}
+
+	var env []string
+	for _, kv := range os.Environ() {
+		// The watchdog belongs to whichever process is the main one.
+		if !strings.HasPrefix(kv, "WATCHDOG_PID=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env, namesEnv+"="+strings.Join(names, ":"))
+
+	p, err := os.StartProcess(exe, os.Args, &os.ProcAttr{Env: env, Files: files})
+	_ = w.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		// Reading fails if the new process exits, closing the pipe, without reporting ready.
+		buf := make([]byte, 1)
+		_, err := r.Read(buf)
+		result <- err
+	}()
+	select {
+	case err = <-result:
+	case <-time.After(readyTimeout):
+		err = errors.New("timed out")
+	}
+	if err != nil {
+		_ = p.Signal(syscall.SIGTERM)
+		_, _ = p.Wait()
+		return 0, fmt.Errorf("new process %d did not become ready (%w)", p.Pid, err)
+	}
+	pid := p.Pid
+	_ = p.Release()
+	return pid, nil
+}
@@ -0,0 +1,240 @@
+package wire
+
+import (
+	"bufio"
+	"bytes"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Fuzz targets for `make fuzz`; go test runs them on their seeds, and on the inputs of testdata/fuzz that once failed.
+
+// smuggling are requests a Guard must reject, as the edge and services could disagree on where they end.
+var smuggling = []string{
+	"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 4\r\nContent-Length: 30\r\n\r\nabcdGET /hidden HTTP/1.1\r\nHost: a\r\n\r\n",
+	"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nGET /hidden HTTP/1.1\r\nHost: a\r\n\r\n",
+	"GET / HTTP/1.1\nHost: a\n\n",
+	"GET / HTTP/1.1\r\nHost: a\r\nX-Folded: a\r\n b\r\n\r\n",
+	"GET / HTTP/1.1\r\nHost: a\r\nX-Padding: " + strings.Repeat("a", MaxRequestHead) + "\r\n\r\n",
+	"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n",
+	"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: +4\r\n\r\nabcd",
+	"GET http://elsewhere/ HTTP/1.1\r\nHost: a\r\n\r\n",
+}
+
+// framed are connections a Guard must let through whole.
+var framed = []string{
+	"GET / HTTP/1.1\r\nHost: a\r\n\r\nGET /next HTTP/1.1\r\nHost: a\r\n\r\n",
+	"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 4\r\n\r\nabcdGET / HTTP/1.1\r\nHost: a\r\n\r\n",
+	"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n4;ext\r\nabcd\r\n0\r\nTrailer: x\r\n\r\nGET / HTTP/1.1\r\nHost: a\r\n\r\n",
+	"\r\nGET / HTTP/1.0\r\n\r\n",
+}
+
+// FuzzSSHPayloads checks that request payloads either fail to decode, or survive a round-trip unchanged.
+// The first byte picks the payload type.
+func FuzzSSHPayloads(f *testing.F) {
+	f.Add(append([]byte{0}, ssh.Marshal(&ForwardRequest{BindAddr: "localhost", BindPort: 1})...))
+	f.Add(append([]byte{3}, ssh.Marshal(&ExecRequest{Command: "help"})...))
+	f.Add(append([]byte{4}, ssh.Marshal(&EnvRequest{Name: "SRVUS_TUI", Value: "1"})...))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) == 0 {
+			t.Skip()
+		}
+		payloads := []func() any{
+			func() any { return &ForwardRequest{} },
+			func() any { return &ForwardCancelRequest{} },
+			func() any { return &ForwardedChannelData{} },
+			func() any { return &ExecRequest{} },
+			func() any { return &EnvRequest{} },
+			func() any { return &PtyRequest{} },
+			func() any { return &WindowChangeRequest{} },
+			func() any { return &SubsystemRequest{} },
+		}
+		payload := payloads[int(data[0])%len(payloads)]()
+		if err := ssh.Unmarshal(data[1:], payload); err != nil {
+			t.Skip()
+		}
+		if fwd, ok := payload.(*ForwardRequest); ok && ValidBindAddr(fwd.BindAddr) && strings.ContainsAny(fwd.BindAddr, " /:\x00") && net.ParseIP(strings.Trim(fwd.BindAddr, "[]")) == nil {
+			t.Fatalf("invalid bind address %q accepted", fwd.BindAddr)
+		}
+		if !bytes.Equal(ssh.Marshal(payload), data[1:]) {
+			t.Fatal("payload changed during round-trip")
+		}
+		again := reflect.New(reflect.TypeOf(payload).Elem()).Interface()
+		if err := ssh.Unmarshal(data[1:], again); err != nil || !reflect.DeepEqual(payload, again) {
+			t.Fatal("payload decoded differently")
+		}
+	})
+}
+
+type fuzzConn struct {
+	io.Reader
+	bytes.Buffer
+}
+
+func (c *fuzzConn) Read(p []byte) (int, error) {
+	return c.Reader.Read(p)
+}
+
+// FuzzErrorOut feeds what a visitor sends to a tunnel that cannot serve it.
+func FuzzErrorOut(f *testing.F) {
+	for _, seed := range append(append([]string{}, framed...), smuggling...) {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conn := &fuzzConn{Reader: bytes.NewReader(data)}
+		if err := ErrorOut(conn, "503 Service Unavailable", "No tunnel available."); err != nil {
+			t.Skip()
+		}
+		if !bytes.HasPrefix(conn.Bytes(), []byte("HTTP/1.1 503 ")) {
+			t.Fatalf("unexpected answer %q", conn.Bytes())
+		}
+	})
+}
+
+// readerConn is a connection reading from r, which fails but to Read.
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// FuzzGuard reads requests through a Guard as http.Server would, checking that each one went through it as a request,
+// rather than hidden in the body of another.
+func FuzzGuard(f *testing.F) {
+	for _, seed := range append(append([]string{}, framed...), smuggling...) {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		g := NewGuard(&readerConn{r: bytes.NewReader(data)})
+		r := bufio.NewReader(g)
+		for read := 0; ; read++ {
+			req, err := http.ReadRequest(r)
+			if err != nil {
+				return
+			}
+			if read >= g.screened {
+				t.Fatal("request smuggled past the guard")
+			}
+			if _, err := io.Copy(io.Discard, req.Body); err != nil {
+				return
+			}
+		}
+	})
+}
+
+// FuzzWatcher reads a connection through a watching Guard, checking that it only withholds requests for reserved targets,
+// and lets everything else through unchanged.
+func FuzzWatcher(f *testing.F) {
+	for _, seed := range append(append([]string{}, framed...), smuggling...) {
+		f.Add([]byte(seed))
+	}
+	f.Add([]byte("GET / HTTP/1.1\r\nHost: a\r\n\r\nGET /.reserved HTTP/1.1\r\nHost: a\r\n\r\n"))
+	f.Add([]byte("SSH-2.0-OpenSSH_9.6\r\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		g := NewWatcher(&readerConn{}, bytes.NewReader(data), func(target string) bool {
+			return strings.HasPrefix(target, "/.reserved")
+		})
+		passed, _ := io.ReadAll(g)
+		if g.Rejected() != nil {
+			passed = append(passed, g.Withheld()...)
+			requestLine, _, _ := bytes.Cut(g.Withheld(), []byte("\r\n"))
+			if fields := strings.Fields(string(requestLine)); len(fields) != 3 || !strings.HasPrefix(fields[1], "/.reserved") {
+				t.Fatalf("request %q withheld for another reason", requestLine)
+			}
+		}
+		if !bytes.HasPrefix(data, passed) {
+			t.Fatal("connection altered by the watcher")
+		}
+	})
+}
+
+// FuzzHeaders checks that headers ValidHeader accepts, given as "name:value", read back unchanged.
+func FuzzHeaders(f *testing.F) {
+	f.Add("X-Request-Id:0123456789abcdef")
+	f.Add("Content-Type: text/plain; charset=utf-8 ")
+	f.Add("X-Folded:a\r\n b")
+	f.Fuzz(func(t *testing.T, data string) {
+		name, value, found := strings.Cut(data, ":")
+		if !found || !ValidHeader(name, value) {
+			t.Skip()
+		}
+		header := http.Header{}
+		header.Set(name, value)
+		var raw strings.Builder
+		raw.WriteString("HTTP/1.1 204 No Content\r\n")
+		_ = header.Write(&raw)
+		raw.WriteString("\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(raw.String())), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.Header.Values(name); len(got) != 1 || got[0] != strings.Trim(value, " \t") {
+			t.Fatalf("header %q changed during round-trip into %q", value, got)
+		}
+	})
+}
+
+// FuzzObserver feeds both directions of a connection to an observer, separated by "\n\x00\n" in the input.
+func FuzzObserver(f *testing.F) {
+	f.Add([]byte("POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 4\r\n\r\nabcd\n\x00\nHTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+	f.Add([]byte("GET /events HTTP/1.1\r\nHost: a\r\n\r\n\n\x00\nHTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\n\r\ndata: x\n\n"))
+	f.Add([]byte("GET / HTTP/1.1\r\nHost: a\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n\n\x00\nHTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n\x81\x00"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		requests, responses, _ := bytes.Cut(data, []byte("\n\x00\n"))
+		done := make(chan struct{})
+		// Observers call back from their own goroutines, so only the first failure is reported, once fed.
+		failure := make(chan string, 1)
+		fail := func(reason string) {
+			select {
+			case failure <- reason:
+			default:
+			}
+		}
+		o := NewCapturingObserver(64, func(ex *Exchange) {
+			if ex.Request == nil || ex.Response == nil {
+				fail("incomplete exchange head")
+				return
+			}
+			_ = IsStreamingResponse(ex.Response)
+		}, func(ex *Exchange) {
+			if ex.ResponseBytes < 0 {
+				fail("negative response size")
+			}
+			if len(ex.RequestBody) > 64 || int64(len(ex.RequestBody)) > ex.RequestBytes {
+				fail("request body captured past its limit")
+			}
+		})
+		go func() {
+			feed(o.Responses, responses)
+			close(done)
+		}()
+		feed(o.Requests, requests)
+		<-done
+		select {
+		case reason := <-failure:
+			t.Fatal(reason)
+		default:
+		}
+	})
+}
+
+// feed writes data in small pieces, as a proxy would over a slow link.
+func feed(t *Tap, data []byte) {
+	defer t.Close()
+	for len(data) > 0 {
+		n := 1 + len(data)%61
+		if n > len(data) {
+			n = len(data)
+		}
+		_, _ = t.Write(data[:n])
+		data = data[n:]
+	}
+}
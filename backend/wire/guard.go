@@ -0,0 +1,346 @@
+package wire
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The edge parses requests it proxies one by one, and the services behind it parse them again:
+// any disagreement on where a request ends lets a visitor smuggle a request past the edge, e.g. past its routes.
+// A Guard screens requests before an http.Server reads them, only letting through heads both sides read alike,
+// with at most one Content-Length or a Transfer-Encoding of chunked, paths as targets, and no folded headers,
+// bare line feeds or control characters. Reads fail with a *RejectedRequest otherwise,
+// which http.Server answers with a 400 before closing the connection.
+//
+// Connections proxied byte by byte are only watched: their heads are framed the same way to find where each
+// request starts, but only requests for reserved targets are rejected, and anything the Guard cannot frame
+// (other protocols, upgrades, heads it would reject) lets the rest of the connection through as is.
+// The heads of requests rejected that way are withheld, for the proxy to answer them itself.
+
+// MaxRequestHead bounds the head of a request, as http.DefaultMaxHeaderBytes does.
+const MaxRequestHead = 1 << 20
+
+// reservedTarget is why requests for reserved targets are rejected.
+const reservedTarget = "reserved target"
+
+// maxMethod bounds the methods watching Guards expect at the start of a request.
+const maxMethod = 20
+
+// RejectedRequest is why a Guard rejected a request.
+type RejectedRequest struct {
+	Reason string
+}
+
+func (e *RejectedRequest) Error() string {
+	return "rejected request: " + e.Reason
+}
+
+type framing int
+
+const (
+	inHead framing = iota
+	inBody
+	inChunkSize
+	inChunkData
+	inChunkEnd
+	inTrailers
+	passing
+)
+
+// Guard is a connection whose requests are screened as they are read.
+type Guard struct {
+	net.Conn
+	r       *bufio.Reader
+	state   framing
+	left    int64
+	head    []byte
+	line    []byte
+	pending []byte
+	err     error
+	// screened counts the heads let through.
+	screened int
+	// reserved tells which targets are not for the service; watching Guards only reject those.
+	reserved func(target string) bool
+	watching bool
+	withheld []byte
+}
+
+func NewGuard(conn net.Conn) *Guard {
+	return &Guard{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+// NewWatcher returns a watching Guard of conn, whose requests are read from r, rejecting those for reserved targets.
+func NewWatcher(conn net.Conn, r io.Reader, reserved func(target string) bool) *Guard {
+	return &Guard{Conn: conn, r: bufio.NewReader(r), reserved: reserved, watching: true}
+}
+
+// Pass stops screening, e.g. once the connection is upgraded to another protocol; what was not screened yet goes through as is.
+// It must not be called during a Read.
+func (g *Guard) Pass() {
+	if g.state == passing {
+		return
+	}
+	g.pending = append(append(g.pending, g.head...), g.line...)
+	g.head, g.line, g.state = nil, nil, passing
+}
+
+// Rejected returns why the last request read was rejected, if it was.
+func (g *Guard) Rejected() *RejectedRequest {
+	var rejected *RejectedRequest
+	if errors.As(g.err, &rejected) {
+		return rejected
+	}
+	return nil
+}
+
+// Withheld returns the head of the request a watching Guard rejected for its target, if it did.
+func (g *Guard) Withheld() []byte {
+	return g.withheld
+}
+
+func (g *Guard) Read(p []byte) (int, error) {
+	for len(g.pending) == 0 {
+		if g.err != nil {
+			return 0, g.err
+		}
+		if g.state == passing || g.state == inBody || g.state == inChunkData {
+			return g.readBody(p)
+		}
+		if g.watching && g.state == inHead && len(g.head) == 0 && len(g.line) == 0 && !g.plausible() {
+			g.Pass()
+			continue
+		}
+		if err := g.advance(); err != nil {
+			var rejected *RejectedRequest
+			if g.watching && errors.As(err, &rejected) {
+				if rejected.Reason != reservedTarget {
+					g.Pass()
+					continue
+				}
+				g.withheld = g.head
+			}
+			// Deadlines, e.g. set by http.Server to abort a read, leave the connection usable.
+			var ne net.Error
+			if !errors.As(err, &ne) || !ne.Timeout() {
+				g.err = err
+			}
+			if len(g.pending) == 0 {
+				return 0, err
+			}
+		}
+	}
+	n := copy(p, g.pending)
+	g.pending = g.pending[n:]
+	return n, nil
+}
+
+// plausible tells whether the bytes at hand of a watched connection may start a request: a short method, then a space.
+// Waiting for a whole line instead could hold other protocols back for long.
+func (g *Guard) plausible() bool {
+	if _, err := g.r.Peek(1); err != nil {
+		return true
+	}
+	b, _ := g.r.Peek(g.r.Buffered())
+	for i, c := range b {
+		switch {
+		case c == ' ':
+			return i > 0
+		case c == '\r' || c == '\n':
+			// Empty lines may precede a request.
+			return i == 0
+		case i >= maxMethod || !isToken(string(c)):
+			return false
+		}
+	}
+	return true
+}
+
+func (g *Guard) readBody(p []byte) (int, error) {
+	if g.state != passing && int64(len(p)) > g.left {
+		p = p[:g.left]
+	}
+	n, err := g.r.Read(p)
+	if g.state == passing {
+		return n, err
+	}
+	g.left -= int64(n)
+	if g.left == 0 {
+		if g.state == inBody {
+			g.state = inHead
+		} else {
+			g.state = inChunkEnd
+		}
+	}
+	return n, err
+}
+
+// advance reads the next line of the head or chunked body, queuing it once screened.
+func (g *Guard) advance() error {
+	line, err := g.readLine()
+	if err != nil {
+		return err
+	}
+	switch g.state {
+	case inHead:
+		// Empty lines before a request are ignored (RFC 9112, section 2.2), and left to the service when watching.
+		if len(g.head) == 0 && len(line) == 2 {
+			if g.watching {
+				g.pending = line
+			}
+			return nil
+		}
+		g.head = append(g.head, line...)
+		if len(line) > 2 {
+			return nil
+		}
+		head := g.head
+		g.head = nil
+		if err := g.screen(head); err != nil {
+			g.head = head
+			return err
+		}
+		g.pending = head
+		g.screened++
+	case inChunkSize:
+		sizeText, _, _ := strings.Cut(strings.TrimSuffix(string(line), "\r\n"), ";")
+		size, err := strconv.ParseInt(sizeText, 16, 64)
+		if err != nil || size < 0 || sizeText == "" || strings.HasPrefix(sizeText, "+") {
+			g.line = line
+			return &RejectedRequest{"invalid chunk size"}
+		}
+		if size == 0 {
+			g.state = inTrailers
+		} else {
+			g.state, g.left = inChunkData, size
+		}
+		g.pending = line
+	case inChunkEnd:
+		if len(line) != 2 {
+			g.line = line
+			return &RejectedRequest{"chunk longer than its size"}
+		}
+		g.state = inChunkSize
+		g.pending = line
+	case inTrailers:
+		if len(line) == 2 {
+			g.state = inHead
+		} else if _, err := field(line); err != nil {
+			g.line = line
+			return err
+		}
+		g.pending = line
+	}
+	return nil
+}
+
+// readLine returns the next line, ending with CRLF, keeping what it read so far if the connection fails or the line is rejected.
+func (g *Guard) readLine() ([]byte, error) {
+	for {
+		part, err := g.r.ReadSlice('\n')
+		g.line = append(g.line, part...)
+		if len(g.head)+len(g.line) > MaxRequestHead {
+			return nil, &RejectedRequest{"head too large"}
+		}
+		switch {
+		case err == nil:
+			if !bytes.HasSuffix(g.line, []byte("\r\n")) {
+				return nil, &RejectedRequest{"bare line feed"}
+			}
+			line := g.line
+			g.line = nil
+			return line, nil
+		case !errors.Is(err, bufio.ErrBufferFull):
+			return nil, err
+		}
+	}
+}
+
+// screen checks the head of a request, and sets the framing of its body.
+func (g *Guard) screen(head []byte) error {
+	lines := strings.Split(strings.TrimSuffix(string(head), "\r\n\r\n"), "\r\n")
+	method, rest, _ := strings.Cut(lines[0], " ")
+	target, proto, _ := strings.Cut(rest, " ")
+	switch {
+	case !isToken(method):
+		return &RejectedRequest{"invalid method"}
+	case proto != "HTTP/1.1" && proto != "HTTP/1.0":
+		return &RejectedRequest{"unsupported protocol"}
+	case !(strings.HasPrefix(target, "/") || (method == "OPTIONS" && target == "*")):
+		return &RejectedRequest{"target is not a path"}
+	}
+	for i := 0; i < len(target); i++ {
+		if target[i] <= ' ' || target[i] >= 0x7f {
+			return &RejectedRequest{"invalid character in target"}
+		}
+	}
+	if g.reserved != nil && g.reserved(target) {
+		return &RejectedRequest{reservedTarget}
+	}
+
+	var lengths, encodings, hosts, connection []string
+	for _, line := range lines[1:] {
+		name, err := field([]byte(line))
+		if err != nil {
+			return err
+		}
+		_, value, _ := strings.Cut(line, ":")
+		value = strings.Trim(value, " \t")
+		switch {
+		case strings.EqualFold(name, "Content-Length"):
+			lengths = append(lengths, value)
+		case strings.EqualFold(name, "Transfer-Encoding"):
+			encodings = append(encodings, value)
+		case strings.EqualFold(name, "Host"):
+			hosts = append(hosts, value)
+		case strings.EqualFold(name, "Connection"):
+			connection = append(connection, value)
+		}
+	}
+	if len(hosts) > 1 || (len(hosts) == 0 && proto == "HTTP/1.1") {
+		return &RejectedRequest{"expected one Host"}
+	}
+	// Watched connections may carry another protocol after this request, which only the service frames.
+	if g.watching && (method == http.MethodConnect || IsUpgrade(http.Header{"Connection": connection})) {
+		g.state = passing
+		return nil
+	}
+	switch {
+	case len(encodings) > 0 && len(lengths) > 0:
+		return &RejectedRequest{"both Content-Length and Transfer-Encoding"}
+	case len(encodings) > 0:
+		if len(encodings) > 1 || !strings.EqualFold(encodings[0], "chunked") || proto != "HTTP/1.1" {
+			return &RejectedRequest{"unsupported Transfer-Encoding"}
+		}
+		g.state = inChunkSize
+	case len(lengths) > 1:
+		return &RejectedRequest{"several Content-Length"}
+	case len(lengths) == 1:
+		n, err := strconv.ParseInt(lengths[0], 10, 64)
+		if err != nil || n < 0 || strings.HasPrefix(lengths[0], "+") {
+			return &RejectedRequest{"invalid Content-Length"}
+		}
+		if n > 0 {
+			g.state, g.left = inBody, n
+		}
+	}
+	return nil
+}
+
+// field checks a header line, without its CRLF if it is a whole one, returning its name.
+func field(line []byte) (string, error) {
+	text := strings.TrimSuffix(string(line), "\r\n")
+	if strings.HasPrefix(text, " ") || strings.HasPrefix(text, "\t") {
+		return "", &RejectedRequest{"folded header"}
+	}
+	name, value, found := strings.Cut(text, ":")
+	if !found || !ValidHeader(name, value) {
+		return "", &RejectedRequest{"invalid header"}
+	}
+	return name, nil
+}
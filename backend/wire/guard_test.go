@@ -0,0 +1,107 @@
+package wire
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGuardRejects(t *testing.T) {
+	for _, tc := range []struct {
+		request string
+		reason  string
+	}{
+		{smuggling[0], "several Content-Length"},
+		{smuggling[1], "both Content-Length and Transfer-Encoding"},
+		{smuggling[2], "bare line feed"},
+		{smuggling[3], "folded header"},
+		{smuggling[4], "head too large"},
+		{smuggling[5], "unsupported Transfer-Encoding"},
+		{smuggling[6], "invalid Content-Length"},
+		{smuggling[7], "target is not a path"},
+		{"GET / HTTP/1.1\r\n\r\n", "expected one Host"},
+		{"GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n", "expected one Host"},
+		{"GET / HTTP/2.0\r\nHost: a\r\n\r\n", "unsupported protocol"},
+		{"GET /\x01 HTTP/1.1\r\nHost: a\r\n\r\n", "invalid character in target"},
+		{"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\nx\r\n", "invalid chunk size"},
+		{"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n1\r\nabcd\r\n", "chunk longer than its size"},
+	} {
+		g := NewGuard(&readerConn{r: strings.NewReader(tc.request)})
+		r := bufio.NewReader(g)
+		var err error
+		for err == nil {
+			var req *http.Request
+			if req, err = http.ReadRequest(r); err == nil {
+				_, err = io.Copy(io.Discard, req.Body)
+			}
+		}
+		if rejected := g.Rejected(); rejected == nil || rejected.Reason != tc.reason {
+			t.Errorf("%.40q: rejected with %v, expected %q", tc.request, err, tc.reason)
+		}
+	}
+}
+
+func TestGuardPasses(t *testing.T) {
+	for i, bodies := range [][]string{
+		{"", ""},
+		{"abcd", ""},
+		{"abcd", ""},
+		{""},
+	} {
+		g := NewGuard(&readerConn{r: strings.NewReader(framed[i])})
+		r := bufio.NewReader(g)
+		for _, expected := range bodies {
+			req, err := http.ReadRequest(r)
+			if err != nil {
+				t.Fatalf("%q: %v", framed[i], err)
+			}
+			if body, err := io.ReadAll(req.Body); err != nil || string(body) != expected {
+				t.Fatalf("%q: read %q, %v", framed[i], body, err)
+			}
+		}
+		if _, err := r.Peek(1); err != io.EOF || g.Rejected() != nil || g.screened != len(bodies) {
+			t.Errorf("%q: %d requests screened, then %v", framed[i], g.screened, err)
+		}
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	reserved := func(target string) bool {
+		return strings.HasPrefix(target, "/.reserved")
+	}
+	for _, tc := range []struct {
+		connection string
+		passed     string
+		withheld   string
+	}{
+		{
+			"GET / HTTP/1.1\r\nHost: a\r\n\r\nGET /.reserved HTTP/1.1\r\nHost: a\r\n\r\n",
+			"GET / HTTP/1.1\r\nHost: a\r\n\r\n",
+			"GET /.reserved HTTP/1.1\r\nHost: a\r\n\r\n",
+		},
+		{
+			"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 36\r\n\r\nGET /.reserved HTTP/1.1\r\nHost: a\r\n\r\n",
+			"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 36\r\n\r\nGET /.reserved HTTP/1.1\r\nHost: a\r\n\r\n",
+			"",
+		},
+		{
+			"GET / HTTP/1.1\r\nHost: a\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\nGET /.reserved HTTP/1.1\r\nHost: a\r\n\r\n",
+			"GET / HTTP/1.1\r\nHost: a\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\nGET /.reserved HTTP/1.1\r\nHost: a\r\n\r\n",
+			"",
+		},
+		{smuggling[1], smuggling[1], ""},
+		{smuggling[2], smuggling[2], ""},
+		{"SSH-2.0-OpenSSH_9.6\r\nGET /.reserved HTTP/1.1\r\n", "SSH-2.0-OpenSSH_9.6\r\nGET /.reserved HTTP/1.1\r\n", ""},
+	} {
+		g := NewWatcher(&readerConn{}, strings.NewReader(tc.connection), reserved)
+		passed, err := io.ReadAll(g)
+		if string(passed) != tc.passed || string(g.Withheld()) != tc.withheld {
+			t.Errorf("%.40q: passed %q, withheld %q", tc.connection, passed, g.Withheld())
+		}
+		if rejected := g.Rejected(); (rejected != nil) != (tc.withheld != "") || (rejected == nil && err != nil) {
+			t.Errorf("%.40q: read until %v", tc.connection, err)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package wire
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ErrorOut reads the visitor's request, then answers it with a plain-text error.
+func ErrorOut(conn io.ReadWriter, status string, message string) error {
+	return ErrorOutWithHeader(conn, status, nil, message)
+}
+
+// ErrorOutWithHeader is ErrorOut with extra response headers, such as Retry-After.
+func ErrorOutWithHeader(conn io.ReadWriter, status string, header http.Header, message string) error {
+	r := bufio.NewReader(conn)
+	if _, err := http.ReadRequest(r); err != nil {
+		return err
+	}
+	var extra strings.Builder
+	_ = header.Write(&extra)
+	_, err := conn.Write([]byte(fmt.Sprintf("HTTP/1.1 %s\r\n%sContent-Length: %d\r\n\r\n%s", status, extra.String(), len(message), message)))
+	return err
+}
+
+// ValidHeader reports whether a header can be written as is in an HTTP/1.1 message:
+// its name is a token, and its value holds no control characters besides tabs.
+func ValidHeader(name, value string) bool {
+	if !isToken(name) {
+		return false
+	}
+	for _, r := range value {
+		if r == 0x7f || r < ' ' && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// isToken reports whether s is a token (RFC 9110, section 5.6.2), such as a method or header name.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r >= 0x7f || r <= ' ' || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,240 @@
+// Package wire holds the parsing of what visitors and SSH clients send us, kept apart so it can be fuzzed.
+package wire
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Tap receives a copy of the bytes flowing in one direction of a proxied connection.
+// It never blocks the proxy: if its consumer falls behind, it gives up and drops everything.
+type Tap struct {
+	ch      chan []byte
+	dropped atomic.Bool
+}
+
+func NewTap() *Tap {
+	return &Tap{ch: make(chan []byte, 16)}
+}
+
+func (t *Tap) Write(p []byte) (int, error) {
+	if t.dropped.Load() {
+		return len(p), nil
+	}
+	b := make([]byte, len(p))
+	copy(b, p)
+	select {
+	case t.ch <- b:
+	default:
+		t.dropped.Store(true)
+	}
+	return len(p), nil
+}
+
+// Close must be called by the writer once the direction is done.
+func (t *Tap) Close() {
+	close(t.ch)
+}
+
+// Stop tells the writer to stop copying, used once the consumer cannot make sense of the stream.
+func (t *Tap) Stop() {
+	t.dropped.Store(true)
+	go func() {
+		for range t.ch {
+		}
+	}()
+}
+
+type tapReader struct {
+	t   *Tap
+	buf []byte
+}
+
+func (r *tapReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		b, ok := <-r.t.ch
+		if !ok {
+			return 0, io.EOF
+		}
+		r.buf = b
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Exchange is one HTTP request and its response as seen on the wire.
+type Exchange struct {
+	Request       *http.Request
+	Response      *http.Response
+	Start         time.Time
+	ResponseBytes int64
+	// RequestBody holds the first bytes of the request body, up to the limit of a capturing observer,
+	// and RequestBytes how long the body was.
+	RequestBody  []byte
+	RequestBytes int64
+	// bodyRead is closed once the request body was captured.
+	bodyRead chan struct{}
+}
+
+// Observer passively parses the HTTP/1.x traffic of a proxied connection.
+// The proxy writes what it forwards into Requests and Responses; the bytes themselves are never altered or delayed.
+// Parsing stops silently on anything that isn't HTTP/1.x, including after a protocol upgrade.
+type Observer struct {
+	Requests  *Tap
+	Responses *Tap
+	pending   chan *Exchange
+	// bodyLimit bounds the request bodies captured, none if 0.
+	bodyLimit int
+
+	// Called from the observer's goroutines; they must not block.
+	onResponseHead func(*Exchange)
+	onExchangeDone func(*Exchange)
+}
+
+func NewObserver(onResponseHead, onExchangeDone func(*Exchange)) *Observer {
+	return NewCapturingObserver(0, onResponseHead, onExchangeDone)
+}
+
+// NewCapturingObserver is NewObserver, also keeping the first bodyLimit bytes of request bodies in the exchanges it reports.
+// Exchanges are then reported once their request bodies are read, so a response that completes first waits for them.
+func NewCapturingObserver(bodyLimit int, onResponseHead, onExchangeDone func(*Exchange)) *Observer {
+	o := &Observer{
+		Requests:       NewTap(),
+		Responses:      NewTap(),
+		pending:        make(chan *Exchange, 16),
+		bodyLimit:      bodyLimit,
+		onResponseHead: onResponseHead,
+		onExchangeDone: onExchangeDone,
+	}
+	go o.readRequests()
+	go o.readResponses()
+	return o
+}
+
+func (o *Observer) readRequests() {
+	defer close(o.pending)
+	r := bufio.NewReader(&tapReader{t: o.Requests})
+	for {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			o.Requests.Stop()
+			return
+		}
+		ex := &Exchange{Request: req, Start: time.Now()}
+		if o.bodyLimit > 0 {
+			ex.bodyRead = make(chan struct{})
+		}
+		select {
+		case o.pending <- ex:
+		default:
+			o.Requests.Stop()
+			return
+		}
+		if err := o.readBody(ex); err != nil {
+			o.Requests.Stop()
+			return
+		}
+		if IsUpgrade(req.Header) {
+			o.Requests.Stop()
+			return
+		}
+	}
+}
+
+// readBody reads the body of a request, capturing what the limit allows.
+func (o *Observer) readBody(ex *Exchange) error {
+	if ex.bodyRead == nil {
+		_, err := io.Copy(io.Discard, ex.Request.Body)
+		return err
+	}
+	defer close(ex.bodyRead)
+	body := &capped{limit: o.bodyLimit}
+	n, err := io.Copy(body, ex.Request.Body)
+	ex.RequestBody, ex.RequestBytes = body.buf, n
+	return err
+}
+
+// done reports an exchange, once its request body was captured.
+func (o *Observer) done(ex *Exchange) {
+	if ex.bodyRead != nil {
+		<-ex.bodyRead
+	}
+	if o.onExchangeDone != nil {
+		o.onExchangeDone(ex)
+	}
+}
+
+// capped keeps what is written to it up to its limit, and discards the rest.
+type capped struct {
+	buf   []byte
+	limit int
+}
+
+func (c *capped) Write(p []byte) (int, error) {
+	if room := c.limit - len(c.buf); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		c.buf = append(c.buf, p[:room]...)
+	}
+	return len(p), nil
+}
+
+func (o *Observer) readResponses() {
+	r := bufio.NewReader(&tapReader{t: o.Responses})
+	defer o.Responses.Stop()
+	for ex := range o.pending {
+		resp, err := http.ReadResponse(r, ex.Request)
+		// Informational responses (100 Continue, 103 Early Hints) precede the real one.
+		for err == nil && resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+			resp, err = http.ReadResponse(r, ex.Request)
+		}
+		if err != nil {
+			return
+		}
+		ex.Response = resp
+		if o.onResponseHead != nil {
+			o.onResponseHead(ex)
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			o.done(ex)
+			return
+		}
+		ex.ResponseBytes, err = io.Copy(io.Discard, resp.Body)
+		o.done(ex)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func IsUpgrade(h http.Header) bool {
+	for _, v := range h.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsStreamingResponse reports whether a response is meant to be delivered progressively,
+// such as Server-Sent Events or chunked long-poll responses.
+func IsStreamingResponse(resp *http.Response) bool {
+	ct := strings.ToLower(resp.Header.Get("Content-Type"))
+	if strings.HasPrefix(ct, "text/event-stream") {
+		return true
+	}
+	for _, te := range resp.TransferEncoding {
+		if strings.EqualFold(te, "chunked") {
+			return true
+		}
+	}
+	return strings.EqualFold(resp.Header.Get("X-Accel-Buffering"), "no")
+}
@@ -0,0 +1,82 @@
+package wire
+
+import (
+	"net"
+	"strings"
+)
+
+// Payloads of the SSH requests and channels we handle, as laid out by RFC 4254.
+
+// ForwardRequest is the payload of a tcpip-forward global request.
+type ForwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+// MaxBindPort is the highest port clients can forward; the port is only a label telling tunnels apart.
+const MaxBindPort = 65535
+
+// ValidBindAddr reports whether a forward's bind address is plausible: empty, a wildcard,
+// an IP address or a host name. We never bind it, but send it back in forwarded channels.
+func ValidBindAddr(addr string) bool {
+	if addr == "" || addr == "*" || net.ParseIP(strings.Trim(addr, "[]")) != nil {
+		return true
+	}
+	if len(addr) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(addr, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ForwardCancelRequest is the payload of a cancel-tcpip-forward global request.
+type ForwardCancelRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+// ForwardedChannelData is the extra data of the forwarded-tcpip channels we open.
+type ForwardedChannelData struct {
+	DestAddr   string
+	DestPort   uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// ExecRequest is the payload of an exec session request.
+type ExecRequest struct {
+	Command string
+}
+
+// PtyRequest is the payload of a pty-req session request, asking for a terminal of Columns by Rows characters
+// (Width by Height pixels), 0 if unknown.
+type PtyRequest struct {
+	Term                         string
+	Columns, Rows, Width, Height uint32
+	Modes                        string
+}
+
+// WindowChangeRequest is the payload of a window-change session request, telling the new size of the terminal.
+type WindowChangeRequest struct {
+	Columns, Rows, Width, Height uint32
+}
+
+// EnvRequest is the payload of an env session request, setting a variable for the session.
+type EnvRequest struct {
+	Name  string
+	Value string
+}
+
+// SubsystemRequest is the payload of a subsystem session request, running Name on the session.
+type SubsystemRequest struct {
+	Name string
+}